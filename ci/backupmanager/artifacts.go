@@ -0,0 +1,445 @@
+package backupmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Names of the artifacts of a run in its folder, backups/<env>/<runId>/. The
+// files archive is named files with the extension of its compression, e.g.
+// files.tar.zst. The manifest is stored last, a folder without one holds a
+// run that didn't complete.
+const (
+	runManifestName = "manifest.json"
+	runDumpName     = "db.sql.gz"
+	runFilesName    = "files"
+	runIndexName    = "index.json"
+)
+
+// storedRun locates what a run stored in the archive store. Runs are stored
+// as separate artifacts in a folder of their own, runs stored before that as
+// a single archive with their file index next to it.
+type storedRun struct {
+	// Folder holds the Manifest, Dump and Files archive of a run stored as
+	// separate artifacts. Dump and Files are empty when the artifact is
+	// missing.
+	Folder   string
+	Manifest string
+	Dump     string
+	Files    string
+
+	// Archive is the single archive of a run stored without a folder
+	Archive string
+
+	// Index is where the file index of the run is stored, runs stored
+	// before incremental backups were added have none
+	Index string
+}
+
+// runFolderURL returns the storage location of the folder holding the
+// artifacts of a run, e.g. gs://bucket/backups/staging/<runId>
+func runFolderURL(envConfig *EnvironmentConfig, environment string, runId string) string {
+	return fmt.Sprintf("%s/backups/%s/%s", envConfig.ArchiveBaseURL(), environment, runId)
+}
+
+// findStoredRun looks up what a run stored. The folder of the run wins when
+// it holds a manifest, otherwise the run is looked up as a single archive,
+// see findArchive.
+func findStoredRun(store ArchiveStore, envConfig *EnvironmentConfig, environment string, runId string) (*storedRun, error) {
+	folder := runFolderURL(envConfig, environment, runId)
+	stored, err := store.ListArchives(folder + "/")
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(stored))
+	for _, url := range stored {
+		found[url] = true
+	}
+	if manifest := folder + "/" + runManifestName; found[manifest] {
+		run := &storedRun{Folder: folder, Manifest: manifest, Index: folder + "/" + runIndexName}
+		if dump := folder + "/" + runDumpName; found[dump] {
+			run.Dump = dump
+		}
+		run.Files = pickArchive(found, folder+"/"+runFilesName, envConfig.ArchiveCompression)
+		return run, nil
+	}
+
+	archive, err := findArchive(store, envConfig, environment, runId)
+	if err != nil {
+		if len(stored) > 0 {
+			return nil, fmt.Errorf("%s run '%s' in %s is incomplete, its manifest is missing", environment, runId, folder)
+		}
+		return nil, err
+	}
+	return &storedRun{Archive: archive, Index: fileIndexURL(envConfig, environment, runId)}, nil
+}
+
+// storeDumpArtifact streams the database dump into the archive store, gzipped
+// unless it is already and encrypted when configured, and returns the size
+// and checksum of the dump as stored. Nothing is stored when any step fails.
+func storeDumpArtifact(ctx context.Context, backends *EnvironmentBackends, dumpFormat string, dump io.Reader, destination string) (digest *archiveDigest, err error) {
+	store, err := backends.Archives.NewArchiveWriter(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	upload := &digestArchiveWriter{ArchiveWriter: store, digest: newArchiveDigest()}
+	defer func() {
+		if err != nil {
+			upload.Abort(err)
+		}
+	}()
+
+	var w io.Writer = upload
+	var encrypter io.WriteCloser
+	if backends.Encryption.CanEncrypt() {
+		if encrypter, err = backends.Encryption.NewEncryptingWriter(w); err != nil {
+			return nil, err
+		}
+		w = encrypter
+	}
+	var compressor io.WriteCloser = nopWriteCloser{w}
+	if dumpFormat != DumpFormatSQLGzip {
+		if compressor, err = newCompressionWriter(w, CompressionGzip, 0); err != nil {
+			return nil, fmt.Errorf("failed to create gzip writer: %v", err)
+		}
+	}
+
+	if _, err = io.Copy(compressor, dump); err != nil {
+		return nil, fmt.Errorf("failed to write database dump: %v", err)
+	}
+	if err = compressor.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish compressed stream: %v", err)
+	}
+	if encrypter != nil {
+		if err = encrypter.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finish encrypted stream: %v", err)
+		}
+	}
+	if err = upload.Close(); err != nil {
+		return nil, err
+	}
+	Info("Database dump stored at %s", destination)
+	return upload.digest, nil
+}
+
+// openDumpArtifact returns a reader of the database dump stored at url, read
+// from stored, decrypted with the keys of the environment that stores it and
+// in the format the manifest records: gzipped SQL dumps stay gzipped. A
+// missing or wrong key results in a DecryptionKeyError.
+func openDumpArtifact(stored io.Reader, backends *EnvironmentBackends, manifest *BackupManifest, url string) (io.ReadCloser, error) {
+	stream, encrypted, err := backends.Encryption.NewDecryptingReader(stored, url)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		Info("Decrypting database dump")
+	}
+	if manifest.DumpFormat == DumpFormatSQLGzip {
+		return io.NopCloser(stream), nil
+	}
+	gzipReader, err := gzip.NewReader(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress database dump: %v", err)
+	}
+	return gzipReader, nil
+}
+
+// checkDumpArtifact reads the database dump of a run out of the archive
+// store, decrypting and decompressing it without keeping it, and returns the
+// size and checksum of the dump as stored
+func checkDumpArtifact(ctx context.Context, backends *EnvironmentBackends, manifest *BackupManifest, url string) (*archiveDigest, error) {
+	reader, err := backends.Archives.NewArchiveReader(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	digest := newBlockDigest()
+	stored := io.TeeReader(reader, digest)
+	dump, err := openDumpArtifact(stored, backends, manifest, url)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+	if _, err := io.Copy(io.Discard, dump); err != nil {
+		return nil, fmt.Errorf("failed to read database dump: %v", err)
+	}
+	// Whatever follows the dump counts towards its checksum as well
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return nil, fmt.Errorf("failed to read the end of the database dump: %v", err)
+	}
+	return digest, nil
+}
+
+// streamDumpArtifact streams the database dump of a run out of the archive
+// store into importDump. The dump was checked by checkDumpArtifact, reading
+// it fails before passing on anything that changed since then.
+func streamDumpArtifact(ctx context.Context, backends *EnvironmentBackends, manifest *BackupManifest, url string, checked *archiveDigest, importDump func(dump io.Reader) error) error {
+	reader, err := backends.Archives.NewArchiveReader(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	stored := newCheckedReader(reader, url, checked)
+	dump, err := openDumpArtifact(stored, backends, manifest, url)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+	if err := importDump(dump); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return fmt.Errorf("failed to read the end of the database dump: %v", err)
+	}
+	return nil
+}
+
+// writeRunManifest stores the manifest of a run stored as separate artifacts
+// and returns the size and checksum of the stored manifest
+func writeRunManifest(ctx context.Context, store ArchiveStore, url string, manifest *BackupManifest) (*archiveDigest, error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := writeStoredObject(ctx, store, url, data); err != nil {
+		return nil, err
+	}
+	digest := newArchiveDigest()
+	digest.Write(data)
+	return digest, nil
+}
+
+// readRunManifest reads the manifest of a run stored as separate artifacts
+// along with the size and checksum of the stored manifest. A manifest that
+// can't be parsed results in an *archiveMetadataError.
+func readRunManifest(ctx context.Context, store ArchiveStore, url string) (*BackupManifest, *archiveDigest, error) {
+	data, err := readStoredObject(ctx, store, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := newArchiveDigest()
+	digest.Write(data)
+	manifest, err := parseBackupManifest(bytes.NewReader(data))
+	if err == nil && manifest.FormatVersion < ArchiveFormatArtifacts {
+		err = fmt.Errorf("manifest records format version %d, runs stored as separate artifacts have version %d or later", manifest.FormatVersion, ArchiveFormatArtifacts)
+	}
+	if err != nil {
+		return nil, nil, &archiveMetadataError{Entry: runManifestName, Err: fmt.Errorf("%s: %v", url, err)}
+	}
+	return manifest, digest, nil
+}
+
+// checkArtifact checks an artifact read from the archive store against the
+// size and checksum the manifest of its run records
+func checkArtifact(manifest *BackupManifest, url string, digest *archiveDigest) error {
+	name := path.Base(url)
+	for _, artifact := range manifest.Artifacts {
+		if artifact.Path != name {
+			continue
+		}
+		if artifact.Size != digest.size || artifact.SHA256 != digest.sum() {
+			return fmt.Errorf("%s has %d bytes with SHA-256 %s, but the manifest records %d bytes with SHA-256 %s",
+				name, digest.size, digest.sum(), artifact.Size, artifact.SHA256)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not listed in the manifest", name)
+}
+
+// extractRunArtifacts restores a run stored as separate artifacts: the files
+// archive into tmpFolder, on top of the files of the runs it builds on, and,
+// for the last run of a chain, a dump source for the database dump, which is
+// checked against the manifest first. Artifacts options don't restore aren't
+// downloaded, nor are the dumps of the other runs of a chain. signature is the checked signature of the manifest, nil
+// for unsigned runs; the artifacts must match the manifest.
+func (e *BackupEngineCloud) extractRunArtifacts(ctx context.Context, srcConfig *EnvironmentConfig, srcBackends *EnvironmentBackends, stored *storedRun, signature *archiveSignature, last bool, destinationEnvironment string, tmpFolder string, options RestoreOptions) (*BackupManifest, dumpSource, error) {
+	manifest, digest, err := readRunManifest(ctx, srcBackends.Archives, stored.Manifest)
+	if err != nil {
+		Error("Failed to read manifest: %v", err)
+		return nil, nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if signature != nil {
+		if err := checkRestoreSignature(signature.checkDigest(stored.Manifest, digest), destinationEnvironment, options); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if options.restoresFiles() {
+		if stored.Files == "" {
+			Error("No files archive is stored in %s", stored.Folder)
+			return nil, nil, fmt.Errorf("no files archive is stored in %s", stored.Folder)
+		}
+		Info("Streaming files archive from %s", stored.Files)
+		_, filesDigest, err := e.extractStoredArchive(ctx, srcConfig, srcBackends, stored.Files, tmpFolder, options.include())
+		if err != nil {
+			Error("Extracting files archive failed: %v", err)
+			return nil, nil, fmt.Errorf("extracting files archive failed: %v", err)
+		}
+		if err := checkArtifact(manifest, stored.Files, filesDigest); err != nil {
+			Error("Files archive doesn't match the manifest: %v", err)
+			return nil, nil, fmt.Errorf("files archive doesn't match the manifest: %v", err)
+		}
+	}
+	if !last || !options.restoresDatabase() {
+		return manifest, nil, nil
+	}
+
+	if stored.Dump == "" {
+		Error("No database dump is stored in %s", stored.Folder)
+		return nil, nil, fmt.Errorf("no database dump is stored in %s", stored.Folder)
+	}
+	Info("Checking database dump at %s", stored.Dump)
+	dumpDigest, err := checkDumpArtifact(ctx, srcBackends, manifest, stored.Dump)
+	if err != nil {
+		Error("Reading database dump failed: %v", err)
+		return nil, nil, fmt.Errorf("reading database dump failed: %v", err)
+	}
+	if err := checkArtifact(manifest, stored.Dump, dumpDigest); err != nil {
+		Error("Database dump doesn't match the manifest: %v", err)
+		return nil, nil, fmt.Errorf("database dump doesn't match the manifest: %v", err)
+	}
+	return manifest, func(importDump func(dump io.Reader) error) error {
+		Info("Streaming database dump from %s", stored.Dump)
+		return streamDumpArtifact(ctx, srcBackends, manifest, stored.Dump, dumpDigest, importDump)
+	}, nil
+}
+
+// verifyRunArtifacts runs the checks of VerifyBackup on a run stored as
+// separate artifacts. The files archive is checked like an archive, the
+// database dump on its own, and both must match the signed manifest.
+func (e *BackupEngineCloud) verifyRunArtifacts(ctx context.Context, envConfig *EnvironmentConfig, backends *EnvironmentBackends, environment string, runId string, stored *storedRun) (*VerificationReport, error) {
+	manifest, manifestDigest, err := readRunManifest(ctx, backends.Archives, stored.Manifest)
+	var metadataErr *archiveMetadataError
+	if errors.As(err, &metadataErr) {
+		report := &VerificationReport{}
+		report.add("manifest", CheckFailed, "%v", err)
+		Error("Check 'manifest' failed: %v", err)
+		return report, nil
+	}
+	if err != nil {
+		Error("Failed to read manifest: %v", err)
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	// The signature of the manifest covers the artifacts it lists
+	signature, signatureErr := checkStoredSignature(ctx, backends.Archives, backends.Signing, environment, runId, stored.Manifest)
+	var unsigned *SignatureError
+	if signatureErr != nil && !errors.As(signatureErr, &unsigned) {
+		Error("Failed to check manifest signature: %v", signatureErr)
+		return nil, fmt.Errorf("failed to check manifest signature: %v", signatureErr)
+	}
+
+	report := &VerificationReport{}
+	var filesDigest *archiveDigest
+	if stored.Files != "" {
+		Info("Streaming files archive from %s", stored.Files)
+		if report, filesDigest, err = verifyStoredArchive(ctx, envConfig, backends, stored.Files); err != nil {
+			return nil, err
+		}
+	}
+	report.Manifest = manifest
+
+	dumpCheck, dumpDigest, err := verifyDumpArtifact(ctx, backends, manifest, stored.Dump)
+	if err != nil {
+		return nil, err
+	}
+	report.replace(dumpCheck)
+
+	var problems []string
+	for _, artifact := range []struct {
+		name   string
+		url    string
+		digest *archiveDigest
+	}{
+		{runFilesName + archiveExtension(manifest.Compression), stored.Files, filesDigest},
+		{runDumpName, stored.Dump, dumpDigest},
+	} {
+		switch {
+		case artifact.url == "":
+			problems = append(problems, fmt.Sprintf("%s is missing", artifact.name))
+		case artifact.digest == nil:
+			problems = append(problems, fmt.Sprintf("%s could not be read to the end", path.Base(artifact.url)))
+		default:
+			if err := checkArtifact(manifest, artifact.url, artifact.digest); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		report.add("artifacts", CheckFailed, "%s", strings.Join(problems, "; "))
+		Error("Check 'artifacts' failed: %s", strings.Join(problems, "; "))
+	} else {
+		report.add("artifacts", CheckPassed, "%d artifacts in %s match the manifest", len(manifest.Artifacts), stored.Folder)
+	}
+
+	switch {
+	case backends.Signing == nil || len(backends.Signing.TrustedKeys) == 0:
+		report.add("signature", CheckSkipped, "no trusted keys are configured for %s", environment)
+	case signatureErr != nil:
+		report.add("signature", CheckFailed, "%v", signatureErr)
+	default:
+		if err := signature.checkDigest(stored.Manifest, manifestDigest); err != nil {
+			report.add("signature", CheckFailed, "%v", err)
+		} else {
+			report.add("signature", CheckPassed, "manifest matches its signature by the trusted key %s", signature.fingerprint())
+		}
+	}
+	addRunChecks(report, backends.Archives, envConfig, environment, runId)
+	return report, nil
+}
+
+// verifyDumpArtifact reads the database dump of a run end to end and checks
+// it like the dump in an archive, see verifySQLDump. It returns the size and
+// checksum of the dump as stored, nil when it couldn't be read to the end. A
+// missing or wrong key is returned as an error.
+func verifyDumpArtifact(ctx context.Context, backends *EnvironmentBackends, manifest *BackupManifest, url string) (VerificationCheck, *archiveDigest, error) {
+	check := VerificationCheck{Name: "database dump", Status: CheckFailed}
+	if url == "" {
+		check.Detail = "no database dump is stored"
+		return check, nil, nil
+	}
+	Info("Streaming database dump from %s", url)
+	reader, err := backends.Archives.NewArchiveReader(ctx, url)
+	if err != nil {
+		Error("NewArchiveReader failed: %v", err)
+		return check, nil, fmt.Errorf("NewArchiveReader failed: %v", err)
+	}
+	defer reader.Close()
+
+	digest := newArchiveDigest()
+	stored := &readErrorRecorder{Reader: io.TeeReader(&contextReader{ctx: ctx, Reader: reader}, digest)}
+	dump, err := openDumpArtifact(stored, backends, manifest, url)
+	var keyErr *DecryptionKeyError
+	if errors.As(err, &keyErr) {
+		Error("Decryption failed: %v", err)
+		return check, nil, err
+	}
+	if err != nil {
+		check.Detail = err.Error()
+	} else {
+		defer dump.Close()
+		decompressed := &readErrorRecorder{Reader: dump}
+		check = verifySQLDump(decompressed, manifest)
+		io.Copy(io.Discard, decompressed)
+		if decompressed.err != nil {
+			check.Status = CheckFailed
+			check.Detail = fmt.Sprintf("failed to read the dump: %v", decompressed.err)
+		}
+	}
+	if check.Status == CheckFailed {
+		Error("Check 'database dump' failed: %s", check.Detail)
+	}
+	if _, err := io.Copy(io.Discard, stored); err != nil || stored.err != nil {
+		return check, nil, nil
+	}
+	return check, digest, nil
+}
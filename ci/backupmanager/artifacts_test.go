@@ -0,0 +1,124 @@
+package backupmanager
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunArtifacts(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].FullBackups = 7
+	staging := configs["staging"].TargetPath
+	production := configs["production"].TargetPath
+	unsigned := RestoreOptions{AllowUnsigned: true}
+	runs := filepath.Join(root, "backups/backups/staging")
+
+	mustWriteFile(t, filepath.Join(staging, "a.txt"), "a")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-artifacts-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	for _, name := range []string{"manifest.json", "db.sql.gz", "files.tar.gz", "index.json"} {
+		if _, err := os.Stat(filepath.Join(runs, "test-run-artifacts-1", name)); err != nil {
+			t.Errorf("%s not stored: %v", name, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(runs, "backup_test-run-artifacts-1*")); len(matches) != 0 {
+		t.Errorf("run should not be stored as a single archive, found %v", matches)
+	}
+
+	// Only the dump of the last run in a chain is downloaded
+	mustWriteFile(t, filepath.Join(staging, "b.txt"), "b")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-artifacts-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(runs, "test-run-artifacts-1", "db.sql.gz")); err != nil {
+		t.Fatalf("Failed to remove dump: %v", err)
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-artifacts-2", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{"a.txt": "a", "b.txt": "b"})
+	if imported := engine.backends["production"].Database.(*MockBackend).importedDump; string(imported) != "CREATE TABLE test (id INT);" {
+		t.Errorf("unexpected dump imported: %q", imported)
+	}
+	err := engine.PerformRestore(context.Background(), "staging", "test-run-artifacts-1", "production", unsigned)
+	if err == nil || !strings.Contains(err.Error(), "no database dump is stored") {
+		t.Errorf("restore without the dump should fail, got %v", err)
+	}
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-artifacts-1")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"database dump": CheckFailed, "artifacts": CheckFailed})
+
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-artifacts-2")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"manifest": CheckPassed, "checksums": CheckPassed, "artifacts": CheckPassed, "parent": CheckPassed})
+
+	// The dump is checked before the import and read again for it, a dump
+	// replaced in between is refused
+	backends := engine.backends["staging"]
+	stored, err := findStoredRun(backends.Archives, configs["staging"], "staging", "test-run-artifacts-2")
+	if err != nil {
+		t.Fatalf("failed to find run: %v", err)
+	}
+	manifest, _, err := readRunManifest(context.Background(), backends.Archives, stored.Manifest)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	checked, err := checkDumpArtifact(context.Background(), backends, manifest, stored.Dump)
+	if err != nil {
+		t.Fatalf("checkDumpArtifact failed: %v", err)
+	}
+	dump := filepath.Join(runs, "test-run-artifacts-2", "db.sql.gz")
+	writeGzipFile(t, dump, completeMySQLDump)
+	var imported []byte
+	err = streamDumpArtifact(context.Background(), backends, manifest, stored.Dump, checked, func(dump io.Reader) error {
+		imported, err = io.ReadAll(dump)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "changed since it was checked") {
+		t.Errorf("dump replaced after its check should fail, got %v", err)
+	}
+	if len(imported) > 0 {
+		t.Errorf("importer got %q of the replaced dump", imported)
+	}
+
+	// A dump that doesn't match the manifest is refused
+	writeGzipFile(t, dump, completeMySQLDump)
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-artifacts-2", "production", unsigned)
+	if err == nil || !strings.Contains(err.Error(), "doesn't match the manifest") {
+		t.Errorf("restore of a replaced dump should fail, got %v", err)
+	}
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-artifacts-2")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"database dump": CheckPassed, "artifacts": CheckFailed})
+
+	// A run whose manifest is missing didn't complete
+	if err := os.Remove(filepath.Join(runs, "test-run-artifacts-2", "manifest.json")); err != nil {
+		t.Fatalf("Failed to remove manifest: %v", err)
+	}
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-artifacts-2", "production", unsigned)
+	if err == nil || !strings.Contains(err.Error(), "its manifest is missing") {
+		t.Errorf("restore of an incomplete run should fail, got %v", err)
+	}
+
+	// Runs stored as a single archive are still restored
+	archive, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	if err := copyFile(archive, filepath.Join(runs, "backup_test-run-legacy.tar.gz"), 0644); err != nil {
+		t.Fatalf("Failed to store archive: %v", err)
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-legacy", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{"inline-images/logo.png": "not really a png"})
+}
@@ -0,0 +1,346 @@
+package backupmanager
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"cloud.google.com/go/storage"
+	"github.com/go-sql-driver/mysql"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// BackendCloudSQL exports and imports databases with the Cloud SQL Admin API,
+// staging the dumps in the GCS backup bucket
+type BackendCloudSQL struct{}
+
+func NewBackendCloudSQL() *BackendCloudSQL {
+	return &BackendCloudSQL{}
+}
+
+// DatabaseEngine returns the engine of the dumps written by the backend,
+// the Cloud SQL backend only handles MySQL instances
+func (b *BackendCloudSQL) DatabaseEngine() string {
+	return DatabaseEngineMySQL
+}
+
+// ExportDatabase uses Cloud SQL's native export to export a MySQL database to GCS,
+// then streams it from there into out
+func (b *BackendCloudSQL) ExportDatabase(ctx context.Context, envConfig *EnvironmentConfig, out io.Writer) error {
+	if envConfig.DBExportMode == DBExportModeDirect {
+		return b.exportDatabaseDirect(ctx, envConfig, out)
+	}
+
+	// Create Cloud SQL Admin service
+	sqlAdminService, err := sqladmin.NewService(ctx)
+	if err != nil {
+		Error("Failed to create Cloud SQL Admin service: %v", err)
+		return fmt.Errorf("failed to create Cloud SQL Admin service: %v", err)
+	}
+
+	// Generate a unique filename for the export in GCS
+	timestamp := time.Now().Format("20060102-150405")
+	exportFileName := fmt.Sprintf("db-exports/%s-export-%s.sql.gz", envConfig.DBName, timestamp)
+	exportURI := fmt.Sprintf("gs://%s/%s", envConfig.BackupBucket, exportFileName)
+	Info("Exporting database to %s", exportURI)
+
+	// Create the export request
+	exportRequest := &sqladmin.InstancesExportRequest{
+		ExportContext: &sqladmin.ExportContext{
+			FileType:  "SQL",
+			Uri:       exportURI,
+			Databases: []string{envConfig.DBName},
+		},
+	}
+
+	// Start the export operation
+	Info("Starting Cloud SQL export operation for instance %s", envConfig.CloudSQLInstance)
+	op, err := sqlAdminService.Instances.Export(envConfig.GCPProjectID, envConfig.CloudSQLInstance, exportRequest).Context(ctx).Do()
+	if err != nil {
+		Error("Failed to start database export: %v", err)
+		return fmt.Errorf("failed to start database export: %v", err)
+	}
+
+	// Wait for the export operation to complete
+	Info("Waiting for export operation %s to complete...", op.Name)
+	if err := newOperationWaiter(sqlAdminService, envConfig).Wait(ctx, op); err != nil {
+		Error("Export operation failed: %v", err)
+		return fmt.Errorf("export operation failed: %v", err)
+	}
+	Info("Export operation completed successfully")
+
+	// Stream the exported file from GCS
+	Info("Reading exported database from %s", exportURI)
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		Error("Failed to create storage client: %v", err)
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer storageClient.Close()
+
+	bucket := storageClient.Bucket(envConfig.BackupBucket)
+	obj := bucket.Object(exportFileName)
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		Error("Failed to read exported file from GCS: %v", err)
+		return fmt.Errorf("failed to read exported file from GCS: %v", err)
+	}
+	defer reader.Close()
+
+	written, err := io.Copy(out, reader)
+	if err != nil {
+		Error("Failed to read exported database: %v", err)
+		return fmt.Errorf("failed to read exported database: %v", err)
+	}
+
+	Info("Successfully exported database %s (%d bytes)", envConfig.DBName, written)
+	return nil
+}
+
+// ImportDatabase imports a SQL dump taken from the source environment into the
+// database of the environment, with a Cloud SQL import staged in the backup
+// bucket or over a direct connection
+func (b *BackendCloudSQL) ImportDatabase(ctx context.Context, sqlDump io.Reader, envConfig *EnvironmentConfig, sourceConfig *EnvironmentConfig) error {
+	Info("Importing database %s", envConfig.DBName)
+
+	// The dump is usually gzipped from a Cloud SQL export. It is decompressed,
+	// renamed and uploaded as a stream, never as a whole in memory.
+	dump, err := openSQLDumpForImport(sqlDump, envConfig.DBName, sourceConfig.DBName)
+	if err != nil {
+		Error("Failed to read SQL dump: %v", err)
+		return fmt.Errorf("failed to read SQL dump: %v", err)
+	}
+	defer dump.Close()
+
+	if envConfig.DBImportMode == DBImportModeDirect {
+		return b.importDatabaseDirect(ctx, envConfig, dump)
+	}
+
+	// Create storage client
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		Error("Failed to create storage client: %v", err)
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	// Upload the SQL dump to a temporary location in the backup bucket. Cloud
+	// SQL decompresses imports with a .gz name.
+	timestamp := time.Now().Format("20060102-150405")
+	tempGcsPath := fmt.Sprintf("temp-imports/%s-import-%s.sql.gz", envConfig.DBName, timestamp)
+
+	Info("Uploading SQL file to temporary GCS location: gs://%s/%s", envConfig.BackupBucket, tempGcsPath)
+
+	bucket := client.Bucket(envConfig.BackupBucket)
+	obj := bucket.Object(tempGcsPath)
+	// Cancelling the upload context discards a partial upload on failure
+	uploadCtx, cancelUpload := context.WithCancel(ctx)
+	defer cancelUpload()
+	writer := obj.NewWriter(uploadCtx)
+
+	written, err := writeCompressedSQLDump(writer, dump)
+	if err != nil {
+		cancelUpload()
+		writer.Close()
+		Error("Failed to upload SQL file to GCS: %v", err)
+		return fmt.Errorf("failed to upload SQL file to GCS: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		Error("Failed to finalize SQL file upload: %v", err)
+		return fmt.Errorf("failed to finalize SQL file upload: %v", err)
+	}
+	Info("SQL file uploaded successfully (%d bytes uncompressed), initiating database import", written)
+
+	// Create Cloud SQL Admin service
+	sqlAdminService, err := sqladmin.NewService(ctx)
+	if err != nil {
+		Error("Failed to create Cloud SQL Admin service: %v", err)
+		return fmt.Errorf("failed to create Cloud SQL Admin service: %v", err)
+	}
+
+	// Create import request
+	importRequest := &sqladmin.InstancesImportRequest{
+		ImportContext: &sqladmin.ImportContext{
+			Uri:      fmt.Sprintf("gs://%s/%s", envConfig.BackupBucket, tempGcsPath),
+			Database: envConfig.DBName,
+			FileType: "SQL",
+		},
+	}
+
+	// Start import operation
+	op, err := sqlAdminService.Instances.Import(envConfig.GCPProjectID, envConfig.CloudSQLInstance, importRequest).Context(ctx).Do()
+	if err != nil {
+		Error("Failed to start database import: %v", err)
+		return fmt.Errorf("failed to start database import: %v", err)
+	}
+
+	Info("Database import operation started: %s", op.Name)
+
+	if err := newOperationWaiter(sqlAdminService, envConfig).Wait(ctx, op); err != nil {
+		Error("Database import failed: %v", err)
+		return fmt.Errorf("database import failed: %v", err)
+	}
+	Info("Database import completed successfully")
+
+	// Clean up temporary SQL file from GCS
+	Info("Cleaning up temporary SQL file from GCS")
+	if err := obj.Delete(ctx); err != nil {
+		Warn("Failed to delete temporary SQL file from GCS: %v", err)
+		// Don't fail the operation if cleanup fails
+	}
+
+	return nil
+}
+
+// exportDatabaseDirect connects straight to the database instance and writes a
+// gzipped logical dump to out, without staging it in the backup bucket
+func (b *BackendCloudSQL) exportDatabaseDirect(ctx context.Context, config *EnvironmentConfig, out io.Writer) error {
+	Info("Exporting database %s over a direct connection", config.DBName)
+
+	db, closeDB, err := openDirectConnection(ctx, config)
+	if err != nil {
+		Error("Failed to connect to database: %v", err)
+		return err
+	}
+	defer closeDB()
+
+	// Compressed like a Cloud SQL export
+	gzipWriter := gzip.NewWriter(out)
+	bufferedWriter := bufio.NewWriterSize(gzipWriter, 1<<20)
+
+	start := time.Now()
+	stats, err := dumpMySQLDatabase(ctx, db, config.DBName, bufferedWriter)
+	if err != nil {
+		Error("Database export failed: %v", err)
+		return fmt.Errorf("database export failed: %v", err)
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to write dump: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write dump: %v", err)
+	}
+
+	Info("Successfully exported %d tables (%d rows), %d views, %d triggers, %d routines and %d events of %s in %s",
+		stats.Tables, stats.Rows, stats.Views, stats.Triggers, stats.Routines, stats.Events, config.DBName, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// openDirectConnection opens a MySQL connection to the environment's database
+// instance, without selecting a database. It goes through the Cloud SQL Go connector, which authorizes the
+// connection with the runner's Google credentials, or over plain TCP when
+// DBHost is set (e.g. the Cloud SQL Auth Proxy or a local MySQL server).
+func openDirectConnection(ctx context.Context, config *EnvironmentConfig) (*sql.DB, func(), error) {
+	cfg := mysql.NewConfig()
+	cfg.User = config.DBUser
+	cfg.Passwd = config.DBPassword
+
+	closeDialer := func() {}
+	if config.DBHost != "" {
+		port := config.DBPort
+		if port == "" {
+			port = "3306"
+		}
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(config.DBHost, port)
+	} else {
+		connectionName, err := cloudSQLConnectionName(ctx, config)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var opts []cloudsqlconn.Option
+		if config.DBIAMAuth {
+			// The connector sends an OAuth token as password over the TLS tunnel
+			opts = append(opts, cloudsqlconn.WithIAMAuthN())
+			cfg.AllowCleartextPasswords = true
+		}
+		if config.DBPrivateIP {
+			opts = append(opts, cloudsqlconn.WithDefaultDialOptions(cloudsqlconn.WithPrivateIP()))
+		}
+		dialer, err := cloudsqlconn.NewDialer(ctx, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create Cloud SQL connector: %v", err)
+		}
+		closeDialer = func() { dialer.Close() }
+
+		network := "cloudsql-" + connectionName
+		mysql.RegisterDialContext(network, func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.Dial(ctx, addr)
+		})
+		cfg.Net = network
+		cfg.Addr = connectionName
+	}
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		closeDialer()
+		return nil, nil, fmt.Errorf("invalid database connection settings: %v", err)
+	}
+	db := sql.OpenDB(connector)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		closeDialer()
+		return nil, nil, fmt.Errorf("failed to connect to database server at %s: %v", cfg.Addr, err)
+	}
+
+	return db, func() {
+		db.Close()
+		closeDialer()
+	}, nil
+}
+
+// importDatabaseDirect executes the SQL dump over a direct connection to the
+// database instance, without staging it in the backup bucket. The size of
+// the streamed dump isn't known, progress is reported in bytes.
+func (b *BackendCloudSQL) importDatabaseDirect(ctx context.Context, config *EnvironmentConfig, dump io.Reader) error {
+	Info("Importing database %s over a direct connection", config.DBName)
+
+	db, closeDB, err := openDirectConnection(ctx, config)
+	if err != nil {
+		Error("Failed to connect to database: %v", err)
+		return err
+	}
+	defer closeDB()
+
+	start := time.Now()
+	err = importMySQLDump(ctx, db, config.DBName, dump, 0, logImportProgress)
+	if err != nil {
+		var statementErr *SQLStatementError
+		if errors.As(err, &statementErr) {
+			Error("Database import failed at line %d of the dump: %v\nStatement: %s", statementErr.Line, statementErr.Err, statementErr.Statement)
+			return err
+		}
+		Error("Database import failed: %v", err)
+		return fmt.Errorf("database import failed: %v", err)
+	}
+
+	Info("Database import completed successfully in %s", time.Since(start).Round(time.Second))
+	return nil
+}
+
+// cloudSQLConnectionName returns the project:region:instance connection name
+// of the environment's instance, looking it up when it isn't configured
+func cloudSQLConnectionName(ctx context.Context, config *EnvironmentConfig) (string, error) {
+	if config.CloudSQLConnectionName != "" {
+		return config.CloudSQLConnectionName, nil
+	}
+
+	sqlAdminService, err := sqladmin.NewService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create Cloud SQL Admin service: %v", err)
+	}
+	instance, err := sqlAdminService.Instances.Get(config.GCPProjectID, config.CloudSQLInstance).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to look up connection name of instance %s: %v", config.CloudSQLInstance, err)
+	}
+	return instance.ConnectionName, nil
+}
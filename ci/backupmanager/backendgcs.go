@@ -0,0 +1,172 @@
+package backupmanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// BackendGcs stores backup archives in Google Cloud Storage
+type BackendGcs struct{}
+
+func NewBackendGcs() *BackendGcs {
+	return &BackendGcs{}
+}
+
+// ListArchives returns the URLs of the objects whose name starts with prefix
+// prefix should be in format: gs://bucket-name/path/filename
+func (b *BackendGcs) ListArchives(prefix string) ([]string, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		Error("Failed to create storage client: %v", err)
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	// Parse the GCS path
+	if !strings.HasPrefix(prefix, "gs://") {
+		return nil, fmt.Errorf("prefix must start with gs://")
+	}
+	bucketName, objectPrefix, found := strings.Cut(strings.TrimPrefix(prefix, "gs://"), "/")
+	if !found {
+		return nil, fmt.Errorf("invalid GCS path: %s", prefix)
+	}
+
+	var archives []string
+	objects := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: objectPrefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			Error("Failed to list archives: %v", err)
+			return nil, fmt.Errorf("failed to list archives: %v", err)
+		}
+		archives = append(archives, "gs://"+bucketName+"/"+attrs.Name)
+	}
+	return archives, nil
+}
+
+// DeleteArchive removes an object from GCS
+func (b *BackendGcs) DeleteArchive(url string) error {
+	bucketName, objectName, err := parseGCSURL(url)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		Error("Failed to create storage client: %v", err)
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Bucket(bucketName).Object(objectName).Delete(ctx); err != nil {
+		Error("Failed to delete %s: %v", url, err)
+		return fmt.Errorf("failed to delete %s: %v", url, err)
+	}
+	return nil
+}
+
+// gcsArchiveWriter uploads an archive as a single object, which only appears
+// in the bucket once the writer is closed
+type gcsArchiveWriter struct {
+	*storage.Writer
+	client *storage.Client
+	cancel context.CancelFunc
+	closed bool
+}
+
+// NewArchiveWriter starts a streaming upload to GCS
+// destination should be in format: gs://bucket-name/path/filename.tar.gz
+func (b *BackendGcs) NewArchiveWriter(ctx context.Context, destination string) (ArchiveWriter, error) {
+	bucketName, objectName, err := parseGCSURL(destination)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		Error("Failed to create storage client: %v", err)
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+
+	// Cancelling the context is the only way to abort an upload
+	ctx, cancel := context.WithCancel(ctx)
+	Info("Streaming archive to %s", destination)
+	return &gcsArchiveWriter{
+		Writer: client.Bucket(bucketName).Object(objectName).NewWriter(ctx),
+		client: client,
+		cancel: cancel,
+	}, nil
+}
+
+func (w *gcsArchiveWriter) Close() error {
+	w.closed = true
+	defer w.client.Close()
+	defer w.cancel()
+	if err := w.Writer.Close(); err != nil {
+		Error("Failed to finish upload: %v", err)
+		return fmt.Errorf("failed to finish upload: %v", err)
+	}
+	return nil
+}
+
+func (w *gcsArchiveWriter) Abort(err error) {
+	if w.closed {
+		return
+	}
+	Warn("Aborting upload: %v", err)
+	w.cancel()
+	w.Writer.Close()
+	w.client.Close()
+}
+
+// gcsArchiveReader closes the storage client along with the object reader
+type gcsArchiveReader struct {
+	*storage.Reader
+	client *storage.Client
+}
+
+func (r *gcsArchiveReader) Close() error {
+	defer r.client.Close()
+	return r.Reader.Close()
+}
+
+// NewArchiveReader starts a streaming download from GCS
+// source should be in format: gs://bucket-name/path/filename.tar.gz
+func (b *BackendGcs) NewArchiveReader(ctx context.Context, source string) (io.ReadCloser, error) {
+	bucketName, objectName, err := parseGCSURL(source)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		Error("Failed to create storage client: %v", err)
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	reader, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		client.Close()
+		Error("Failed to create object reader: %v", err)
+		return nil, fmt.Errorf("failed to create object reader: %v", err)
+	}
+	Info("Streaming archive %s (%d bytes)", source, reader.Attrs.Size)
+	return &gcsArchiveReader{Reader: reader, client: client}, nil
+}
+
+// parseGCSURL splits gs://bucket/object into its bucket and object name
+func parseGCSURL(url string) (string, string, error) {
+	if !strings.HasPrefix(url, "gs://") {
+		return "", "", fmt.Errorf("GCS path must start with gs://")
+	}
+	bucketName, objectName, found := strings.Cut(strings.TrimPrefix(url, "gs://"), "/")
+	if !found || bucketName == "" || objectName == "" {
+		return "", "", fmt.Errorf("invalid GCS path: %s", url)
+	}
+	return bucketName, objectName, nil
+}
@@ -0,0 +1,358 @@
+package backupmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// BackendLocal runs backups and restores entirely on the local machine: the
+// database is dumped and imported with mysqldump/mysql against a local MySQL
+// server, files are plain directory copies of TargetPath and archives are
+// stored under file:// URLs.
+type BackendLocal struct {
+	DB LocalDBConfig
+}
+
+func NewBackendLocal() *BackendLocal {
+	return &BackendLocal{
+		DB: localDBConfigFromEnv(),
+	}
+}
+
+// DownloadFolder copies the files of the environment its files filter keeps
+// to a local destination
+func (b *BackendLocal) DownloadFolder(envConfig *EnvironmentConfig, destination string) error {
+	Info("Copying files from %s to %s", envConfig.TargetPath, destination)
+
+	filter, err := envConfig.FilesFilter()
+	if err != nil {
+		return err
+	}
+	if err := copyDir(envConfig.TargetPath, destination, filter); err != nil {
+		Error("Failed to copy files: %v", err)
+		return fmt.Errorf("failed to copy files: %v", err)
+	}
+
+	Info("Successfully copied files from %s", envConfig.TargetPath)
+	return nil
+}
+
+// DatabaseEngine returns the engine of the dumps written by the backend,
+// the local backend dumps a MySQL server
+func (b *BackendLocal) DatabaseEngine() string {
+	return DatabaseEngineMySQL
+}
+
+// ExportDatabase dumps the database with mysqldump into out. Like a Cloud SQL
+// export the dump contains the CREATE DATABASE and USE statements for the
+// database.
+func (b *BackendLocal) ExportDatabase(ctx context.Context, envConfig *EnvironmentConfig, out io.Writer) error {
+	databaseName := envConfig.DBName
+	Info("Exporting database %s with mysqldump", databaseName)
+
+	var stderr bytes.Buffer
+	cmd := b.mysqlCommand(ctx, "mysqldump", "--single-transaction", "--routines", "--triggers", "--no-tablespaces", "--databases", databaseName)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		Error("mysqldump failed: %v\nOutput: %s", err, stderr.String())
+		return fmt.Errorf("mysqldump failed: %v\nOutput: %s", err, stderr.String())
+	}
+
+	Info("Successfully exported database %s", databaseName)
+	return nil
+}
+
+// ListArchives returns the file:// URLs of the archives whose path starts
+// with prefix, like the object names of a bucket, so archives in folders
+// below the prefix are listed as well
+func (b *BackendLocal) ListArchives(prefix string) ([]string, error) {
+	prefixPath, err := parseFileURL(prefix)
+	if err != nil {
+		return nil, err
+	}
+	folder, _ := filepath.Split(prefixPath)
+
+	var archives []string
+	err = filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && strings.HasPrefix(path, prefixPath) {
+			archives = append(archives, "file://"+path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		Error("Failed to list archives: %v", err)
+		return nil, fmt.Errorf("failed to list archives: %v", err)
+	}
+	return archives, nil
+}
+
+// DeleteArchive removes an archive at a file:// URL
+func (b *BackendLocal) DeleteArchive(url string) error {
+	archivePath, err := parseFileURL(url)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(archivePath); err != nil {
+		Error("Failed to delete %s: %v", url, err)
+		return fmt.Errorf("failed to delete %s: %v", url, err)
+	}
+	// Folders only exist as long as they hold objects, as in a bucket
+	os.Remove(filepath.Dir(archivePath))
+	return nil
+}
+
+// localArchiveWriter writes an archive next to its destination and renames
+// it into place when closed, so readers never see a partial archive
+type localArchiveWriter struct {
+	*os.File
+	destinationPath string
+	closed          bool
+}
+
+// NewArchiveWriter starts writing an archive to a file:// URL
+func (b *BackendLocal) NewArchiveWriter(ctx context.Context, destination string) (ArchiveWriter, error) {
+	destinationPath, err := parseFileURL(destination)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0755); err != nil {
+		Error("Failed to create archive folder: %v", err)
+		return nil, fmt.Errorf("failed to create archive folder: %v", err)
+	}
+	file, err := os.Create(destinationPath + ".partial")
+	if err != nil {
+		Error("Failed to create archive file: %v", err)
+		return nil, fmt.Errorf("failed to create archive file: %v", err)
+	}
+	Info("Streaming archive to %s", destination)
+	return &localArchiveWriter{File: file, destinationPath: destinationPath}, nil
+}
+
+func (w *localArchiveWriter) Close() error {
+	w.closed = true
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	if err := os.Rename(w.File.Name(), w.destinationPath); err != nil {
+		os.Remove(w.File.Name())
+		return fmt.Errorf("failed to store archive: %v", err)
+	}
+	return nil
+}
+
+func (w *localArchiveWriter) Abort(err error) {
+	if w.closed {
+		return
+	}
+	Warn("Discarding archive: %v", err)
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// NewArchiveReader opens an archive at a file:// URL
+func (b *BackendLocal) NewArchiveReader(ctx context.Context, source string) (io.ReadCloser, error) {
+	sourcePath, err := parseFileURL(source)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		Error("Failed to open archive: %v", err)
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	return file, nil
+}
+
+// ImportDatabase streams the (optionally gzipped) SQL dump into the database
+// with the mysql client, renaming the source database on the way
+func (b *BackendLocal) ImportDatabase(ctx context.Context, sqlDump io.Reader, envConfig *EnvironmentConfig, sourceConfig *EnvironmentConfig) error {
+	databaseName := envConfig.DBName
+	Info("Importing database %s", databaseName)
+
+	dump, err := openSQLDumpForImport(sqlDump, databaseName, sourceConfig.DBName)
+	if err != nil {
+		Error("Failed to read SQL dump: %v", err)
+		return fmt.Errorf("failed to read SQL dump: %v", err)
+	}
+	defer dump.Close()
+
+	// Dumps without a CREATE DATABASE statement expect the database to exist
+	var stderr bytes.Buffer
+	cmd := b.mysqlCommand(ctx, "mysql", "-e", fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", databaseName))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		Error("Failed to create database %s: %v\nOutput: %s", databaseName, err, stderr.String())
+		return fmt.Errorf("failed to create database %s: %v\nOutput: %s", databaseName, err, stderr.String())
+	}
+
+	stderr.Reset()
+	cmd = b.mysqlCommand(ctx, "mysql", databaseName)
+	cmd.Stdin = dump
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		Error("Database import failed: %v\nOutput: %s", err, stderr.String())
+		return fmt.Errorf("database import failed: %v\nOutput: %s", err, stderr.String())
+	}
+
+	Info("Database import completed successfully")
+	return nil
+}
+
+// UploadFolder mirrors the source folder into the environment files directory,
+// deleting files that don't exist in the source (like rsync --delete). Only
+// files the filter selects are deleted.
+func (b *BackendLocal) UploadFolder(sourcePath string, envConfig *EnvironmentConfig, filter *PathFilter) error {
+	Info("Copying folder from %s to %s", sourcePath, envConfig.TargetPath)
+
+	if err := copyDir(sourcePath, envConfig.TargetPath, nil); err != nil {
+		Error("Failed to copy files: %v", err)
+		return fmt.Errorf("failed to copy files: %v", err)
+	}
+	if err := removeExtraneous(sourcePath, envConfig.TargetPath, filter); err != nil {
+		Error("Failed to remove deleted files: %v", err)
+		return fmt.Errorf("failed to remove deleted files: %v", err)
+	}
+
+	Info("Successfully copied files to %s", envConfig.TargetPath)
+	return nil
+}
+
+// mysqlCommand builds a mysql/mysqldump command connecting to the local server.
+// The password is passed through the environment to keep it out of the process list.
+// The command is killed when ctx is cancelled.
+func (b *BackendLocal) mysqlCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	connArgs := []string{
+		"--protocol=TCP",
+		"--host=" + b.DB.Host,
+		"--port=" + b.DB.Port,
+		"--user=" + b.DB.User,
+	}
+	cmd := exec.CommandContext(ctx, name, append(connArgs, args...)...)
+	cmd.Env = os.Environ()
+	if b.DB.Password != "" {
+		cmd.Env = append(cmd.Env, "MYSQL_PWD="+b.DB.Password)
+	}
+	return cmd
+}
+
+// parseFileURL returns the local path of a file:// URL
+func parseFileURL(url string) (string, error) {
+	if !strings.HasPrefix(url, "file://") {
+		return "", fmt.Errorf("local archive path must start with file://")
+	}
+	path := strings.TrimPrefix(url, "file://")
+	if path == "" {
+		return "", fmt.Errorf("invalid local archive path: %s", url)
+	}
+	return path, nil
+}
+
+// copyDir recursively copies the contents of src that filter keeps into dst.
+// Symlinks are recreated as links rather than followed.
+func copyDir(src string, dst string, filter *PathFilter) error {
+	src = filepath.Clean(src)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %v", err)
+		}
+		if relPath != "." && !filter.keeps(filepath.ToSlash(relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, relPath)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %v", path, err)
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", target, err)
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			// Never write through a symlink or onto a directory left at the target
+			if existing, err := os.Lstat(target); err == nil && !existing.Mode().IsRegular() {
+				if err := os.RemoveAll(target); err != nil {
+					return fmt.Errorf("failed to replace %s: %v", target, err)
+				}
+			}
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			Warn("Skipping special file %s", path)
+			return nil
+		}
+	})
+}
+
+// removeExtraneous deletes everything below dst that has no counterpart in
+// src and is selected by filter
+func removeExtraneous(src string, dst string, filter *PathFilter) error {
+	dst = filepath.Clean(dst)
+	return filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dst, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %v", err)
+		}
+		if relPath == "." || !filter.Match(filepath.ToSlash(relPath)) {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(src, relPath)); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", path, err)
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %v", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %v", src, dst, err)
+	}
+	return out.Close()
+}
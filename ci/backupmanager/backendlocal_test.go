@@ -0,0 +1,159 @@
+package backupmanager
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func localConfigs(root string) EnvironmentConfigs {
+	configs := mockConfigs()
+	for env, config := range configs {
+		config.BackupURL = "file://" + filepath.Join(root, "backups")
+		config.TargetPath = filepath.Join(root, env, "files")
+	}
+	return configs
+}
+
+func TestLocalArchiveRoundTrip(t *testing.T) {
+	tmpFolder := t.TempDir()
+	backend := NewBackendLocal()
+
+	destination := "file://" + filepath.Join(tmpFolder, "backups/staging/backup_run.tar.gz")
+	writer, err := backend.NewArchiveWriter(context.Background(), destination)
+	if err != nil {
+		t.Fatalf("NewArchiveWriter failed: %v", err)
+	}
+	if _, err := io.WriteString(writer, "archive content"); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to store archive: %v", err)
+	}
+
+	reader, err := backend.NewArchiveReader(context.Background(), destination)
+	if err != nil {
+		t.Fatalf("NewArchiveReader failed: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "archive content" {
+		t.Errorf("Read archive differs: %q, %v", data, err)
+	}
+
+	if _, err := backend.NewArchiveWriter(context.Background(), "gs://bucket/archive.tar.gz"); err == nil {
+		t.Errorf("NewArchiveWriter should reject non file:// destinations")
+	}
+}
+
+func TestLocalUploadFolderMirrors(t *testing.T) {
+	tmpFolder := t.TempDir()
+	configs := localConfigs(tmpFolder)
+	backend := NewBackendLocal()
+	target := configs["production"].TargetPath
+
+	// Source tree to restore
+	source := filepath.Join(tmpFolder, "restore/files")
+	mustWriteFile(t, filepath.Join(source, "kept.txt"), "new content")
+	mustWriteFile(t, filepath.Join(source, "inline-images/image.png"), "png")
+	if err := os.Symlink("kept.txt", filepath.Join(source, "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	// Existing destination with stale content
+	mustWriteFile(t, filepath.Join(target, "kept.txt"), "old content")
+	mustWriteFile(t, filepath.Join(target, "stale.txt"), "stale")
+	mustWriteFile(t, filepath.Join(target, "old-dir/stale.txt"), "stale")
+
+	if err := backend.UploadFolder(source, configs["production"], nil); err != nil {
+		t.Fatalf("UploadFolder failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(target, "kept.txt"))
+	if err != nil || string(data) != "new content" {
+		t.Errorf("kept.txt not updated: %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "inline-images/image.png")); err != nil {
+		t.Errorf("inline-images/image.png not copied: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "link.txt")); err != nil || link != "kept.txt" {
+		t.Errorf("link.txt not recreated as symlink: %q, %v", link, err)
+	}
+	for _, stale := range []string{"stale.txt", "old-dir"} {
+		if _, err := os.Lstat(filepath.Join(target, stale)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", stale)
+		}
+	}
+}
+
+// TestLocalBackupAndRestore runs a real backup and restore against a local MySQL
+// server, e.g. the one from local/docker-compose.yaml:
+//
+//	LOCAL_DB_TEST=1 LOCAL_DB_PASSWORD=rootpass123 go test -run Local ./...
+func TestLocalBackupAndRestore(t *testing.T) {
+	if os.Getenv("LOCAL_DB_TEST") == "" {
+		t.Skip("LOCAL_DB_TEST not set, skipping local MySQL integration test")
+	}
+	if _, err := exec.LookPath("mysqldump"); err != nil {
+		t.Skip("mysqldump not installed")
+	}
+
+	tmpFolder := t.TempDir()
+	configs := localConfigs(tmpFolder)
+	for _, config := range configs {
+		config.DBBackend = DBBackendLocal
+		config.FilesBackend = FilesBackendLocal
+	}
+	backend := NewBackendLocal()
+	engine, err := NewBackupEngine(configs)
+	if err != nil {
+		t.Fatalf("NewBackupEngine failed: %v", err)
+	}
+
+	// Seed the staging database and files
+	runSQL(t, backend, "DROP DATABASE IF EXISTS staging_db; DROP DATABASE IF EXISTS production_db; "+
+		"CREATE DATABASE staging_db; CREATE TABLE staging_db.node (id INT PRIMARY KEY, title TEXT); "+
+		"INSERT INTO staging_db.node VALUES (1, 'Hello from staging');")
+	mustWriteFile(t, filepath.Join(configs["staging"].TargetPath, "inline-images/image.png"), "png")
+
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-local-001"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpFolder, "backups/backups/staging/backup_test-run-local-001.tar.gz")); err != nil {
+		t.Fatalf("Archive not stored: %v", err)
+	}
+
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-local-001", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+
+	if got := runSQL(t, backend, "SELECT title FROM production_db.node WHERE id = 1"); got != "Hello from staging" {
+		t.Errorf("unexpected restored row: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(configs["production"].TargetPath, "inline-images/image.png")); err != nil {
+		t.Errorf("files not restored: %v", err)
+	}
+}
+
+func runSQL(t *testing.T, backend *BackendLocal, sql string) string {
+	t.Helper()
+	output, err := backend.mysqlCommand(context.Background(), "mysql", "-N", "-B", "-e", sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("mysql failed: %v\nOutput: %s", err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func mustWriteFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,86 @@
+package backupmanager
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPostgresCommandEnvironment(t *testing.T) {
+	config := &EnvironmentConfig{DBHost: "10.0.0.5", DBUser: "backup", DBPassword: "secret"}
+
+	cmd := postgresCommand(context.Background(), config, "pg_dump", "--dbname=staging_db")
+	for _, expected := range []string{"PGHOST=10.0.0.5", "PGPORT=5432", "PGUSER=backup", "PGPASSWORD=secret"} {
+		if !slices.Contains(cmd.Env, expected) {
+			t.Errorf("missing %s in command environment", expected)
+		}
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "secret") {
+		t.Errorf("password must not be passed as an argument: %v", cmd.Args)
+	}
+}
+
+// TestPostgresBackupAndRestore runs a real backup and restore against a local
+// PostgreSQL server, e.g. docker run -e POSTGRES_PASSWORD=pgpass123 -p 5432:5432 postgres:
+//
+//	LOCAL_PG_TEST=1 LOCAL_PG_PASSWORD=pgpass123 go test -run Postgres ./...
+func TestPostgresBackupAndRestore(t *testing.T) {
+	if os.Getenv("LOCAL_PG_TEST") == "" {
+		t.Skip("LOCAL_PG_TEST not set, skipping local PostgreSQL integration test")
+	}
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		t.Skip("pg_dump not installed")
+	}
+
+	tmpFolder := t.TempDir()
+	configs := localConfigs(tmpFolder)
+	for _, config := range configs {
+		config.DBBackend = DBBackendPostgres
+		config.FilesBackend = FilesBackendLocal
+		config.DBHost = envOrDefault("LOCAL_PG_HOST", "127.0.0.1")
+		config.DBPort = os.Getenv("LOCAL_PG_PORT")
+		config.DBUser = envOrDefault("LOCAL_PG_USER", "postgres")
+		config.DBPassword = os.Getenv("LOCAL_PG_PASSWORD")
+	}
+	engine, err := NewBackupEngine(configs)
+	if err != nil {
+		t.Fatalf("NewBackupEngine failed: %v", err)
+	}
+
+	// Seed the staging database and files
+	runPostgresSQL(t, configs["staging"], "postgres", "DROP DATABASE IF EXISTS staging_db")
+	runPostgresSQL(t, configs["staging"], "postgres", "DROP DATABASE IF EXISTS production_db")
+	runPostgresSQL(t, configs["staging"], "postgres", "CREATE DATABASE staging_db")
+	runPostgresSQL(t, configs["staging"], "staging_db", "CREATE TABLE node (id INT PRIMARY KEY, title TEXT); "+
+		"INSERT INTO node VALUES (1, 'Hello from staging');")
+	mustWriteFile(t, filepath.Join(configs["staging"].TargetPath, "inline-images/image.png"), "png")
+
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-pg-001"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// Restoring twice replaces the objects of the first restore
+	for i := 0; i < 2; i++ {
+		if err := engine.PerformRestore(context.Background(), "staging", "test-run-pg-001", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+			t.Fatalf("PerformRestore failed: %v", err)
+		}
+	}
+
+	if got := runPostgresSQL(t, configs["production"], "production_db", "SELECT title FROM node WHERE id = 1"); got != "Hello from staging" {
+		t.Errorf("unexpected restored row: %q", got)
+	}
+}
+
+func runPostgresSQL(t *testing.T, config *EnvironmentConfig, databaseName string, sql string) string {
+	t.Helper()
+	output, err := postgresCommand(context.Background(), config, "psql", "--dbname="+databaseName, "--no-psqlrc", "--tuples-only", "--no-align",
+		"--set=ON_ERROR_STOP=1", "--command="+sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("psql failed: %v\nOutput: %s", err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
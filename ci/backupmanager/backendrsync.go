@@ -0,0 +1,133 @@
+package backupmanager
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// BackendRsync transfers the environment files from and to the VM with rsync over SSH
+type BackendRsync struct{}
+
+func NewBackendRsync() *BackendRsync {
+	return &BackendRsync{}
+}
+
+// DownloadFolder downloads the files the files filter of the environment keeps
+// from the VM via rsync over SSH to a local destination
+func (b *BackendRsync) DownloadFolder(envConfig *EnvironmentConfig, destination string) error {
+	Info("Starting rsync download from %s@%s:%s to %s", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath, destination)
+
+	filter, err := envConfig.FilesFilter()
+	if err != nil {
+		return err
+	}
+
+	// Build rsync command with SSH options
+	// Use -avz for archive mode, verbose, and compression
+	// Trailing slash on source ensures we copy contents, not the directory itself
+	source := fmt.Sprintf("%s@%s:%s/", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+
+	args := append([]string{"-avz"}, rsyncSelectArgs(filter)...)
+	cmd := exec.Command("rsync", append(args, "-e", "ssh", source, destination)...)
+
+	// Capture combined output for logging
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		Error("Rsync failed: %v\nOutput: %s", err, string(output))
+		return fmt.Errorf("rsync failed: %v\nOutput: %s", err, string(output))
+	}
+
+	Info("Rsync output:\n%s", string(output))
+	Info("Successfully downloaded files via rsync from %s@%s:%s", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+	return nil
+}
+
+// UploadFolder uploads the source folder to the VM with rsync --delete. Only
+// files the filter selects are deleted, rsync protects the others.
+func (b *BackendRsync) UploadFolder(sourcePath string, envConfig *EnvironmentConfig, filter *PathFilter) error {
+	Info("Uploading folder from %s to %s@%s:%s via rsync", sourcePath, envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+
+	// Build rsync command with SSH options
+	// Use -rlptz instead of -a to avoid setting directory timestamps and preserve permissions
+	// Delete files on destination that don't exist in source
+	destination := fmt.Sprintf("%s@%s:%s/", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+
+	// Add trailing slash to source to copy contents, not the directory itself
+	source := sourcePath
+	if !strings.HasSuffix(source, "/") {
+		source = source + "/"
+	}
+
+	// Use -rlpz: recursive, copy symlinks, preserve permissions, compress
+	// Use --no-times to skip setting timestamps entirely (avoids permission errors)
+	filterArgs, err := rsyncFilterArgs(filter)
+	if err != nil {
+		Error("Can't upload via rsync: %v", err)
+		return err
+	}
+	args := append([]string{"-rlpz", "--delete", "--no-times", "--no-perms", "--chmod=ugo=rwX"}, filterArgs...)
+	cmd := exec.Command("rsync", append(args, "-e", "ssh", source, destination)...)
+
+	// Capture combined output for logging
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		Error("Rsync upload failed: %v\nOutput: %s", err, string(output))
+		return fmt.Errorf("rsync upload failed: %v\nOutput: %s", err, string(output))
+	}
+
+	Info("Rsync output:\n%s", string(output))
+	Info("Successfully uploaded files via rsync to %s@%s:%s", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+	return nil
+}
+
+// rsyncSelectArgs returns the filter rules limiting the files rsync transfers
+// to those filter keeps. Excluded directories aren't walked, with include
+// patterns every other directory is walked but only the selected files are
+// transferred.
+func rsyncSelectArgs(filter *PathFilter) []string {
+	if filter == nil {
+		return nil
+	}
+	var args []string
+	for _, pattern := range filter.Exclude {
+		args = append(args, "--exclude=/"+pattern)
+	}
+	if len(filter.Include) == 0 {
+		return args
+	}
+	for _, pattern := range filter.Include {
+		args = append(args, "--include=/"+pattern, "--include=/"+pattern+"/**")
+	}
+	return append(args, "--include=*/", "--exclude=*")
+}
+
+// rsyncFilterArgs returns the filter rules limiting the deletions of rsync
+// --delete to the paths filter selects. The first rule matching a path wins:
+// excluded paths are protected, the included paths and everything below them
+// are at risk, everything else is protected. rsync can't express the paths
+// two lists of include patterns both select, filters restricted to another
+// filter with include patterns are refused.
+func rsyncFilterArgs(filter *PathFilter) ([]string, error) {
+	var args []string
+	var included *PathFilter
+	for f := filter; f != nil; f = f.within {
+		for _, pattern := range f.Exclude {
+			args = append(args, "--filter=P /"+pattern, "--filter=P /"+pattern+"/**")
+		}
+		if len(f.Include) == 0 {
+			continue
+		}
+		if included != nil {
+			return nil, fmt.Errorf("rsync can't limit deletions to the paths both %s and %s select, restore with the ssh files backend", strings.Join(included.Include, ", "), strings.Join(f.Include, ", "))
+		}
+		included = f
+	}
+	if included == nil {
+		return args, nil
+	}
+	for _, pattern := range included.Include {
+		args = append(args, "--filter=R /"+pattern, "--filter=R /"+pattern+"/**")
+	}
+	return append(args, "--filter=P *"), nil
+}
@@ -0,0 +1,40 @@
+package backupmanager
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRsyncFilterArgs(t *testing.T) {
+	backedUp, _ := NewPathFilter(nil, []string{"styles"})
+	paths, _ := NewPathFilter([]string{"inline-images/**"}, nil)
+
+	args, err := rsyncFilterArgs(paths.restrict(backedUp))
+	if err != nil {
+		t.Fatalf("rsyncFilterArgs failed: %v", err)
+	}
+	expected := []string{
+		"--filter=P /styles", "--filter=P /styles/**",
+		"--filter=R /inline-images/**", "--filter=R /inline-images/**/**",
+		"--filter=P *",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("rsyncFilterArgs = %v, expected %v", args, expected)
+	}
+	if args, err := rsyncFilterArgs(nil); args != nil || err != nil {
+		t.Errorf("no filter should give no rules, got %v, %v", args, err)
+	}
+
+	// rsync rules can't select what two include lists both select
+	included, _ := NewPathFilter([]string{"**/*.png"}, nil)
+	if _, err := rsyncFilterArgs(paths.restrict(included)); err == nil || !strings.Contains(err.Error(), "ssh files backend") {
+		t.Errorf("two include lists should be refused, got %v", err)
+	}
+
+	selecting, _ := NewPathFilter([]string{"**/*.png"}, []string{"styles"})
+	expected = []string{"--exclude=/styles", "--include=/**/*.png", "--include=/**/*.png/**", "--include=*/", "--exclude=*"}
+	if args := rsyncSelectArgs(selecting); !reflect.DeepEqual(args, expected) {
+		t.Errorf("rsyncSelectArgs = %v, expected %v", args, expected)
+	}
+}
@@ -0,0 +1,179 @@
+package backupmanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// BackendS3 stores backup archives in an S3-compatible object store
+// (AWS S3, MinIO, Wasabi, ...). Archive paths use the s3://bucket/key form.
+type BackendS3 struct {
+	client *minio.Client
+}
+
+func NewBackendS3(cfg S3Config) (*BackendS3, error) {
+	// minio-go expects a bare host[:port], but accept URLs for convenience
+	endpoint := cfg.Endpoint
+	secure := !cfg.Insecure
+	if strings.HasPrefix(endpoint, "http://") {
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+		secure = false
+	}
+	endpoint = strings.TrimPrefix(endpoint, "https://")
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	// Prefer explicitly configured keys, otherwise fall back to the usual
+	// AWS/MinIO environment variables, shared credentials file and IAM role
+	var creds *credentials.Credentials
+	if cfg.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client for %s: %v", endpoint, err)
+	}
+
+	return &BackendS3{
+		client: client,
+	}, nil
+}
+
+// ListArchives returns the URLs of the objects whose key starts with prefix
+// prefix should be in format: s3://bucket-name/path/filename
+func (b *BackendS3) ListArchives(prefix string) ([]string, error) {
+	ctx := context.Background()
+
+	bucketName, objectPrefix, err := parseS3URL(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []string
+	for object := range b.client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: objectPrefix, Recursive: true}) {
+		if object.Err != nil {
+			Error("Failed to list archives: %v", object.Err)
+			return nil, fmt.Errorf("failed to list archives: %v", object.Err)
+		}
+		archives = append(archives, "s3://"+bucketName+"/"+object.Key)
+	}
+	return archives, nil
+}
+
+// DeleteArchive removes an object from an S3 bucket
+func (b *BackendS3) DeleteArchive(url string) error {
+	bucketName, objectName, err := parseS3URL(url)
+	if err != nil {
+		return err
+	}
+	if err := b.client.RemoveObject(context.Background(), bucketName, objectName, minio.RemoveObjectOptions{}); err != nil {
+		Error("Failed to delete %s: %v", url, err)
+		return fmt.Errorf("failed to delete %s: %v", url, err)
+	}
+	return nil
+}
+
+// s3UploadPartSize is the part size of streamed uploads. Their size is
+// unknown up front, so minio-go would otherwise buffer 512 MiB parts to stay
+// within the 10,000 parts of a multipart upload.
+const s3UploadPartSize = 64 << 20
+
+// s3ArchiveWriter pipes an archive into a multipart upload, which is only
+// completed when the writer is closed
+type s3ArchiveWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// NewArchiveWriter starts a streaming upload to an S3 bucket
+// destination should be in format: s3://bucket-name/path/filename.tar.gz
+func (b *BackendS3) NewArchiveWriter(ctx context.Context, destination string) (ArchiveWriter, error) {
+	bucketName, objectName, err := parseS3URL(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	Info("Streaming archive to %s", destination)
+	reader, writer := io.Pipe()
+	w := &s3ArchiveWriter{PipeWriter: writer, done: make(chan struct{})}
+	go func() {
+		_, w.err = b.client.PutObject(ctx, bucketName, objectName, reader, -1, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			PartSize:    s3UploadPartSize,
+		})
+		// Unblock the writer when the upload fails early
+		reader.CloseWithError(w.err)
+		close(w.done)
+	}()
+	return w, nil
+}
+
+func (w *s3ArchiveWriter) Close() error {
+	w.PipeWriter.Close()
+	<-w.done
+	if w.err != nil {
+		Error("Failed to upload archive: %v", w.err)
+		return fmt.Errorf("failed to upload archive: %v", w.err)
+	}
+	return nil
+}
+
+// Abort fails the upload, minio-go then aborts the multipart upload
+func (w *s3ArchiveWriter) Abort(err error) {
+	Warn("Aborting upload: %v", err)
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+}
+
+// NewArchiveReader starts a streaming download from an S3 bucket
+// source should be in format: s3://bucket-name/path/filename.tar.gz
+func (b *BackendS3) NewArchiveReader(ctx context.Context, source string) (io.ReadCloser, error) {
+	bucketName, objectName, err := parseS3URL(source)
+	if err != nil {
+		return nil, err
+	}
+	object, err := b.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		Error("Failed to create object reader: %v", err)
+		return nil, fmt.Errorf("failed to create object reader: %v", err)
+	}
+
+	// GetObject is lazy, so stat first to get a clear error for missing objects
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		Error("Failed to read archive %s: %v", source, err)
+		return nil, fmt.Errorf("failed to read archive %s: %v", source, err)
+	}
+	Info("Streaming archive %s (%d bytes)", source, info.Size)
+	return object, nil
+}
+
+// parseS3URL splits s3://bucket/key into its bucket and object key
+func parseS3URL(url string) (string, string, error) {
+	if !strings.HasPrefix(url, "s3://") {
+		return "", "", fmt.Errorf("S3 path must start with s3://")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid S3 path: %s", url)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,692 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// BackendSSH transfers the environment files from and to the VM over an
+// in-process SSH connection. Host keys are verified against known_hosts and
+// only new or changed files are transferred, compared by size and mtime or,
+// when SSHChecksum is set, by SHA-256.
+//
+// The remote side needs GNU find, tar, xargs and sha256sum rather than the
+// SFTP subsystem: SFTP can't hash files on the server, lists a tree one
+// directory per round trip and transfers files one request at a time, where
+// a single find, sha256sum or tar stream does.
+type BackendSSH struct{}
+
+func NewBackendSSH() *BackendSSH {
+	return &BackendSSH{}
+}
+
+// SSHError describes a failed operation on the remote host, including the
+// remote stderr output when a command failed
+type SSHError struct {
+	Host   string
+	Op     string
+	Err    error
+	Stderr string
+}
+
+func (e *SSHError) Error() string {
+	msg := fmt.Sprintf("ssh %s on %s failed: %v", e.Op, e.Host, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *SSHError) Unwrap() error {
+	return e.Err
+}
+
+// syncEntry describes a file, directory or symlink of a synced tree
+type syncEntry struct {
+	Type  byte // 'f' regular file, 'd' directory, 'l' symlink
+	Size  int64
+	Mtime int64
+	Mode  os.FileMode
+	Link  string
+	Hash  string
+}
+
+// DownloadFolder copies new and changed files the files filter of the
+// environment keeps from the VM to a local destination
+func (b *BackendSSH) DownloadFolder(envConfig *EnvironmentConfig, destination string) error {
+	Info("Starting SSH download from %s@%s:%s to %s", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath, destination)
+
+	client, err := dialSSH(envConfig)
+	if err != nil {
+		Error("SSH connection failed: %v", err)
+		return err
+	}
+	defer client.Close()
+
+	remote, err := listRemoteTree(client, envConfig)
+	if err != nil {
+		Error("Failed to list remote files: %v", err)
+		return err
+	}
+	filter, err := envConfig.FilesFilter()
+	if err != nil {
+		return err
+	}
+	filterTree(remote, filter)
+	local, err := listLocalTree(destination)
+	if err != nil {
+		Error("Failed to list local files: %v", err)
+		return err
+	}
+	if envConfig.SSHChecksum {
+		if err := addChecksums(client, envConfig, remote, destination, local); err != nil {
+			Error("Failed to compute checksums: %v", err)
+			return err
+		}
+	}
+
+	transfer, _ := planSync(remote, local, envConfig.SSHChecksum, nil)
+	Info("%d of %d remote entries are new or changed", len(transfer), len(remote))
+	if len(transfer) == 0 {
+		Info("Local files are up to date")
+		return nil
+	}
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return fmt.Errorf("failed to create destination folder: %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "session", Err: err}
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = bytes.NewReader(nulList(transfer))
+	session.Stderr = &stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "session", Err: err}
+	}
+
+	if err := session.Start(remoteTarCommand(envConfig, true)); err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "tar", Err: err}
+	}
+	count, size, extractErr := extractSyncTar(stdout, destination)
+	if extractErr != nil {
+		// Drain the stream so the remote tar can exit
+		io.Copy(io.Discard, stdout)
+	}
+	if err := waitRemoteTar(session, envConfig, &stderr); err != nil {
+		return err
+	}
+	if extractErr != nil {
+		Error("Failed to extract downloaded files: %v", extractErr)
+		return fmt.Errorf("failed to extract downloaded files: %v", extractErr)
+	}
+
+	Info("Successfully downloaded %d files (%d bytes) via SSH from %s@%s:%s", count, size, envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+	return nil
+}
+
+// UploadFolder copies new and changed files to the VM and deletes remote files
+// that don't exist in the source (like rsync --delete). Only files the filter
+// selects are deleted.
+func (b *BackendSSH) UploadFolder(sourcePath string, envConfig *EnvironmentConfig, filter *PathFilter) error {
+	Info("Uploading folder from %s to %s@%s:%s via SSH", sourcePath, envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+
+	client, err := dialSSH(envConfig)
+	if err != nil {
+		Error("SSH connection failed: %v", err)
+		return err
+	}
+	defer client.Close()
+
+	if err := runRemote(client, envConfig, "mkdir -p "+shellQuote(envConfig.TargetPath), nil, nil); err != nil {
+		Error("Failed to create remote folder: %v", err)
+		return err
+	}
+
+	local, err := listLocalTree(sourcePath)
+	if err != nil {
+		Error("Failed to list local files: %v", err)
+		return err
+	}
+	remote, err := listRemoteTree(client, envConfig)
+	if err != nil {
+		Error("Failed to list remote files: %v", err)
+		return err
+	}
+	if envConfig.SSHChecksum {
+		if err := addChecksums(client, envConfig, remote, sourcePath, local); err != nil {
+			Error("Failed to compute checksums: %v", err)
+			return err
+		}
+	}
+
+	transfer, remove := planSync(local, remote, envConfig.SSHChecksum, filter)
+	Info("%d entries to upload, %d entries to delete", len(transfer), len(remove))
+
+	// Delete first, entries that changed type are in both lists
+	if len(remove) > 0 {
+		cmd := fmt.Sprintf("cd %s && xargs -0 rm -rf --", shellQuote(envConfig.TargetPath))
+		if err := runRemote(client, envConfig, cmd, bytes.NewReader(nulList(remove)), nil); err != nil {
+			Error("Failed to delete remote files: %v", err)
+			return err
+		}
+	}
+
+	if len(transfer) > 0 {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(writeSyncTar(writer, sourcePath, transfer))
+		}()
+		// Existing directories keep their owner, mode and mtime
+		cmd := fmt.Sprintf("tar -C %s -xf - --no-overwrite-dir --no-same-owner", shellQuote(envConfig.TargetPath))
+		err := runRemote(client, envConfig, cmd, reader, nil)
+		reader.Close()
+		if err != nil {
+			Error("Failed to upload files: %v", err)
+			return err
+		}
+	}
+
+	Info("Successfully uploaded files via SSH to %s@%s:%s", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+	return nil
+}
+
+// dialSSH connects to the environment's VM, verifying its host key against the
+// configured known_hosts file. Authentication uses the configured identity
+// file, or the keys of a running ssh-agent, whose connection is closed along
+// with the client.
+func dialSSH(envConfig *EnvironmentConfig) (*ssh.Client, error) {
+	host := envConfig.TargetHost
+	port := envConfig.SSHPort
+	if port == "" {
+		port = "22"
+	}
+	knownHostsFile := envConfig.SSHKnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = "~/.ssh/known_hosts"
+	}
+
+	hostKeyCallback, err := knownhosts.New(expandHome(knownHostsFile))
+	if err != nil {
+		return nil, &SSHError{Host: host, Op: "connect", Err: fmt.Errorf("failed to load known hosts: %v", err)}
+	}
+
+	var auth []ssh.AuthMethod
+	var agentConn net.Conn
+	if envConfig.SSHIdentityFile != "" {
+		key, err := os.ReadFile(expandHome(envConfig.SSHIdentityFile))
+		if err != nil {
+			return nil, &SSHError{Host: host, Op: "connect", Err: fmt.Errorf("failed to read identity file: %v", err)}
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, &SSHError{Host: host, Op: "connect", Err: fmt.Errorf("failed to parse identity file %s: %v", envConfig.SSHIdentityFile, err)}
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	} else if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		agentConn, err = net.Dial("unix", sock)
+		if err != nil {
+			return nil, &SSHError{Host: host, Op: "connect", Err: fmt.Errorf("failed to connect to ssh-agent: %v", err)}
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	} else {
+		return nil, &SSHError{Host: host, Op: "connect", Err: fmt.Errorf("no identity file configured and no ssh-agent available")}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            envConfig.TargetUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, port), config)
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				err = fmt.Errorf("host key verification failed, %s is not in %s: %v", host, knownHostsFile, err)
+			} else {
+				err = fmt.Errorf("host key verification failed, the key of %s does not match %s: %v", host, knownHostsFile, err)
+			}
+		}
+		return nil, &SSHError{Host: host, Op: "connect", Err: err}
+	}
+	// The agent connection goes with the client
+	if agentConn != nil {
+		go func() {
+			client.Wait()
+			agentConn.Close()
+		}()
+	}
+	return client, nil
+}
+
+// runRemote runs a command on the remote host
+func runRemote(client *ssh.Client, envConfig *EnvironmentConfig, cmd string, stdin io.Reader, stdout io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "session", Err: err}
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		op, _, _ := strings.Cut(cmd, " ")
+		return &SSHError{Host: envConfig.TargetHost, Op: op, Err: err, Stderr: stderr.String()}
+	}
+	return nil
+}
+
+// listRemoteTree lists every entry below the remote TargetPath
+func listRemoteTree(client *ssh.Client, envConfig *EnvironmentConfig) (map[string]syncEntry, error) {
+	var output bytes.Buffer
+	cmd := fmt.Sprintf(`cd %s && find . -mindepth 1 -printf '%%y %%s %%T@ %%m\0%%P\0%%l\0'`, shellQuote(envConfig.TargetPath))
+	if err := runRemote(client, envConfig, cmd, nil, &output); err != nil {
+		return nil, err
+	}
+	return parseRemoteTree(output.Bytes())
+}
+
+// filterTree removes the entries filter doesn't keep from a tree
+func filterTree(entries map[string]syncEntry, filter *PathFilter) {
+	if filter == nil {
+		return
+	}
+	for path, entry := range entries {
+		if !filter.keeps(path, entry.Type == 'd') {
+			delete(entries, path)
+		}
+	}
+}
+
+// parseRemoteTree parses the output of find -printf '%y %s %T@ %m\0%P\0%l\0'
+func parseRemoteTree(output []byte) (map[string]syncEntry, error) {
+	entries := make(map[string]syncEntry)
+	fields := strings.Split(string(output), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		attrs := strings.Fields(fields[i])
+		if len(attrs) != 4 || len(attrs[0]) != 1 {
+			return nil, fmt.Errorf("unexpected remote listing entry: %q", fields[i])
+		}
+		size, err := strconv.ParseInt(attrs[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in remote listing: %q", fields[i])
+		}
+		seconds, _, _ := strings.Cut(attrs[2], ".")
+		mtime, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mtime in remote listing: %q", fields[i])
+		}
+		mode, err := strconv.ParseUint(attrs[3], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode in remote listing: %q", fields[i])
+		}
+
+		entryType := attrs[0][0]
+		if entryType != 'f' && entryType != 'd' && entryType != 'l' {
+			Warn("Skipping special file %s", fields[i+1])
+			continue
+		}
+		entries[fields[i+1]] = syncEntry{
+			Type:  entryType,
+			Size:  size,
+			Mtime: mtime,
+			Mode:  os.FileMode(mode),
+			Link:  fields[i+2],
+		}
+	}
+	return entries, nil
+}
+
+// listLocalTree lists every entry below root, an absent root is an empty tree
+func listLocalTree(root string) (map[string]syncEntry, error) {
+	entries := make(map[string]syncEntry)
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return entries, nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %v", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		entry := syncEntry{
+			Size:  info.Size(),
+			Mtime: info.ModTime().Unix(),
+			Mode:  info.Mode().Perm(),
+		}
+		switch {
+		case info.IsDir():
+			entry.Type = 'd'
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Type = 'l'
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink %s: %v", path, err)
+			}
+		case info.Mode().IsRegular():
+			entry.Type = 'f'
+		default:
+			Warn("Skipping special file %s", path)
+			return nil
+		}
+		entries[filepath.ToSlash(relPath)] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// addChecksums fills in the SHA-256 of the regular files that exist with the
+// same size on both sides, for all others size alone decides
+func addChecksums(client *ssh.Client, envConfig *EnvironmentConfig, remote map[string]syncEntry, localRoot string, local map[string]syncEntry) error {
+	var candidates []string
+	for path, r := range remote {
+		if l, ok := local[path]; ok && r.Type == 'f' && l.Type == 'f' && r.Size == l.Size {
+			candidates = append(candidates, path)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Strings(candidates)
+
+	var output bytes.Buffer
+	cmd := fmt.Sprintf("cd %s && xargs -0 sha256sum --zero --", shellQuote(envConfig.TargetPath))
+	if err := runRemote(client, envConfig, cmd, bytes.NewReader(nulList(candidates)), &output); err != nil {
+		return err
+	}
+	for _, record := range strings.Split(output.String(), "\x00") {
+		// Records are "<hash>  <path>" or "<hash> *<path>" for binary mode
+		if len(record) < 66 {
+			continue
+		}
+		path := record[66:]
+		if entry, ok := remote[path]; ok {
+			entry.Hash = record[:64]
+			remote[path] = entry
+		}
+	}
+
+	for _, path := range candidates {
+		hash, err := fileSHA256(filepath.Join(localRoot, filepath.FromSlash(path)))
+		if err != nil {
+			return err
+		}
+		entry := local[path]
+		entry.Hash = hash
+		local[path] = entry
+	}
+	return nil
+}
+
+// planSync compares a source and a destination tree and returns the source
+// entries to transfer and the destination entries to delete. Entries that
+// changed type appear in both lists and must be deleted first. Destination
+// entries missing in the source are only deleted when filter selects them.
+func planSync(source map[string]syncEntry, destination map[string]syncEntry, checksum bool, filter *PathFilter) ([]string, []string) {
+	var transfer, remove []string
+	for path, src := range source {
+		dst, ok := destination[path]
+		switch {
+		case !ok:
+			transfer = append(transfer, path)
+		case src.Type != dst.Type:
+			remove = append(remove, path)
+			transfer = append(transfer, path)
+		case src.Type == 'l' && src.Link != dst.Link:
+			remove = append(remove, path)
+			transfer = append(transfer, path)
+		case src.Type == 'f' && fileChanged(src, dst, checksum):
+			transfer = append(transfer, path)
+		}
+	}
+	for path := range destination {
+		if _, ok := source[path]; !ok && filter.Match(path) {
+			remove = append(remove, path)
+		}
+	}
+
+	// Sorting puts directories before their content
+	sort.Strings(transfer)
+	sort.Strings(remove)
+
+	// Entries inside a deleted directory go with it
+	var pruned []string
+	for _, path := range remove {
+		if n := len(pruned); n > 0 && strings.HasPrefix(path, pruned[n-1]+"/") {
+			continue
+		}
+		pruned = append(pruned, path)
+	}
+	return transfer, pruned
+}
+
+func fileChanged(src syncEntry, dst syncEntry, checksum bool) bool {
+	if src.Size != dst.Size {
+		return true
+	}
+	if checksum {
+		return src.Hash == "" || src.Hash != dst.Hash
+	}
+	return src.Mtime != dst.Mtime
+}
+
+// writeSyncTar writes the given entries below root as a tar stream
+func writeSyncTar(w io.Writer, root string, paths []string) error {
+	tarWriter := tar.NewWriter(w)
+	for _, path := range paths {
+		fullPath := filepath.Join(root, filepath.FromSlash(path))
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", fullPath, err)
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(fullPath); err != nil {
+				return fmt.Errorf("failed to read symlink %s: %v", fullPath, err)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("failed to create tar header for %s: %v", fullPath, err)
+		}
+		header.Name = path
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		header.Uname, header.Gname = "", ""
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write header for %s: %v", path, err)
+		}
+		if info.Mode().IsRegular() {
+			file, err := os.Open(fullPath)
+			if err != nil {
+				return fmt.Errorf("failed to open file %s: %v", fullPath, err)
+			}
+			_, err = io.Copy(tarWriter, file)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("failed to write file %s to tar: %v", fullPath, err)
+			}
+		}
+	}
+	return tarWriter.Close()
+}
+
+// extractSyncTar extracts a tar stream produced by the remote tar into
+// destination, keeping file mtimes so later syncs can skip unchanged files.
+// Symlinks pointing outside destination, also by way of the symlinks already
+// there, are rejected and existing symlinks are never followed, so nothing is
+// written outside of it.
+func extractSyncTar(r io.Reader, destination string) (int, int64, error) {
+	tarReader := tar.NewReader(r)
+	links := newLinkResolver(func(name string) (string, bool) {
+		link, err := os.Readlink(filepath.Join(destination, filepath.FromSlash(name)))
+		return link, err == nil
+	})
+	count := 0
+	var size int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return count, size, nil
+		}
+		if err != nil {
+			return count, size, fmt.Errorf("failed to read tar header: %v", err)
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+			return count, size, fmt.Errorf("invalid file path in transfer: %s", header.Name)
+		}
+		targetPath := filepath.Join(destination, name)
+
+		if header.Typeflag == tar.TypeSymlink && !links.add(filepath.ToSlash(name), header.Linkname) {
+			return count, size, fmt.Errorf("symlink %s points outside the files: %s", header.Name, header.Linkname)
+		}
+		if err := makeExtractDirs(destination, filepath.Dir(targetPath)); err != nil {
+			return count, size, fmt.Errorf("failed to create parent directory: %v", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if existing, err := os.Lstat(targetPath); err == nil && !existing.IsDir() {
+				if err := os.RemoveAll(targetPath); err != nil {
+					return count, size, fmt.Errorf("failed to replace %s: %v", targetPath, err)
+				}
+			}
+			if err := os.Mkdir(targetPath, header.FileInfo().Mode().Perm()|0700); err != nil && !os.IsExist(err) {
+				return count, size, fmt.Errorf("failed to create directory %s: %v", targetPath, err)
+			}
+		case tar.TypeLink:
+			return count, size, fmt.Errorf("hard link %s to %s in transfer, the remote tar must write hard linked files in full", header.Name, header.Linkname)
+		case tar.TypeSymlink:
+			if err := os.RemoveAll(targetPath); err != nil {
+				return count, size, fmt.Errorf("failed to replace %s: %v", targetPath, err)
+			}
+			if err := os.Symlink(header.Linkname, targetPath); err != nil {
+				return count, size, fmt.Errorf("failed to create symlink %s: %v", targetPath, err)
+			}
+		case tar.TypeReg:
+			if existing, err := os.Lstat(targetPath); err == nil && !existing.Mode().IsRegular() {
+				if err := os.RemoveAll(targetPath); err != nil {
+					return count, size, fmt.Errorf("failed to replace %s: %v", targetPath, err)
+				}
+			}
+			outFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return count, size, fmt.Errorf("failed to create file %s: %v", targetPath, err)
+			}
+			written, err := io.Copy(outFile, tarReader)
+			outFile.Close()
+			if err != nil {
+				return count, size, fmt.Errorf("failed to write file %s: %v", targetPath, err)
+			}
+			if err := os.Chtimes(targetPath, header.ModTime, header.ModTime); err != nil {
+				return count, size, fmt.Errorf("failed to set mtime of %s: %v", targetPath, err)
+			}
+			count++
+			size += written
+		}
+	}
+}
+
+// remoteTarCommand returns the remote command writing the files below
+// TargetPath as a tar stream, of the NUL separated paths on its stdin when
+// fromList is set. Hard linked files are written in full every time, so the
+// stream only holds files, directories and symlinks.
+func remoteTarCommand(envConfig *EnvironmentConfig, fromList bool) string {
+	if fromList {
+		return fmt.Sprintf("tar -C %s --hard-dereference --no-recursion --null --verbatim-files-from -T - -cf -", shellQuote(envConfig.TargetPath))
+	}
+	return fmt.Sprintf("tar -C %s --hard-dereference -cf - .", shellQuote(envConfig.TargetPath))
+}
+
+// waitRemoteTar waits for the remote tar of remoteTarCommand to exit. GNU tar
+// exits with status 1 when files changed or vanished while it read them: the
+// stream is still complete, with those files as tar read them, so that is
+// only a warning. Other failures are returned as an SSHError.
+func waitRemoteTar(session *ssh.Session, envConfig *EnvironmentConfig, stderr *bytes.Buffer) error {
+	err := session.Wait()
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 {
+		Warn("Remote tar read files that changed meanwhile, they are kept as read: %s", strings.TrimSpace(stderr.String()))
+		return nil
+	}
+	if err != nil {
+		Error("Remote tar failed: %v\nOutput: %s", err, stderr.String())
+		return &SSHError{Host: envConfig.TargetHost, Op: "tar", Err: err, Stderr: stderr.String()}
+	}
+	return nil
+}
+
+// nulList joins paths into a NUL separated list for xargs -0 and tar --null
+func nulList(paths []string) []byte {
+	var buf bytes.Buffer
+	for _, path := range paths {
+		buf.WriteString(path)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// shellQuote quotes a string for use as a single word in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, bufio.NewReader(file)); err != nil {
+		return "", fmt.Errorf("failed to hash file %s: %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
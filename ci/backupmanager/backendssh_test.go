@@ -0,0 +1,624 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testRemote runs a remote command for the test SSH server and returns its
+// exit status
+type testRemote func(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) uint32
+
+// newTestSSHServer starts an in-process SSH server that runs the remote
+// commands of BackendSSH locally, see runTestRemoteShell, and returns an
+// environment config pointing at it with a matching identity file and
+// known_hosts entry
+func newTestSSHServer(t *testing.T) *EnvironmentConfig {
+	t.Helper()
+	requireGNUTools(t)
+	return newTestSSHServerRunning(t, runTestRemoteShell)
+}
+
+// newTestSSHServerRunning starts a test SSH server like newTestSSHServer that
+// runs the remote commands with remote
+func newTestSSHServerRunning(t *testing.T, remote testRemote) *EnvironmentConfig {
+	t.Helper()
+	tmpFolder := t.TempDir()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create host signer: %v", err)
+	}
+	clientPublicKey, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	authorizedKey, err := ssh.NewPublicKey(clientPublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create client public key: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "deployer" && string(key.Marshal()) == string(authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config, remote)
+		}
+	}()
+
+	// Client side identity file and known_hosts
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatalf("Failed to marshal client key: %v", err)
+	}
+	identityFile := filepath.Join(tmpFolder, "id_ed25519")
+	mustWriteFile(t, identityFile, string(pem.EncodeToMemory(block)))
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	knownHostsFile := filepath.Join(tmpFolder, "known_hosts")
+	mustWriteFile(t, knownHostsFile, knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())+"\n")
+
+	return &EnvironmentConfig{
+		FilesBackend:      FilesBackendSSH,
+		TargetHost:        host,
+		TargetUser:        "deployer",
+		TargetPath:        filepath.Join(tmpFolder, "remote/site's files"),
+		SSHPort:           port,
+		SSHIdentityFile:   identityFile,
+		SSHKnownHostsFile: knownHostsFile,
+	}
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig, remote testRemote) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" || len(req.Payload) < 4 {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				command := string(req.Payload[4 : 4+binary.BigEndian.Uint32(req.Payload)])
+
+				status := remote(command, channel, channel, channel.Stderr())
+				channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+				return
+			}
+		}()
+	}
+}
+
+// runTestRemoteShell runs a remote command of BackendSSH with the local sh,
+// so the tests run the same GNU find, tar, xargs and sha256sum as the VM
+func runTestRemoteShell(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) uint32 {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.ExitCode())
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+	return 0
+}
+
+// requireGNUTools skips a test when the host lacks the GNU tools the remote
+// commands of BackendSSH need
+func requireGNUTools(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"find", "tar", "xargs", "sha256sum"} {
+		version, err := exec.Command(tool, "--version").Output()
+		if err != nil || !strings.Contains(string(version), "GNU") {
+			t.Skipf("GNU %s is needed to run the remote commands", tool)
+		}
+	}
+}
+
+func TestSSHDownloadFolder(t *testing.T) {
+	envConfig := newTestSSHServer(t)
+	backend := NewBackendSSH()
+
+	// Remote tree to back up
+	mtime := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	mustWriteFile(t, filepath.Join(envConfig.TargetPath, "file.txt"), "content")
+	mustWriteFile(t, filepath.Join(envConfig.TargetPath, "inline-images/image with space.png"), "png")
+	if err := os.Chtimes(filepath.Join(envConfig.TargetPath, "file.txt"), mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(envConfig.TargetPath, "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(envConfig.TargetPath, "empty"), 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	// tar writes hard linked files in full
+	if err := os.Link(filepath.Join(envConfig.TargetPath, "file.txt"), filepath.Join(envConfig.TargetPath, "hard-link.txt")); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+
+	destination := filepath.Join(t.TempDir(), "files")
+	if err := backend.DownloadFolder(envConfig, destination); err != nil {
+		t.Fatalf("DownloadFolder failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(destination, "file.txt"))
+	if err != nil || string(data) != "content" {
+		t.Errorf("file.txt not downloaded: %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(destination, "file.txt")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("file.txt mtime not preserved: %v, %v", info.ModTime(), err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "inline-images/image with space.png")); err != nil {
+		t.Errorf("nested file not downloaded: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(destination, "link.txt")); err != nil || link != "file.txt" {
+		t.Errorf("link.txt not downloaded as symlink: %q, %v", link, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(destination, "hard-link.txt")); err != nil || string(data) != "content" {
+		t.Errorf("hard-link.txt not downloaded: %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(destination, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty folder not downloaded: %v", err)
+	}
+
+	// A second download has nothing to transfer and leaves local files alone
+	mustWriteFile(t, filepath.Join(destination, "local-only.txt"), "local")
+	if err := backend.DownloadFolder(envConfig, destination); err != nil {
+		t.Fatalf("Second DownloadFolder failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "local-only.txt")); err != nil {
+		t.Errorf("download should not delete local files: %v", err)
+	}
+}
+
+func TestSSHUploadFolderMirrors(t *testing.T) {
+	envConfig := newTestSSHServer(t)
+	backend := NewBackendSSH()
+	target := envConfig.TargetPath
+
+	// Source tree to restore
+	source := filepath.Join(t.TempDir(), "restore/files")
+	mustWriteFile(t, filepath.Join(source, "kept.txt"), "new content")
+	mustWriteFile(t, filepath.Join(source, "inline-images/image.png"), "png")
+	mustWriteFile(t, filepath.Join(source, "-dash.txt"), "dash")
+	if err := os.Symlink("kept.txt", filepath.Join(source, "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	// Existing destination with stale content, and a file that became a folder
+	mustWriteFile(t, filepath.Join(target, "kept.txt"), "old content")
+	mustWriteFile(t, filepath.Join(target, "stale.txt"), "stale")
+	mustWriteFile(t, filepath.Join(target, "old-dir/stale.txt"), "stale")
+	mustWriteFile(t, filepath.Join(target, "inline-images"), "not a folder")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(target, "kept.txt"), old, old); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	if err := backend.UploadFolder(source, envConfig, nil); err != nil {
+		t.Fatalf("UploadFolder failed: %v", err)
+	}
+
+	for path, want := range map[string]string{"kept.txt": "new content", "inline-images/image.png": "png", "-dash.txt": "dash"} {
+		data, err := os.ReadFile(filepath.Join(target, path))
+		if err != nil || string(data) != want {
+			t.Errorf("%s not uploaded: %q, %v", path, data, err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(target, "link.txt")); err != nil || link != "kept.txt" {
+		t.Errorf("link.txt not recreated as symlink: %q, %v", link, err)
+	}
+	for _, stale := range []string{"stale.txt", "old-dir"} {
+		if _, err := os.Lstat(filepath.Join(target, stale)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", stale)
+		}
+	}
+
+	// Same size and mtime, only a checksum notices the change
+	info, err := os.Stat(filepath.Join(target, "kept.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat kept.txt: %v", err)
+	}
+	mustWriteFile(t, filepath.Join(source, "kept.txt"), "NEW CONTENT")
+	if err := os.Chtimes(filepath.Join(source, "kept.txt"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+	envConfig.SSHChecksum = true
+	if err := backend.UploadFolder(source, envConfig, nil); err != nil {
+		t.Fatalf("UploadFolder with checksums failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "kept.txt")); err != nil || string(data) != "NEW CONTENT" {
+		t.Errorf("kept.txt not updated in checksum mode: %q, %v", data, err)
+	}
+}
+
+func TestSSHUnknownHostKey(t *testing.T) {
+	envConfig := newTestSSHServer(t)
+
+	// Replace the known host entry with a different key
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKey, err := ssh.NewPublicKey(otherKey)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+	address := net.JoinHostPort(envConfig.TargetHost, envConfig.SSHPort)
+	mustWriteFile(t, envConfig.SSHKnownHostsFile, knownhosts.Line([]string{knownhosts.Normalize(address)}, publicKey)+"\n")
+
+	err = NewBackendSSH().DownloadFolder(envConfig, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "host key verification failed") {
+		t.Fatalf("expected host key verification error, got %v", err)
+	}
+	var sshErr *SSHError
+	if !errors.As(err, &sshErr) || sshErr.Op != "connect" {
+		t.Errorf("expected a connect SSHError, got %T", err)
+	}
+
+	// Hosts missing from known_hosts are rejected as well
+	mustWriteFile(t, envConfig.SSHKnownHostsFile, "")
+	if err := NewBackendSSH().DownloadFolder(envConfig, t.TempDir()); err == nil {
+		t.Errorf("expected unknown host to be rejected")
+	}
+}
+
+func TestExtractSyncTarRejectsEscapingLinks(t *testing.T) {
+	outside := t.TempDir()
+	for _, test := range []struct {
+		name     string
+		existing map[string]string
+		entries  []*tar.Header
+		problem  string
+	}{
+		{"absolute link", nil, []*tar.Header{
+			{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside},
+		}, "points outside the files"},
+		{"relative link", nil, []*tar.Header{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "dir/escape", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+		}, "points outside the files"},
+		{"chained links", nil, []*tar.Header{
+			{Name: "x/y/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "x/y/b", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "x/y/b/.."},
+		}, "points outside the files"},
+		{"link chained to a synced link", map[string]string{"x/b": ".."}, []*tar.Header{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "x/b/.."},
+		}, "points outside the files"},
+		{"write through a link", nil, []*tar.Header{
+			{Name: "images", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "images/a.png", Typeflag: tar.TypeReg, Mode: 0644},
+		}, "leads through the symlink"},
+	} {
+		var buf bytes.Buffer
+		tarWriter := tar.NewWriter(&buf)
+		for _, header := range test.entries {
+			if err := tarWriter.WriteHeader(header); err != nil {
+				t.Fatalf("Failed to write tar header: %v", err)
+			}
+		}
+		tarWriter.Close()
+
+		destination := filepath.Join(t.TempDir(), "files")
+		for name, link := range test.existing {
+			linkPath := filepath.Join(destination, name)
+			os.MkdirAll(filepath.Dir(linkPath), 0755)
+			if err := os.Symlink(link, linkPath); err != nil {
+				t.Fatalf("Failed to create symlink: %v", err)
+			}
+		}
+		_, _, err := extractSyncTar(&buf, destination)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.problem, err)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("nothing should be written outside the destination, found %v", entries)
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	source := map[string]syncEntry{
+		"same.txt":        {Type: 'f', Size: 4, Mtime: 100},
+		"newer.txt":       {Type: 'f', Size: 4, Mtime: 200},
+		"resized.txt":     {Type: 'f', Size: 5, Mtime: 100},
+		"new-dir":         {Type: 'd'},
+		"new-dir/new.txt": {Type: 'f', Size: 1, Mtime: 100},
+		"was-file":        {Type: 'd'},
+		"link":            {Type: 'l', Link: "same.txt"},
+	}
+	destination := map[string]syncEntry{
+		"same.txt":        {Type: 'f', Size: 4, Mtime: 100},
+		"newer.txt":       {Type: 'f', Size: 4, Mtime: 100},
+		"resized.txt":     {Type: 'f', Size: 4, Mtime: 100},
+		"was-file":        {Type: 'f', Size: 1, Mtime: 100},
+		"link":            {Type: 'l', Link: "other.txt"},
+		"stale-dir":       {Type: 'd'},
+		"stale-dir/a.txt": {Type: 'f', Size: 1, Mtime: 100},
+	}
+
+	transfer, remove := planSync(source, destination, false, nil)
+	wantTransfer := []string{"link", "new-dir", "new-dir/new.txt", "newer.txt", "resized.txt", "was-file"}
+	wantRemove := []string{"link", "stale-dir", "was-file"}
+	if !reflect.DeepEqual(transfer, wantTransfer) {
+		t.Errorf("transfer = %v, want %v", transfer, wantTransfer)
+	}
+	if !reflect.DeepEqual(remove, wantRemove) {
+		t.Errorf("remove = %v, want %v", remove, wantRemove)
+	}
+
+	// A filter keeps the entries it doesn't select, unless they changed type
+	filter, _ := NewPathFilter([]string{"stale-dir/*.txt"}, nil)
+	_, remove = planSync(source, destination, false, filter)
+	if wantRemove := []string{"link", "stale-dir/a.txt", "was-file"}; !reflect.DeepEqual(remove, wantRemove) {
+		t.Errorf("filtered remove = %v, want %v", remove, wantRemove)
+	}
+
+	// With checksums the mtime is ignored and the content decides
+	source = map[string]syncEntry{
+		"touched.txt":  {Type: 'f', Size: 4, Mtime: 200, Hash: "aaaa"},
+		"modified.txt": {Type: 'f', Size: 4, Mtime: 100, Hash: "bbbb"},
+	}
+	destination = map[string]syncEntry{
+		"touched.txt":  {Type: 'f', Size: 4, Mtime: 100, Hash: "aaaa"},
+		"modified.txt": {Type: 'f', Size: 4, Mtime: 100, Hash: "cccc"},
+	}
+	transfer, _ = planSync(source, destination, true, nil)
+	if !reflect.DeepEqual(transfer, []string{"modified.txt"}) {
+		t.Errorf("checksum transfer = %v, want [modified.txt]", transfer)
+	}
+}
+
+// gnuFindOutput is the output of GNU find 4.9 for the listing command of
+// listRemoteTree, on a tree with names holding a space, a backslash and a
+// newline
+const gnuFindOutput = "f 7 1705312800.5000000000 644\x00a b.txt\x00\x00" +
+	"d 4096 1705312800.5000000000 755\x00dir\x00\x00" +
+	"f 3 1705312800.5000000000 644\x00dir/back\\slash.png\x00\x00" +
+	"l 7 1705312800.0000000000 777\x00link\x00a b.txt\x00" +
+	"f 1 1705312800.5000000000 644\x00new\nline.txt\x00\x00"
+
+// gnuSHA256Output is the output of GNU sha256sum 9.1 --zero for the files of
+// gnuFindOutput, names aren't escaped with --zero
+const gnuSHA256Output = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73  a b.txt\x00" +
+	"8f8cbb7dcf46e0bc7d53265749a6c17d116093a6ba95e442764060c76fd4a86c  dir/back\\slash.png\x00" +
+	"2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881  new\nline.txt\x00"
+
+func TestParseRemoteTreeGNUOutput(t *testing.T) {
+	entries, err := parseRemoteTree([]byte(gnuFindOutput))
+	if err != nil {
+		t.Fatalf("parseRemoteTree failed: %v", err)
+	}
+	want := map[string]syncEntry{
+		"a b.txt":             {Type: 'f', Size: 7, Mtime: 1705312800, Mode: 0644},
+		"dir":                 {Type: 'd', Size: 4096, Mtime: 1705312800, Mode: 0755},
+		"dir/back\\slash.png": {Type: 'f', Size: 3, Mtime: 1705312800, Mode: 0644},
+		"link":                {Type: 'l', Size: 7, Mtime: 1705312800, Mode: 0777, Link: "a b.txt"},
+		"new\nline.txt":       {Type: 'f', Size: 1, Mtime: 1705312800, Mode: 0644},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("parsed %v, want %v", entries, want)
+	}
+}
+
+func TestAddChecksumsGNUOutput(t *testing.T) {
+	var list []byte
+	envConfig := newTestSSHServerRunning(t, func(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) uint32 {
+		list, _ = io.ReadAll(stdin)
+		io.WriteString(stdout, gnuSHA256Output)
+		return 0
+	})
+	client, err := dialSSH(envConfig)
+	if err != nil {
+		t.Fatalf("dialSSH failed: %v", err)
+	}
+	defer client.Close()
+
+	remote, _ := parseRemoteTree([]byte(gnuFindOutput))
+	localRoot := t.TempDir()
+	local := map[string]syncEntry{}
+	for _, name := range []string{"a b.txt", "dir/back\\slash.png", "new\nline.txt"} {
+		entry := remote[name]
+		mustWriteFile(t, filepath.Join(localRoot, name), strings.Repeat("y", int(entry.Size)))
+		local[name] = entry
+	}
+	if err := addChecksums(client, envConfig, remote, localRoot, local); err != nil {
+		t.Fatalf("addChecksums failed: %v", err)
+	}
+	if string(list) != "a b.txt\x00dir/back\\slash.png\x00new\nline.txt\x00" {
+		t.Errorf("sha256sum got the list %q", list)
+	}
+	for name, hash := range map[string]string{
+		"a b.txt":             "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73",
+		"dir/back\\slash.png": "8f8cbb7dcf46e0bc7d53265749a6c17d116093a6ba95e442764060c76fd4a86c",
+		"new\nline.txt":       "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881",
+	} {
+		if remote[name].Hash != hash {
+			t.Errorf("%q got the remote checksum %q, want %q", name, remote[name].Hash, hash)
+		}
+		if local[name].Hash == "" || local[name].Hash == hash {
+			t.Errorf("%q got the local checksum %q", name, local[name].Hash)
+		}
+	}
+}
+
+func TestSSHRemoteCommands(t *testing.T) {
+	requireGNUTools(t)
+	var mu sync.Mutex
+	var commands []string
+	envConfig := newTestSSHServerRunning(t, func(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) uint32 {
+		mu.Lock()
+		commands = append(commands, command)
+		mu.Unlock()
+		return runTestRemoteShell(command, stdin, stdout, stderr)
+	})
+	envConfig.SSHChecksum = true
+	backend := NewBackendSSH()
+	target := envConfig.TargetPath
+
+	// Names with a space and a newline, of the same size on both sides so
+	// only their checksums tell them apart
+	mustWriteFile(t, filepath.Join(target, "a b.txt"), "content")
+	mustWriteFile(t, filepath.Join(target, "stale.txt"), "stale")
+	source := filepath.Join(t.TempDir(), "files")
+	mustWriteFile(t, filepath.Join(source, "a b.txt"), "CONTENT")
+	mustWriteFile(t, filepath.Join(source, "new\nline.txt"), "new")
+	if err := backend.UploadFolder(source, envConfig, nil); err != nil {
+		t.Fatalf("UploadFolder failed: %v", err)
+	}
+	destination := filepath.Join(t.TempDir(), "files")
+	mustWriteFile(t, filepath.Join(destination, "a b.txt"), "xxxxxxx")
+	mustWriteFile(t, filepath.Join(destination, "new\nline.txt"), "xxx")
+	if err := backend.DownloadFolder(envConfig, destination); err != nil {
+		t.Fatalf("DownloadFolder failed: %v", err)
+	}
+	for name, want := range map[string]string{"a b.txt": "CONTENT", "new\nline.txt": "new"} {
+		if data, err := os.ReadFile(filepath.Join(destination, name)); err != nil || string(data) != want {
+			t.Errorf("%q not downloaded: %q, %v", name, data, err)
+		}
+	}
+	var streamed []string
+	addFile := func(header *tar.Header, content io.Reader) error {
+		streamed = append(streamed, header.Name)
+		return nil
+	}
+	if err := backend.StreamFolder(envConfig, addFile); err != nil {
+		t.Fatalf("StreamFolder failed: %v", err)
+	}
+	envConfig.FilesExclude = "a b.txt"
+	if err := backend.StreamFolder(envConfig, addFile); err != nil {
+		t.Fatalf("filtered StreamFolder failed: %v", err)
+	}
+	if want := []string{"a b.txt", "new\nline.txt", "new\nline.txt"}; !reflect.DeepEqual(streamed, want) {
+		t.Errorf("streamed %q, want %q", streamed, want)
+	}
+
+	quoted := "'" + strings.ReplaceAll(target, "'", `'\''`) + "'"
+	find := "cd " + quoted + ` && find . -mindepth 1 -printf '%y %s %T@ %m\0%P\0%l\0'`
+	sha256sum := "cd " + quoted + " && xargs -0 sha256sum --zero --"
+	tarList := "tar -C " + quoted + " --hard-dereference --no-recursion --null --verbatim-files-from -T - -cf -"
+	want := []string{
+		// UploadFolder
+		"mkdir -p " + quoted,
+		find,
+		sha256sum,
+		"cd " + quoted + " && xargs -0 rm -rf --",
+		"tar -C " + quoted + " -xf - --no-overwrite-dir --no-same-owner",
+		// DownloadFolder
+		find,
+		sha256sum,
+		tarList,
+		// StreamFolder, then with a files filter
+		"tar -C " + quoted + " --hard-dereference -cf - .",
+		find,
+		tarList,
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("remote commands:\n%s\nwant:\n%s", strings.Join(commands, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSSHAgentConnectionClosedWithClient(t *testing.T) {
+	envConfig := newTestSSHServer(t)
+	identity, err := os.ReadFile(envConfig.SSHIdentityFile)
+	if err != nil {
+		t.Fatalf("Failed to read identity file: %v", err)
+	}
+	key, err := ssh.ParseRawPrivateKey(identity)
+	if err != nil {
+		t.Fatalf("Failed to parse identity file: %v", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatalf("Failed to add key to agent: %v", err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	served := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// Serving ends when the client closes its connection
+		agent.ServeAgent(keyring, conn)
+		close(served)
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	envConfig.SSHIdentityFile = ""
+
+	client, err := dialSSH(envConfig)
+	if err != nil {
+		t.Fatalf("dialSSH with the agent failed: %v", err)
+	}
+	client.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Errorf("agent connection still open after the client closed")
+	}
+}
@@ -0,0 +1,1183 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sizes of the content-defined chunks. A chunk ends where the rolling hash of
+// its last bytes matches chunkBoundaryMask, but never before chunkMinSize or
+// after chunkMaxSize bytes, so an insert or delete only changes the chunks
+// around it. Changing any of them makes new backups share no chunks with
+// the old ones.
+const (
+	chunkMinSize      = 256 << 10
+	chunkMaxSize      = 4 << 20
+	chunkBoundaryMask = uint64(0xfffff) << 44
+)
+
+// snapshotExtension is appended to the name of a run's archive, without its
+// extension, to store the snapshot of a run backed up into the chunk store
+const snapshotExtension = ".snapshot.json"
+
+// chunkSnapshotFormat is the version of the snapshots written, snapshots of
+// newer versions are refused. Version 2 records the chunk naming.
+const chunkSnapshotFormat = 2
+
+// Namings of the chunks of a snapshot. Unencrypted chunks are named after the
+// SHA-256 checksum of their content. Encrypted chunks are named after its
+// HMAC-SHA256 with a key derived from the chunk key and their set, so anyone
+// who can list the store can't tell whether a known file is backed up.
+// Snapshots of format version 1 name every chunk after its SHA-256 checksum.
+const (
+	chunkNamingSHA256 = "sha256"
+	chunkNamingHMAC   = "hmac-sha256"
+)
+
+// Kinds of chunk store locks, see chunkLock. A lock is refreshed every
+// chunkLockRefresh while it is held, locks that weren't refreshed for
+// chunkLockExpiry were left behind by a backup or collection that didn't
+// finish and are ignored.
+const (
+	chunkLockBackup  = "backup"
+	chunkLockCollect = "collect"
+	chunkLockRefresh = 5 * time.Minute
+	chunkLockExpiry  = time.Hour
+)
+
+// chunkGear maps every byte to a random value of the rolling hash. The
+// values are generated from a fixed seed and must never change.
+var chunkGear = func() [256]uint64 {
+	var gear [256]uint64
+	state := uint64(0x6a09e667f3bcc908)
+	for i := range gear {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+	return gear
+}()
+
+// ChunkSnapshot lists the database dump and the files of a run backed up into
+// the chunk store. The content of regular files is the concatenation of
+// their chunks, stored once under their name however many runs, environments
+// or files share them, as long as they're encrypted for the same recipients
+// with the same chunk key. A snapshot restores on its own, it doesn't depend on the
+// snapshots of other runs. Like a file index it is stored unencrypted and
+// holds names, sizes and checksums, the chunks are encrypted.
+type ChunkSnapshot struct {
+	FormatVersion int `json:"format_version"`
+
+	// ChunkSet names the part of the chunk store the chunks are stored in,
+	// see chunkStoreURL
+	ChunkSet string `json:"chunk_set"`
+
+	// ChunkNaming is how the chunks are named, chunkNamingSHA256 or
+	// chunkNamingHMAC. ChunkKeyID identifies the chunk key of HMAC named
+	// chunks, see chunkKeyID.
+	ChunkNaming string `json:"chunk_naming,omitempty"`
+	ChunkKeyID  string `json:"chunk_key_id,omitempty"`
+
+	// Manifest describes the backup like the manifest of an archive, without
+	// the files
+	Manifest *BackupManifest `json:"manifest"`
+
+	Entries []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry is the dump, a file, directory or symlink of a snapshot,
+// named as in an archive: db_dump.sql and files/<path>. Directory paths end
+// with a slash, symlinks have a link target and regular files a size,
+// checksum and chunks.
+type SnapshotEntry struct {
+	Path    string    `json:"path"`
+	Mode    int64     `json:"mode"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"`
+	Chunks  []string  `json:"chunks,omitempty"`
+}
+
+// isRegular reports whether the entry is a regular file
+func (e SnapshotEntry) isRegular() bool {
+	return !strings.HasSuffix(e.Path, "/") && e.Link == ""
+}
+
+// tarHeader returns the header of the entry in an archive
+func (e SnapshotEntry) tarHeader() *tar.Header {
+	header := &tar.Header{Name: e.Path, Mode: e.Mode, ModTime: e.ModTime}
+	switch {
+	case strings.HasSuffix(e.Path, "/"):
+		header.Typeflag = tar.TypeDir
+	case e.Link != "":
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = e.Link
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = e.Size
+	}
+	return header
+}
+
+// chunkStoreURL returns the location of a chunk set of the chunk store
+// shared by every environment backed up to the same location, e.g.
+// gs://bucket/chunks/unencrypted. Chunks are only shared within a set: the
+// set is named after the recipients its chunks are encrypted for, see
+// recipientsFingerprint, so a chunk is never reused by a backup encrypted for
+// other recipients or not encrypted at all. A flat chunks/<hash> layout would
+// hand a backup a chunk that the recipients it encrypts for can't decrypt.
+func chunkStoreURL(envConfig *EnvironmentConfig, set string) string {
+	return envConfig.ArchiveBaseURL() + "/chunks/" + set
+}
+
+// isChunkSetName reports whether name is the name of a chunk set
+func isChunkSetName(name string) bool {
+	if name == "unencrypted" {
+		return true
+	}
+	decoded, err := hex.DecodeString(name)
+	return err == nil && len(decoded) == 16 && strings.ToLower(name) == name
+}
+
+// snapshotURL returns the storage location of the snapshot of a run, e.g.
+// gs://bucket/backups/staging/backup_<runId>.snapshot.json
+func snapshotURL(envConfig *EnvironmentConfig, environment string, runId string) string {
+	return archivePrefix(envConfig, environment, runId) + snapshotExtension
+}
+
+// chunkLock marks a backup storing chunks or a garbage collection removing
+// them. Each writes its lock before it looks for the locks of the other
+// kind, so of a backup and a collection running at the same time at least
+// one sees the other and stops before a chunk the backup reuses is removed.
+// Locks are stored next to the chunk store, e.g.
+// gs://bucket/chunk-locks/backup_staging_<runId>.json, and refreshed while
+// they're held, see chunkLockHolder.
+type chunkLock struct {
+	Kind        string    `json:"kind"`
+	Environment string    `json:"environment"`
+	RunID       string    `json:"run_id,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	RefreshedAt time.Time `json:"refreshed_at,omitempty"`
+}
+
+// chunkLocksURL returns the location of the locks of the chunk store
+func chunkLocksURL(envConfig *EnvironmentConfig) string {
+	return envConfig.ArchiveBaseURL() + "/chunk-locks"
+}
+
+// describe names the backup or collection holding the lock
+func (l *chunkLock) describe() string {
+	if l.Kind == chunkLockBackup {
+		return fmt.Sprintf("backup of %s run '%s' started at %s", l.Environment, l.RunID, l.StartedAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("garbage collection started by %s at %s", l.Environment, l.StartedAt.Format(time.RFC3339))
+}
+
+// expired reports whether the lock wasn't refreshed for chunkLockExpiry
+func (l *chunkLock) expired() bool {
+	refreshed := l.RefreshedAt
+	if refreshed.IsZero() {
+		refreshed = l.StartedAt
+	}
+	return time.Since(refreshed) > chunkLockExpiry
+}
+
+// chunkLockHolder holds a stored lock until it is released
+type chunkLockHolder struct {
+	store ArchiveStore
+	url   string
+	lock  chunkLock
+
+	// stop ends the refreshes started by keep, done is closed once they
+	// ended
+	stop, done chan struct{}
+}
+
+// acquireChunkLock stores the lock and returns its holder, unless a lock of
+// the other kind is held. The lock is removed again then and the error names
+// the holder.
+func acquireChunkLock(ctx context.Context, store ArchiveStore, envConfig *EnvironmentConfig, lock *chunkLock) (*chunkLockHolder, error) {
+	id := lock.RunID
+	other := chunkLockCollect
+	if lock.Kind == chunkLockCollect {
+		id = strconv.FormatInt(lock.StartedAt.UnixNano(), 10)
+		other = chunkLockBackup
+	}
+	holder := &chunkLockHolder{
+		store: store,
+		url:   chunkLocksURL(envConfig) + "/" + lock.Kind + "_" + lock.Environment + "_" + id + ".json",
+		lock:  *lock,
+	}
+	if err := holder.write(ctx); err != nil {
+		return nil, err
+	}
+
+	held, err := heldChunkLock(ctx, store, envConfig, other)
+	if err == nil && held != nil {
+		err = fmt.Errorf("the %s holds the chunk store", held.describe())
+	}
+	if err != nil {
+		holder.release()
+		return nil, err
+	}
+	return holder, nil
+}
+
+// write stores the lock
+func (h *chunkLockHolder) write(ctx context.Context) error {
+	data, err := json.MarshalIndent(&h.lock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lock: %v", err)
+	}
+	return writeStoredObject(ctx, h.store, h.url, data)
+}
+
+// keep refreshes the lock every interval until it is released and returns a
+// context of ctx that is cancelled when the lock couldn't be refreshed for
+// timeout. Another backup or collection may take the lock for an abandoned
+// one soon after, so whatever the lock protects must stop then.
+func (h *chunkLockHolder) keep(ctx context.Context, interval time.Duration, timeout time.Duration) context.Context {
+	locked, cancel := context.WithCancelCause(ctx)
+	h.stop, h.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		refreshed := time.Now()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-locked.Done():
+				return
+			case now := <-ticker.C:
+				h.lock.RefreshedAt = now.UTC()
+				err := h.write(locked)
+				if err == nil {
+					refreshed = now
+					continue
+				}
+				if now.Sub(refreshed) >= timeout {
+					cancel(fmt.Errorf("lost the chunk store lock, it wasn't refreshed since %s: %v", refreshed.UTC().Format(time.RFC3339), err))
+					return
+				}
+				Warn("Failed to refresh chunk store lock %s, retrying: %v", h.url, err)
+			}
+		}
+	}()
+	return locked
+}
+
+// release stops refreshing the lock and removes it, one that can't be
+// removed expires
+func (h *chunkLockHolder) release() {
+	if h.stop != nil {
+		close(h.stop)
+		<-h.done
+	}
+	if err := h.store.DeleteArchive(h.url); err != nil {
+		Warn("Failed to remove chunk store lock %s, it expires in %s: %v", h.url, chunkLockExpiry, err)
+	}
+}
+
+// heldChunkLock returns a lock of the given kind that hasn't expired, or nil
+// when none is held
+func heldChunkLock(ctx context.Context, store ArchiveStore, envConfig *EnvironmentConfig, kind string) (*chunkLock, error) {
+	urls, err := store.ListArchives(chunkLocksURL(envConfig) + "/" + kind + "_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunk store locks: %v", err)
+	}
+	for _, url := range urls {
+		data, err := readStoredObject(ctx, store, url)
+		if err != nil {
+			// Locks released since they were listed don't hold
+			if found, existsErr := storedObjectExists(store, url); existsErr == nil && !found {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read chunk store lock: %v", err)
+		}
+		var lock chunkLock
+		if err := json.Unmarshal(data, &lock); err != nil {
+			return nil, fmt.Errorf("failed to parse chunk store lock %s: %v", url, err)
+		}
+		if lock.expired() {
+			Warn("Ignoring the lock of the %s, it expired", lock.describe())
+			continue
+		}
+		return &lock, nil
+	}
+	return nil, nil
+}
+
+// chunker splits a stream into content-defined chunks with a gear rolling
+// hash, as in FastCDC. Its buffer is reused for every stream, a chunk is only
+// valid until the next call of Next.
+type chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func newChunker() *chunker {
+	return &chunker{buf: make([]byte, chunkMaxSize)}
+}
+
+// Reset starts chunking r
+func (c *chunker) Reset(r io.Reader) {
+	c.r, c.start, c.end, c.eof = r, 0, 0, false
+}
+
+// Next returns the next chunk of the stream, or io.EOF at its end
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < chunkMaxSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			c.eof = true
+		case err != nil:
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := chunkBoundary(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// chunkBoundary returns the length of the chunk data starts with
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	if len(data) > chunkMaxSize {
+		data = data[:chunkMaxSize]
+	}
+	var hash uint64
+	for i := chunkMinSize; i < len(data); i++ {
+		hash = (hash << 1) + chunkGear[data[i]]
+		if hash&chunkBoundaryMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// chunkStore reads and writes the chunks of an environment's chunk store.
+// Chunks are compressed like the environment's archives and, when
+// configured, encrypted; they're named as their set's snapshots record, see
+// chunkNamingSHA256 and chunkNamingHMAC.
+type chunkStore struct {
+	store       ArchiveStore
+	url         string
+	encryption  *ArchiveEncryption
+	compression string
+	level       int
+
+	// key names HMAC named chunks, it is nil for SHA-256 named ones
+	naming string
+	key    []byte
+
+	// stored are the chunks known to be in the store, chunker splits the
+	// streams written
+	stored  map[string]bool
+	chunker *chunker
+
+	// Chunks written and found in the store, with their uncompressed size
+	written, reused         int
+	writtenSize, reusedSize int64
+}
+
+// newChunkStore returns the chunk store of a set whose chunks are named with
+// naming. HMAC named chunks need the chunk key of the environment.
+func newChunkStore(store ArchiveStore, envConfig *EnvironmentConfig, encryption *ArchiveEncryption, set string, naming string) (*chunkStore, error) {
+	chunks := &chunkStore{
+		store:       store,
+		url:         chunkStoreURL(envConfig, set),
+		encryption:  encryption,
+		compression: envConfig.ArchiveCompression,
+		level:       envConfig.ArchiveCompressionLevel,
+		naming:      naming,
+	}
+	switch naming {
+	case chunkNamingSHA256:
+	case chunkNamingHMAC:
+		if encryption == nil || len(encryption.ChunkKey) == 0 {
+			return nil, fmt.Errorf("chunks of set %s are named with a chunk key, but none is configured, "+
+				"set BACKUP_ENCRYPTION_CHUNK_KEY_FILE or BACKUP_ENCRYPTION_CHUNK_KEY", set)
+		}
+		mac := hmac.New(sha256.New, encryption.ChunkKey)
+		mac.Write([]byte("chunk set " + set))
+		chunks.key = mac.Sum(nil)
+	default:
+		return nil, fmt.Errorf("unknown chunk naming %q", naming)
+	}
+	return chunks, nil
+}
+
+// snapshotChunkStore returns the chunk store of the chunks of a snapshot. A
+// chunk key other than the one the chunks are named with is refused before
+// any chunk is read.
+func snapshotChunkStore(store ArchiveStore, envConfig *EnvironmentConfig, encryption *ArchiveEncryption, snapshot *ChunkSnapshot) (*chunkStore, error) {
+	naming := snapshot.ChunkNaming
+	if naming == "" {
+		naming = chunkNamingSHA256
+	}
+	chunks, err := newChunkStore(store, envConfig, encryption, snapshot.ChunkSet, naming)
+	if err != nil {
+		return nil, err
+	}
+	if naming == chunkNamingHMAC && chunks.keyID() != snapshot.ChunkKeyID {
+		return nil, fmt.Errorf("chunks of set %s are named with chunk key %s, but the configured chunk key is %s",
+			snapshot.ChunkSet, snapshot.ChunkKeyID, chunks.keyID())
+	}
+	return chunks, nil
+}
+
+// chunkID returns the name of a chunk
+func (s *chunkStore) chunkID(chunk []byte) string {
+	if s.key == nil {
+		sum := sha256.Sum256(chunk)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyID identifies the chunk key HMAC named chunks are named with, without
+// revealing it, as the first 8 bytes of its HMAC-SHA256 of "chunk key id"
+func (s *chunkStore) keyID() string {
+	if s.key == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.encryption.ChunkKey)
+	mac.Write([]byte("chunk key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// chunkURL returns the storage location of a chunk
+func (s *chunkStore) chunkURL(id string) string {
+	return s.url + "/" + id
+}
+
+// listChunks returns the names of the chunks in the store
+func (s *chunkStore) listChunks() (map[string]bool, error) {
+	urls, err := s.store.ListArchives(s.url + "/")
+	if err != nil {
+		return nil, err
+	}
+	chunks := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		chunks[strings.TrimPrefix(url, s.url+"/")] = true
+	}
+	return chunks, nil
+}
+
+// write splits a stream into chunks, stores those that aren't stored yet and
+// returns the names of its chunks along with its size and checksum
+func (s *chunkStore) write(ctx context.Context, r io.Reader) ([]string, int64, string, error) {
+	if s.chunker == nil {
+		s.chunker = newChunker()
+	}
+	s.chunker.Reset(r)
+	hash := sha256.New()
+	var chunks []string
+	var size int64
+	for {
+		chunk, err := s.chunker.Next()
+		if err == io.EOF {
+			return chunks, size, hex.EncodeToString(hash.Sum(nil)), nil
+		}
+		if err != nil {
+			return nil, 0, "", err
+		}
+		hash.Write(chunk)
+		size += int64(len(chunk))
+		id, err := s.put(ctx, chunk)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		chunks = append(chunks, id)
+	}
+}
+
+// put stores a chunk unless it is stored already and returns its name
+func (s *chunkStore) put(ctx context.Context, chunk []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	id := s.chunkID(chunk)
+	if s.stored[id] {
+		s.reused++
+		s.reusedSize += int64(len(chunk))
+		return id, nil
+	}
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var encrypter io.WriteCloser
+	if s.encryption.CanEncrypt() {
+		var err error
+		if encrypter, err = s.encryption.NewEncryptingWriter(w); err != nil {
+			return "", err
+		}
+		w = encrypter
+	}
+	compressor, err := newCompressionWriter(w, s.compression, s.level)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s writer: %v", s.compression, err)
+	}
+	if _, err := compressor.Write(chunk); err != nil {
+		return "", fmt.Errorf("failed to compress chunk %s: %v", id, err)
+	}
+	if err := compressor.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress chunk %s: %v", id, err)
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return "", fmt.Errorf("failed to encrypt chunk %s: %v", id, err)
+		}
+	}
+	if err := writeStoredObject(ctx, s.store, s.chunkURL(id), buf.Bytes()); err != nil {
+		return "", err
+	}
+	if s.stored == nil {
+		s.stored = make(map[string]bool)
+	}
+	s.stored[id] = true
+	s.written++
+	s.writtenSize += int64(len(chunk))
+	return id, nil
+}
+
+// get reads a chunk and checks it against its name. Encrypted chunks are
+// decrypted with the keys of the environment, a missing or wrong key is
+// returned as a *DecryptionKeyError.
+func (s *chunkStore) get(ctx context.Context, id string) ([]byte, error) {
+	url := s.chunkURL(id)
+	reader, err := s.store.NewArchiveReader(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %v", id, err)
+	}
+	defer reader.Close()
+	decrypted, _, err := s.encryption.NewDecryptingReader(reader, url)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, _, err := newDecompressionReader(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %v", id, err)
+	}
+	defer decompressed.Close()
+
+	// No chunk is ever written larger, a bigger one is corrupted
+	data, err := io.ReadAll(io.LimitReader(decompressed, chunkMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %v", id, err)
+	}
+	if len(data) > chunkMaxSize || s.chunkID(data) != id {
+		return nil, fmt.Errorf("chunk %s doesn't match its checksum, it is corrupted", id)
+	}
+	return data, nil
+}
+
+// storeChunkedBackup stores the database dump and the files of a run in the
+// chunk store, only uploading the chunks that aren't stored yet, followed
+// by the snapshot of the run and its signature. Gzipped dumps are stored
+// uncompressed, so unchanged tables share their chunks between runs.
+// Encrypted chunks are named with the chunk key. The backup locks the chunk
+// store against garbage collections until the snapshot is stored, see
+// chunkLock, and fails when it loses the lock.
+func storeChunkedBackup(ctx context.Context, backends *EnvironmentBackends, envConfig *EnvironmentConfig, manifest *BackupManifest, dump io.Reader, filesFolder string) error {
+	environment, runId := manifest.Environment, manifest.RunID
+	set, err := backends.Encryption.recipientsFingerprint()
+	if err != nil {
+		Error("Failed to identify the encryption recipients: %v", err)
+		return fmt.Errorf("failed to identify the encryption recipients: %v", err)
+	}
+	naming := chunkNamingSHA256
+	if backends.Encryption.CanEncrypt() {
+		naming = chunkNamingHMAC
+	}
+	chunks, err := newChunkStore(backends.Archives, envConfig, backends.Encryption, set, naming)
+	if err != nil {
+		Error("Failed to open the chunk store: %v", err)
+		return fmt.Errorf("failed to open the chunk store: %v", err)
+	}
+	Info("Storing database dump and files in the chunk store at %s", chunks.url)
+	if backends.Encryption.CanEncrypt() {
+		Info("Encrypting chunks for %d recipients", len(backends.Encryption.Recipients))
+	}
+
+	// The chunks listed here are reused, a garbage collection must not remove
+	// them until the snapshot using them is stored
+	lock := &chunkLock{Kind: chunkLockBackup, Environment: environment, RunID: runId, StartedAt: time.Now().UTC()}
+	holder, err := acquireChunkLock(ctx, backends.Archives, envConfig, lock)
+	if err != nil {
+		Error("Failed to lock the chunk store, run the backup again once the garbage collection finished: %v", err)
+		return fmt.Errorf("failed to lock the chunk store, run the backup again once the garbage collection finished: %v", err)
+	}
+	defer holder.release()
+	ctx = holder.keep(ctx, chunkLockRefresh, chunkLockExpiry/2)
+	stored, err := chunks.listChunks()
+	if err != nil {
+		Error("Failed to list stored chunks: %v", err)
+		return fmt.Errorf("failed to list stored chunks: %v", err)
+	}
+	chunks.stored = stored
+	Info("Chunk store holds %d chunks", len(stored))
+
+	snapshot, err := writeSnapshotChunks(ctx, backends, envConfig, chunks, manifest, dump, filesFolder)
+	if cause := context.Cause(ctx); cause != nil {
+		// A collection may have removed reused chunks once the lock was lost
+		err = cause
+	}
+	if err != nil {
+		Error("Storing chunks failed: %v", err)
+		return fmt.Errorf("storing chunks failed: %v", err)
+	}
+	snapshot.ChunkSet, snapshot.ChunkNaming, snapshot.ChunkKeyID = set, naming, chunks.keyID()
+
+	url := snapshotURL(envConfig, environment, runId)
+	Info("Step 3/3: Storing snapshot at %s", url)
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		Error("Failed to encode snapshot: %v", err)
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+	if err := writeStoredObject(ctx, backends.Archives, url, data); err != nil {
+		Error("Storing snapshot failed: %v", err)
+		return fmt.Errorf("storing snapshot failed: %v", err)
+	}
+	if backends.Signing.CanSign() {
+		digest := newArchiveDigest()
+		digest.Write(data)
+		Info("Signing snapshot with SHA-256 %s", digest.sum())
+		if err := signStoredObject(ctx, backends, environment, runId, url, digest); err != nil {
+			Error("Signing snapshot failed: %v", err)
+			return fmt.Errorf("signing snapshot failed: %v", err)
+		}
+	}
+
+	Info("Snapshot of %d entries stored at %s: %d new chunks (%d bytes) stored, %d chunks (%d bytes) already in the chunk store",
+		len(snapshot.Entries), url, chunks.written, chunks.writtenSize, chunks.reused, chunks.reusedSize)
+	return nil
+}
+
+// writeSnapshotChunks stores the chunks of the dump and the files and returns
+// the snapshot listing them
+func writeSnapshotChunks(ctx context.Context, backends *EnvironmentBackends, envConfig *EnvironmentConfig, chunks *chunkStore, manifest *BackupManifest, sqlDump io.Reader, filesFolder string) (*ChunkSnapshot, error) {
+	var err error
+	manifest.DumpFormat, sqlDump, err = detectDumpFormat(sqlDump)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SQL dump: %v", err)
+	}
+	if manifest.DumpFormat == DumpFormatSQLGzip {
+		manifest.DumpFormat = DumpFormatSQL
+	}
+	manifest.FormatVersion = ArchiveFormatVersioned
+	manifest.Compression, manifest.CompressionLevel = "", 0
+	snapshot := &ChunkSnapshot{FormatVersion: chunkSnapshotFormat, Manifest: manifest}
+
+	dump, err := openSQLDump(sqlDump)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+	dumpChunks, size, checksum, err := chunks.write(ctx, dump)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store db_dump.sql: %v", err)
+	}
+	snapshot.Entries = append(snapshot.Entries, SnapshotEntry{
+		Path: "db_dump.sql", Mode: 0644, Size: size, ModTime: time.Now().UTC(), SHA256: checksum, Chunks: dumpChunks,
+	})
+
+	Info("Step 2/3: Storing files in the chunk store")
+
+	addFile := func(header *tar.Header, content io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry := SnapshotEntry{Path: "files/" + header.Name, Mode: header.Mode, ModTime: header.ModTime.UTC(), Link: header.Linkname}
+		if header.Typeflag == tar.TypeReg {
+			var err error
+			if entry.Chunks, entry.Size, entry.SHA256, err = chunks.write(ctx, content); err != nil {
+				return fmt.Errorf("failed to store %s: %v", header.Name, err)
+			}
+			if entry.Size != header.Size {
+				return fmt.Errorf("%s has %d bytes, expected %d", header.Name, entry.Size, header.Size)
+			}
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+		return nil
+	}
+	if err := streamFiles(backends, envConfig, filesFolder, addFile); err != nil {
+		return nil, fmt.Errorf("failed to add files: %v", err)
+	}
+	manifest.FinishedAt = time.Now().UTC()
+	return snapshot, nil
+}
+
+// readChunkSnapshot reads the snapshot of a run along with the size and
+// checksum of the stored snapshot. It returns a nil snapshot for runs that
+// weren't backed up into the chunk store.
+func readChunkSnapshot(ctx context.Context, store ArchiveStore, envConfig *EnvironmentConfig, environment string, runId string) (*ChunkSnapshot, *archiveDigest, error) {
+	url := snapshotURL(envConfig, environment, runId)
+	found, err := storedObjectExists(store, url)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+	data, err := readStoredObject(ctx, store, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := newArchiveDigest()
+	digest.Write(data)
+	var snapshot ChunkSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse snapshot %s: %v", url, err)
+	}
+	if err := snapshot.validate(environment, runId); err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot %s: %v", url, err)
+	}
+	return &snapshot, digest, nil
+}
+
+// validate checks that a snapshot belongs to a run and can be restored by
+// this backup manager. The entries are checked like archive entries when
+// they're extracted.
+func (s *ChunkSnapshot) validate(environment string, runId string) error {
+	switch {
+	case s.FormatVersion < 1:
+		return fmt.Errorf("invalid snapshot format version %d", s.FormatVersion)
+	case s.FormatVersion > chunkSnapshotFormat:
+		return fmt.Errorf("snapshot format version %d is newer than this backup manager reads (up to %d), restore it with a newer backup manager",
+			s.FormatVersion, chunkSnapshotFormat)
+	case s.Manifest == nil:
+		return fmt.Errorf("snapshot has no manifest")
+	case s.Manifest.Environment != environment || s.Manifest.RunID != runId:
+		return fmt.Errorf("snapshot of %s run '%s' belongs to %s run '%s'", environment, runId, s.Manifest.Environment, s.Manifest.RunID)
+	case !isChunkSetName(s.ChunkSet):
+		return fmt.Errorf("invalid chunk set %q", s.ChunkSet)
+	case s.ChunkNaming != "" && s.ChunkNaming != chunkNamingSHA256 && s.ChunkNaming != chunkNamingHMAC:
+		return fmt.Errorf("unknown chunk naming %q", s.ChunkNaming)
+	}
+	for _, entry := range s.Entries {
+		if entry.Path != "db_dump.sql" && !strings.HasPrefix(entry.Path, "files/") {
+			return fmt.Errorf("unexpected entry %s", entry.Path)
+		}
+		if !entry.isRegular() && len(entry.Chunks) > 0 {
+			return fmt.Errorf("%s has chunks, but isn't a file", entry.Path)
+		}
+		for _, id := range entry.Chunks {
+			if !isChunkName(id) {
+				return fmt.Errorf("invalid chunk name %q of %s", id, entry.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// isChunkName reports whether name is the hex encoded SHA-256 checksum or
+// HMAC-SHA256 that names a chunk
+func isChunkName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// manifest returns the manifest of the archive a snapshot is read as, with
+// the sizes and checksums of its files
+func (s *ChunkSnapshot) manifest() *BackupManifest {
+	manifest := *s.Manifest
+	manifest.ChecksumsAtEnd = false
+	manifest.Files = []ManifestFile{}
+	for _, entry := range s.Entries {
+		if entry.isRegular() {
+			manifest.Files = append(manifest.Files, ManifestFile{Path: entry.Path, Size: entry.Size, SHA256: entry.SHA256})
+		}
+	}
+	return &manifest
+}
+
+// chunkUses returns the distinct chunks of a snapshot and the number of
+// times each is used
+func (s *ChunkSnapshot) chunkUses() map[string]int {
+	uses := make(map[string]int)
+	for _, entry := range s.Entries {
+		for _, id := range entry.Chunks {
+			uses[id]++
+		}
+	}
+	return uses
+}
+
+// snapshotReader reads a snapshot as an uncompressed archive of the current
+// format, so it is extracted and verified like any archive. The chunks are
+// read from the chunk store as the archive is read, nothing else is stored
+// locally.
+type snapshotReader struct {
+	*io.PipeReader
+	done chan struct{}
+
+	// err is the first error reading the chunks, e.g. a *DecryptionKeyError,
+	// set once the reader is closed
+	err error
+}
+
+// newSnapshotReader starts reading a snapshot. Chunks used more than once
+// are kept in cacheFolder until their last use, so every chunk is only read
+// once; without a cacheFolder they're read on every use.
+func newSnapshotReader(ctx context.Context, chunks *chunkStore, snapshot *ChunkSnapshot, cacheFolder string) *snapshotReader {
+	reader, writer := io.Pipe()
+	r := &snapshotReader{PipeReader: reader, done: make(chan struct{})}
+	cache := &chunkCache{folder: cacheFolder, uses: snapshot.chunkUses()}
+	go func() {
+		defer close(r.done)
+		err := r.writeArchive(ctx, writer, chunks, snapshot, cache)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			r.err = err
+		}
+		writer.CloseWithError(err)
+	}()
+	return r
+}
+
+// Close stops reading the snapshot and waits for the chunks being read
+func (r *snapshotReader) Close() error {
+	r.PipeReader.Close()
+	<-r.done
+	return nil
+}
+
+func (r *snapshotReader) writeArchive(ctx context.Context, w io.Writer, chunks *chunkStore, snapshot *ChunkSnapshot, cache *chunkCache) error {
+	defer cache.clear()
+	tarWriter := tar.NewWriter(w)
+	if err := addManifestToTar(tarWriter, snapshot.manifest()); err != nil {
+		return err
+	}
+	for _, entry := range snapshot.Entries {
+		if err := tarWriter.WriteHeader(entry.tarHeader()); err != nil {
+			return fmt.Errorf("failed to write header for %s: %v", entry.Path, err)
+		}
+		for _, id := range entry.Chunks {
+			data, err := cache.get(ctx, chunks, id)
+			if err != nil {
+				return err
+			}
+			if _, err := tarWriter.Write(data); err != nil {
+				return fmt.Errorf("failed to write %s: %v", entry.Path, err)
+			}
+		}
+	}
+	return tarWriter.Close()
+}
+
+// chunkCache keeps the chunks a snapshot uses more than once on disk until
+// their last use
+type chunkCache struct {
+	folder string
+	uses   map[string]int
+}
+
+// get returns a chunk from the cache or the chunk store, and caches it when
+// it is used again
+func (c *chunkCache) get(ctx context.Context, chunks *chunkStore, id string) ([]byte, error) {
+	if c.folder == "" {
+		return chunks.get(ctx, id)
+	}
+	cached := filepath.Join(c.folder, id)
+	data, readErr := os.ReadFile(cached)
+	if readErr != nil {
+		var err error
+		if data, err = chunks.get(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	c.uses[id]--
+	switch {
+	case c.uses[id] <= 0:
+		os.Remove(cached)
+	case readErr != nil:
+		if err := os.MkdirAll(c.folder, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create chunk cache: %v", err)
+		}
+		if err := os.WriteFile(cached, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to cache chunk %s: %v", id, err)
+		}
+	}
+	return data, nil
+}
+
+// clear removes the chunks left in the cache
+func (c *chunkCache) clear() {
+	if c.folder != "" {
+		os.RemoveAll(c.folder)
+	}
+}
+
+// extractSnapshot restores the files of a snapshot into destinationFolder,
+// fetching every chunk they use once, and returns a dump source reading the
+// chunks of the database dump when options restore the database. The
+// snapshot must be signed by a key the destination environment trusts,
+// unless options allow unsigned backups, and is checked before any chunk is
+// read.
+func (e *BackupEngineCloud) extractSnapshot(ctx context.Context, srcConfig *EnvironmentConfig, srcBackends *EnvironmentBackends, signing *ArchiveSigning, environment string, runId string, snapshot *ChunkSnapshot, digest *archiveDigest, destinationEnvironment string, destinationFolder string, options RestoreOptions) (*BackupManifest, dumpSource, error) {
+	url := snapshotURL(srcConfig, environment, runId)
+	signature, err := checkStoredSignature(ctx, srcBackends.Archives, signing, environment, runId, url)
+	if err := checkRestoreSignature(err, destinationEnvironment, options); err != nil {
+		return nil, nil, err
+	}
+	if signature != nil {
+		if err := checkRestoreSignature(signature.checkDigest(url, digest), destinationEnvironment, options); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The dump goes straight into the import, the files are extracted
+	files := *snapshot
+	files.Entries = nil
+	var dumpEntry *SnapshotEntry
+	for i, entry := range snapshot.Entries {
+		if entry.Path == "db_dump.sql" {
+			dumpEntry = &snapshot.Entries[i]
+			continue
+		}
+		files.Entries = append(files.Entries, entry)
+	}
+
+	chunks, err := snapshotChunkStore(srcBackends.Archives, srcConfig, srcBackends.Encryption, snapshot)
+	if err != nil {
+		Error("Failed to open the chunk store: %v", err)
+		return nil, nil, fmt.Errorf("failed to open the chunk store: %v", err)
+	}
+	Info("Restoring %d entries from %d chunks of the chunk store at %s", len(files.Entries), len(files.chunkUses()), chunks.url)
+	reader := newSnapshotReader(ctx, chunks, &files, destinationFolder+"/chunks")
+	defer reader.Close()
+	manifest, err := extractBackupStream(reader, destinationFolder, srcConfig.ExtractLimits(), options.include())
+	if err != nil {
+		Error("Extracting snapshot failed: %v", err)
+		return nil, nil, fmt.Errorf("extracting snapshot failed: %v", err)
+	}
+	if !options.restoresDatabase() {
+		return manifest, nil, nil
+	}
+	if dumpEntry == nil || !dumpEntry.isRegular() {
+		Error("Snapshot of run '%s' has no database dump", runId)
+		return nil, nil, fmt.Errorf("snapshot of run '%s' has no database dump", runId)
+	}
+	return manifest, func(importDump func(dump io.Reader) error) error {
+		Info("Streaming database dump from %d chunks", len(dumpEntry.Chunks))
+		// The signed snapshot names the chunks and each is checked against
+		// its id before any of it is read
+		return importDump(&chunkReader{ctx: ctx, chunks: chunks, ids: dumpEntry.Chunks})
+	}, nil
+}
+
+// chunkReader reads the content of a snapshot entry from the chunk store,
+// one chunk at a time
+type chunkReader struct {
+	ctx    context.Context
+	chunks *chunkStore
+	ids    []string
+	chunk  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if len(r.ids) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.chunks.get(r.ctx, r.ids[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunk, r.ids = data, r.ids[1:]
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// verifySnapshot verifies the snapshot of a run like an archive, reading
+// every chunk it uses. A missing or wrong key to decrypt the chunks is
+// returned as an error, like for archives.
+func (e *BackupEngineCloud) verifySnapshot(ctx context.Context, envConfig *EnvironmentConfig, backends *EnvironmentBackends, environment string, runId string, snapshot *ChunkSnapshot, digest *archiveDigest) (*VerificationReport, error) {
+	url := snapshotURL(envConfig, environment, runId)
+	signature, signatureErr := checkStoredSignature(ctx, backends.Archives, backends.Signing, environment, runId, url)
+	var unsigned *SignatureError
+	if signatureErr != nil && !errors.As(signatureErr, &unsigned) {
+		Error("Failed to check snapshot signature: %v", signatureErr)
+		return nil, fmt.Errorf("failed to check snapshot signature: %v", signatureErr)
+	}
+
+	chunks, err := snapshotChunkStore(backends.Archives, envConfig, backends.Encryption, snapshot)
+	if err != nil {
+		Error("Failed to open the chunk store: %v", err)
+		return nil, fmt.Errorf("failed to open the chunk store: %v", err)
+	}
+	Info("Reading %d chunks of the snapshot from %s", len(snapshot.chunkUses()), chunks.url)
+	reader := newSnapshotReader(ctx, chunks, snapshot, "")
+	defer reader.Close()
+	report := verifyBackupStream(reader, envConfig.ExtractLimits())
+	reader.Close()
+	var keyErr *DecryptionKeyError
+	if errors.As(reader.err, &keyErr) {
+		Error("Decryption failed: %v", reader.err)
+		return nil, reader.err
+	}
+
+	switch {
+	case backends.Signing == nil || len(backends.Signing.TrustedKeys) == 0:
+		report.add("signature", CheckSkipped, "no trusted keys are configured for %s", environment)
+	case signatureErr != nil:
+		report.add("signature", CheckFailed, "%v", signatureErr)
+	default:
+		if err := signature.checkDigest(url, digest); err != nil {
+			report.add("signature", CheckFailed, "%v", err)
+		} else {
+			report.add("signature", CheckPassed, "snapshot matches its signature by the trusted key %s", signature.fingerprint())
+		}
+	}
+	return report, nil
+}
+
+// GarbageCollection summarizes a garbage collection of a chunk store
+type GarbageCollection struct {
+	// Snapshots is the number of snapshots in the store, Chunks the number
+	// of chunks stored before the collection
+	Snapshots int
+	Chunks    int
+
+	// Unreferenced are the URLs of the chunks no snapshot uses, which are
+	// removed unless the collection is a dry run
+	Unreferenced []string
+	Removed      int
+}
+
+// Will remove the chunks of the chunk store of the given environment that no
+// snapshot uses any more, e.g. after the snapshots of old runs were deleted.
+// The chunk store is shared by every environment stored in the same
+// location, so the snapshots of all of them are read and the chunks of every
+// chunk set are collected; the collection stops
+// before removing anything when one of them can't be read. A dry run only
+// reports the chunks it would remove.
+//
+// Backups running meanwhile reuse chunks their snapshot doesn't list yet, so
+// the collection locks the chunk store first and removes nothing while a
+// backup holds it; backups starting meanwhile fail. See chunkLock. Dry runs
+// don't lock the chunk store.
+func (e *BackupEngineCloud) CollectGarbage(ctx context.Context, environment string, dryRun bool) (*GarbageCollection, error) {
+	envConfig, ok := e.configs[environment]
+	if !ok {
+		Error("Unknown environment: %s", environment)
+		return nil, fmt.Errorf("unknown environment: %s", environment)
+	}
+	backends := e.backends[environment]
+	storeURL := envConfig.ArchiveBaseURL() + "/chunks"
+	Info("Collecting unreferenced chunks of the chunk store at %s", storeURL)
+	if !dryRun {
+		lock := &chunkLock{Kind: chunkLockCollect, Environment: environment, StartedAt: time.Now().UTC()}
+		holder, err := acquireChunkLock(ctx, backends.Archives, envConfig, lock)
+		if err != nil {
+			Error("Failed to lock the chunk store, no chunks removed: %v", err)
+			return nil, fmt.Errorf("failed to lock the chunk store, no chunks removed: %v", err)
+		}
+		defer holder.release()
+		ctx = holder.keep(ctx, chunkLockRefresh, chunkLockExpiry/2)
+	}
+
+	// Snapshots are listed before the chunks. Once the store is locked,
+	// backups that stored chunks before have stored their snapshot; dry runs
+	// may report the chunks of running backups.
+	backupsURL := envConfig.ArchiveBaseURL() + "/backups/"
+	stored, err := backends.Archives.ListArchives(backupsURL)
+	if err != nil {
+		Error("Failed to list snapshots: %v", err)
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	report := &GarbageCollection{}
+	// Chunks are referenced by URL, the same chunk may be in several sets
+	referenced := make(map[string]bool)
+	for _, url := range stored {
+		if !strings.HasSuffix(url, snapshotExtension) {
+			continue
+		}
+		data, err := readStoredObject(ctx, backends.Archives, url)
+		if err != nil {
+			Error("Failed to read snapshot %s, no chunks removed: %v", url, err)
+			return nil, fmt.Errorf("failed to read snapshot %s, no chunks removed: %v", url, err)
+		}
+		var snapshot ChunkSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			Error("Failed to parse snapshot %s, no chunks removed: %v", url, err)
+			return nil, fmt.Errorf("failed to parse snapshot %s, no chunks removed: %v", url, err)
+		}
+		if !isChunkSetName(snapshot.ChunkSet) {
+			Error("Snapshot %s has an invalid chunk set %q, no chunks removed", url, snapshot.ChunkSet)
+			return nil, fmt.Errorf("snapshot %s has an invalid chunk set %q, no chunks removed", url, snapshot.ChunkSet)
+		}
+		for id := range snapshot.chunkUses() {
+			referenced[chunkStoreURL(envConfig, snapshot.ChunkSet)+"/"+id] = true
+		}
+		report.Snapshots++
+	}
+
+	storedChunks, err := backends.Archives.ListArchives(storeURL + "/")
+	if err != nil {
+		Error("Failed to list stored chunks: %v", err)
+		return nil, fmt.Errorf("failed to list stored chunks: %v", err)
+	}
+	report.Chunks = len(storedChunks)
+	for _, url := range storedChunks {
+		if !referenced[url] {
+			report.Unreferenced = append(report.Unreferenced, url)
+		}
+	}
+	sort.Strings(report.Unreferenced)
+	Info("%d snapshots use %d of %d stored chunks", report.Snapshots, report.Chunks-len(report.Unreferenced), report.Chunks)
+	if dryRun {
+		Info("Dry run, %d unreferenced chunks are kept", len(report.Unreferenced))
+		return report, nil
+	}
+
+	for _, url := range report.Unreferenced {
+		if err := context.Cause(ctx); err != nil {
+			return report, err
+		}
+		if err := backends.Archives.DeleteArchive(url); err != nil {
+			Error("Failed to remove chunk: %v", err)
+			return report, fmt.Errorf("failed to remove chunk: %v", err)
+		}
+		report.Removed++
+	}
+	Info("Removed %d unreferenced chunks", report.Removed)
+	return report, nil
+}
@@ -0,0 +1,449 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// randomContent returns size bytes of reproducible random data
+func randomContent(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// splitChunks returns the checksums of the chunks data is split into
+func splitChunks(t *testing.T, data []byte) []string {
+	t.Helper()
+	c := newChunker()
+	c.Reset(bytes.NewReader(data))
+	var sums []string
+	total := 0
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if len(chunk) > chunkMaxSize {
+			t.Errorf("chunk of %d bytes exceeds the maximum size", len(chunk))
+		}
+		total += len(chunk)
+		sum := sha256.Sum256(chunk)
+		sums = append(sums, hex.EncodeToString(sum[:]))
+	}
+	if total != len(data) {
+		t.Errorf("chunks hold %d bytes, expected %d", total, len(data))
+	}
+	return sums
+}
+
+// storedChunks returns the chunks stored below root, named <set>/<sha256>
+func storedChunks(t *testing.T, root string) map[string]bool {
+	t.Helper()
+	sets, err := os.ReadDir(filepath.Join(root, "backups/chunks"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Failed to list chunk sets: %v", err)
+	}
+	chunks := make(map[string]bool)
+	for _, set := range sets {
+		entries, err := os.ReadDir(filepath.Join(root, "backups/chunks", set.Name()))
+		if err != nil {
+			t.Fatalf("Failed to list chunks: %v", err)
+		}
+		for _, entry := range entries {
+			chunks[set.Name()+"/"+entry.Name()] = true
+		}
+	}
+	return chunks
+}
+
+func TestChunkBoundariesFollowContent(t *testing.T) {
+	data := randomContent(1, 12<<20)
+	original := splitChunks(t, data)
+	if len(original) < 3 {
+		t.Fatalf("expected several chunks, got %d", len(original))
+	}
+
+	// Inserting data at the start only changes the chunks around it
+	shifted := splitChunks(t, append([]byte("inserted bytes"), data...))
+	known := make(map[string]bool)
+	for _, sum := range original {
+		known[sum] = true
+	}
+	shared := 0
+	for _, sum := range shifted {
+		if known[sum] {
+			shared++
+		}
+	}
+	if shared < len(original)-2 {
+		t.Errorf("only %d of %d chunks are shared after an insertion", shared, len(original))
+	}
+
+	if sums := splitChunks(t, nil); len(sums) != 0 {
+		t.Errorf("empty stream should have no chunks, got %d", len(sums))
+	}
+	if sums := splitChunks(t, []byte("small")); len(sums) != 1 {
+		t.Errorf("small stream should be one chunk, got %d", len(sums))
+	}
+}
+
+func TestChunkedBackupAndRestore(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].BackupMode = BackupModeChunks
+	staging := configs["staging"].TargetPath
+	production := configs["production"].TargetPath
+	unsigned := RestoreOptions{AllowUnsigned: true}
+
+	large := randomContent(2, 6<<20)
+	mustWriteFile(t, filepath.Join(staging, "large.bin"), string(large))
+	mustWriteFile(t, filepath.Join(staging, "dir/a.txt"), "a")
+	mustWriteFile(t, filepath.Join(staging, "copy.txt"), "a")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-chunks-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "backups/backups/staging/backup_test-run-chunks-1.snapshot.json")); err != nil {
+		t.Fatalf("snapshot not stored: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "backups/backups/staging/backup_test-run-chunks-1.tar*")); len(matches) != 0 {
+		t.Errorf("chunked backup should not store an archive, found %v", matches)
+	}
+	first := storedChunks(t, root)
+
+	// A small change to the large file only stores the chunks around it
+	copy(large[3<<20:], "changed")
+	mustWriteFile(t, filepath.Join(staging, "large.bin"), string(large))
+	mustWriteFile(t, filepath.Join(staging, "dir/b.txt"), "b")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-chunks-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	second := storedChunks(t, root)
+	added := 0
+	for id := range second {
+		if !first[id] {
+			added++
+		}
+	}
+	if added == 0 || added > 3 {
+		t.Errorf("second backup should add a few chunks, added %d of %d", added, len(second))
+	}
+
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-chunks-2", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{
+		"large.bin": string(large), "dir/a.txt": "a", "dir/b.txt": "b", "copy.txt": "a",
+	})
+	if dump := engine.backends["production"].Database.(*MockBackend).importedDump; string(dump) != "CREATE TABLE test (id INT);" {
+		t.Errorf("unexpected dump imported: %q", dump)
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-chunks-1", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{"dir/a.txt": "a", "dir/b.txt": ""})
+
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-chunks-2")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"manifest": CheckPassed, "checksums": CheckPassed, "signature": CheckSkipped})
+
+	// A damaged chunk fails the verification and the restore
+	for id := range second {
+		if first[id] {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(root, "backups/chunks", id), []byte("damaged"), 0644); err != nil {
+			t.Fatalf("Failed to damage chunk: %v", err)
+		}
+		break
+	}
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-chunks-2")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"archive stream": CheckFailed})
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-chunks-2", "production", unsigned); err == nil {
+		t.Errorf("restore of a damaged snapshot should fail")
+	}
+
+	config := mockConfigs()["staging"]
+	config.BackupMode = "tape"
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("unknown backup mode should be rejected")
+	}
+}
+
+func TestChunkSetsFollowRecipients(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	alice := generateIdentity(t)
+	chunkKey := []byte(strings.Repeat("k", minChunkKeySize))
+	engine.backends["staging"].Encryption = &ArchiveEncryption{Recipients: []age.Recipient{alice.Recipient()}, Identities: []age.Identity{alice}, ChunkKey: chunkKey}
+	content := string(randomContent(5, 1<<20))
+	for _, env := range []string{"staging", "production"} {
+		configs[env].BackupMode = BackupModeChunks
+		mustWriteFile(t, filepath.Join(configs[env].TargetPath, "same.bin"), content)
+	}
+
+	// Both back up the same content, but share no chunks
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-sets-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if err := engine.PerformBackup(context.Background(), "production", "test-run-sets-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	set, err := engine.backends["staging"].Encryption.recipientsFingerprint()
+	if err != nil {
+		t.Fatalf("recipientsFingerprint failed: %v", err)
+	}
+	// Encrypted chunks aren't named after the checksum of their content
+	sums := make(map[string]bool)
+	for _, sum := range splitChunks(t, []byte(content)) {
+		sums[sum] = true
+	}
+	encrypted, unencrypted := 0, 0
+	for name := range storedChunks(t, root) {
+		if strings.HasPrefix(name, set+"/") && sums[filepath.Base(name)] {
+			t.Errorf("encrypted chunk %s is named after its checksum", name)
+		}
+		data, err := os.ReadFile(filepath.Join(root, "backups/chunks", name))
+		if err != nil {
+			t.Fatalf("Failed to read chunk: %v", err)
+		}
+		switch {
+		case strings.HasPrefix(name, set+"/") && bytes.HasPrefix(data, []byte(ageHeader)):
+			encrypted++
+		case strings.HasPrefix(name, "unencrypted/") && !bytes.HasPrefix(data, []byte(ageHeader)):
+			unencrypted++
+		default:
+			t.Errorf("chunk %s is in the wrong set", name)
+		}
+	}
+	if encrypted == 0 || encrypted != unencrypted {
+		t.Errorf("each backup should store its own chunks, got %d encrypted and %d unencrypted", encrypted, unencrypted)
+	}
+
+	// The unencrypted backup restores without a key, the other one with it
+	if err := engine.PerformRestore(context.Background(), "production", "test-run-sets-2", "staging", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-sets-1", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, configs["production"].TargetPath, map[string]string{"same.bin": content})
+
+	// Without the chunk key the chunks of the encrypted backup can't be
+	// checked, with another one they don't match
+	for _, key := range [][]byte{nil, []byte(strings.Repeat("o", minChunkKeySize))} {
+		engine.backends["staging"].Encryption.ChunkKey = key
+		err := engine.PerformRestore(context.Background(), "staging", "test-run-sets-1", "production", RestoreOptions{AllowUnsigned: true})
+		if err == nil || !strings.Contains(err.Error(), "chunk key") {
+			t.Errorf("restore with chunk key %q should fail, got %v", key, err)
+		}
+		err = engine.PerformBackup(context.Background(), "staging", "test-run-sets-3")
+		if key == nil && (err == nil || !strings.Contains(err.Error(), "chunk key")) {
+			t.Errorf("encrypted backup without a chunk key should fail, got %v", err)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].BackupMode = BackupModeChunks
+	staging := configs["staging"].TargetPath
+
+	mustWriteFile(t, filepath.Join(staging, "kept.bin"), string(randomContent(3, 1<<20)))
+	mustWriteFile(t, filepath.Join(staging, "removed.bin"), string(randomContent(4, 1<<20)))
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-gc-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(staging, "removed.bin")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-gc-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// Every chunk is still used by the first snapshot
+	result, err := engine.CollectGarbage(context.Background(), "staging", false)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if result.Snapshots != 2 || len(result.Unreferenced) != 0 || result.Removed != 0 {
+		t.Errorf("no chunk should be unreferenced, got %+v", result)
+	}
+
+	if err := os.Remove(filepath.Join(root, "backups/backups/staging/backup_test-run-gc-1.snapshot.json")); err != nil {
+		t.Fatalf("Failed to remove snapshot: %v", err)
+	}
+	before := storedChunks(t, root)
+	result, err = engine.CollectGarbage(context.Background(), "staging", true)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(result.Unreferenced) == 0 || result.Removed != 0 || len(storedChunks(t, root)) != len(before) {
+		t.Errorf("dry run should report chunks without removing them, got %+v", result)
+	}
+	result, err = engine.CollectGarbage(context.Background(), "staging", false)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if result.Removed != len(result.Unreferenced) || len(storedChunks(t, root)) != len(before)-result.Removed {
+		t.Errorf("unreferenced chunks should be removed, got %+v", result)
+	}
+
+	// The remaining snapshot still restores
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-gc-2", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, configs["production"].TargetPath, map[string]string{"removed.bin": ""})
+
+	// A snapshot that can't be read stops the collection
+	path := filepath.Join(root, "backups/backups/production/backup_broken.snapshot.json")
+	mustWriteFile(t, path, "{broken")
+	_, err = engine.CollectGarbage(context.Background(), "staging", false)
+	if err == nil || !strings.Contains(err.Error(), "no chunks removed") {
+		t.Errorf("unreadable snapshot should stop the collection, got %v", err)
+	}
+}
+
+// interleavedFiles streams the files of a local folder and calls during
+// first, while a backup holds the chunk store
+type interleavedFiles struct {
+	*BackendLocal
+	during func()
+}
+
+func (b *interleavedFiles) StreamFolder(envConfig *EnvironmentConfig, addFile func(header *tar.Header, content io.Reader) error) error {
+	b.during()
+	return b.BackendLocal.StreamFolder(envConfig, addFile)
+}
+
+func TestChunkStoreLocks(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].BackupMode = BackupModeChunks
+	mustWriteFile(t, filepath.Join(configs["staging"].TargetPath, "a.bin"), string(randomContent(6, 1<<20)))
+	locks := filepath.Join(root, "backups/chunk-locks")
+
+	// The chunks of the dump are stored before the files, no snapshot lists
+	// them yet when a collection runs
+	var collectErr error
+	engine.backends["staging"].Files = &interleavedFiles{BackendLocal: NewBackendLocal(), during: func() {
+		before := storedChunks(t, root)
+		_, collectErr = engine.CollectGarbage(context.Background(), "production", false)
+		if len(before) == 0 || len(storedChunks(t, root)) != len(before) {
+			t.Errorf("collection during a backup should keep its %d chunks", len(before))
+		}
+	}}
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-lock-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if collectErr == nil || !strings.Contains(collectErr.Error(), "backup of staging run 'test-run-lock-1'") {
+		t.Errorf("collection during a backup should stop, got %v", collectErr)
+	}
+	if entries, _ := os.ReadDir(locks); len(entries) != 0 {
+		t.Errorf("%d locks left behind", len(entries))
+	}
+	result, err := engine.CollectGarbage(context.Background(), "production", false)
+	if err != nil || result.Removed != 0 {
+		t.Fatalf("collection after the backup should keep every chunk, got %+v, %v", result, err)
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-lock-1", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+
+	// A backup starting during a collection fails, an expired lock is ignored
+	engine.backends["staging"].Files = NewBackendLocal()
+	lock := &chunkLock{Kind: chunkLockCollect, Environment: "production", StartedAt: time.Now().UTC()}
+	holder, err := acquireChunkLock(context.Background(), NewBackendLocal(), configs["staging"], lock)
+	if err != nil {
+		t.Fatalf("acquireChunkLock failed: %v", err)
+	}
+	err = engine.PerformBackup(context.Background(), "staging", "test-run-lock-2")
+	if err == nil || !strings.Contains(err.Error(), "garbage collection started by production") {
+		t.Errorf("backup during a collection should fail, got %v", err)
+	}
+	holder.release()
+	lock.StartedAt = time.Now().Add(-2 * chunkLockExpiry)
+	if _, err := acquireChunkLock(context.Background(), NewBackendLocal(), configs["staging"], lock); err != nil {
+		t.Fatalf("acquireChunkLock failed: %v", err)
+	}
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-lock-2"); err != nil {
+		t.Errorf("expired lock should be ignored, got %v", err)
+	}
+}
+
+// unavailableWrites fails every write to the store while unavailable is set
+type unavailableWrites struct {
+	*BackendLocal
+	unavailable atomic.Bool
+}
+
+func (b *unavailableWrites) NewArchiveWriter(ctx context.Context, destination string) (ArchiveWriter, error) {
+	if b.unavailable.Load() {
+		return nil, fmt.Errorf("store unavailable")
+	}
+	return b.BackendLocal.NewArchiveWriter(ctx, destination)
+}
+
+func TestChunkLockRefresh(t *testing.T) {
+	root := t.TempDir()
+	_, configs := newLocalFilesEngine(t, root)
+	store := &unavailableWrites{BackendLocal: NewBackendLocal()}
+
+	// A lock started long ago is held as long as it is refreshed
+	lock := &chunkLock{Kind: chunkLockBackup, Environment: "staging", RunID: "test-run-refresh", StartedAt: time.Now().Add(-2 * chunkLockExpiry).UTC()}
+	holder, err := acquireChunkLock(context.Background(), store, configs["staging"], lock)
+	if err != nil {
+		t.Fatalf("acquireChunkLock failed: %v", err)
+	}
+	ctx := holder.keep(context.Background(), 10*time.Millisecond, 200*time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		held, err := heldChunkLock(context.Background(), store, configs["staging"], chunkLockBackup)
+		if err != nil {
+			t.Fatalf("heldChunkLock failed: %v", err)
+		}
+		if held != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed lock should be held")
+		}
+	}
+
+	// The context of the lock is cancelled once it can't be refreshed
+	store.unavailable.Store(true)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock that can't be refreshed should be lost")
+	}
+	if cause := context.Cause(ctx); cause == nil || !strings.Contains(cause.Error(), "lost the chunk store lock") {
+		t.Errorf("expected the lock to be lost, got %v", cause)
+	}
+	holder.release()
+	if entries, _ := os.ReadDir(filepath.Join(root, "backups/chunk-locks")); len(entries) != 0 {
+		t.Errorf("%d locks left behind", len(entries))
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"cloud.google.com/go/storage"
 	backupmanager "github.com/interledger/interledger.org-v4/ci/backup-manager"
@@ -21,6 +23,8 @@ func main() {
 	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
 	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
 	preflightCmd := flag.NewFlagSet("preflight", flag.ExitOnError)
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	gcCmd := flag.NewFlagSet("gc", flag.ExitOnError)
 
 	// Backup command flags
 	backupEnv := backupCmd.String("env", "", "Environment to backup (staging or production)")
@@ -30,6 +34,17 @@ func main() {
 	restoreEnv := restoreCmd.String("env", "", "Source environment of the backup (staging or production)")
 	restoreRunID := restoreCmd.String("run-id", "", "Run ID of the backup to restore")
 	restoreDestEnv := restoreCmd.String("dest-env", "", "Destination environment to restore to (staging or production)")
+	restoreAllowUnsigned := restoreCmd.Bool("allow-unsigned", false, "Restore archives that aren't signed by a key the destination environment trusts")
+	restoreOnly := restoreCmd.String("only", "", "Restore only the database (db) or the files (files)")
+	restorePaths := restoreCmd.String("paths", "", "Comma-separated glob patterns of the files to restore, relative to the files directory (e.g. 'inline-images/**')")
+
+	// Verify command flags
+	verifyEnv := verifyCmd.String("env", "", "Environment of the backup (staging or production)")
+	verifyRunID := verifyCmd.String("run-id", "", "Run ID of the backup to verify")
+
+	// Garbage collection command flags
+	gcEnv := gcCmd.String("env", "", "Environment whose chunk store to collect (staging or production)")
+	gcDryRun := gcCmd.Bool("dry-run", false, "Only report the unreferenced chunks without removing them")
 
 	// Check for subcommand
 	if len(os.Args) < 2 {
@@ -38,7 +53,7 @@ func main() {
 	}
 
 	// Load environment configs
-	configs, err := loadConfigs()
+	configs, err := backupmanager.LoadEnvironmentConfigs()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading configs: %v\n", err)
 		fmt.Fprintln(os.Stderr, "\nMake sure you have set the following environment variables:")
@@ -49,11 +64,27 @@ func main() {
 		fmt.Fprintln(os.Stderr, "  - TARGET_HOST_STAGING, TARGET_HOST_PRODUCTION")
 		fmt.Fprintln(os.Stderr, "  - TARGET_USER_STAGING, TARGET_USER_PRODUCTION")
 		fmt.Fprintln(os.Stderr, "  - TARGET_PATH_STAGING, TARGET_PATH_PRODUCTION")
+		fmt.Fprintln(os.Stderr, "  - SSH_IDENTITY_FILE (or a running ssh-agent)")
+		fmt.Fprintln(os.Stderr, "\nWith BACKUP_BACKEND=local only these are needed:")
+		fmt.Fprintln(os.Stderr, "  - BACKUP_URL (file:///path/to/backups)")
+		fmt.Fprintln(os.Stderr, "  - DB_NAME_STAGING, DB_NAME_PRODUCTION")
+		fmt.Fprintln(os.Stderr, "  - TARGET_PATH_STAGING, TARGET_PATH_PRODUCTION")
+		fmt.Fprintln(os.Stderr, "\nBackends can also be chosen per environment with DB_BACKEND_<ENV> (cloudsql, postgres, local),")
+		fmt.Fprintln(os.Stderr, "FILES_BACKEND_<ENV> (ssh, rsync, local) and BACKUP_URL_<ENV> (gs://, s3://, file://).")
 		os.Exit(1)
 	}
 
 	// Create backup engine
-	engine := backupmanager.NewBackupEngineGcp(configs)
+	engine, err := backupmanager.NewBackupEngine(configs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up backends: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Interrupting the CLI cancels running database exports and imports,
+	// including Cloud SQL operations
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Parse subcommand
 	switch os.Args[1] {
@@ -70,7 +101,7 @@ func main() {
 		}
 
 		fmt.Printf("Starting backup for environment '%s' with run ID '%s'...\n", *backupEnv, *backupRunID)
-		if err := engine.PerformBackup(*backupEnv, *backupRunID); err != nil {
+		if err := engine.PerformBackup(ctx, *backupEnv, *backupRunID); err != nil {
 			fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -91,15 +122,84 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Error: -dest-env must be 'staging' or 'production'")
 			os.Exit(1)
 		}
+		if *restoreOnly != "" && *restoreOnly != backupmanager.RestoreDatabase && *restoreOnly != backupmanager.RestoreFiles {
+			fmt.Fprintln(os.Stderr, "Error: -only must be 'db' or 'files'")
+			os.Exit(1)
+		}
+		paths, err := backupmanager.NewPathFilter(strings.Split(*restorePaths, ","), nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -paths: %v\n", err)
+			os.Exit(1)
+		}
+		if paths != nil && *restoreOnly == backupmanager.RestoreDatabase {
+			fmt.Fprintln(os.Stderr, "Error: -paths can't be combined with -only db")
+			os.Exit(1)
+		}
 
 		fmt.Printf("Starting restore from environment '%s' (run ID '%s') to '%s'...\n",
 			*restoreEnv, *restoreRunID, *restoreDestEnv)
-		if err := engine.PerformRestore(*restoreEnv, *restoreRunID, *restoreDestEnv); err != nil {
+		options := backupmanager.RestoreOptions{AllowUnsigned: *restoreAllowUnsigned, Only: *restoreOnly, Paths: paths}
+		if err := engine.PerformRestore(ctx, *restoreEnv, *restoreRunID, *restoreDestEnv, options); err != nil {
 			fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
 			os.Exit(1)
 		}
 		fmt.Println("✓ Restore completed successfully!")
 
+	case "verify":
+		verifyCmd.Parse(os.Args[2:])
+		if *verifyEnv == "" || *verifyRunID == "" {
+			fmt.Fprintln(os.Stderr, "Error: -env and -run-id are required")
+			verifyCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		if *verifyEnv != "staging" && *verifyEnv != "production" {
+			fmt.Fprintln(os.Stderr, "Error: -env must be 'staging' or 'production'")
+			os.Exit(1)
+		}
+
+		fmt.Printf("Verifying backup of environment '%s' with run ID '%s'...\n", *verifyEnv, *verifyRunID)
+		report, err := engine.VerifyBackup(ctx, *verifyEnv, *verifyRunID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+			os.Exit(1)
+		}
+		for _, check := range report.Checks {
+			fmt.Printf("  [%s] %-15s %s\n", check.Status, check.Name, check.Detail)
+		}
+		if !report.Passed() {
+			fmt.Fprintln(os.Stderr, "Verification failed: the backup is damaged or incomplete")
+			os.Exit(1)
+		}
+		fmt.Println("✓ Backup verified successfully!")
+
+	case "gc":
+		gcCmd.Parse(os.Args[2:])
+		if *gcEnv == "" {
+			fmt.Fprintln(os.Stderr, "Error: -env is required")
+			gcCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		if *gcEnv != "staging" && *gcEnv != "production" {
+			fmt.Fprintln(os.Stderr, "Error: -env must be 'staging' or 'production'")
+			os.Exit(1)
+		}
+
+		fmt.Printf("Collecting unreferenced chunks of environment '%s'...\n", *gcEnv)
+		result, err := engine.CollectGarbage(ctx, *gcEnv, *gcDryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Garbage collection failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("  %d snapshots, %d chunks stored, %d unreferenced\n", result.Snapshots, result.Chunks, len(result.Unreferenced))
+		if *gcDryRun {
+			for _, url := range result.Unreferenced {
+				fmt.Printf("  would remove %s\n", url)
+			}
+			fmt.Println("✓ Dry run completed, no chunks removed")
+		} else {
+			fmt.Printf("✓ Removed %d unreferenced chunks\n", result.Removed)
+		}
+
 	case "preflight":
 		preflightCmd.Parse(os.Args[2:])
 		if err := runPreflight(configs); err != nil {
@@ -119,64 +219,45 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Usage:")
 	fmt.Println("  backup-cli backup  -env <environment> -run-id <run-id>")
-	fmt.Println("  backup-cli restore   -env <environment> -run-id <run-id> -dest-env <destination-environment>")
+	fmt.Println("  backup-cli restore   -env <environment> -run-id <run-id> -dest-env <destination-environment> [-allow-unsigned] [-only db|files] [-paths <patterns>]")
+	fmt.Println("  backup-cli verify    -env <environment> -run-id <run-id>")
+	fmt.Println("  backup-cli gc        -env <environment> [-dry-run]")
 	fmt.Println("  backup-cli preflight")
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("  backup   Create a backup of the specified environment")
 	fmt.Println("  restore   Restore a backup to the specified destination environment")
+	fmt.Println("  verify    Check the integrity of a backup without restoring it")
+	fmt.Println("  gc        Remove chunks no snapshot of the chunk store uses any more")
 	fmt.Println("  preflight Validate IAM: Cloud SQL service agent access to BACKUP_BUCKET")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  backup-cli backup -env staging -run-id 2024-01-15-001")
 	fmt.Println("  backup-cli restore -env staging -run-id 2024-01-15-001 -dest-env production")
+	fmt.Println("  backup-cli restore -env production -run-id 2024-01-15-001 -dest-env production -only files -paths 'inline-images/**'")
+	fmt.Println("  backup-cli verify -env production -run-id 2024-01-15-001")
+	fmt.Println("  backup-cli gc -env production -dry-run")
 }
 
-func loadConfigs() (backupmanager.EnvironmentConfigs, error) {
-	configs := make(backupmanager.EnvironmentConfigs)
-
-	staging := &backupmanager.EnvironmentConfig{
-		BackupBucket:     os.Getenv("BACKUP_BUCKET"),
-		DBName:           os.Getenv("DB_NAME_STAGING"),
-		GCPProjectID:     os.Getenv("GCP_PROJECT_ID"),
-		CloudSQLInstance: os.Getenv("CLOUDSQL_INSTANCE_STAGING"),
-		TargetHost:       os.Getenv("TARGET_HOST_STAGING"),
-		TargetUser:       os.Getenv("TARGET_USER_STAGING"),
-		TargetPath:       os.Getenv("TARGET_PATH_STAGING"),
-	}
-
-	production := &backupmanager.EnvironmentConfig{
-		BackupBucket:     os.Getenv("BACKUP_BUCKET"),
-		DBName:           os.Getenv("DB_NAME_PRODUCTION"),
-		GCPProjectID:     os.Getenv("GCP_PROJECT_ID"),
-		CloudSQLInstance: os.Getenv("CLOUDSQL_INSTANCE_PRODUCTION"),
-		TargetHost:       os.Getenv("TARGET_HOST_PRODUCTION"),
-		TargetUser:       os.Getenv("TARGET_USER_PRODUCTION"),
-		TargetPath:       os.Getenv("TARGET_PATH_PRODUCTION"),
-	}
-
-	// Validate required fields
-	if staging.BackupBucket == "" {
-		return nil, fmt.Errorf("BACKUP_BUCKET is required")
-	}
-	if staging.GCPProjectID == "" {
-		return nil, fmt.Errorf("GCP_PROJECT_ID is required")
-	}
-	if staging.DBName == "" || staging.CloudSQLInstance == "" || staging.TargetHost == "" || staging.TargetUser == "" || staging.TargetPath == "" {
-		return nil, fmt.Errorf("missing staging environment configuration")
+// runPreflight validates that the Cloud SQL service agent has viewer and (optionally) creator roles on the BACKUP_BUCKET.
+func runPreflight(configs backupmanager.EnvironmentConfigs) error {
+	// Only Cloud SQL Admin API exports and imports go through the bucket
+	usesAdminExport := false
+	usesAdminImport := false
+	for _, cfg := range configs {
+		if cfg.DBBackend == backupmanager.DBBackendCloudSQL {
+			if cfg.DBExportMode != backupmanager.DBExportModeDirect {
+				usesAdminExport = true
+			}
+			if cfg.DBImportMode != backupmanager.DBImportModeDirect {
+				usesAdminImport = true
+			}
+		}
 	}
-	if production.DBName == "" || production.CloudSQLInstance == "" || production.TargetHost == "" || production.TargetUser == "" || production.TargetPath == "" {
-		return nil, fmt.Errorf("missing production environment configuration")
+	if !usesAdminExport && !usesAdminImport {
+		return fmt.Errorf("no environment uses Cloud SQL Admin API exports or imports, nothing to check")
 	}
 
-	configs["staging"] = staging
-	configs["production"] = production
-
-	return configs, nil
-}
-
-// runPreflight validates that the Cloud SQL service agent has viewer and (optionally) creator roles on the BACKUP_BUCKET.
-func runPreflight(configs backupmanager.EnvironmentConfigs) error {
 	// Use the backup bucket from either environment (they share the same bucket per current config).
 	var backupBucket string
 	if cfg, ok := configs["staging"]; ok && cfg != nil && cfg.BackupBucket != "" {
@@ -210,14 +291,16 @@ func runPreflight(configs backupmanager.EnvironmentConfigs) error {
 	// Ensure every Cloud SQL SA present in creator is also present in viewer
 	missing := missingCloudSqlViewers(viewerMembers, creatorMembers)
 
-	if !hasViewer || len(missing) > 0 {
+	// Direct imports connect to the instance and don't read from the bucket
+	if usesAdminImport && (!hasViewer || len(missing) > 0) {
 		printFixInstructions(backupBucket)
 		if len(missing) > 0 {
 			fmt.Printf("[ERROR] missing viewer for: %s\n", strings.Join(missing, ", "))
 		}
 		return fmt.Errorf("cloud sql service agent missing roles/storage.objectViewer on bucket %s", backupBucket)
 	}
-	if !hasCreator {
+	// Direct exports connect to the instance and don't write to the bucket
+	if !hasCreator && usesAdminExport {
 		fmt.Println("[WARN] Cloud SQL service agent missing roles/storage.objectCreator (needed for exports).")
 	}
 	return nil
@@ -0,0 +1,212 @@
+package backupmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// Defaults of the Cloud SQL operation waiter
+const (
+	defaultOperationTimeout    = 2 * time.Hour
+	defaultOperationInterval   = 2 * time.Second
+	defaultOperationMaxPolling = 30 * time.Second
+	defaultOperationMultiplier = 1.5
+
+	// operationCancelTimeout bounds the cancel request sent after the wait
+	// was interrupted, when the caller's context is already done
+	operationCancelTimeout = 30 * time.Second
+)
+
+// cloudSQLOperations is the part of the Cloud SQL Admin API used to follow
+// long-running operations such as exports and imports
+type cloudSQLOperations interface {
+	Get(ctx context.Context, project string, operation string) (*sqladmin.Operation, error)
+	Cancel(ctx context.Context, project string, operation string) error
+}
+
+// sqlAdminOperations follows operations through the Cloud SQL Admin API
+type sqlAdminOperations struct {
+	service *sqladmin.Service
+}
+
+func (o sqlAdminOperations) Get(ctx context.Context, project string, operation string) (*sqladmin.Operation, error) {
+	return o.service.Operations.Get(project, operation).Context(ctx).Do()
+}
+
+func (o sqlAdminOperations) Cancel(ctx context.Context, project string, operation string) error {
+	_, err := o.service.Operations.Cancel(project, operation).Context(ctx).Do()
+	return err
+}
+
+// OperationProgress describes a running operation each time it is polled
+type OperationProgress struct {
+	Operation string
+	Type      string
+	Status    string
+	Elapsed   time.Duration
+}
+
+// OperationWaiter waits for Cloud SQL operations to finish. It polls with an
+// exponential backoff from InitialInterval up to MaxInterval and gives up
+// after Timeout. An operation that runs out of time, or whose wait is
+// cancelled through the context, e.g. by interrupting the CLI, is cancelled
+// in Cloud SQL as well so it doesn't keep the instance busy.
+type OperationWaiter struct {
+	Operations      cloudSQLOperations
+	Project         string
+	Timeout         time.Duration
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+
+	// Progress is called after every poll of an unfinished operation
+	Progress func(OperationProgress)
+}
+
+// newOperationWaiter creates a waiter for operations of the environment's
+// project, logging the progress of the operations
+func newOperationWaiter(service *sqladmin.Service, config *EnvironmentConfig) *OperationWaiter {
+	return &OperationWaiter{
+		Operations:      sqlAdminOperations{service: service},
+		Project:         config.GCPProjectID,
+		Timeout:         config.CloudSQLOperationTimeout,
+		InitialInterval: defaultOperationInterval,
+		MaxInterval:     defaultOperationMaxPolling,
+		Multiplier:      defaultOperationMultiplier,
+		Progress:        logOperationProgress,
+	}
+}
+
+func logOperationProgress(progress OperationProgress) {
+	Info("%s operation in progress (status: %s, %s elapsed), waiting...",
+		operationTypeName(progress.Type), progress.Status, progress.Elapsed.Round(time.Second))
+}
+
+// operationTypeName turns an operation type like IMPORT into Import
+func operationTypeName(operationType string) string {
+	if operationType == "" {
+		return "Cloud SQL"
+	}
+	name := strings.ToLower(strings.ReplaceAll(operationType, "_", " "))
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// OperationFailedError is returned for operations that finished with errors
+type OperationFailedError struct {
+	Operation string
+	Errors    []*sqladmin.OperationError
+}
+
+func (e *OperationFailedError) Error() string {
+	var messages []string
+	for _, operationError := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", operationError.Code, operationError.Message))
+	}
+	return fmt.Sprintf("operation %s failed: %s", e.Operation, strings.Join(messages, "; "))
+}
+
+// OperationTimeoutError is returned when an operation didn't finish within the
+// waiter's timeout. The operation was cancelled when Cancelled is set.
+type OperationTimeoutError struct {
+	Operation string
+	Status    string
+	Timeout   time.Duration
+	Cancelled bool
+}
+
+func (e *OperationTimeoutError) Error() string {
+	msg := fmt.Sprintf("operation %s did not finish within %s (last status: %s)", e.Operation, e.Timeout, e.Status)
+	if e.Cancelled {
+		return msg + ", the operation was cancelled"
+	}
+	return msg + ", cancelling the operation failed, it may still be running"
+}
+
+// Wait polls the operation until it is done. It returns an
+// *OperationFailedError when the operation finished with errors and an
+// *OperationTimeoutError when it ran out of time. When ctx is done first the
+// operation is cancelled and the returned error wraps the context's error.
+func (w *OperationWaiter) Wait(ctx context.Context, operation *sqladmin.Operation) error {
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = defaultOperationTimeout
+	}
+	interval := w.InitialInterval
+	if interval <= 0 {
+		interval = defaultOperationInterval
+	}
+	maxInterval := max(w.MaxInterval, interval)
+	multiplier := w.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	status := operation.Status
+	for {
+		current, err := w.Operations.Get(ctx, w.Project, operation.Name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return w.cancel(ctx, operation.Name, ctx.Err())
+			}
+			return fmt.Errorf("failed to get status of operation %s: %v", operation.Name, err)
+		}
+		status = current.Status
+
+		if current.Status == "DONE" {
+			if current.Error != nil && len(current.Error.Errors) > 0 {
+				return &OperationFailedError{Operation: operation.Name, Errors: current.Error.Errors}
+			}
+			return nil
+		}
+
+		if w.Progress != nil {
+			w.Progress(OperationProgress{
+				Operation: operation.Name,
+				Type:      current.OperationType,
+				Status:    current.Status,
+				Elapsed:   time.Since(start),
+			})
+		}
+
+		poll := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			poll.Stop()
+			return w.cancel(ctx, operation.Name, ctx.Err())
+		case <-deadline.C:
+			poll.Stop()
+			err := w.cancel(ctx, operation.Name, nil)
+			return &OperationTimeoutError{Operation: operation.Name, Status: status, Timeout: timeout, Cancelled: err == nil}
+		case <-poll.C:
+		}
+		interval = min(time.Duration(float64(interval)*multiplier), maxInterval)
+	}
+}
+
+// cancel cancels the operation in Cloud SQL after the wait was given up
+// because of cause, or because of the timeout when cause is nil
+func (w *OperationWaiter) cancel(ctx context.Context, operationName string, cause error) error {
+	Warn("Cancelling Cloud SQL operation %s", operationName)
+	cancelCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), operationCancelTimeout)
+	defer cancel()
+
+	err := w.Operations.Cancel(cancelCtx, w.Project, operationName)
+	if err != nil {
+		Error("Failed to cancel operation %s, it may still be running: %v", operationName, err)
+	}
+	if cause == nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("waiting for operation %s stopped: %w (cancelling the operation failed: %v)", operationName, cause, err)
+	}
+	return fmt.Errorf("waiting for operation %s stopped, the operation was cancelled: %w", operationName, cause)
+}
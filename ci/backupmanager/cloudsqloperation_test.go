@@ -0,0 +1,173 @@
+package backupmanager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// fakeOperations serves a fixed sequence of operation states
+type fakeOperations struct {
+	mu        sync.Mutex
+	states    []*sqladmin.Operation
+	gets      int
+	cancelled []string
+	cancelErr error
+}
+
+func (f *fakeOperations) Get(ctx context.Context, project string, operation string) (*sqladmin.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := f.states[min(f.gets, len(f.states)-1)]
+	f.gets++
+	return state, nil
+}
+
+func (f *fakeOperations) Cancel(ctx context.Context, project string, operation string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	f.cancelled = append(f.cancelled, operation)
+	return f.cancelErr
+}
+
+func testOperationWaiter(operations cloudSQLOperations) *OperationWaiter {
+	return &OperationWaiter{
+		Operations:      operations,
+		Project:         "test-project",
+		Timeout:         time.Second,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     4 * time.Millisecond,
+		Multiplier:      2,
+	}
+}
+
+func TestOperationWaiterCompletes(t *testing.T) {
+	running := &sqladmin.Operation{Name: "op-1", OperationType: "IMPORT", Status: "RUNNING"}
+	operations := &fakeOperations{states: []*sqladmin.Operation{
+		{Name: "op-1", OperationType: "IMPORT", Status: "PENDING"},
+		running, running,
+		{Name: "op-1", OperationType: "IMPORT", Status: "DONE"},
+	}}
+	waiter := testOperationWaiter(operations)
+	var progress []OperationProgress
+	waiter.Progress = func(p OperationProgress) { progress = append(progress, p) }
+
+	if err := waiter.Wait(context.Background(), &sqladmin.Operation{Name: "op-1"}); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if operations.gets != 4 {
+		t.Errorf("expected 4 status checks, got %d", operations.gets)
+	}
+	if len(progress) != 3 || progress[0].Status != "PENDING" || progress[2].Status != "RUNNING" || progress[2].Type != "IMPORT" {
+		t.Errorf("unexpected progress reports: %+v", progress)
+	}
+	if len(operations.cancelled) != 0 {
+		t.Errorf("completed operation should not be cancelled")
+	}
+}
+
+func TestOperationWaiterFailedOperation(t *testing.T) {
+	operations := &fakeOperations{states: []*sqladmin.Operation{{
+		Name:   "op-2",
+		Status: "DONE",
+		Error: &sqladmin.OperationErrors{Errors: []*sqladmin.OperationError{
+			{Code: "ERROR_RDBMS", Message: "syntax error at line 12"},
+		}},
+	}}}
+
+	err := testOperationWaiter(operations).Wait(context.Background(), &sqladmin.Operation{Name: "op-2"})
+	var failedErr *OperationFailedError
+	if !errors.As(err, &failedErr) {
+		t.Fatalf("expected an OperationFailedError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "ERROR_RDBMS: syntax error at line 12") {
+		t.Errorf("error should contain the operation errors, got: %v", err)
+	}
+}
+
+func TestOperationWaiterTimeout(t *testing.T) {
+	operations := &fakeOperations{states: []*sqladmin.Operation{{Name: "op-3", Status: "RUNNING"}}}
+	waiter := testOperationWaiter(operations)
+	waiter.Timeout = 20 * time.Millisecond
+
+	err := waiter.Wait(context.Background(), &sqladmin.Operation{Name: "op-3"})
+	var timeoutErr *OperationTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected an OperationTimeoutError, got %v", err)
+	}
+	if !timeoutErr.Cancelled || timeoutErr.Status != "RUNNING" || timeoutErr.Timeout != waiter.Timeout {
+		t.Errorf("unexpected timeout error: %+v", timeoutErr)
+	}
+	if len(operations.cancelled) != 1 || operations.cancelled[0] != "op-3" {
+		t.Errorf("expected op-3 to be cancelled, got %v", operations.cancelled)
+	}
+
+	// A failed cancel is reported, the operation may still be running
+	operations = &fakeOperations{states: []*sqladmin.Operation{{Name: "op-3", Status: "RUNNING"}}, cancelErr: errors.New("denied")}
+	waiter.Operations = operations
+	err = waiter.Wait(context.Background(), &sqladmin.Operation{Name: "op-3"})
+	if !errors.As(err, &timeoutErr) || timeoutErr.Cancelled || !strings.Contains(err.Error(), "may still be running") {
+		t.Errorf("expected a timeout without cancel, got %v", err)
+	}
+}
+
+func TestOperationWaiterCancelledContext(t *testing.T) {
+	operations := &fakeOperations{states: []*sqladmin.Operation{{Name: "op-4", Status: "RUNNING"}}}
+	waiter := testOperationWaiter(operations)
+	waiter.Timeout = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter.Progress = func(p OperationProgress) {
+		if operations.gets == 3 {
+			cancel()
+		}
+	}
+
+	err := waiter.Wait(ctx, &sqladmin.Operation{Name: "op-4"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+	// The cancel request must not use the cancelled context
+	if len(operations.cancelled) != 1 || operations.cancelled[0] != "op-4" {
+		t.Errorf("expected op-4 to be cancelled, got %v", operations.cancelled)
+	}
+}
+
+func TestOperationWaiterBackoff(t *testing.T) {
+	operations := &fakeOperations{states: []*sqladmin.Operation{{Name: "op-5", Status: "RUNNING"}}}
+	waiter := testOperationWaiter(operations)
+	waiter.InitialInterval = 10 * time.Millisecond
+	waiter.MaxInterval = 40 * time.Millisecond
+	waiter.Timeout = 200 * time.Millisecond
+
+	var polls []time.Duration
+	waiter.Progress = func(p OperationProgress) { polls = append(polls, p.Elapsed) }
+	waiter.Wait(context.Background(), &sqladmin.Operation{Name: "op-5"})
+
+	// Intervals of 10, 20, 40, 40, ... ms fit about 6 polls in 200ms, a fixed
+	// interval of 10ms would fit 20
+	if len(polls) < 4 || len(polls) > 10 {
+		t.Errorf("expected backoff to limit the polls, got %d in %s", len(polls), waiter.Timeout)
+	}
+	for i := 3; i < len(polls); i++ {
+		if gap := polls[i] - polls[i-1]; gap < waiter.MaxInterval-5*time.Millisecond {
+			t.Errorf("poll %d came after %s, expected at least the max interval of %s", i, gap, waiter.MaxInterval)
+		}
+	}
+}
+
+func TestOperationTypeName(t *testing.T) {
+	for operationType, expected := range map[string]string{"IMPORT": "Import", "EXPORT": "Export", "RESTORE_VOLUME": "Restore volume", "": "Cloud SQL"} {
+		if got := operationTypeName(operationType); got != expected {
+			t.Errorf("operationTypeName(%q) = %q, expected %q", operationType, got, expected)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package backupmanager
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of backup archives
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// Magic bytes that start compressed streams
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// archiveExtensions maps compressions to the extensions of archive names.
+// The order is the one archives of a run are looked up in.
+var archiveExtensions = []struct {
+	compression string
+	extension   string
+}{
+	{CompressionZstd, ".tar.zst"},
+	{CompressionGzip, ".tar.gz"},
+	{CompressionNone, ".tar"},
+}
+
+// archiveExtension returns the extension of archives with the given
+// compression, e.g. .tar.zst, archives without a compression are gzipped
+func archiveExtension(compression string) string {
+	for _, candidate := range archiveExtensions {
+		if candidate.compression == compression {
+			return candidate.extension
+		}
+	}
+	return ".tar.gz"
+}
+
+// validateCompression checks a compression and its level. Level 0 stands for
+// the default level of the compression.
+func validateCompression(compression string, level int) error {
+	switch compression {
+	case "", CompressionGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be between 1 and %d, got %d", gzip.BestCompression, level)
+		}
+	case CompressionZstd:
+		if level < 0 || level > 22 {
+			return fmt.Errorf("zstd compression level must be between 1 and 22, got %d", level)
+		}
+	case CompressionNone:
+		if level != 0 {
+			return fmt.Errorf("archives without compression have no compression level")
+		}
+	default:
+		return fmt.Errorf("unknown compression '%s', expected %s, %s or %s", compression, CompressionZstd, CompressionGzip, CompressionNone)
+	}
+	return nil
+}
+
+// newCompressionWriter compresses everything written to it into w. Closing it
+// flushes the compressed stream, but doesn't close w.
+func newCompressionWriter(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	if err := validateCompression(compression, level); err != nil {
+		return nil, err
+	}
+	switch compression {
+	case CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+}
+
+// newDecompressionReader tells the compression of an archive by its magic
+// bytes and returns a reader of the uncompressed tar stream along with the
+// compression. Archives that are neither gzip nor zstd compressed are read as
+// plain tar streams.
+func newDecompressionReader(r io.Reader) (io.ReadCloser, string, error) {
+	buffered := bufio.NewReaderSize(r, sqlDumpChunkSize)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("failed to read archive: %v", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create gzip reader: %v", err)
+		}
+		return gzipReader, CompressionGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create zstd reader: %v", err)
+		}
+		return zstdReader.IOReadCloser(), CompressionZstd, nil
+	default:
+		return io.NopCloser(buffered), CompressionNone, nil
+	}
+}
+
+// describeCompression names a compression and its level for log messages
+func describeCompression(compression string, level int) string {
+	if level == 0 || compression == CompressionNone {
+		return compression
+	}
+	return fmt.Sprintf("%s level %d", compression, level)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
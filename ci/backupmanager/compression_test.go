@@ -0,0 +1,141 @@
+package backupmanager
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveCompressions(t *testing.T) {
+	for _, test := range []struct {
+		compression string
+		level       int
+		magic       []byte
+	}{
+		{CompressionZstd, 0, zstdMagic},
+		{CompressionZstd, 19, zstdMagic},
+		{CompressionGzip, 1, gzipMagic},
+		{CompressionNone, 0, []byte("manifest.json")},
+	} {
+		tmpFolder := t.TempDir()
+		filesFolder := filepath.Join(tmpFolder, "files")
+		mustWriteFile(t, filepath.Join(filesFolder, "inline-images", "logo.png"), strings.Repeat("not really a png ", 100))
+		dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+		mustWriteFile(t, dumpPath, completeMySQLDump)
+
+		archivePath := filepath.Join(tmpFolder, "backup_archive"+archiveExtension(test.compression))
+		manifest := &BackupManifest{DatabaseEngine: DatabaseEngineMySQL, Compression: test.compression, CompressionLevel: test.level}
+		writeTestArchive(t, archivePath, manifest, dumpPath, filesFolder)
+		data, err := os.ReadFile(archivePath)
+		if err != nil {
+			t.Fatalf("failed to read archive: %v", err)
+		}
+		if !bytes.HasPrefix(data, test.magic) {
+			t.Errorf("%s archive starts with %x", test.compression, data[:8])
+		}
+
+		extracted, err := extractTestArchive(t, archivePath, filepath.Join(tmpFolder, "extracted"))
+		if err != nil {
+			t.Fatalf("%s: extracting archive failed: %v", test.compression, err)
+		}
+		if extracted.Compression != test.compression || extracted.CompressionLevel != test.level {
+			t.Errorf("manifest records %s level %d, expected %s level %d",
+				extracted.Compression, extracted.CompressionLevel, test.compression, test.level)
+		}
+		if report := VerifyBackupArchive(archivePath); !report.Passed() {
+			t.Errorf("%s archive fails verification: %+v", test.compression, report.Checks)
+		}
+	}
+}
+
+func TestArchiveCompressionDefaultsToGzip(t *testing.T) {
+	archivePath, manifest := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	if manifest.Compression != CompressionGzip {
+		t.Errorf("archives without a compression should be gzipped, manifest records %q", manifest.Compression)
+	}
+	data, _ := os.ReadFile(archivePath)
+	if !bytes.HasPrefix(data, gzipMagic) {
+		t.Errorf("archive is not gzipped")
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for _, valid := range []struct {
+		compression string
+		level       int
+	}{{"", 0}, {CompressionGzip, 9}, {CompressionZstd, 0}, {CompressionZstd, 22}, {CompressionNone, 0}} {
+		if err := validateCompression(valid.compression, valid.level); err != nil {
+			t.Errorf("%s level %d rejected: %v", valid.compression, valid.level, err)
+		}
+	}
+	for _, invalid := range []struct {
+		compression string
+		level       int
+	}{{"xz", 0}, {CompressionGzip, 10}, {CompressionZstd, 23}, {CompressionZstd, -1}, {CompressionNone, 3}} {
+		if err := validateCompression(invalid.compression, invalid.level); err == nil {
+			t.Errorf("%s level %d should be rejected", invalid.compression, invalid.level)
+		}
+	}
+
+	config := mockConfigs()["staging"]
+	config.ArchiveCompression = "bzip2"
+	if err := config.Validate("staging"); err == nil || !strings.Contains(err.Error(), "BACKUP_COMPRESSION_STAGING") {
+		t.Errorf("unknown compression should be rejected, got %v", err)
+	}
+}
+
+func TestFindArchive(t *testing.T) {
+	backupFolder := t.TempDir()
+	config := mockConfigs()["staging"]
+	config.BackupURL = "file://" + backupFolder
+	config.ArchiveCompression = CompressionZstd
+	store := NewBackendLocal()
+	runFolder := filepath.Join(backupFolder, "backups", "staging")
+
+	if _, err := findArchive(store, config, "staging", "test-run"); err == nil {
+		t.Errorf("finding a missing archive should fail")
+	}
+
+	// Archives written before zstd was enabled are still found
+	mustWriteFile(t, filepath.Join(runFolder, "backup_test-run.tar.gz"), "gzip")
+	mustWriteFile(t, filepath.Join(runFolder, "backup_test-run-2.tar.zst"), "other run")
+	url, err := findArchive(store, config, "staging", "test-run")
+	if err != nil || url != config.BackupURL+"/backups/staging/backup_test-run.tar.gz" {
+		t.Errorf("expected the .tar.gz archive, got %s, %v", url, err)
+	}
+
+	// The configured compression wins when a run was stored twice
+	mustWriteFile(t, filepath.Join(runFolder, "backup_test-run.tar.zst"), "zstd")
+	url, err = findArchive(store, config, "staging", "test-run")
+	if err != nil || url != config.BackupURL+"/backups/staging/backup_test-run.tar.zst" {
+		t.Errorf("expected the .tar.zst archive, got %s, %v", url, err)
+	}
+}
+
+func TestCompressedBackupAndRestore(t *testing.T) {
+	backend := NewMockBackend()
+	backend.uploadedArchive = filepath.Join(t.TempDir(), "uploaded")
+	configs := mockConfigs()
+	configs["staging"].ArchiveCompression = CompressionZstd
+	configs["staging"].ArchiveCompressionLevel = 3
+	engine := newMockEngine(backend, configs)
+
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-zstd"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if expected := "gs://test-backup-bucket/backups/staging/test-run-zstd/files.tar.zst"; backend.uploadedTo != expected {
+		t.Errorf("files archive uploaded to %s, expected %s", backend.uploadedTo, expected)
+	}
+
+	// Restores find the files archive by its extension and sniff the
+	// compression
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-zstd", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	if backend.importedConfig == nil {
+		t.Errorf("database dump was not imported")
+	}
+}
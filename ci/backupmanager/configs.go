@@ -3,23 +3,133 @@ package backupmanager
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type EnvironmentConfigs map[string]*EnvironmentConfig
 
+// Database backends
+const (
+	DBBackendCloudSQL = "cloudsql"
+	DBBackendLocal    = "local"
+	DBBackendPostgres = "postgres"
+)
+
+// Export and import modes of the cloudsql database backend
+const (
+	DBExportModeAdmin  = "admin"
+	DBExportModeDirect = "direct"
+	DBImportModeAdmin  = "admin"
+	DBImportModeDirect = "direct"
+)
+
+// File backends
+const (
+	FilesBackendSSH   = "ssh"
+	FilesBackendRsync = "rsync"
+	FilesBackendLocal = "local"
+)
+
+// Backup modes, how the backups of an environment are stored
+const (
+	BackupModeArchive = "archive"
+	BackupModeChunks  = "chunks"
+)
+
 // EnvironmentConfig holds typed configuration values for an environment.
 type EnvironmentConfig struct {
 	BackupBucket     string
+	BackupURL        string
+	DBBackend        string
 	DBName           string
 	GCPProjectID     string
 	CloudSQLInstance string
+	FilesBackend     string
 	TargetHost       string
 	TargetUser       string
 	TargetPath       string
+
+	// SSH file backend settings
+	SSHPort           string
+	SSHIdentityFile   string
+	SSHKnownHostsFile string
+	SSHChecksum       bool
+
+	// Direct database connection settings, used by the direct export and
+	// import modes and the postgres backend. Without DBHost the direct modes
+	// use the Cloud SQL Go connector. DBPort defaults to the engine's port.
+	DBExportMode           string
+	DBImportMode           string
+	CloudSQLConnectionName string
+	DBHost                 string
+	DBPort                 string
+	DBUser                 string
+	DBPassword             string
+	DBPrivateIP            bool
+	DBIAMAuth              bool
+
+	// CloudSQLOperationTimeout limits how long Cloud SQL Admin API exports and
+	// imports may run before they are cancelled, 0 uses the default of 2h
+	CloudSQLOperationTimeout time.Duration
+
+	// ArchiveCompression compresses backup archives with CompressionZstd,
+	// CompressionGzip or CompressionNone, ArchiveCompressionLevel picks the
+	// level of zstd (1-22) or gzip (1-9), 0 uses the default level
+	ArchiveCompression      string
+	ArchiveCompressionLevel int
+
+	// Archive encryption settings. Archives are encrypted for the age or SSH
+	// public keys in EncryptionRecipients (comma or newline separated) and
+	// EncryptionRecipientsFile before upload, restores decrypt them with the
+	// identity in EncryptionIdentityFile or EncryptionIdentity. Encrypted
+	// chunks of the chunk store are named with the secret in
+	// EncryptionChunkKey or EncryptionChunkKeyFile.
+	EncryptionRecipients     string
+	EncryptionRecipientsFile string
+	EncryptionIdentityFile   string
+	EncryptionIdentity       string
+	EncryptionChunkKeyFile   string
+	EncryptionChunkKey       string
+
+	// Archive signing settings. Backups are signed with the OpenSSH ed25519
+	// private key in SigningKeyFile or SigningKey, restores into the
+	// environment only accept archives signed by one of the ssh-ed25519
+	// public keys in TrustedKeys (comma or newline separated) and
+	// TrustedKeysFile.
+	SigningKeyFile  string
+	SigningKey      string
+	TrustedKeys     string
+	TrustedKeysFile string
+
+	// FullBackups forces a full backup every this many runs, the runs in
+	// between are incremental. 1 makes every backup a full backup, 0 uses
+	// DefaultFullBackupInterval, which does as well.
+	FullBackups int
+
+	// BackupMode stores every run as an archive, BackupModeArchive, or as a
+	// snapshot of deduplicated chunks in the chunk store, BackupModeChunks.
+	// Empty is BackupModeArchive.
+	BackupMode string
+
+	// FilesInclude and FilesExclude limit the files backed up to the paths
+	// their glob patterns (comma or newline separated) select, see
+	// PathFilter. The patterns are recorded in the manifest, restores of the
+	// backup leave the paths they don't select untouched.
+	FilesInclude string
+	FilesExclude string
+
+	// ExtractMaxEntries and ExtractMaxSize limit the number of entries and
+	// the total size of the files extracted from an archive on restore, 0
+	// uses the defaults
+	ExtractMaxEntries int
+	ExtractMaxSize    int64
 }
 
-func environmentConfigs() (EnvironmentConfigs, error) {
+// LoadEnvironmentConfigs reads the configuration of every environment from
+// the process environment
+func LoadEnvironmentConfigs() (EnvironmentConfigs, error) {
 	configs := make(EnvironmentConfigs)
 
 	// Load all configured environments from ENVIRONMENTS env var
@@ -33,7 +143,7 @@ func environmentConfigs() (EnvironmentConfigs, error) {
 		env = strings.TrimSpace(env)
 		config, err := environmentConfig(env)
 		if err != nil {
-			return nil, fmt.Errorf("error loading %s environment config: %v", env, err)
+			return nil, err
 		}
 		configs[env] = config
 	}
@@ -42,49 +152,339 @@ func environmentConfigs() (EnvironmentConfigs, error) {
 }
 
 func environmentConfig(environment string) (*EnvironmentConfig, error) {
-	cfg := &EnvironmentConfig{}
+	env := strings.ToUpper(environment)
+	// BACKUP_BACKEND=local switches the default database and files backends
+	// to the local ones, DB_BACKEND_<ENV> and FILES_BACKEND_<ENV> choose them
+	// per environment
+	dbBackend, filesBackend := DBBackendCloudSQL, FilesBackendSSH
+	if os.Getenv("BACKUP_BACKEND") == "local" {
+		dbBackend, filesBackend = DBBackendLocal, FilesBackendLocal
+	}
+	var operationTimeout time.Duration
+	if value := os.Getenv("CLOUDSQL_OPERATION_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CLOUDSQL_OPERATION_TIMEOUT '%s': %v", value, err)
+		}
+		operationTimeout = timeout
+	}
+	extractMaxEntries, extractMaxSize, err := extractLimitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var compressionLevel int
+	if value := envOrDefault("BACKUP_COMPRESSION_LEVEL_"+env, os.Getenv("BACKUP_COMPRESSION_LEVEL")); value != "" {
+		level, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_COMPRESSION_LEVEL '%s': %v", value, err)
+		}
+		compressionLevel = level
+	}
+	var fullBackups int
+	if value := envOrDefault("BACKUP_FULL_EVERY_"+env, os.Getenv("BACKUP_FULL_EVERY")); value != "" {
+		runs, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_FULL_EVERY '%s': %v", value, err)
+		}
+		fullBackups = runs
+	}
+
+	cfg := &EnvironmentConfig{
+		BackupBucket:     os.Getenv("BACKUP_BUCKET"),
+		BackupURL:        envOrDefault("BACKUP_URL_"+env, os.Getenv("BACKUP_URL")),
+		DBBackend:        envOrDefault("DB_BACKEND_"+env, dbBackend),
+		DBName:           os.Getenv("DB_NAME_" + env),
+		GCPProjectID:     os.Getenv("GCP_PROJECT_ID"),
+		CloudSQLInstance: os.Getenv("CLOUDSQL_INSTANCE_" + env),
+		FilesBackend:     envOrDefault("FILES_BACKEND_"+env, filesBackend),
+		TargetHost:       os.Getenv("TARGET_HOST_" + env),
+		TargetUser:       os.Getenv("TARGET_USER_" + env),
+		TargetPath:       os.Getenv("TARGET_PATH_" + env),
+
+		SSHPort:           envOrDefault("SSH_PORT_"+env, envOrDefault("SSH_PORT", "22")),
+		SSHIdentityFile:   envOrDefault("SSH_IDENTITY_FILE_"+env, os.Getenv("SSH_IDENTITY_FILE")),
+		SSHKnownHostsFile: envOrDefault("SSH_KNOWN_HOSTS", "~/.ssh/known_hosts"),
+		SSHChecksum:       os.Getenv("SSH_CHECKSUM") == "true",
+
+		DBExportMode:           envOrDefault("DB_EXPORT_MODE_"+env, DBExportModeAdmin),
+		DBImportMode:           envOrDefault("DB_IMPORT_MODE_"+env, DBImportModeAdmin),
+		CloudSQLConnectionName: os.Getenv("CLOUDSQL_CONNECTION_NAME_" + env),
+		DBHost:                 os.Getenv("DB_HOST_" + env),
+		DBPort:                 os.Getenv("DB_PORT_" + env),
+		DBUser:                 os.Getenv("DB_USER_" + env),
+		DBPassword:             os.Getenv("DB_PASSWORD_" + env),
+		DBPrivateIP:            os.Getenv("CLOUDSQL_PRIVATE_IP") == "true",
+		DBIAMAuth:              os.Getenv("CLOUDSQL_IAM_AUTH") == "true",
+
+		CloudSQLOperationTimeout: operationTimeout,
+
+		ArchiveCompression:      envOrDefault("BACKUP_COMPRESSION_"+env, envOrDefault("BACKUP_COMPRESSION", CompressionGzip)),
+		ArchiveCompressionLevel: compressionLevel,
+
+		EncryptionRecipients:     envOrDefault("BACKUP_ENCRYPTION_RECIPIENTS_"+env, os.Getenv("BACKUP_ENCRYPTION_RECIPIENTS")),
+		EncryptionRecipientsFile: envOrDefault("BACKUP_ENCRYPTION_RECIPIENTS_FILE_"+env, os.Getenv("BACKUP_ENCRYPTION_RECIPIENTS_FILE")),
+		EncryptionIdentityFile:   envOrDefault("BACKUP_ENCRYPTION_IDENTITY_FILE_"+env, os.Getenv("BACKUP_ENCRYPTION_IDENTITY_FILE")),
+		EncryptionIdentity:       envOrDefault("BACKUP_ENCRYPTION_IDENTITY_"+env, os.Getenv("BACKUP_ENCRYPTION_IDENTITY")),
+		EncryptionChunkKeyFile:   envOrDefault("BACKUP_ENCRYPTION_CHUNK_KEY_FILE_"+env, os.Getenv("BACKUP_ENCRYPTION_CHUNK_KEY_FILE")),
+		EncryptionChunkKey:       envOrDefault("BACKUP_ENCRYPTION_CHUNK_KEY_"+env, os.Getenv("BACKUP_ENCRYPTION_CHUNK_KEY")),
+
+		SigningKeyFile:  envOrDefault("BACKUP_SIGNING_KEY_FILE_"+env, os.Getenv("BACKUP_SIGNING_KEY_FILE")),
+		SigningKey:      envOrDefault("BACKUP_SIGNING_KEY_"+env, os.Getenv("BACKUP_SIGNING_KEY")),
+		TrustedKeys:     envOrDefault("BACKUP_TRUSTED_KEYS_"+env, os.Getenv("BACKUP_TRUSTED_KEYS")),
+		TrustedKeysFile: envOrDefault("BACKUP_TRUSTED_KEYS_FILE_"+env, os.Getenv("BACKUP_TRUSTED_KEYS_FILE")),
+
+		FullBackups: fullBackups,
+		BackupMode:  envOrDefault("BACKUP_MODE_"+env, envOrDefault("BACKUP_MODE", BackupModeArchive)),
+
+		FilesInclude: envOrDefault("BACKUP_FILES_INCLUDE_"+env, os.Getenv("BACKUP_FILES_INCLUDE")),
+		FilesExclude: envOrDefault("BACKUP_FILES_EXCLUDE_"+env, os.Getenv("BACKUP_FILES_EXCLUDE")),
+
+		ExtractMaxEntries: extractMaxEntries,
+		ExtractMaxSize:    extractMaxSize,
+	}
+
+	if err := cfg.Validate(environment); err != nil {
+		return nil, fmt.Errorf("invalid %s environment configuration: %v", environment, err)
+	}
+
+	// Return the typed config
+	return cfg, nil
+}
+
+// Validate checks that every setting needed by the configured database, file
+// and archive backends of the environment is present.
+func (c *EnvironmentConfig) Validate(environment string) error {
+	env := strings.ToUpper(environment)
+
+	if c.DBName == "" {
+		return fmt.Errorf("missing configuration DB_NAME_%s", env)
+	}
+
+	switch c.DBBackend {
+	case DBBackendCloudSQL:
+		if c.GCPProjectID == "" {
+			return fmt.Errorf("missing configuration GCP_PROJECT_ID")
+		}
+		if c.CloudSQLInstance == "" {
+			return fmt.Errorf("missing configuration CLOUDSQL_INSTANCE_%s", env)
+		}
+		switch c.DBExportMode {
+		case "", DBExportModeAdmin, DBExportModeDirect:
+		default:
+			return fmt.Errorf("unknown database export mode '%s' for DB_EXPORT_MODE_%s", c.DBExportMode, env)
+		}
+		switch c.DBImportMode {
+		case "", DBImportModeAdmin, DBImportModeDirect:
+		default:
+			return fmt.Errorf("unknown database import mode '%s' for DB_IMPORT_MODE_%s", c.DBImportMode, env)
+		}
+		if (c.DBExportMode == DBExportModeDirect || c.DBImportMode == DBImportModeDirect) && c.DBUser == "" {
+			return fmt.Errorf("missing configuration DB_USER_%s", env)
+		}
+		// Cloud SQL Admin API exports and imports are staged in the backup bucket
+		if (c.DBExportMode != DBExportModeDirect || c.DBImportMode != DBImportModeDirect) && c.BackupBucket == "" {
+			return fmt.Errorf("missing configuration BACKUP_BUCKET")
+		}
+		if c.CloudSQLOperationTimeout < 0 {
+			return fmt.Errorf("CLOUDSQL_OPERATION_TIMEOUT must not be negative")
+		}
+	case DBBackendLocal:
+	case DBBackendPostgres:
+		if c.DBHost == "" {
+			return fmt.Errorf("missing configuration DB_HOST_%s", env)
+		}
+		if c.DBUser == "" {
+			return fmt.Errorf("missing configuration DB_USER_%s", env)
+		}
+	default:
+		return fmt.Errorf("unknown database backend '%s' for DB_BACKEND_%s", c.DBBackend, env)
+	}
 
-	cfg.BackupBucket = os.Getenv("BACKUP_BUCKET")
-	if cfg.BackupBucket == "" {
-		return nil, fmt.Errorf("missing configuration BACKUP_BUCKET")
+	switch c.FilesBackend {
+	case FilesBackendSSH, FilesBackendRsync:
+		if c.TargetHost == "" {
+			return fmt.Errorf("missing configuration TARGET_HOST_%s", env)
+		}
+		if c.TargetUser == "" {
+			return fmt.Errorf("missing configuration TARGET_USER_%s", env)
+		}
+	case FilesBackendLocal:
+	default:
+		return fmt.Errorf("unknown files backend '%s' for FILES_BACKEND_%s", c.FilesBackend, env)
+	}
+	if c.TargetPath == "" {
+		return fmt.Errorf("missing configuration TARGET_PATH_%s", env)
 	}
 
-	dbName := os.Getenv(fmt.Sprintf("DB_NAME_%s", strings.ToUpper(environment)))
-	if dbName == "" {
-		return nil, fmt.Errorf("missing configuration DB_NAME_%s", strings.ToUpper(environment))
+	if c.BackupURL == "" && c.BackupBucket == "" {
+		return fmt.Errorf("missing configuration BACKUP_BUCKET or BACKUP_URL")
+	}
+	switch archiveScheme(c.ArchiveBaseURL()) {
+	case "gs", "s3", "file":
+	default:
+		return fmt.Errorf("unsupported backup location %s, expected gs://, s3:// or file://", c.ArchiveBaseURL())
+	}
+	if err := validateCompression(c.ArchiveCompression, c.ArchiveCompressionLevel); err != nil {
+		return fmt.Errorf("invalid BACKUP_COMPRESSION_%s: %v", env, err)
+	}
+	if c.FullBackups < 0 {
+		return fmt.Errorf("BACKUP_FULL_EVERY_%s must not be negative", env)
+	}
+	switch c.BackupMode {
+	case "", BackupModeArchive, BackupModeChunks:
+	default:
+		return fmt.Errorf("unknown backup mode '%s' for BACKUP_MODE_%s, expected %s or %s", c.BackupMode, env, BackupModeArchive, BackupModeChunks)
+	}
+	encrypted := c.EncryptionRecipients != "" || c.EncryptionRecipientsFile != ""
+	if c.BackupMode == BackupModeChunks && encrypted && c.EncryptionChunkKey == "" && c.EncryptionChunkKeyFile == "" {
+		return fmt.Errorf("missing configuration BACKUP_ENCRYPTION_CHUNK_KEY_%s, encrypted chunks are named with it", env)
+	}
+	if _, err := c.FilesFilter(); err != nil {
+		return fmt.Errorf("invalid BACKUP_FILES_INCLUDE_%s or BACKUP_FILES_EXCLUDE_%s: %v", env, env, err)
+	}
+	if c.ExtractMaxEntries < 0 || c.ExtractMaxSize < 0 {
+		return fmt.Errorf("BACKUP_EXTRACT_MAX_ENTRIES and BACKUP_EXTRACT_MAX_SIZE must not be negative")
 	}
-	cfg.DBName = dbName
 
-	gcpProjectID := os.Getenv("GCP_PROJECT_ID")
-	if gcpProjectID == "" {
-		return nil, fmt.Errorf("missing configuration GCP_PROJECT_ID")
+	return nil
+}
+
+// FullBackupInterval returns the number of runs after which a full backup is
+// forced
+func (c *EnvironmentConfig) FullBackupInterval() int {
+	if c.FullBackups <= 0 {
+		return DefaultFullBackupInterval
 	}
-	cfg.GCPProjectID = gcpProjectID
+	return c.FullBackups
+}
 
-	cloudSQLInstance := os.Getenv(fmt.Sprintf("CLOUDSQL_INSTANCE_%s", strings.ToUpper(environment)))
-	if cloudSQLInstance == "" {
-		return nil, fmt.Errorf("missing configuration CLOUDSQL_INSTANCE_%s", strings.ToUpper(environment))
+// FilesFilter returns the filter selecting the files to back up, nil when
+// every file is backed up
+func (c *EnvironmentConfig) FilesFilter() (*PathFilter, error) {
+	return NewPathFilter(splitPatterns(c.FilesInclude), splitPatterns(c.FilesExclude))
+}
+
+// ExtractLimits returns the limits for extracting archives on restore
+func (c *EnvironmentConfig) ExtractLimits() ExtractLimits {
+	return ExtractLimits{MaxEntries: c.ExtractMaxEntries, MaxSize: c.ExtractMaxSize}
+}
+
+// extractLimitsFromEnv reads BACKUP_EXTRACT_MAX_ENTRIES and
+// BACKUP_EXTRACT_MAX_SIZE
+func extractLimitsFromEnv() (int, int64, error) {
+	var maxEntries int
+	var maxSize int64
+	if value := os.Getenv("BACKUP_EXTRACT_MAX_ENTRIES"); value != "" {
+		entries, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid BACKUP_EXTRACT_MAX_ENTRIES '%s': %v", value, err)
+		}
+		maxEntries = entries
 	}
-	cfg.CloudSQLInstance = cloudSQLInstance
+	if value := os.Getenv("BACKUP_EXTRACT_MAX_SIZE"); value != "" {
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid BACKUP_EXTRACT_MAX_SIZE '%s': %v", value, err)
+		}
+		maxSize = size
+	}
+	return maxEntries, maxSize, nil
+}
 
-	targetHost := os.Getenv(fmt.Sprintf("TARGET_HOST_%s", strings.ToUpper(environment)))
-	if targetHost == "" {
-		return nil, fmt.Errorf("missing configuration TARGET_HOST_%s", strings.ToUpper(environment))
+// ParseByteSize parses a size in bytes with an optional binary unit suffix,
+// K, M, G or T in either case, e.g. 1048576, 512M or 100G
+func ParseByteSize(value string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	number, multiplier := strings.TrimSpace(value), int64(1)
+	for suffix, unit := range units {
+		if trimmed, ok := strings.CutSuffix(strings.ToUpper(number), suffix); ok {
+			number, multiplier = trimmed, unit
+			break
+		}
 	}
-	cfg.TargetHost = targetHost
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("size %s is too large", value)
+	}
+	return size * multiplier, nil
+}
 
-	targetUser := os.Getenv(fmt.Sprintf("TARGET_USER_%s", strings.ToUpper(environment)))
-	if targetUser == "" {
-		return nil, fmt.Errorf("missing configuration TARGET_USER_%s", strings.ToUpper(environment))
+// ArchiveBaseURL returns the location under which backup archives are stored.
+// Archives go to BackupURL when configured, otherwise to the GCS backup bucket.
+func (c *EnvironmentConfig) ArchiveBaseURL() string {
+	if c.BackupURL != "" {
+		return strings.TrimSuffix(c.BackupURL, "/")
 	}
-	cfg.TargetUser = targetUser
+	return "gs://" + c.BackupBucket
+}
 
-	targetPath := os.Getenv(fmt.Sprintf("TARGET_PATH_%s", strings.ToUpper(environment)))
-	if targetPath == "" {
-		return nil, fmt.Errorf("missing configuration TARGET_PATH_%s", strings.ToUpper(environment))
+// archiveScheme returns the scheme of an archive URL, e.g. "gs" for gs://bucket/key
+func archiveScheme(url string) string {
+	scheme, _, found := strings.Cut(url, "://")
+	if !found {
+		return ""
 	}
-	cfg.TargetPath = targetPath
+	return scheme
+}
 
-	// Return the typed config
-	return cfg, nil
+func envOrDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// S3Config holds the connection settings for an S3-compatible archive store
+// such as AWS S3, MinIO or Wasabi.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Insecure        bool
+}
+
+func s3ConfigFromEnv() S3Config {
+	cfg := S3Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		Insecure:        os.Getenv("S3_INSECURE") == "true",
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "s3.amazonaws.com"
+	}
+	return cfg
+}
+
+// LocalDBConfig holds the connection settings of the MySQL server used by the
+// local backend, e.g. the one started by local/docker-compose.yaml.
+type LocalDBConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+}
+
+func localDBConfigFromEnv() LocalDBConfig {
+	cfg := LocalDBConfig{
+		Host:     os.Getenv("LOCAL_DB_HOST"),
+		Port:     os.Getenv("LOCAL_DB_PORT"),
+		User:     os.Getenv("LOCAL_DB_USER"),
+		Password: os.Getenv("LOCAL_DB_PASSWORD"),
+	}
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Port == "" {
+		cfg.Port = "3306"
+	}
+	if cfg.User == "" {
+		cfg.User = "root"
+	}
+	return cfg
 }
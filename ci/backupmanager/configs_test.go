@@ -0,0 +1,51 @@
+package backupmanager
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadEnvironmentConfigsLocalBackend(t *testing.T) {
+	t.Setenv("ENVIRONMENTS", "staging, production")
+	t.Setenv("BACKUP_BACKEND", "local")
+	t.Setenv("BACKUP_URL", "file:///tmp/backups")
+	t.Setenv("DB_NAME_STAGING", "staging")
+	t.Setenv("TARGET_PATH_STAGING", "/srv/staging")
+	t.Setenv("DB_NAME_PRODUCTION", "production")
+	t.Setenv("TARGET_PATH_PRODUCTION", "/srv/production")
+	t.Setenv("FILES_BACKEND_PRODUCTION", FilesBackendSSH)
+	t.Setenv("TARGET_HOST_PRODUCTION", "files.example.org")
+	t.Setenv("TARGET_USER_PRODUCTION", "deployer")
+	t.Setenv("BACKUP_COMPRESSION", CompressionGzip)
+	t.Setenv("BACKUP_COMPRESSION_PRODUCTION", CompressionZstd)
+
+	configs, err := LoadEnvironmentConfigs()
+	if err != nil {
+		t.Fatalf("LoadEnvironmentConfigs: %v", err)
+	}
+	staging, production := configs["staging"], configs["production"]
+	if staging == nil || production == nil {
+		t.Fatalf("expected staging and production configs, got %v", configs)
+	}
+	if staging.DBBackend != DBBackendLocal || staging.FilesBackend != FilesBackendLocal {
+		t.Errorf("staging backends = %s/%s, want local/local", staging.DBBackend, staging.FilesBackend)
+	}
+	if production.DBBackend != DBBackendLocal || production.FilesBackend != FilesBackendSSH {
+		t.Errorf("production backends = %s/%s, want local/ssh", production.DBBackend, production.FilesBackend)
+	}
+	if staging.ArchiveCompression != CompressionGzip || production.ArchiveCompression != CompressionZstd {
+		t.Errorf("compression = %s/%s, want gzip/zstd", staging.ArchiveCompression, production.ArchiveCompression)
+	}
+}
+
+func TestLoadEnvironmentConfigsInvalid(t *testing.T) {
+	t.Setenv("ENVIRONMENTS", "staging")
+	t.Setenv("BACKUP_BACKEND", "local")
+	t.Setenv("BACKUP_URL", "file:///tmp/backups")
+	t.Setenv("TARGET_PATH_STAGING", "/srv/staging")
+
+	_, err := LoadEnvironmentConfigs()
+	if err == nil || !strings.Contains(err.Error(), "invalid staging environment configuration") {
+		t.Fatalf("expected an invalid staging configuration error, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package backupmanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// ageHeader starts every age encrypted file
+const ageHeader = "age-encryption.org/v1\n"
+
+// ArchiveEncryption holds the age recipients backup archives are encrypted
+// for before they are uploaded and the identities that decrypt them again.
+// Every recipient can decrypt an archive on its own, so several team members
+// can restore backups with their own keys. ChunkKey is the secret encrypted
+// chunks of the chunk store are named with, see chunkStore.
+type ArchiveEncryption struct {
+	Recipients []age.Recipient
+	Identities []age.Identity
+	ChunkKey   []byte
+}
+
+// minChunkKeySize is the smallest chunk key accepted, in bytes
+const minChunkKeySize = 32
+
+// DecryptionKeyError reports an encrypted archive that can't be decrypted
+// because no identity is configured or none of them is one of its recipients
+type DecryptionKeyError struct {
+	Archive    string
+	Identities int
+}
+
+func (e *DecryptionKeyError) Error() string {
+	if e.Identities == 0 {
+		return fmt.Sprintf("archive %s is encrypted, but no decryption key is configured, "+
+			"set BACKUP_ENCRYPTION_IDENTITY_FILE or BACKUP_ENCRYPTION_IDENTITY", e.Archive)
+	}
+	return fmt.Sprintf("archive %s is encrypted, but none of the %d configured decryption keys is one of its recipients",
+		e.Archive, e.Identities)
+}
+
+// newArchiveEncryption parses the recipients and identities configured for an
+// environment along with its chunk key. It returns nil when none of them are
+// configured.
+func newArchiveEncryption(envConfig *EnvironmentConfig) (*ArchiveEncryption, error) {
+	encryption := &ArchiveEncryption{}
+
+	recipients := splitRecipients(envConfig.EncryptionRecipients)
+	if envConfig.EncryptionRecipientsFile != "" {
+		data, err := os.ReadFile(expandHome(envConfig.EncryptionRecipientsFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recipients file: %v", err)
+		}
+		recipients = append(recipients, splitRecipients(string(data))...)
+	}
+	for _, recipient := range recipients {
+		parsed, err := parseRecipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+		encryption.Recipients = append(encryption.Recipients, parsed)
+	}
+
+	if envConfig.EncryptionIdentityFile != "" {
+		data, err := os.ReadFile(expandHome(envConfig.EncryptionIdentityFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity file: %v", err)
+		}
+		identities, err := parseIdentities(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %v", envConfig.EncryptionIdentityFile, err)
+		}
+		encryption.Identities = append(encryption.Identities, identities...)
+	}
+	if envConfig.EncryptionIdentity != "" {
+		identities, err := parseIdentities([]byte(envConfig.EncryptionIdentity))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity in BACKUP_ENCRYPTION_IDENTITY: %v", err)
+		}
+		encryption.Identities = append(encryption.Identities, identities...)
+	}
+
+	chunkKey := envConfig.EncryptionChunkKey
+	if envConfig.EncryptionChunkKeyFile != "" {
+		data, err := os.ReadFile(expandHome(envConfig.EncryptionChunkKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk key file: %v", err)
+		}
+		chunkKey = string(data)
+	}
+	if chunkKey = strings.TrimSpace(chunkKey); chunkKey != "" {
+		if len(chunkKey) < minChunkKeySize {
+			return nil, fmt.Errorf("chunk key has %d bytes, expected at least %d", len(chunkKey), minChunkKeySize)
+		}
+		encryption.ChunkKey = []byte(chunkKey)
+	}
+
+	if len(encryption.Recipients) == 0 && len(encryption.Identities) == 0 && len(encryption.ChunkKey) == 0 {
+		return nil, nil
+	}
+	return encryption, nil
+}
+
+// splitRecipients splits a comma or newline separated list of recipients,
+// skipping empty lines and # comments
+func splitRecipients(list string) []string {
+	var recipients []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// SSH public keys contain spaces, but never commas
+		for _, recipient := range strings.Split(line, ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				recipients = append(recipients, recipient)
+			}
+		}
+	}
+	return recipients
+}
+
+// parseRecipient parses an age public key (age1...) or an SSH public key
+// (ssh-ed25519 or ssh-rsa)
+func parseRecipient(recipient string) (age.Recipient, error) {
+	if strings.HasPrefix(recipient, "ssh-") {
+		parsed, err := agessh.ParseRecipient(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption recipient: %v", err)
+		}
+		// The comment after the key doesn't change the recipient
+		key := strings.Join(strings.Fields(recipient)[:2], " ")
+		return &sshRecipient{Recipient: parsed, key: key}, nil
+	}
+	parsed, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption recipient '%s': %v", recipient, err)
+	}
+	return parsed, nil
+}
+
+// sshRecipient is an SSH public key recipient along with its key, which the
+// agessh recipients don't return
+type sshRecipient struct {
+	age.Recipient
+	key string
+}
+
+func (r *sshRecipient) String() string {
+	return r.key
+}
+
+// parseIdentities parses age secret keys (AGE-SECRET-KEY-1...), one per line,
+// or an unencrypted SSH private key in PEM format
+func parseIdentities(data []byte) ([]age.Identity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH private key: %v", err)
+		}
+		return []age.Identity{identity}, nil
+	}
+	return age.ParseIdentities(bytes.NewReader(data))
+}
+
+// CanEncrypt reports whether archives are encrypted before upload
+func (e *ArchiveEncryption) CanEncrypt() bool {
+	return e != nil && len(e.Recipients) > 0
+}
+
+// recipientsFingerprint identifies the recipients archives are encrypted
+// for, whatever their order, as the first 16 bytes of the SHA-256 checksum of
+// their keys. It is "unencrypted" when archives aren't encrypted.
+func (e *ArchiveEncryption) recipientsFingerprint() (string, error) {
+	if !e.CanEncrypt() {
+		return "unencrypted", nil
+	}
+	var keys []string
+	for _, recipient := range e.Recipients {
+		key, ok := recipient.(fmt.Stringer)
+		if !ok {
+			return "", fmt.Errorf("recipient %T has no key to identify it by", recipient)
+		}
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	keys = slices.Compact(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// NewEncryptingWriter encrypts everything written to it into w for all
+// recipients. Closing it writes the last chunk, but doesn't close w.
+func (e *ArchiveEncryption) NewEncryptingWriter(w io.Writer) (io.WriteCloser, error) {
+	encrypter, err := age.Encrypt(w, e.Recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start encryption: %v", err)
+	}
+	return encrypter, nil
+}
+
+// NewDecryptingReader returns a reader of the archive stream r that decrypts
+// it when it is age encrypted, and reports whether it was. Archives keep
+// their name when encrypted, so they are told apart by their header. age
+// authenticates every chunk, so reads of a corrupted or truncated archive fail
+// instead of producing a damaged tar. A missing or wrong key results in a
+// DecryptionKeyError.
+func (e *ArchiveEncryption) NewDecryptingReader(r io.Reader, archive string) (io.Reader, bool, error) {
+	buffered := bufio.NewReaderSize(r, sqlDumpChunkSize)
+	header, err := buffered.Peek(len(ageHeader))
+	if err != nil && err != io.EOF {
+		return nil, false, fmt.Errorf("failed to read archive: %v", err)
+	}
+	if string(header) != ageHeader {
+		return buffered, false, nil
+	}
+	decrypter, err := e.decrypt(buffered, archive)
+	if err != nil {
+		return nil, true, err
+	}
+	return decrypter, true, nil
+}
+
+// decrypt starts decrypting an encrypted archive with the configured
+// identities
+func (e *ArchiveEncryption) decrypt(r io.Reader, archive string) (io.Reader, error) {
+	var identities []age.Identity
+	if e != nil {
+		identities = e.Identities
+	}
+	if len(identities) == 0 {
+		return nil, &DecryptionKeyError{Archive: archive}
+	}
+
+	decrypter, err := age.Decrypt(r, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, &DecryptionKeyError{Archive: archive, Identities: len(identities)}
+		}
+		return nil, fmt.Errorf("failed to decrypt archive: %v", err)
+	}
+	return decrypter, nil
+}
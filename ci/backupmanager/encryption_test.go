@@ -0,0 +1,249 @@
+package backupmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	return identity
+}
+
+// encryptTestArchive encrypts a test archive as it streams into the
+// archive store and returns the plain and the encrypted archive
+func encryptTestArchive(t *testing.T, encryption *ArchiveEncryption) ([]byte, []byte) {
+	t.Helper()
+	archivePath, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	plain, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	var encrypted bytes.Buffer
+	writer, err := encryption.NewEncryptingWriter(&encrypted)
+	if err != nil {
+		t.Fatalf("NewEncryptingWriter failed: %v", err)
+	}
+	if _, err := writer.Write(plain); err != nil {
+		t.Fatalf("failed to encrypt archive: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to encrypt archive: %v", err)
+	}
+	return plain, encrypted.Bytes()
+}
+
+// decryptTestArchive reads an archive through NewDecryptingReader and
+// reports whether it was encrypted
+func decryptTestArchive(keys *ArchiveEncryption, archive []byte) ([]byte, bool, error) {
+	reader, encrypted, err := keys.NewDecryptingReader(bytes.NewReader(archive), "backup.tar.gz")
+	if err != nil {
+		return nil, encrypted, err
+	}
+	decrypted, err := io.ReadAll(reader)
+	return decrypted, encrypted, err
+}
+
+func TestEncryptArchiveForMultipleRecipients(t *testing.T) {
+	alice, bob := generateIdentity(t), generateIdentity(t)
+	encryption := &ArchiveEncryption{Recipients: []age.Recipient{alice.Recipient(), bob.Recipient()}}
+	plain, encrypted := encryptTestArchive(t, encryption)
+
+	// Plain archives pass through unchanged, without any keys
+	if read, wasEncrypted, err := decryptTestArchive(nil, plain); err != nil || wasEncrypted || !bytes.Equal(read, plain) {
+		t.Fatalf("plain archive not passed through: encrypted %v, %v", wasEncrypted, err)
+	}
+
+	for name, identity := range map[string]*age.X25519Identity{"alice": alice, "bob": bob} {
+		keys := &ArchiveEncryption{Identities: []age.Identity{identity}}
+		decrypted, wasEncrypted, err := decryptTestArchive(keys, encrypted)
+		if err != nil || !wasEncrypted {
+			t.Fatalf("%s can't decrypt the archive: encrypted %v, %v", name, wasEncrypted, err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("%s decrypted a different archive", name)
+		}
+	}
+}
+
+func TestDecryptArchiveWithoutKey(t *testing.T) {
+	encryption := &ArchiveEncryption{Recipients: []age.Recipient{generateIdentity(t).Recipient()}}
+	_, encrypted := encryptTestArchive(t, encryption)
+
+	var keyErr *DecryptionKeyError
+	for name, keys := range map[string]*ArchiveEncryption{
+		"no encryption":  nil,
+		"no identities":  {Recipients: encryption.Recipients},
+		"wrong identity": {Identities: []age.Identity{generateIdentity(t), generateIdentity(t)}},
+	} {
+		_, wasEncrypted, err := decryptTestArchive(keys, encrypted)
+		if !errors.As(err, &keyErr) || !wasEncrypted {
+			t.Errorf("%s: expected a DecryptionKeyError, got encrypted %v, %v", name, wasEncrypted, err)
+			continue
+		}
+		if name == "wrong identity" && !strings.Contains(err.Error(), "none of the 2 configured decryption keys") {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if name != "wrong identity" && !strings.Contains(err.Error(), "BACKUP_ENCRYPTION_IDENTITY") {
+			t.Errorf("%s: error should name the settings: %v", name, err)
+		}
+	}
+}
+
+func TestDecryptCorruptedArchive(t *testing.T) {
+	identity := generateIdentity(t)
+	encryption := &ArchiveEncryption{Recipients: []age.Recipient{identity.Recipient()}, Identities: []age.Identity{identity}}
+	_, data := encryptTestArchive(t, encryption)
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)-100] ^= 0x01
+	for name, content := range map[string][]byte{"truncated": data[:len(data)-20], "flipped": flipped} {
+		_, _, err := decryptTestArchive(encryption, content)
+		var keyErr *DecryptionKeyError
+		if err == nil || errors.As(err, &keyErr) {
+			t.Errorf("%s archive should fail to decrypt, got %v", name, err)
+		}
+	}
+}
+
+func TestNewArchiveEncryption(t *testing.T) {
+	alice, bob := generateIdentity(t), generateIdentity(t)
+
+	// SSH keys of team members work as recipients and identities
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate SSH key: %v", err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("failed to convert SSH key: %v", err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatalf("failed to marshal SSH key: %v", err)
+	}
+
+	tmpFolder := t.TempDir()
+	recipientsFile := filepath.Join(tmpFolder, "recipients.txt")
+	mustWriteFile(t, recipientsFile, "# Carol\n"+string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+	identityFile := filepath.Join(tmpFolder, "id_ed25519")
+	mustWriteFile(t, identityFile, string(pem.EncodeToMemory(pemBlock)))
+
+	encryption, err := newArchiveEncryption(&EnvironmentConfig{
+		EncryptionRecipients:     alice.Recipient().String() + ",\n" + bob.Recipient().String(),
+		EncryptionRecipientsFile: recipientsFile,
+		EncryptionIdentityFile:   identityFile,
+		EncryptionIdentity:       "# Alice\n" + alice.String(),
+	})
+	if err != nil {
+		t.Fatalf("newArchiveEncryption failed: %v", err)
+	}
+	if len(encryption.Recipients) != 3 || len(encryption.Identities) != 2 {
+		t.Fatalf("expected 3 recipients and 2 identities, got %d and %d", len(encryption.Recipients), len(encryption.Identities))
+	}
+
+	// The SSH key decrypts on its own
+	_, encrypted := encryptTestArchive(t, encryption)
+	sshOnly := &ArchiveEncryption{Identities: encryption.Identities[:1]}
+	if _, _, err := decryptTestArchive(sshOnly, encrypted); err != nil {
+		t.Errorf("SSH identity can't decrypt the archive: %v", err)
+	}
+
+	// Chunk sets are named after the recipients, whatever their order or the
+	// comments of SSH keys
+	fingerprint, err := encryption.recipientsFingerprint()
+	if err != nil {
+		t.Fatalf("recipientsFingerprint failed: %v", err)
+	}
+	reordered, err := newArchiveEncryption(&EnvironmentConfig{
+		EncryptionRecipients: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))) + " carol@laptop\n" +
+			bob.Recipient().String() + "," + alice.Recipient().String(),
+	})
+	if err != nil {
+		t.Fatalf("newArchiveEncryption failed: %v", err)
+	}
+	if other, err := reordered.recipientsFingerprint(); err != nil || other != fingerprint {
+		t.Errorf("same recipients should have the same fingerprint, got %s and %s, %v", fingerprint, other, err)
+	}
+	reordered.Recipients = reordered.Recipients[1:]
+	if other, _ := reordered.recipientsFingerprint(); other == fingerprint || !isChunkSetName(other) {
+		t.Errorf("other recipients should have another fingerprint, got %s", other)
+	}
+
+	if encryption, err := newArchiveEncryption(&EnvironmentConfig{}); err != nil || encryption != nil {
+		t.Errorf("no keys should disable encryption, got %v, %v", encryption, err)
+	}
+	for name, config := range map[string]*EnvironmentConfig{
+		"bad recipient":      {EncryptionRecipients: "age1notakey"},
+		"bad identity":       {EncryptionIdentity: "AGE-SECRET-KEY-1NOTAKEY"},
+		"missing identities": {EncryptionIdentityFile: filepath.Join(tmpFolder, "missing")},
+	} {
+		if _, err := newArchiveEncryption(config); err == nil {
+			t.Errorf("%s should be rejected", name)
+		}
+	}
+}
+
+func TestEncryptedBackupAndRestore(t *testing.T) {
+	alice, bob := generateIdentity(t), generateIdentity(t)
+	backend := NewMockBackend()
+	backend.uploadedArchive = filepath.Join(t.TempDir(), "uploaded.tar.gz")
+	engine := newMockEngine(backend, mockConfigs())
+	for _, backends := range engine.backends {
+		backends.Encryption = &ArchiveEncryption{
+			Recipients: []age.Recipient{alice.Recipient(), bob.Recipient()},
+			Identities: []age.Identity{bob},
+		}
+	}
+
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-encrypted"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	uploaded, err := os.ReadFile(backend.uploadedArchive)
+	if err != nil {
+		t.Fatalf("failed to read uploaded archive: %v", err)
+	}
+	if _, encrypted, _ := decryptTestArchive(nil, uploaded); !encrypted {
+		t.Fatalf("uploaded archive should be encrypted")
+	}
+
+	backend.archiveToServe = backend.uploadedArchive
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-encrypted", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-encrypted")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"encryption": CheckPassed, "checksums": CheckPassed})
+
+	// Without a matching key the restore stops before the database is touched
+	backend.importedConfig = nil
+	engine.backends["staging"].Encryption = &ArchiveEncryption{Identities: []age.Identity{generateIdentity(t)}}
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-encrypted", "production", RestoreOptions{AllowUnsigned: true})
+	if err == nil || !strings.Contains(err.Error(), "none of the 1 configured decryption keys") {
+		t.Errorf("restore with the wrong key should fail, got %v", err)
+	}
+	if backend.importedConfig != nil {
+		t.Errorf("database should not be imported when the archive can't be decrypted")
+	}
+	if _, err := engine.VerifyBackup(context.Background(), "staging", "test-run-encrypted"); err == nil {
+		t.Errorf("verify with the wrong key should fail")
+	}
+}
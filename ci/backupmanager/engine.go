@@ -2,93 +2,292 @@ package backupmanager
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"path"
+	"strings"
+	"time"
 )
 
-type BackupBackend interface {
+// DatabaseBackend exports and imports the database of an environment.
+// DatabaseEngine names the engine of the dumps it writes and reads, e.g.
+// DatabaseEngineMySQL. ExportDatabase writes the dump to out as it is
+// produced and ImportDatabase reads it from dump as it is imported, neither
+// stores it locally. Cancelling the context stops a running export or
+// import.
+type DatabaseBackend interface {
+	DatabaseEngine() string
+	ExportDatabase(ctx context.Context, envConfig *EnvironmentConfig, out io.Writer) error
+	ImportDatabase(ctx context.Context, dump io.Reader, envConfig *EnvironmentConfig, sourceConfig *EnvironmentConfig) error
+}
+
+// FileBackend transfers the files directory of an environment
+type FileBackend interface {
 	DownloadFolder(envConfig *EnvironmentConfig, destination string) error
-	ExportDatabase(databaseName string, dumpPath string) error
-	UploadArchive(archivePath string, destination string) error
-	DownloadArchive(archivePath string, destination string) error
-	ImportDatabase(databaseName string, dumpPath string) error
-	UploadFolder(source string, envConfig *EnvironmentConfig) error
+	UploadFolder(source string, envConfig *EnvironmentConfig, filter *PathFilter) error
+}
+
+// ArchiveStore stores and retrieves backup archives. ListArchives returns the
+// URLs of the stored archives starting with the given URL prefix, including
+// those in folders below it. NewArchiveWriter and NewArchiveReader stream an
+// archive into and out of the store without a local copy.
+type ArchiveStore interface {
+	ListArchives(prefix string) ([]string, error)
+	DeleteArchive(url string) error
+	NewArchiveWriter(ctx context.Context, destination string) (ArchiveWriter, error)
+	NewArchiveReader(ctx context.Context, source string) (io.ReadCloser, error)
+}
+
+// ArchiveWriter streams an archive into an archive store. The archive is only
+// stored once Close succeeds, Abort discards everything written so far.
+type ArchiveWriter interface {
+	io.WriteCloser
+	Abort(err error)
+}
+
+// EnvironmentBackends are the backends used for a single environment.
+// Encryption is nil when archives of the environment aren't encrypted,
+// Signing when no signing or trusted keys are configured.
+type EnvironmentBackends struct {
+	Database   DatabaseBackend
+	Files      FileBackend
+	Archives   ArchiveStore
+	Encryption *ArchiveEncryption
+	Signing    *ArchiveSigning
 }
 
+// Parts of a backup a restore can be limited to, see RestoreOptions
+const (
+	RestoreDatabase = "db"
+	RestoreFiles    = "files"
+)
+
+// RestoreOptions change how PerformRestore treats a backup
+type RestoreOptions struct {
+	// AllowUnsigned restores archives that aren't signed by a key the
+	// destination environment trusts, or don't match their signature,
+	// with a warning instead of refusing them
+	AllowUnsigned bool
+
+	// Only limits the restore to the database, RestoreDatabase, or to the
+	// files, RestoreFiles. Both are restored when it is empty.
+	Only string
+
+	// Paths limits the files restored to those it selects. Files it doesn't
+	// select are left untouched on the destination, they are neither
+	// replaced nor deleted.
+	Paths *PathFilter
+}
+
+// validate rejects unknown parts and paths for restores without files
+func (o RestoreOptions) validate() error {
+	switch o.Only {
+	case "", RestoreDatabase, RestoreFiles:
+	default:
+		return fmt.Errorf("unknown part to restore '%s', must be %s or %s", o.Only, RestoreDatabase, RestoreFiles)
+	}
+	if o.Paths != nil && !o.restoresFiles() {
+		return fmt.Errorf("paths can't be selected when only the database is restored")
+	}
+	return nil
+}
+
+// restoresDatabase reports whether the database of the backup is restored
+func (o RestoreOptions) restoresDatabase() bool {
+	return o.Only != RestoreFiles
+}
+
+// restoresFiles reports whether files of the backup are restored
+func (o RestoreOptions) restoresFiles() bool {
+	return o.Only != RestoreDatabase
+}
+
+// include returns the include func of extractBackupStream for the entries
+// of an archive a restore needs. The database dump is never extracted, it is
+// streamed into the import, see dumpSource.
+func (o RestoreOptions) include() func(name string) bool {
+	return func(name string) bool {
+		switch {
+		case name == "db_dump.sql":
+			return false
+		case name == "files" || strings.HasPrefix(name, "files/"):
+			return o.restoresFiles() && o.Paths.Match(strings.TrimPrefix(strings.TrimPrefix(name, "files"), "/"))
+		}
+		return true
+	}
+}
+
+// dumpSource streams the database dump of a restored run into importDump.
+// The dump was checked along with the rest of the run, reading it fails when
+// it differs from what was checked.
+type dumpSource func(importDump func(dump io.Reader) error) error
+
 type BackupEngineCloud struct {
-	backupBackend BackupBackend
-	configs       EnvironmentConfigs
+	backends map[string]*EnvironmentBackends
+	configs  EnvironmentConfigs
 }
 
-func NewBackupEngineGcp(configs EnvironmentConfigs) *BackupEngineCloud {
-	backend := NewBackendGcp(configs)
+// NewBackupEngine creates an engine using the database, file and archive
+// backends configured for each environment
+func NewBackupEngine(configs EnvironmentConfigs) (*BackupEngineCloud, error) {
+	backends := make(map[string]*EnvironmentBackends)
+	for environment, envConfig := range configs {
+		envBackends, err := newEnvironmentBackends(envConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up backends for %s: %v", environment, err)
+		}
+		backends[environment] = envBackends
+	}
 	return &BackupEngineCloud{
-		backupBackend: backend,
-		configs:       configs,
+		backends: backends,
+		configs:  configs,
+	}, nil
+}
+
+func newEnvironmentBackends(envConfig *EnvironmentConfig) (*EnvironmentBackends, error) {
+	backends := &EnvironmentBackends{}
+
+	switch envConfig.DBBackend {
+	case DBBackendCloudSQL:
+		backends.Database = NewBackendCloudSQL()
+	case DBBackendLocal:
+		backends.Database = NewBackendLocal()
+	case DBBackendPostgres:
+		backends.Database = NewBackendPostgres()
+	default:
+		return nil, fmt.Errorf("unknown database backend: %s", envConfig.DBBackend)
+	}
+
+	switch envConfig.FilesBackend {
+	case FilesBackendSSH:
+		backends.Files = NewBackendSSH()
+	case FilesBackendRsync:
+		backends.Files = NewBackendRsync()
+	case FilesBackendLocal:
+		backends.Files = NewBackendLocal()
+	default:
+		return nil, fmt.Errorf("unknown files backend: %s", envConfig.FilesBackend)
+	}
+
+	// The archive store follows from the scheme of the backup location
+	switch archiveScheme(envConfig.ArchiveBaseURL()) {
+	case "gs":
+		backends.Archives = NewBackendGcs()
+	case "s3":
+		s3, err := NewBackendS3(s3ConfigFromEnv())
+		if err != nil {
+			return nil, err
+		}
+		backends.Archives = s3
+	case "file":
+		backends.Archives = NewBackendLocal()
+	default:
+		return nil, fmt.Errorf("unsupported backup location: %s", envConfig.ArchiveBaseURL())
 	}
+
+	// Keys are parsed up front, so a bad key fails before the backup starts
+	encryption, err := newArchiveEncryption(envConfig)
+	if err != nil {
+		return nil, err
+	}
+	backends.Encryption = encryption
+	signing, err := newArchiveSigning(envConfig)
+	if err != nil {
+		return nil, err
+	}
+	backends.Signing = signing
+
+	return backends, nil
 }
 
 // Will trigger a backup for the given environment and use the runId for tracking
 // purposes. A backup involves
-//  1. Sql dump environment specific database
-//  2. Copy files from environment specific storage bucket
-//  3. Create backup archive containig the sql dump and the copied files. Store the
-//     archive in a central backup bucket with a name containing the environment and runId
-func (e *BackupEngineCloud) PerformBackup(environment string, runId string) error {
+//  1. Sql dump environment specific database straight into the central
+//     backup bucket
+//  2. Stream an archive of the files of the environment to the bucket, the
+//     dump and the archive are separate artifacts in the folder of the run,
+//     backups/<environment>/<runId>/
+//  3. Store the file index of the run and the manifest listing the artifacts
+//     in the folder and record the run as the last one of the environment
+//
+// Backups are incremental: the full dump is stored, but the files archive
+// only holds the files that are new or changed since the last run, which the
+// run builds on.
+// A full backup is taken when no previous run is recorded or every
+// FullBackupInterval runs, see findParentRun.
+//
+// Environments in BackupModeChunks store the dump and the files as
+// deduplicated chunks and a snapshot of the run instead, every run restores
+// on its own and only the chunks not stored yet are uploaded, see
+// storeChunkedBackup.
+//
+// Nothing is stored locally. The dump goes from the database export and the
+// files from the file backend through the compression and encryption
+// straight into the archive store, so the runner doesn't need free disk
+// space for the dump, the files or the archive. File backends that can't
+// stream (rsync) download the files first.
+//
+// Only the files selected by the FilesInclude and FilesExclude patterns of the
+// environment are backed up, the patterns are recorded in the manifest.
+//
+// Cancelling the context, e.g. when the CLI is interrupted, stops the database
+// export and aborts the upload.
+func (e *BackupEngineCloud) PerformBackup(ctx context.Context, environment string, runId string) error {
 	Info("Starting backup for environment '%s' with run ID '%s'", environment, runId)
+	startedAt := time.Now().UTC()
 	// Get environment config
 	envConfig, ok := e.configs[environment]
 	if !ok {
 		Error("Unknown environment: %s", environment)
 		return fmt.Errorf("unknown environment: %s", environment)
 	}
-
-	tmpFolder := "/tmp/backup_" + runId
-	filesFolder := tmpFolder + "/files"
-	Info("Creating temporary folders at %s", tmpFolder)
-	err := os.MkdirAll(filesFolder, 0755)
+	backends := e.backends[environment]
+	filter, err := envConfig.FilesFilter()
 	if err != nil {
-		Error("Failed to create files folder: %v", err)
-		return fmt.Errorf("failed to create files folder: %v", err)
+		Error("Invalid file patterns: %v", err)
+		return fmt.Errorf("invalid file patterns: %v", err)
 	}
-
-	// Export database dump
-	dumpPath := tmpFolder + "/db_dump.sql"
-	databaseName := envConfig.DBName
-	Info("Step 1/4: Exporting database %s", databaseName)
-	err = e.backupBackend.ExportDatabase(databaseName, dumpPath)
-	if err != nil {
-		Error("ExportDatabase failed: %v", err)
-		return fmt.Errorf("ExportDatabase failed: %v", err)
+	if filter != nil {
+		Info("Backing up %s", filter)
 	}
 
-	// Download files from VM via rsync
-	Info("Step 2/4: Downloading files from VM via rsync")
-	err = e.backupBackend.DownloadFolder(envConfig, filesFolder)
+	// Only file backends that can't stream download the files to tmpFolder
+	tmpFolder := "/tmp/backup_" + runId
+	Info("Creating temporary folder at %s", tmpFolder)
+	err = os.MkdirAll(tmpFolder, 0755)
 	if err != nil {
-		Error("DownloadFolder failed: %v", err)
-		return fmt.Errorf("DownloadFolder failed: %v", err)
+		Error("Failed to create temporary folder: %v", err)
+		return fmt.Errorf("failed to create temporary folder: %v", err)
 	}
 
-	// Create backup archive
-	archivePath := tmpFolder + "/backup_archive.tar.gz"
-	Info("Step 3/4: Creating backup archive")
-	err = CreateBackupArchive(archivePath, dumpPath, filesFolder)
-	if err != nil {
-		Error("CreateBackupArchive failed: %v", err)
-		return fmt.Errorf("CreateBackupArchive failed: %v", err)
+	// Stream the dump and the files to the central backup bucket
+	manifest := &BackupManifest{
+		Environment:      environment,
+		RunID:            runId,
+		DatabaseName:     envConfig.DBName,
+		CloudSQLInstance: envConfig.CloudSQLInstance,
+		ToolVersion:      Version,
+		StartedAt:        startedAt,
+		DatabaseEngine:   backends.Database.DatabaseEngine(),
+		Compression:      envConfig.ArchiveCompression,
+		CompressionLevel: envConfig.ArchiveCompressionLevel,
 	}
-
-	// Upload archive to central backup bucket
-	destinationStoragePath := fmt.Sprintf("gs://%s/backups/%s/backup_%s.tar.gz", envConfig.BackupBucket, environment, runId)
-	Info("Step 4/4: Uploading archive to backup bucket")
-	err = e.backupBackend.UploadArchive(archivePath, destinationStoragePath)
+	if filter != nil {
+		manifest.FilesInclude, manifest.FilesExclude = filter.Include, filter.Exclude
+	}
+	Info("Step 1/3: Exporting database %s", envConfig.DBName)
+	err = exportDump(ctx, backends, envConfig, func(dump io.Reader) error {
+		if envConfig.BackupMode == BackupModeChunks {
+			return storeChunkedBackup(ctx, backends, envConfig, manifest, dump, tmpFolder+"/files")
+		}
+		return storeArchiveBackup(ctx, backends, envConfig, manifest, dump, tmpFolder+"/files")
+	})
 	if err != nil {
-		Error("UploadArchive failed: %v", err)
-		return fmt.Errorf("UploadArchive failed: %v", err)
+		return err
 	}
 
 	// Clean up temporary files
@@ -103,13 +302,254 @@ func (e *BackupEngineCloud) PerformBackup(environment string, runId string) erro
 	return nil
 }
 
+// exportDump runs the database export of the environment and hands the dump
+// to store as it is written, without storing it locally. Reading the dump
+// fails when the export fails, the export stops once store returns.
+func exportDump(ctx context.Context, backends *EnvironmentBackends, envConfig *EnvironmentConfig, store func(dump io.Reader) error) error {
+	reader, writer := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		err := backends.Database.ExportDatabase(ctx, envConfig, writer)
+		exported <- err
+		writer.CloseWithError(err)
+	}()
+
+	dump := &readErrorRecorder{Reader: reader}
+	err := store(dump)
+	reader.CloseWithError(errors.New("the dump is no longer read"))
+	// A dump that couldn't be read failed because of the export
+	if exportErr := <-exported; exportErr != nil && (err == nil || dump.err != nil) {
+		Error("ExportDatabase failed: %v", exportErr)
+		return fmt.Errorf("ExportDatabase failed: %v", exportErr)
+	}
+	return err
+}
+
+// storeArchiveBackup stores a run as separate artifacts in its folder: the
+// database dump and an archive of the files, followed by the file index, the
+// manifest listing the artifacts and their signatures. It records the run as
+// the last one of the environment. The files archive is incremental when a
+// previous run is recorded, see findParentRun.
+func storeArchiveBackup(ctx context.Context, backends *EnvironmentBackends, envConfig *EnvironmentConfig, manifest *BackupManifest, dump io.Reader, filesFolder string) error {
+	environment, runId := manifest.Environment, manifest.RunID
+	parent := findParentRun(ctx, backends.Archives, envConfig, environment, runId)
+	index := newFileIndexBuilder(environment, runId, parent)
+	manifest.ParentRunID = index.index.ParentRunID
+	var err error
+	manifest.DumpFormat, dump, err = detectDumpFormat(dump)
+	if err != nil {
+		Error("Failed to read SQL dump: %v", err)
+		return fmt.Errorf("failed to read SQL dump: %v", err)
+	}
+
+	folder := runFolderURL(envConfig, environment, runId)
+	dumpURL := folder + "/" + runDumpName
+	Info("Storing database dump of run '%s' in %s", runId, folder)
+	dumpDigest, err := storeDumpArtifact(ctx, backends, manifest.DumpFormat, dump, dumpURL)
+	if err != nil {
+		Error("Storing database dump failed: %v", err)
+		return fmt.Errorf("storing database dump failed: %v", err)
+	}
+	filesURL := folder + "/" + runFilesName + archiveExtension(envConfig.ArchiveCompression)
+	Info("Step 2/3: Streaming files of run '%s' to %s", runId, filesURL)
+	filesDigest, err := streamFilesArchive(ctx, backends, envConfig, manifest, index, filesFolder, filesURL)
+	if err != nil {
+		Error("Streaming files archive failed: %v", err)
+		// The dump of a run without its files isn't left behind either
+		if err := backends.Archives.DeleteArchive(dumpURL); err != nil {
+			Warn("Failed to remove the database dump of the failed run: %v", err)
+		}
+		return fmt.Errorf("streaming files archive failed: %v", err)
+	}
+
+	// The index lists the complete files of the run, the next run builds on it
+	indexURL := folder + "/" + runIndexName
+	Info("Step 3/3: Storing file index and manifest in %s", folder)
+	indexDigest, err := writeFileIndex(ctx, backends.Archives, indexURL, index.index)
+	if err != nil {
+		Error("Storing file index failed: %v", err)
+		return fmt.Errorf("storing file index failed: %v", err)
+	}
+
+	// The manifest goes last, a run is only complete once it is stored
+	manifest.ChecksumsAtEnd = false
+	manifest.Artifacts = []ManifestFile{
+		{Path: runDumpName, Size: dumpDigest.size, SHA256: dumpDigest.sum()},
+		{Path: path.Base(filesURL), Size: filesDigest.size, SHA256: filesDigest.sum()},
+	}
+	manifestURL := folder + "/" + runManifestName
+	manifestDigest, err := writeRunManifest(ctx, backends.Archives, manifestURL, manifest)
+	if err != nil {
+		Error("Storing manifest failed: %v", err)
+		return fmt.Errorf("storing manifest failed: %v", err)
+	}
+
+	// The signature of the manifest covers the artifacts it lists, the index
+	// is signed on its own. Restores check them before the database is touched.
+	if backends.Signing.CanSign() {
+		Info("Signing manifest with SHA-256 %s", manifestDigest.sum())
+		err := signStoredObject(ctx, backends, environment, runId, manifestURL, manifestDigest)
+		if err == nil {
+			err = signStoredObject(ctx, backends, environment, runId, indexURL, indexDigest)
+		}
+		if err != nil {
+			Error("Signing backup failed: %v", err)
+			return fmt.Errorf("signing backup failed: %v", err)
+		}
+	}
+
+	// Only a complete run is built on by the next one
+	if err := writeLatestRun(ctx, backends.Archives, envConfig, environment, runId); err != nil {
+		Error("Recording the last run failed: %v", err)
+		return fmt.Errorf("recording the last run failed: %v", err)
+	}
+	return nil
+}
+
+// signStoredObject signs an archive or file index of a run and stores the
+// signature next to it
+func signStoredObject(ctx context.Context, backends *EnvironmentBackends, environment string, runId string, url string, digest *archiveDigest) error {
+	signature, err := backends.Signing.sign(environment, runId, url, digest)
+	if err != nil {
+		return err
+	}
+	return writeArchiveSignature(ctx, backends.Archives, url, signature)
+}
+
+// streamFilesArchive writes the manifest and the files of the environment
+// into an archive streamed to destination. Every file is recorded in index,
+// files that didn't change since the run index builds on are left out of the
+// archive. filesFolder is only used by file backends that can't stream.
+// Nothing is stored when any step fails. The returned digest is the size and
+// checksum of the archive as stored, the manifest records when the files
+// were complete.
+func streamFilesArchive(ctx context.Context, backends *EnvironmentBackends, envConfig *EnvironmentConfig, manifest *BackupManifest, index *fileIndexBuilder, filesFolder string, destination string) (digest *archiveDigest, err error) {
+	manifest.FormatVersion = ArchiveFormatArtifacts
+	Info("Compressing archive with %s", describeCompression(manifest.Compression, manifest.CompressionLevel))
+	if backends.Encryption.CanEncrypt() {
+		Info("Encrypting archive for %d recipients", len(backends.Encryption.Recipients))
+	}
+
+	store, err := backends.Archives.NewArchiveWriter(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	upload := &digestArchiveWriter{ArchiveWriter: store, digest: newArchiveDigest()}
+	defer func() {
+		if err != nil {
+			upload.Abort(err)
+		}
+	}()
+
+	stream, err := newBackupStream(upload, manifest, backends.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	addFile := func(header *tar.Header, content io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The content of unchanged files is in the archives of earlier runs
+		if previous, ok := index.unchangedFile(header); ok {
+			index.addUnchanged(previous)
+			return nil
+		}
+		name := header.Name
+		header.Name = "files/" + name
+		if err := stream.addFile(header, content); err != nil {
+			return err
+		}
+		checksum := ""
+		if header.Typeflag == tar.TypeReg {
+			checksum = stream.files[len(stream.files)-1].SHA256
+		}
+		header.Name = name
+		index.add(header, checksum)
+		return nil
+	}
+	if err := streamFiles(backends, envConfig, filesFolder, addFile); err != nil {
+		return nil, fmt.Errorf("failed to add files: %v", err)
+	}
+	index.finish()
+
+	// The upload is only committed when the whole archive was written
+	manifest.FinishedAt = time.Now().UTC()
+	if err := stream.finish(manifest.FinishedAt); err != nil {
+		return nil, err
+	}
+	Info("Archive with %d entries (%d bytes before compression) stored at %s, %s", len(stream.files), stream.size, destination, describeIncremental(index))
+	return upload.digest, nil
+}
+
+// streamFiles calls addFile for every file, directory and symlink of the
+// environment the files filter of the environment keeps, see FileStreamer.
+// Files are downloaded to filesFolder first when the file backend can't
+// stream them.
+func streamFiles(backends *EnvironmentBackends, envConfig *EnvironmentConfig, filesFolder string, addFile func(header *tar.Header, content io.Reader) error) error {
+	filter, err := envConfig.FilesFilter()
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		// The backends skip what the filter leaves out where they can, this
+		// makes sure nothing else gets in
+		addSelected := addFile
+		addFile = func(header *tar.Header, content io.Reader) error {
+			if !filter.keeps(header.Name, header.Typeflag == tar.TypeDir) {
+				return nil
+			}
+			return addSelected(header, content)
+		}
+	}
+	if streamer, ok := backends.Files.(FileStreamer); ok {
+		return streamer.StreamFolder(envConfig, addFile)
+	}
+	Info("Downloading files to %s", filesFolder)
+	if err := backends.Files.DownloadFolder(envConfig, filesFolder); err != nil {
+		return err
+	}
+	return streamLocalFolder(filesFolder, filter, addFile)
+}
+
 // Will trigger a restore for the given environment and runId to the destinationEnvironment. A restore involves
-//  1. Retrieving the backup archive from the central backup bucket using the environment and runId
-//  2. Extracting the sql dump and copied files from the archive
-//  3. Restoring the sql dump to the destinationEnvironment specific database
-//  4. Copying the extracted files to the destinationEnvironment specific storage bucket
-func (e *BackupEngineCloud) PerformRestore(environment string, runId string, destinationEnvironment string) error {
+//  1. Streaming the files archive of the run from the central backup bucket
+//     using the environment and runId and extracting it. Incremental runs
+//     are rebuilt from the files archives of the runs they build on, starting
+//     with the full backup, see readRestoreChain. Runs stored as a single
+//     archive before runs had folders are restored from that archive.
+//  2. Streaming the sql dump of the run itself into the destinationEnvironment
+//     specific database
+//  3. Copying the extracted files to the destinationEnvironment specific storage bucket
+//
+// Options can limit the restore to the database or the files, and the files
+// to some paths; what isn't restored is neither downloaded nor touched on the
+// destination. Neither are the paths the FilesInclude and FilesExclude
+// patterns recorded in the manifest left out of the backup.
+//
+// Neither the archives nor the dump are stored locally, only the extracted
+// files. Their manifest, or single archive, must be signed by a key the
+// destination environment trusts, unless options allow unsigned archives, and
+// they are checked against their signatures before the database is touched.
+// That takes reading the dump twice: once to check it and once while it is
+// imported, the import fails when the dump changed in between. Dumps in the
+// chunk store are read once, their chunks are checked as they are read.
+// Cancelling the context, e.g. when the CLI is interrupted, stops the download
+// and the database import.
+func (e *BackupEngineCloud) PerformRestore(ctx context.Context, environment string, runId string, destinationEnvironment string, options RestoreOptions) error {
 	Info("Starting restore from environment '%s' (run ID '%s') to '%s'", environment, runId, destinationEnvironment)
+	if err := options.validate(); err != nil {
+		Error("Invalid restore options: %v", err)
+		return fmt.Errorf("invalid restore options: %v", err)
+	}
+	switch {
+	case !options.restoresFiles():
+		Info("Restoring the database only, the files are left untouched")
+	case !options.restoresDatabase():
+		Info("Restoring %s only, the database is left untouched", options.Paths)
+	case options.Paths != nil:
+		Info("Restoring the database and %s", options.Paths)
+	}
 
 	// Get source environment config
 	srcConfig, ok := e.configs[environment]
@@ -125,49 +565,87 @@ func (e *BackupEngineCloud) PerformRestore(environment string, runId string, des
 		return fmt.Errorf("unknown destination environment: %s", destinationEnvironment)
 	}
 
+	// The archive lives in the source environment's store, the database and
+	// files go to the destination environment's backends
+	srcBackends := e.backends[environment]
+	destBackends := e.backends[destinationEnvironment]
+
+	// Leftovers of an earlier restore of the run would end up in the files
 	tmpFolder := "/tmp/restore_" + runId
 	filesFolder := tmpFolder + "/files"
 	Info("Creating temporary folders at %s", tmpFolder)
-	err := os.MkdirAll(filesFolder, 0755)
+	err := os.RemoveAll(tmpFolder)
+	if err == nil {
+		err = os.MkdirAll(filesFolder, 0755)
+	}
 	if err != nil {
 		Error("Failed to create restore folders: %v", err)
 		return fmt.Errorf("failed to create restore folders: %v", err)
 	}
 
-	// Step 1: Download backup archive from central bucket
-	archivePath := tmpFolder + "/backup_archive.tar.gz"
-	sourceArchivePath := fmt.Sprintf("gs://%s/backups/%s/backup_%s.tar.gz", srcConfig.BackupBucket, environment, runId)
-	Info("Step 1/4: Downloading backup archive from %s", sourceArchivePath)
-	err = e.backupBackend.DownloadArchive(sourceArchivePath, archivePath)
+	// Step 1: Stream the backup archives or chunks from central bucket and extract them
+	snapshot, snapshotDigest, err := readChunkSnapshot(ctx, srcBackends.Archives, srcConfig, environment, runId)
 	if err != nil {
-		Error("DownloadArchive failed: %v", err)
-		return fmt.Errorf("DownloadArchive failed: %v", err)
+		Error("Failed to read snapshot: %v", err)
+		return fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	var manifest *BackupManifest
+	var dump dumpSource
+	if snapshot != nil {
+		Info("Step 1/3: Restoring snapshot of run '%s' from the chunk store", runId)
+		manifest, dump, err = e.extractSnapshot(ctx, srcConfig, srcBackends, destBackends.Signing, environment, runId, snapshot, snapshotDigest, destinationEnvironment, tmpFolder, options)
+	} else {
+		manifest, dump, err = e.extractChain(ctx, srcConfig, srcBackends, destBackends.Signing, environment, runId, destinationEnvironment, tmpFolder, options)
 	}
-
-	// Step 2: Extract archive
-	Info("Step 2/4: Extracting backup archive")
-	err = ExtractBackupArchive(archivePath, tmpFolder)
 	if err != nil {
-		Error("ExtractBackupArchive failed: %v", err)
-		return fmt.Errorf("ExtractBackupArchive failed: %v", err)
+		return err
+	}
+	Info("Archive format version %d", manifest.FormatVersion)
+	if manifest.RunID != "" {
+		Info("Restoring a %s", describeManifest(manifest))
+		if manifest.Environment != environment || manifest.RunID != runId {
+			Warn("Archive stored as %s run '%s' was taken from %s run '%s'", environment, runId, manifest.Environment, manifest.RunID)
+		}
 	}
 
-	// Step 3: Import database to destination
-	dumpPath := tmpFolder + "/db_dump.sql"
-	databaseName := destConfig.DBName
-	Info("Step 3/4: Importing database to %s", databaseName)
-	err = e.backupBackend.ImportDatabase(databaseName, dumpPath)
-	if err != nil {
-		Error("ImportDatabase failed: %v", err)
-		return fmt.Errorf("ImportDatabase failed: %v", err)
+	// Dumps only restore into a database of the engine that produced them
+	engine := destBackends.Database.DatabaseEngine()
+	if options.restoresDatabase() && manifest.DatabaseEngine != engine {
+		Error("Backup contains a %s dump, but %s uses a %s database", manifest.DatabaseEngine, destinationEnvironment, engine)
+		return fmt.Errorf("backup contains a %s dump, but %s uses a %s database", manifest.DatabaseEngine, destinationEnvironment, engine)
 	}
 
-	// Step 4: Upload files to destination VM via rsync
-	Info("Step 4/4: Uploading files to destination VM via rsync")
-	err = e.backupBackend.UploadFolder(filesFolder, destConfig)
-	if err != nil {
-		Error("UploadFolder failed: %v", err)
-		return fmt.Errorf("UploadFolder failed: %v", err)
+	// Step 2: Import database to destination
+	if options.restoresDatabase() {
+		Info("Step 2/3: Importing database to %s", destConfig.DBName)
+		err = dump(func(r io.Reader) error {
+			return destBackends.Database.ImportDatabase(ctx, r, destConfig, srcConfig)
+		})
+		if err != nil {
+			Error("ImportDatabase failed: %v", err)
+			return fmt.Errorf("ImportDatabase failed: %v", err)
+		}
+	} else {
+		Info("Step 2/3: Skipping database import, only files are restored")
+	}
+
+	// Step 3: Upload files to destination
+	if options.restoresFiles() {
+		// Paths the backup left out are left as they are on the destination
+		backedUp, err := manifest.FilesFilter()
+		if err != nil {
+			Error("Failed to read file patterns: %v", err)
+			return err
+		}
+		paths := options.Paths.restrict(backedUp)
+		Info("Step 3/3: Uploading %s to destination", paths)
+		err = destBackends.Files.UploadFolder(filesFolder, destConfig, paths)
+		if err != nil {
+			Error("UploadFolder failed: %v", err)
+			return fmt.Errorf("UploadFolder failed: %v", err)
+		}
+	} else {
+		Info("Step 3/3: Skipping files upload, only the database is restored")
 	}
 
 	// Clean up temporary files
@@ -182,161 +660,295 @@ func (e *BackupEngineCloud) PerformRestore(environment string, runId string, des
 	return nil
 }
 
-func CreateBackupArchive(archivePath string, sqlDumpPath string, filesFolder string) error {
-	Info("Creating archive at %s", archivePath)
-	// Create the output file
-	file, err := os.Create(archivePath)
+// extractChain extracts the archive of a run into tmpFolder, along with the
+// archives of the runs it builds on, and checks the restored files against
+// the file index of the run. The dump source is nil unless options restore
+// the database.
+func (e *BackupEngineCloud) extractChain(ctx context.Context, srcConfig *EnvironmentConfig, srcBackends *EnvironmentBackends, signing *ArchiveSigning, environment string, runId string, destinationEnvironment string, tmpFolder string, options RestoreOptions) (*BackupManifest, dumpSource, error) {
+	chain, err := readRestoreChain(ctx, srcBackends.Archives, signing, srcConfig, environment, runId, destinationEnvironment, options)
 	if err != nil {
-		Error("Failed to create archive file: %v", err)
-		return fmt.Errorf("failed to create archive file: %v", err)
+		return nil, nil, err
 	}
-	defer file.Close()
-
-	// Create a gzip writer
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
-
-	// Create a tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
-
-	// Add SQL dump file to the tar
-	Info("Adding SQL dump to archive")
-	if err := addFileToTar(tarWriter, sqlDumpPath, "db_dump.sql"); err != nil {
-		Error("Failed to add SQL dump: %v", err)
-		return fmt.Errorf("failed to add SQL dump: %v", err)
+	// The dump of the run is complete, the runs it builds on only add files
+	if !options.restoresFiles() {
+		chain = chain[len(chain)-1:]
 	}
-
-	// Add all files from the files folder to the tar (recursively)
-	Info("Adding files from %s to archive", filesFolder)
-	err = filepath.Walk(filesFolder, func(path string, info os.FileInfo, err error) error {
+	if len(chain) > 1 {
+		Info("Step 1/3: Rebuilding run '%s' from %d backup archives, starting with the full backup of run '%s'", runId, len(chain), chain[0].RunID)
+	} else {
+		Info("Step 1/3: Streaming backup archive of run '%s'", runId)
+	}
+	var manifest *BackupManifest
+	var dump dumpSource
+	for i, index := range chain {
+		last := i == len(chain)-1
+		manifest, dump, err = e.extractRun(ctx, srcConfig, srcBackends, signing, environment, runId, index, last, destinationEnvironment, tmpFolder, options)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-		// Get relative path for the file in the archive
-		relPath, err := filepath.Rel(filesFolder, path)
+	}
+	if index := chain[len(chain)-1]; index != nil && options.restoresFiles() {
+		problems, err := checkRestoredFiles(tmpFolder+"/files", index, options.Paths)
 		if err != nil {
-			return fmt.Errorf("failed to get relative path: %v", err)
+			Error("Failed to check restored files: %v", err)
+			return nil, nil, fmt.Errorf("failed to check restored files: %v", err)
 		}
-		archiveName := filepath.Join("files", relPath)
-		return addFileToTar(tarWriter, path, archiveName)
-	})
-	if err != nil {
-		Error("Failed to add files to archive: %v", err)
-		return fmt.Errorf("failed to add files to archive: %v", err)
+		if len(problems) > 0 {
+			Error("Restored files don't match the file index of run '%s': %s", runId, summarizeProblems(problems))
+			return nil, nil, fmt.Errorf("restored files don't match the file index of run '%s': %s", runId, summarizeProblems(problems))
+		}
+		Info("Restored entries match the file index of run '%s'", runId)
 	}
+	return manifest, dump, nil
+}
 
-	Info("Archive created successfully at %s", archivePath)
-	return nil
+// checkRestoreSignature turns a failed signature check into the error that
+// stops a restore, or a warning when options allow unsigned archives
+func checkRestoreSignature(err error, destinationEnvironment string, options RestoreOptions) error {
+	var signatureErr *SignatureError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &signatureErr) && options.AllowUnsigned:
+		Warn("%v, restoring it anyway as unsigned archives are allowed", err)
+		return nil
+	case errors.As(err, &signatureErr):
+		Error("Refusing to restore into %s: %v", destinationEnvironment, err)
+		return fmt.Errorf("refusing to restore into %s: %v", destinationEnvironment, err)
+	default:
+		Error("Failed to check archive signature: %v", err)
+		return fmt.Errorf("failed to check archive signature: %v", err)
+	}
 }
 
-func ExtractBackupArchive(archivePath string, destinationFolder string) error {
-	Info("Extracting archive from %s to %s", archivePath, destinationFolder)
+// extractRun extracts the artifacts or the archive of a run into tmpFolder,
+// on top of the files of the runs it builds on. index is the file index of
+// the run, nil for runs stored without one. Only the last run of a chain is
+// restored, only its dump source is returned and the runId is the one of the
+// last run.
+func (e *BackupEngineCloud) extractRun(ctx context.Context, srcConfig *EnvironmentConfig, srcBackends *EnvironmentBackends, signing *ArchiveSigning, environment string, runId string, index *FileIndex, last bool, destinationEnvironment string, tmpFolder string, options RestoreOptions) (*BackupManifest, dumpSource, error) {
+	run, parentRun := runId, ""
+	if index != nil {
+		run, parentRun = index.RunID, index.ParentRunID
+	}
+	stored, err := findStoredRun(srcBackends.Archives, srcConfig, environment, run)
+	if err != nil {
+		Error("Failed to find backup: %v", err)
+		return nil, nil, fmt.Errorf("failed to find backup: %v", err)
+	}
+
+	// The manifest of a run stored as separate artifacts is signed, the
+	// archive otherwise
+	signedURL := stored.Archive
+	if stored.Folder != "" {
+		signedURL = stored.Manifest
+	}
+	signature, err := checkStoredSignature(ctx, srcBackends.Archives, signing, environment, run, signedURL)
+	if err := checkRestoreSignature(err, destinationEnvironment, options); err != nil {
+		return nil, nil, err
+	}
 
-	// Open the archive file
-	file, err := os.Open(archivePath)
+	// Files deleted since the parent run go before the changed ones arrive
+	if parentRun != "" && options.restoresFiles() {
+		Info("Removing %d entries deleted since run '%s'", len(index.Deleted), parentRun)
+		if err := removeDeletedFiles(tmpFolder+"/files", index.Deleted); err != nil {
+			Error("Failed to remove deleted files: %v", err)
+			return nil, nil, fmt.Errorf("failed to remove deleted files: %v", err)
+		}
+	}
+
+	var manifest *BackupManifest
+	var dump dumpSource
+	if stored.Folder != "" {
+		manifest, dump, err = e.extractRunArtifacts(ctx, srcConfig, srcBackends, stored, signature, last, destinationEnvironment, tmpFolder, options)
+	} else {
+		manifest, dump, err = e.extractRunArchive(ctx, srcConfig, srcBackends, stored.Archive, signature, last, destinationEnvironment, tmpFolder, options)
+	}
 	if err != nil {
-		Error("Failed to open archive file: %v", err)
-		return fmt.Errorf("failed to open archive file: %v", err)
+		return nil, nil, err
 	}
-	defer file.Close()
 
-	// Create gzip reader
-	gzipReader, err := gzip.NewReader(file)
+	// The signed run must build on the run its index names, a run restored
+	// on its own must be a full backup
+	if index == nil && manifest.ParentRunID != "" {
+		Error("Archive of run '%s' builds on run '%s', but has no file index to restore it with", run, manifest.ParentRunID)
+		return nil, nil, fmt.Errorf("archive of run '%s' builds on run '%s', but has no file index to restore it with", run, manifest.ParentRunID)
+	}
+	if manifest.ParentRunID != parentRun {
+		Error("Archive of run '%s' builds on run '%s', but its file index names run '%s'", run, manifest.ParentRunID, parentRun)
+		return nil, nil, fmt.Errorf("archive of run '%s' builds on run '%s', but its file index names run '%s'", run, manifest.ParentRunID, parentRun)
+	}
+	return manifest, dump, nil
+}
+
+// extractRunArchive extracts a run stored as a single archive into
+// tmpFolder, leaving out the database dump and what options don't restore.
+// The whole archive is still downloaded. The dump source reads the archive
+// again for the dump of the last run of a chain, it is nil for the others.
+// signature is the checked signature of the archive, nil for unsigned
+// archives.
+func (e *BackupEngineCloud) extractRunArchive(ctx context.Context, srcConfig *EnvironmentConfig, srcBackends *EnvironmentBackends, archiveURL string, signature *archiveSignature, last bool, destinationEnvironment string, tmpFolder string, options RestoreOptions) (*BackupManifest, dumpSource, error) {
+	Info("Streaming backup archive from %s", archiveURL)
+	manifest, digest, err := e.extractStoredArchive(ctx, srcConfig, srcBackends, archiveURL, tmpFolder, options.include())
 	if err != nil {
-		Error("Failed to create gzip reader: %v", err)
-		return fmt.Errorf("failed to create gzip reader: %v", err)
+		Error("Extracting backup archive failed: %v", err)
+		return nil, nil, fmt.Errorf("extracting backup archive failed: %v", err)
+	}
+	if signature != nil {
+		if err := checkRestoreSignature(signature.checkDigest(archiveURL, digest), destinationEnvironment, options); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !last || !options.restoresDatabase() {
+		return manifest, nil, nil
 	}
-	defer gzipReader.Close()
+	return manifest, func(importDump func(dump io.Reader) error) error {
+		Info("Streaming database dump from %s", archiveURL)
+		return streamArchivedDump(ctx, srcConfig, srcBackends, archiveURL, digest, importDump)
+	}, nil
+}
 
-	// Create tar reader
-	tarReader := tar.NewReader(gzipReader)
+// streamArchivedDump streams db_dump.sql out of a run stored as a single
+// archive into importDump. The archive was checked when its files were
+// extracted, also against the checksum the manifest records for the dump,
+// and every block of it is compared to the one checked before the dump
+// passes on any of its bytes.
+func streamArchivedDump(ctx context.Context, envConfig *EnvironmentConfig, backends *EnvironmentBackends, archiveURL string, checked *archiveDigest, importDump func(dump io.Reader) error) error {
+	reader, err := backends.Archives.NewArchiveReader(ctx, archiveURL)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
 
-	// Extract all files
-	fileCount := 0
+	stored := newCheckedReader(reader, archiveURL, checked)
+	stream, _, err := backends.Encryption.NewDecryptingReader(stored, archiveURL)
+	if err != nil {
+		return err
+	}
+	decompressionReader, _, err := newDecompressionReader(stream)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	defer decompressionReader.Close()
+	archive := newBackupArchiveReader(decompressionReader, envConfig.ExtractLimits())
 	for {
-		header, err := tarReader.Next()
+		header, err := archive.Next()
 		if err == io.EOF {
-			break
+			return fmt.Errorf("archive contains no db_dump.sql")
 		}
 		if err != nil {
-			Error("Failed to read tar header: %v", err)
-			return fmt.Errorf("failed to read tar header: %v", err)
-		}
-
-		// Determine the output path
-		targetPath := filepath.Join(destinationFolder, header.Name)
-
-		// Check for directory traversal
-		if !filepath.HasPrefix(targetPath, filepath.Clean(destinationFolder)+string(os.PathSeparator)) {
-			Error("Invalid file path in archive: %s", header.Name)
-			return fmt.Errorf("invalid file path in archive: %s", header.Name)
+			return err
 		}
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// Create directory
-			if err := os.MkdirAll(targetPath, 0755); err != nil {
-				Error("Failed to create directory %s: %v", targetPath, err)
-				return fmt.Errorf("failed to create directory %s: %v", targetPath, err)
-			}
-		case tar.TypeReg:
-			// Create file
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				Error("Failed to create parent directory: %v", err)
-				return fmt.Errorf("failed to create parent directory: %v", err)
-			}
-
-			outFile, err := os.Create(targetPath)
-			if err != nil {
-				Error("Failed to create file %s: %v", targetPath, err)
-				return fmt.Errorf("failed to create file %s: %v", targetPath, err)
-			}
-
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				Error("Failed to extract file %s: %v", targetPath, err)
-				return fmt.Errorf("failed to extract file %s: %v", targetPath, err)
-			}
-			outFile.Close()
-			fileCount++
+		if header.Name == "db_dump.sql" {
+			break
 		}
 	}
-
-	Info("Successfully extracted %d files from archive", fileCount)
+	if err := importDump(archive); err != nil {
+		return err
+	}
+	// Whatever follows the dump counts towards the checksum of the archive
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return fmt.Errorf("failed to read the end of the archive: %v", err)
+	}
 	return nil
 }
 
-func addFileToTar(tarWriter *tar.Writer, filePath string, archiveName string) error {
-	file, err := os.Open(filePath)
+// extractStoredArchive streams an archive out of the archive store into
+// extractBackupStream, extracting the entries include accepts, and returns
+// the size and checksum of the archive as stored. Encrypted archives are
+// decrypted with the keys of the environment that stores them, which also
+// sets the extraction limits.
+func (e *BackupEngineCloud) extractStoredArchive(ctx context.Context, envConfig *EnvironmentConfig, backends *EnvironmentBackends, archiveURL string, destinationFolder string, include func(name string) bool) (*BackupManifest, *archiveDigest, error) {
+	reader, err := backends.Archives.NewArchiveReader(ctx, archiveURL)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %v", filePath, err)
+		return nil, nil, err
 	}
-	defer file.Close()
+	defer reader.Close()
 
-	info, err := file.Stat()
+	digest := newBlockDigest()
+	stored := io.TeeReader(reader, digest)
+	stream, encrypted, err := backends.Encryption.NewDecryptingReader(stored, archiveURL)
 	if err != nil {
-		return fmt.Errorf("failed to stat file %s: %v", filePath, err)
+		return nil, nil, err
+	}
+	if encrypted {
+		Info("Decrypting backup archive")
 	}
+	manifest, err := extractBackupStream(stream, destinationFolder, envConfig.ExtractLimits(), include)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Whatever follows the archive counts towards its checksum as well
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the end of the archive: %v", err)
+	}
+	return manifest, digest, nil
+}
+
+// archiveURL returns the storage location of the backup archive for the given
+// environment and runId, e.g. gs://bucket/backups/staging/backup_<runId>.tar.zst.
+// The extension follows the configured compression.
+func archiveURL(envConfig *EnvironmentConfig, environment string, runId string) string {
+	return archivePrefix(envConfig, environment, runId) + archiveExtension(envConfig.ArchiveCompression)
+}
+
+// archivePrefix returns the storage location of the backup archive for the
+// given environment and runId without its extension
+func archivePrefix(envConfig *EnvironmentConfig, environment string, runId string) string {
+	return fmt.Sprintf("%s/backups/%s/backup_%s", envConfig.ArchiveBaseURL(), environment, runId)
+}
 
-	header, err := tar.FileInfoHeader(info, "")
+// findArchive looks up the stored archive of a run. Its extension tells the
+// compression it was written with, which may differ from the configured one,
+// e.g. backup_<runId>.tar.gz for archives written before zstd was enabled.
+func findArchive(store ArchiveStore, envConfig *EnvironmentConfig, environment string, runId string) (string, error) {
+	prefix := archivePrefix(envConfig, environment, runId)
+	stored, err := store.ListArchives(prefix)
 	if err != nil {
-		return fmt.Errorf("failed to create tar header for %s: %v", filePath, err)
+		return "", err
+	}
+	found := make(map[string]bool, len(stored))
+	for _, url := range stored {
+		found[url] = true
 	}
+	if url := pickArchive(found, prefix, envConfig.ArchiveCompression); url != "" {
+		return url, nil
+	}
+	return "", fmt.Errorf("no backup archive of %s run '%s' found at %s", environment, runId, archiveURL(envConfig, environment, runId))
+}
 
-	// Use the provided archive name for the header
-	header.Name = archiveName
-	if err := tarWriter.WriteHeader(header); err != nil {
-		return fmt.Errorf("failed to write header for %s: %v", archiveName, err)
+// pickArchive returns the archive named prefix with the extension of any
+// compression among the stored URLs found, or an empty URL. The configured
+// compression wins when a run was stored more than once.
+func pickArchive(found map[string]bool, prefix string, compression string) string {
+	if url := prefix + archiveExtension(compression); found[url] {
+		return url
+	}
+	for _, candidate := range archiveExtensions {
+		if url := prefix + candidate.extension; found[url] {
+			return url
+		}
 	}
+	return ""
+}
 
-	if _, err := io.Copy(tarWriter, file); err != nil {
-		return fmt.Errorf("failed to write file %s to tar: %v", filePath, err)
+func addManifestToTar(tarWriter *tar.Writer, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
 	}
 
+	header := &tar.Header{
+		Name:    manifestFileName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header for %s: %v", manifestFileName, err)
+	}
+	if _, err := tarWriter.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s to tar: %v", manifestFileName, err)
+	}
 	return nil
 }
@@ -1,15 +1,41 @@
 package backupmanager
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MockBackend struct {
-	failDownload   bool
-	archiveToServe string
+	failDownload    bool
+	archiveToServe  string
+	databaseEngine  string
+	uploadedArchive string
+
+	// Archive names passed to the archive methods. The served archive is
+	// listed under the name of the last upload, or as a legacy .tar.gz.
+	uploadedTo   string
+	downloadedAs string
+	abortedWith  error
+
+	// Signatures, file indexes and other metadata stored next to the
+	// archives, by URL. Archives and artifacts written are kept as well.
+	metadata map[string][]byte
+
+	// Environments passed to the database methods and the dump imported
+	exportedConfig     *EnvironmentConfig
+	importedConfig     *EnvironmentConfig
+	importSourceConfig *EnvironmentConfig
+	importedDump       []byte
 }
 
 func NewMockBackend() *MockBackend {
@@ -35,41 +61,152 @@ func (b *MockBackend) DownloadFolder(envConfig *EnvironmentConfig, destination s
 	return nil
 }
 
-func (b *MockBackend) ExportDatabase(databaseName string, dumpPath string) error {
+func (b *MockBackend) DatabaseEngine() string {
+	if b.databaseEngine != "" {
+		return b.databaseEngine
+	}
+	return DatabaseEngineMySQL
+}
+
+func (b *MockBackend) ExportDatabase(ctx context.Context, envConfig *EnvironmentConfig, out io.Writer) error {
+	b.exportedConfig = envConfig
 	// Mock export logic here
-	err := os.WriteFile(dumpPath, []byte("CREATE TABLE test (id INT);"), 0644)
-	if err != nil {
-		return err
+	_, err := io.WriteString(out, "CREATE TABLE test (id INT);")
+	return err
+}
+
+func (b *MockBackend) NewArchiveWriter(ctx context.Context, destination string) (ArchiveWriter, error) {
+	if isMockMetadata(destination) {
+		return &mockMetadataWriter{backend: b, destination: destination}, nil
+	}
+	writer := &mockArchiveWriter{backend: b, destination: destination}
+	// Keep the archive when asked to
+	if b.uploadedArchive != "" {
+		file, err := os.Create(b.uploadedArchive)
+		if err != nil {
+			return nil, err
+		}
+		writer.file = file
+	}
+	return writer, nil
+}
+
+func (b *MockBackend) NewArchiveReader(ctx context.Context, archivePath string) (io.ReadCloser, error) {
+	if data, ok := b.metadata[archivePath]; ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	b.downloadedAs = archivePath
+	if b.failDownload {
+		return nil, fmt.Errorf("simulated download failure")
+	}
+	if b.archiveToServe == "" {
+		return nil, fmt.Errorf("no mock archive set")
+	}
+	return os.Open(b.archiveToServe)
+}
+
+// mockArchiveWriter records the destination and content of an archive once
+// it is closed
+type mockArchiveWriter struct {
+	backend     *MockBackend
+	destination string
+	file        *os.File
+	buf         bytes.Buffer
+}
+
+func (w *mockArchiveWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if w.file == nil {
+		return len(p), nil
+	}
+	return w.file.Write(p)
+}
+
+func (w *mockArchiveWriter) Close() error {
+	w.backend.uploadedTo = w.destination
+	if w.backend.metadata == nil {
+		w.backend.metadata = make(map[string][]byte)
+	}
+	w.backend.metadata[w.destination] = w.buf.Bytes()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func (w *mockArchiveWriter) Abort(err error) {
+	w.backend.abortedWith = err
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+}
+
+// isMockMetadata tells metadata stored next to the archives from archives
+func isMockMetadata(url string) bool {
+	return strings.HasSuffix(url, signatureExtension) || strings.HasSuffix(url, ".json")
+}
+
+// mockMetadataWriter keeps a signature or file index in the backend once it
+// is closed
+type mockMetadataWriter struct {
+	backend     *MockBackend
+	destination string
+	buf         bytes.Buffer
+}
+
+func (w *mockMetadataWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *mockMetadataWriter) Close() error {
+	if w.backend.metadata == nil {
+		w.backend.metadata = make(map[string][]byte)
 	}
+	w.backend.metadata[w.destination] = w.buf.Bytes()
 	return nil
 }
 
-func (b *MockBackend) UploadArchive(archivePath string, destination string) error {
-	// Mock upload logic here
+func (w *mockMetadataWriter) Abort(err error) {}
+
+func (b *MockBackend) DeleteArchive(url string) error {
+	if _, ok := b.metadata[url]; !ok {
+		return fmt.Errorf("no mock metadata at %s", url)
+	}
+	delete(b.metadata, url)
 	return nil
 }
 
-func (b *MockBackend) DownloadArchive(archivePath string, destinationPath string) error {
-	// Copy the prepared archive to the destination
-	if b.archiveToServe == "" {
-		return fmt.Errorf("no mock archive set")
+func (b *MockBackend) ListArchives(prefix string) ([]string, error) {
+	var archives []string
+	for url := range b.metadata {
+		if strings.HasPrefix(url, prefix) {
+			archives = append(archives, url)
+		}
 	}
-	data, err := os.ReadFile(b.archiveToServe)
-	if err != nil {
-		return fmt.Errorf("failed to read mock archive: %v", err)
+	switch {
+	case b.archiveToServe == "":
+	case strings.HasPrefix(b.uploadedTo, prefix):
+		archives = append(archives, b.uploadedTo)
+	default:
+		archives = append(archives, prefix+".tar.gz")
 	}
-	return os.WriteFile(destinationPath, data, 0644)
+	return archives, nil
 }
 
-func (b *MockBackend) ImportDatabase(databaseName string, sqlFilePath string) error {
-	// Mock import logic - just verify the SQL file exists
-	if _, err := os.Stat(sqlFilePath); err != nil {
-		return fmt.Errorf("SQL file not found: %v", err)
+func (b *MockBackend) ImportDatabase(ctx context.Context, dump io.Reader, envConfig *EnvironmentConfig, sourceConfig *EnvironmentConfig) error {
+	b.importedConfig = envConfig
+	b.importSourceConfig = sourceConfig
+	// Mock import logic - just read the whole dump
+	data, err := io.ReadAll(dump)
+	if err != nil {
+		return fmt.Errorf("failed to read SQL dump: %v", err)
 	}
+	b.importedDump = data
 	return nil
 }
 
-func (b *MockBackend) UploadFolder(sourcePath string, envConfig *EnvironmentConfig) error {
+func (b *MockBackend) UploadFolder(sourcePath string, envConfig *EnvironmentConfig, filter *PathFilter) error {
 	// Mock folder upload logic - just verify source exists
 	if _, err := os.Stat(sourcePath); err != nil {
 		return fmt.Errorf("source path not found: %v", err)
@@ -81,18 +218,22 @@ func mockConfigs() EnvironmentConfigs {
 	return EnvironmentConfigs{
 		"staging": &EnvironmentConfig{
 			BackupBucket:     "test-backup-bucket",
+			DBBackend:        DBBackendCloudSQL,
 			DBName:           "staging_db",
 			GCPProjectID:     "test-project",
 			CloudSQLInstance: "test-instance-staging",
+			FilesBackend:     FilesBackendRsync,
 			TargetHost:       "test-host",
 			TargetUser:       "test-user",
 			TargetPath:       "/var/www/staging/web/sites/default/files",
 		},
 		"production": &EnvironmentConfig{
 			BackupBucket:     "test-backup-bucket",
+			DBBackend:        DBBackendCloudSQL,
 			DBName:           "production_db",
 			GCPProjectID:     "test-project",
 			CloudSQLInstance: "test-instance-production",
+			FilesBackend:     FilesBackendRsync,
 			TargetHost:       "test-host",
 			TargetUser:       "test-user",
 			TargetPath:       "/var/www/production/web/sites/default/files",
@@ -100,18 +241,35 @@ func mockConfigs() EnvironmentConfigs {
 	}
 }
 
+// newMockEngine creates an engine using the mock backend for the database,
+// files and archives of every environment
+func newMockEngine(backend *MockBackend, configs EnvironmentConfigs) *BackupEngineCloud {
+	backends := make(map[string]*EnvironmentBackends)
+	for environment := range configs {
+		backends[environment] = &EnvironmentBackends{
+			Database: backend,
+			Files:    backend,
+			Archives: backend,
+		}
+	}
+	return &BackupEngineCloud{
+		backends: backends,
+		configs:  configs,
+	}
+}
+
 func TestFullBackup(t *testing.T) {
 	backend := NewMockBackend()
 	configs := mockConfigs()
-	engine := &BackupEngineCloud{
-		backupBackend: backend,
-		configs:       configs,
-	}
+	engine := newMockEngine(backend, configs)
 
-	err := engine.PerformBackup("staging", "test-run-001")
+	err := engine.PerformBackup(context.Background(), "staging", "test-run-001")
 	if err != nil {
 		t.Errorf("PerformBackup failed: %v", err)
 	}
+	if backend.exportedConfig != configs["staging"] {
+		t.Errorf("database of the wrong environment exported")
+	}
 
 }
 
@@ -119,12 +277,9 @@ func TestFullBackupButDownloadFails(t *testing.T) {
 	backend := NewMockBackend()
 	backend.failDownload = true
 	configs := mockConfigs()
-	engine := &BackupEngineCloud{
-		backupBackend: backend,
-		configs:       configs,
-	}
+	engine := newMockEngine(backend, configs)
 
-	err := engine.PerformBackup("staging", "test-run-002")
+	err := engine.PerformBackup(context.Background(), "staging", "test-run-002")
 	if err == nil {
 		t.Errorf("PerformBackup should have failed due to download error")
 	}
@@ -133,10 +288,7 @@ func TestFullBackupButDownloadFails(t *testing.T) {
 func TestFullRestore(t *testing.T) {
 	backend := NewMockBackend()
 	configs := mockConfigs()
-	engine := &BackupEngineCloud{
-		backupBackend: backend,
-		configs:       configs,
-	}
+	engine := newMockEngine(backend, configs)
 
 	// First create a test backup archive
 	tmpFolder := "/tmp/test_restore_archive"
@@ -163,47 +315,362 @@ func TestFullRestore(t *testing.T) {
 
 	// Create archive
 	archivePath := tmpFolder + "/backup_archive.tar.gz"
-	err = CreateBackupArchive(archivePath, sqlDumpPath, filesFolder)
-	if err != nil {
-		t.Fatalf("Failed to create archive: %v", err)
-	}
+	writeTestArchive(t, archivePath, &BackupManifest{DatabaseEngine: DatabaseEngineMySQL}, sqlDumpPath, filesFolder)
 
 	// Now test restore
 	backend.archiveToServe = archivePath
-	err = engine.PerformRestore("staging", "test-run-restore-001", "production")
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-restore-001", "production", RestoreOptions{AllowUnsigned: true})
 	if err != nil {
 		t.Errorf("PerformRestore failed: %v", err)
 	}
+	if backend.importedConfig != configs["production"] || backend.importSourceConfig != configs["staging"] {
+		t.Errorf("database imported with the wrong environments")
+	}
+	if string(backend.importedDump) != "CREATE TABLE test (id INT);" {
+		t.Errorf("unexpected dump imported: %q", backend.importedDump)
+	}
+
+	// The archive is read again for the dump, which fails when the archive
+	// changed since its files were extracted before the importer gets any
+	// statement of the replacement
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	checked := newBlockDigest()
+	checked.Write(data)
+	mustWriteFile(t, sqlDumpPath, "DROP TABLE users;")
+	writeTestArchive(t, archivePath, &BackupManifest{DatabaseEngine: DatabaseEngineMySQL}, sqlDumpPath, filesFolder)
+	url := archiveURL(configs["staging"], "staging", "test-run-restore-001")
+	var imported []byte
+	err = streamArchivedDump(context.Background(), configs["staging"], engine.backends["staging"], url, checked, func(dump io.Reader) error {
+		var err error
+		imported, err = io.ReadAll(dump)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "changed since it was checked") {
+		t.Errorf("dump of an archive replaced after its check should fail, got %v", err)
+	}
+	if len(imported) > 0 {
+		t.Errorf("importer got %q of the replaced archive", imported)
+	}
 }
 
-func TestCreateBackupArchive(t *testing.T) {
-	// Create tmp folder with dummy files
-	tmpFolder := "/tmp/test_backup_archive"
-	filesFolder := tmpFolder + "/files"
-	err := os.MkdirAll(filesFolder, 0755)
+func TestRestoreTargetsDestinationEnvironment(t *testing.T) {
+	// Environments whose names don't appear in their database names, one of
+	// them containing the name of the other environment
+	configs := mockConfigs()
+	configs["staging"].DBName = "staging_production_copy"
+	configs["production"].DBName = "ilf_site"
+
+	tmpFolder := t.TempDir()
+	filesFolder := filepath.Join(tmpFolder, "files")
+	mustWriteFile(t, filepath.Join(filesFolder, "test.txt"), "test content")
+	dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+	mustWriteFile(t, dumpPath, "CREATE TABLE test (id INT);")
+	archivePath := filepath.Join(tmpFolder, "backup_archive.tar.gz")
+	writeTestArchive(t, archivePath, &BackupManifest{DatabaseEngine: DatabaseEngineMySQL}, dumpPath, filesFolder)
+
+	for _, restore := range []struct{ source, destination string }{
+		{"staging", "production"},
+		{"production", "staging"},
+		{"staging", "staging"},
+	} {
+		backend := NewMockBackend()
+		backend.archiveToServe = archivePath
+		engine := newMockEngine(backend, configs)
+
+		if err := engine.PerformRestore(context.Background(), restore.source, "test-run-restore-env", restore.destination, RestoreOptions{AllowUnsigned: true}); err != nil {
+			t.Fatalf("PerformRestore from %s to %s failed: %v", restore.source, restore.destination, err)
+		}
+		if backend.importedConfig != configs[restore.destination] {
+			t.Errorf("restore from %s to %s imported into %s", restore.source, restore.destination, backend.importedConfig.DBName)
+		}
+		if backend.importSourceConfig != configs[restore.source] {
+			t.Errorf("restore from %s to %s passed source %s", restore.source, restore.destination, backend.importSourceConfig.DBName)
+		}
+	}
+}
+
+func TestExtractLegacyArchive(t *testing.T) {
+	// Archives without a manifest were all written by MySQL backends
+	tmpFolder := t.TempDir()
+	archivePath := filepath.Join(tmpFolder, "backup_archive.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{
+		"db_dump.sql":      "CREATE TABLE test (id INT);",
+		"files/images.txt": "test content",
+	})
+
+	manifest, err := extractTestArchive(t, archivePath, filepath.Join(tmpFolder, "extracted"))
 	if err != nil {
-		t.Fatalf("Failed to create files folder: %v", err)
+		t.Fatalf("extracting archive failed: %v", err)
 	}
-	dummyFilePath := filesFolder + "/dummy.txt"
-	err = os.WriteFile(dummyFilePath, []byte("This is a test file."), 0644)
+	if manifest.DatabaseEngine != DatabaseEngineMySQL {
+		t.Errorf("legacy archive should contain a MySQL dump, got %q", manifest.DatabaseEngine)
+	}
+	if _, err := os.Stat(filepath.Join(tmpFolder, "extracted", "files", "images.txt")); err != nil {
+		t.Errorf("legacy archive not extracted: %v", err)
+	}
+}
+
+func TestArchivePreservesFileMetadata(t *testing.T) {
+	tmpFolder := t.TempDir()
+	filesFolder := filepath.Join(tmpFolder, "files")
+	mtime := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	mustWriteFile(t, filepath.Join(filesFolder, "inline-images", "logo.png"), "png")
+	mustWriteFile(t, filepath.Join(filesFolder, "scripts", "run.sh"), "#!/bin/sh")
+	os.Chmod(filepath.Join(filesFolder, "scripts", "run.sh"), 0755)
+	os.Chtimes(filepath.Join(filesFolder, "scripts", "run.sh"), mtime, mtime)
+	os.MkdirAll(filepath.Join(filesFolder, "styles"), 0750)
+	os.Chtimes(filepath.Join(filesFolder, "styles"), mtime, mtime)
+	os.Symlink("inline-images/logo.png", filepath.Join(filesFolder, "latest.png"))
+	// Links pointing outside the files are left out, restores reject them
+	os.Symlink("/etc/passwd", filepath.Join(filesFolder, "passwd"))
+	dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+	mustWriteFile(t, dumpPath, completeMySQLDump)
+
+	archivePath := filepath.Join(tmpFolder, "backup_archive.tar.gz")
+	writeTestArchive(t, archivePath, &BackupManifest{DatabaseEngine: DatabaseEngineMySQL}, dumpPath, filesFolder)
+
+	// Streamed backups keep the same metadata
+	backend := NewMockBackend()
+	engine, runFolder := newLocalStoreEngine(t, backend)
+	engine.configs["staging"].TargetPath = filesFolder
+	engine.backends["staging"].Files = NewBackendLocal()
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-metadata"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// The files archive of a run holds no database dump
+	for _, archive := range []struct {
+		path  string
+		files int
+	}{
+		{archivePath, 3},
+		{filepath.Join(runFolder, "test-run-metadata", "files.tar.gz"), 2},
+	} {
+		extractFolder := filepath.Join(t.TempDir(), "extracted")
+		manifest, err := extractTestArchive(t, archive.path, extractFolder)
+		if err != nil {
+			t.Fatalf("extracting archive failed: %v", err)
+		}
+		if len(manifest.Files) != archive.files {
+			t.Errorf("only regular files should be checksummed, got %+v", manifest.Files)
+		}
+
+		extracted := filepath.Join(extractFolder, "files")
+		if info, err := os.Stat(filepath.Join(extracted, "styles")); err != nil || !info.IsDir() || info.Mode().Perm() != 0750 || !info.ModTime().Equal(mtime) {
+			t.Errorf("empty directory not restored with its mode and mtime: %v, %v", info, err)
+		}
+		if info, err := os.Stat(filepath.Join(extracted, "scripts", "run.sh")); err != nil || info.Mode().Perm() != 0755 || !info.ModTime().Equal(mtime) {
+			t.Errorf("executable not restored with its mode and mtime: %v, %v", info, err)
+		}
+		if link, err := os.Readlink(filepath.Join(extracted, "latest.png")); err != nil || link != "inline-images/logo.png" {
+			t.Errorf("symlink not restored: %q, %v", link, err)
+		}
+		if _, err := os.Lstat(filepath.Join(extracted, "passwd")); !os.IsNotExist(err) {
+			t.Errorf("symlink pointing outside the files should not be archived")
+		}
+	}
+}
+
+func TestBackupManifestRecordsRun(t *testing.T) {
+	backend := NewMockBackend()
+	backend.uploadedArchive = filepath.Join(t.TempDir(), "uploaded.tar.gz")
+	configs := mockConfigs()
+	engine := newMockEngine(backend, configs)
+
+	before := time.Now()
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-manifest"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	manifest, err := extractTestArchive(t, backend.uploadedArchive, t.TempDir())
 	if err != nil {
-		t.Fatalf("Failed to create dummy file: %v", err)
+		t.Fatalf("extracting archive failed: %v", err)
 	}
-	dumpPath := tmpFolder + "/db_dump.sql"
-	err = os.WriteFile(dumpPath, []byte("CREATE TABLE test (id INT);"), 0644)
+
+	if manifest.Environment != "staging" || manifest.RunID != "test-run-manifest" || manifest.DatabaseName != "staging_db" ||
+		manifest.CloudSQLInstance != "test-instance-staging" || manifest.ToolVersion != Version {
+		t.Errorf("manifest doesn't describe the backup run: %+v", manifest)
+	}
+	if manifest.StartedAt.Before(before.Add(-time.Second)) || manifest.FinishedAt.Before(manifest.StartedAt) {
+		t.Errorf("unexpected backup times %s - %s", manifest.StartedAt, manifest.FinishedAt)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Path != "files/dummy.txt" {
+		t.Errorf("unexpected files in manifest: %+v", manifest.Files)
+	}
+
+	// The manifest of the run lists the dump and files archive stored
+	// next to it
+	stored, err := parseBackupManifest(bytes.NewReader(backend.metadata["gs://test-backup-bucket/backups/staging/test-run-manifest/manifest.json"]))
 	if err != nil {
-		t.Fatalf("Failed to create dummy db dump: %v", err)
+		t.Fatalf("Failed to read run manifest: %v", err)
+	}
+	if len(stored.Artifacts) != 2 || stored.Artifacts[0].Path != "db.sql.gz" || stored.Artifacts[1].Path != "files.tar.gz" {
+		t.Errorf("unexpected artifacts in manifest: %+v", stored.Artifacts)
 	}
+	if stored.RunID != "test-run-manifest" || stored.DumpFormat == "" {
+		t.Errorf("run manifest doesn't describe the backup run: %+v", stored)
+	}
+}
 
-	// Create backup archive
-	archivePath := tmpFolder + "/backup_archive.tar.gz"
-	err = CreateBackupArchive(archivePath, dumpPath, filesFolder)
+func TestRestoreRejectsOtherDatabaseEngine(t *testing.T) {
+	tmpFolder := t.TempDir()
+	filesFolder := filepath.Join(tmpFolder, "files")
+	mustWriteFile(t, filepath.Join(filesFolder, "test.txt"), "test content")
+	dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+	mustWriteFile(t, dumpPath, "CREATE TABLE test (id INT);")
+	archivePath := filepath.Join(tmpFolder, "backup_archive.tar.gz")
+	writeTestArchive(t, archivePath, &BackupManifest{DatabaseEngine: DatabaseEngineMySQL}, dumpPath, filesFolder)
+
+	backend := NewMockBackend()
+	backend.archiveToServe = archivePath
+	backend.databaseEngine = DatabaseEnginePostgres
+	engine := newMockEngine(backend, mockConfigs())
+
+	err := engine.PerformRestore(context.Background(), "staging", "test-run-restore-engine", "production", RestoreOptions{AllowUnsigned: true})
+	if err == nil || !strings.Contains(err.Error(), "mysql dump") {
+		t.Errorf("restoring a MySQL dump into a PostgreSQL database should fail, got %v", err)
+	}
+}
+
+func TestNewBackupEngineMixesBackends(t *testing.T) {
+	configs := mockConfigs()
+	configs["staging"].BackupURL = "s3://offsite-bucket"
+	configs["production"].DBBackend = DBBackendLocal
+	configs["production"].FilesBackend = FilesBackendLocal
+	configs["production"].BackupURL = "file:///tmp/backups"
+
+	engine, err := NewBackupEngine(configs)
 	if err != nil {
-		t.Fatalf("CreateBackupArchive failed: %v", err)
+		t.Fatalf("NewBackupEngine failed: %v", err)
 	}
 
-	// Check if archive file exists
-	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
-		t.Fatalf("Backup archive was not created")
+	staging := engine.backends["staging"]
+	if _, ok := staging.Database.(*BackendCloudSQL); !ok {
+		t.Errorf("staging database backend should be Cloud SQL, got %T", staging.Database)
+	}
+	if _, ok := staging.Files.(*BackendRsync); !ok {
+		t.Errorf("staging files backend should be rsync, got %T", staging.Files)
+	}
+	if _, ok := staging.Archives.(*BackendS3); !ok {
+		t.Errorf("staging archive store should be S3, got %T", staging.Archives)
+	}
+
+	production := engine.backends["production"]
+	if _, ok := production.Database.(*BackendLocal); !ok {
+		t.Errorf("production database backend should be local, got %T", production.Database)
+	}
+	if _, ok := production.Files.(*BackendLocal); !ok {
+		t.Errorf("production files backend should be local, got %T", production.Files)
+	}
+	if _, ok := production.Archives.(*BackendLocal); !ok {
+		t.Errorf("production archive store should be local, got %T", production.Archives)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := mockConfigs()["staging"]
+	if err := config.Validate("staging"); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+
+	// Direct exports log in to the database themselves
+	config.DBExportMode = DBExportModeDirect
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("direct export config without database user should be rejected")
+	}
+	config.DBUser = "backup"
+	if err := config.Validate("staging"); err != nil {
+		t.Errorf("direct export config rejected: %v", err)
+	}
+
+	// Without any Cloud SQL Admin API operation the bucket isn't needed
+	config.DBImportMode = DBImportModeDirect
+	config.BackupBucket = ""
+	config.BackupURL = "s3://offsite-bucket"
+	if err := config.Validate("staging"); err != nil {
+		t.Errorf("direct export and import config without bucket rejected: %v", err)
+	}
+	config.DBImportMode = "restore"
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("unknown import mode should be rejected")
+	}
+	config.DBImportMode = DBImportModeAdmin
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("Cloud SQL import without bucket should be rejected")
+	}
+	config.BackupBucket = "test-backup-bucket"
+
+	config.CloudSQLOperationTimeout = -time.Minute
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("negative Cloud SQL operation timeout should be rejected")
+	}
+	config.CloudSQLOperationTimeout = 0
+
+	config.CloudSQLInstance = ""
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("Cloud SQL config without instance should be rejected")
+	}
+
+	// The local database backend doesn't need Cloud SQL settings
+	config.DBBackend = DBBackendLocal
+	if err := config.Validate("staging"); err != nil {
+		t.Errorf("local database config rejected: %v", err)
+	}
+
+	// The postgres backend connects to the server itself
+	config.DBBackend = DBBackendPostgres
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("postgres config without database host should be rejected")
+	}
+	config.DBHost = "10.0.0.5"
+	if err := config.Validate("staging"); err != nil {
+		t.Errorf("postgres config rejected: %v", err)
+	}
+
+	config.FilesBackend = "ftp"
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("unknown files backend should be rejected")
+	}
+}
+
+// writeTarGz writes a tar.gz archive with the given entries in name order,
+// like the archives written before manifests were added. A manifest goes
+// first, where readers expect it.
+func writeTarGz(t *testing.T, archivePath string, entries map[string]string) {
+	t.Helper()
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == manifestFileName || names[j] == manifestFileName {
+			return names[i] == manifestFileName
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(entries[name])), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if _, err := tarWriter.Write([]byte(entries[name])); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
 	}
 }
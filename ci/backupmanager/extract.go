@@ -0,0 +1,415 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractLimits caps what extracting an archive may write, so a corrupted or
+// malicious archive can't fill the disk. Zero values use the defaults.
+type ExtractLimits struct {
+	// MaxEntries limits the number of entries of the archive
+	MaxEntries int
+	// MaxSize limits the total size of the extracted files in bytes
+	MaxSize int64
+}
+
+// Default extraction limits, well above the size of the site's files
+const (
+	DefaultExtractMaxEntries = 1000000
+	DefaultExtractMaxSize    = 100 << 30
+)
+
+func (l ExtractLimits) withDefaults() ExtractLimits {
+	if l.MaxEntries <= 0 {
+		l.MaxEntries = DefaultExtractMaxEntries
+	}
+	if l.MaxSize <= 0 {
+		l.MaxSize = DefaultExtractMaxSize
+	}
+	return l
+}
+
+// archiveEntryChecker checks the entries of an archive before they are
+// extracted: names must stay inside the destination and never lead through a
+// symlink, every path appears once, links must point to entries of the
+// archive and the limits hold.
+// Device files and other special entries are rejected.
+type archiveEntryChecker struct {
+	limits  ExtractLimits
+	seen    map[string]byte
+	links   *linkResolver
+	entries int
+	size    int64
+}
+
+func newArchiveEntryChecker(limits ExtractLimits) *archiveEntryChecker {
+	return &archiveEntryChecker{limits: limits.withDefaults(), seen: make(map[string]byte), links: newLinkResolver(nil)}
+}
+
+// check validates the next entry of the archive and returns its cleaned name
+func (c *archiveEntryChecker) check(header *tar.Header) (string, error) {
+	c.entries++
+	if c.entries > c.limits.MaxEntries {
+		return "", fmt.Errorf("archive has more than %d entries", c.limits.MaxEntries)
+	}
+
+	name := path.Clean(header.Name)
+	if header.Name == "" || path.IsAbs(header.Name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid file path in archive: %s", header.Name)
+	}
+	if _, ok := c.seen[name]; ok {
+		return "", fmt.Errorf("duplicate entry %s in archive", name)
+	}
+	for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+		switch c.seen[parent] {
+		case tar.TypeSymlink:
+			return "", fmt.Errorf("%s leads through the symlink %s", name, parent)
+		case tar.TypeReg, tar.TypeLink:
+			return "", fmt.Errorf("%s leads through the file %s", name, parent)
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg:
+		if header.Size < 0 {
+			return "", fmt.Errorf("invalid size of %s: %d", name, header.Size)
+		}
+		c.size += header.Size
+		if c.size > c.limits.MaxSize {
+			return "", fmt.Errorf("archive expands to more than %d bytes", c.limits.MaxSize)
+		}
+	case tar.TypeDir:
+	case tar.TypeSymlink:
+		relName, ok := strings.CutPrefix(name, "files/")
+		if !ok || !c.links.add(relName, header.Linkname) {
+			return "", fmt.Errorf("symlink %s points outside the files: %s", name, header.Linkname)
+		}
+	case tar.TypeLink:
+		target := path.Clean(header.Linkname)
+		if c.seen[target] != tar.TypeReg || !strings.HasPrefix(name, "files/") || !strings.HasPrefix(target, "files/") {
+			return "", fmt.Errorf("hard link %s doesn't point to a file of the archive: %s", name, header.Linkname)
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return "", fmt.Errorf("device file %s in archive", name)
+	default:
+		return "", fmt.Errorf("unsupported entry %s of type %q in archive", name, header.Typeflag)
+	}
+	c.seen[name] = header.Typeflag
+	return name, nil
+}
+
+// maxLinkHops bounds how many symlinks resolving a target follows, as the
+// kernel does, so loops of symlinks end
+const maxLinkHops = 40
+
+// linkResolver checks that symlinks stay inside a root folder. A target is
+// resolved one name at a time through the symlinks added before, the way the
+// filesystem follows them, so a chain of links that each look harmless on
+// their own can't lead outside either. Adding a symlink under a path that an
+// earlier link resolved through checks that earlier link again.
+type linkResolver struct {
+	links    map[string]string
+	through  map[string][]string
+	readLink func(name string) (string, bool)
+}
+
+// newLinkResolver returns a resolver without symlinks. readLink, when not
+// nil, looks up symlinks that already exist under the root.
+func newLinkResolver(readLink func(name string) (string, bool)) *linkResolver {
+	return &linkResolver{links: make(map[string]string), through: make(map[string][]string), readLink: readLink}
+}
+
+// add checks the symlink at name, relative to the root, and keeps it for
+// resolving the next ones. It reports false and keeps nothing when the
+// symlink, or an earlier one resolving through name, points outside.
+func (r *linkResolver) add(name string, target string) bool {
+	if r.escapes(name, target) {
+		return false
+	}
+	r.links[name] = target
+	for _, earlier := range r.through[name] {
+		if earlierTarget, ok := r.links[earlier]; ok && earlier != name && r.escapes(earlier, earlierTarget) {
+			delete(r.links, name)
+			return false
+		}
+	}
+	return true
+}
+
+// escapes reports whether the symlink at name points outside the root.
+// Absolute and empty targets always do, and so do loops.
+func (r *linkResolver) escapes(name string, target string) bool {
+	if target == "" || path.IsAbs(target) {
+		return true
+	}
+	var dir []string
+	if parent := path.Dir(name); parent != "." {
+		dir = strings.Split(parent, "/")
+	}
+	pending := strings.Split(target, "/")
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(dir) == 0 {
+				return true
+			}
+			dir = dir[:len(dir)-1]
+			continue
+		}
+		dir = append(dir, part)
+		current := strings.Join(dir, "/")
+		r.through[current] = append(r.through[current], name)
+		next, ok := r.link(current)
+		if !ok {
+			continue
+		}
+		if hops++; hops > maxLinkHops || next == "" || path.IsAbs(next) {
+			return true
+		}
+		dir = dir[:len(dir)-1]
+		pending = append(strings.Split(next, "/"), pending...)
+	}
+	return false
+}
+
+// link returns the target of the symlink at name if there is one
+func (r *linkResolver) link(name string) (string, bool) {
+	if target, ok := r.links[name]; ok {
+		return target, true
+	}
+	if r.readLink != nil {
+		return r.readLink(name)
+	}
+	return "", false
+}
+
+// extractBackupStream extracts the dump and files of an archive read from r
+// into destinationFolder as it streams in, and returns its manifest. The
+// compression is told by the archive's first bytes, so gzip, zstd and
+// uncompressed archives all extract regardless of their name. Extracted
+// files are checked against the sizes and checksums in the manifest.
+// Archives of every format version up to CurrentArchiveFormat are read, those
+// without a manifest get a legacy one naming a MySQL dump, see
+// backupArchiveReader. Streamed archives list their checksums in a last
+// entry, archives that end before it are rejected as truncated. Extraction
+// stops at the first entry that breaks the limits or isn't safe to extract,
+// see archiveEntryChecker.
+//
+// Only the entries include accepts are extracted, all of them when it is
+// nil. The entries left out are still read and checked against the
+// manifest, but never written.
+func extractBackupStream(r io.Reader, destinationFolder string, limits ExtractLimits, include func(name string) bool) (*BackupManifest, error) {
+	// Create the decompression and tar readers
+	decompressionReader, compression, err := newDecompressionReader(r)
+	if err != nil {
+		Error("Failed to read archive: %v", err)
+		return nil, fmt.Errorf("failed to read archive: %v", err)
+	}
+	defer decompressionReader.Close()
+	Info("Archive is compressed with %s", compression)
+	archive := newBackupArchiveReader(decompressionReader, limits)
+
+	// Extract all files
+	entries := make(map[string]ManifestFile)
+	var directories []*tar.Header
+	skipped := make(map[string]bool)
+	fileCount, linkCount := 0, 0
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Error("Failed to read archive: %v", err)
+			return nil, err
+		}
+
+		// Entries left out are hashed, so the manifest check still covers them
+		if include != nil && !include(header.Name) {
+			switch header.Typeflag {
+			case tar.TypeReg:
+				hash := sha256.New()
+				size, err := io.Copy(hash, archive)
+				if err != nil {
+					Error("Failed to read %s: %v", header.Name, err)
+					return nil, fmt.Errorf("failed to read %s: %v", header.Name, err)
+				}
+				entries[header.Name] = ManifestFile{Path: header.Name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+				skipped[header.Name] = true
+			case tar.TypeLink:
+				linked := entries[path.Clean(header.Linkname)]
+				entries[header.Name] = ManifestFile{Path: header.Name, Size: linked.Size, SHA256: linked.SHA256}
+			}
+			continue
+		}
+
+		// Determine the output path, the checker keeps it inside the destination
+		targetPath := filepath.Join(destinationFolder, filepath.FromSlash(header.Name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Modes and mtimes of directories are set once their content is
+			// in place
+			if err := makeExtractDirs(destinationFolder, targetPath); err != nil {
+				Error("Failed to create directory %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to create directory %s: %v", targetPath, err)
+			}
+			directories = append(directories, header)
+		case tar.TypeSymlink:
+			if err := makeExtractDirs(destinationFolder, filepath.Dir(targetPath)); err != nil {
+				Error("Failed to create parent directory: %v", err)
+				return nil, fmt.Errorf("failed to create parent directory: %v", err)
+			}
+			if err := os.RemoveAll(targetPath); err != nil {
+				Error("Failed to replace %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to replace %s: %v", targetPath, err)
+			}
+			if err := os.Symlink(header.Linkname, targetPath); err != nil {
+				Error("Failed to create symlink %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to create symlink %s: %v", targetPath, err)
+			}
+			linkCount++
+		case tar.TypeLink:
+			// Hard links share the content of a file extracted before
+			if skipped[path.Clean(header.Linkname)] {
+				linked := entries[path.Clean(header.Linkname)]
+				entries[header.Name] = ManifestFile{Path: header.Name, Size: linked.Size, SHA256: linked.SHA256}
+				continue
+			}
+			linkedPath := filepath.Join(destinationFolder, filepath.FromSlash(path.Clean(header.Linkname)))
+			if err := makeExtractDirs(destinationFolder, filepath.Dir(targetPath)); err != nil {
+				Error("Failed to create parent directory: %v", err)
+				return nil, fmt.Errorf("failed to create parent directory: %v", err)
+			}
+			if err := os.RemoveAll(targetPath); err != nil {
+				Error("Failed to replace %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to replace %s: %v", targetPath, err)
+			}
+			if err := os.Link(linkedPath, targetPath); err != nil {
+				Error("Failed to create hard link %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to create hard link %s: %v", targetPath, err)
+			}
+			linked := entries[path.Clean(header.Linkname)]
+			entries[header.Name] = ManifestFile{Path: header.Name, Size: linked.Size, SHA256: linked.SHA256}
+			fileCount++
+		case tar.TypeReg:
+			// Create file
+			if err := makeExtractDirs(destinationFolder, filepath.Dir(targetPath)); err != nil {
+				Error("Failed to create parent directory: %v", err)
+				return nil, fmt.Errorf("failed to create parent directory: %v", err)
+			}
+			// Never write through a symlink or onto a directory left at the target
+			if existing, err := os.Lstat(targetPath); err == nil && !existing.Mode().IsRegular() {
+				if err := os.RemoveAll(targetPath); err != nil {
+					Error("Failed to replace %s: %v", targetPath, err)
+					return nil, fmt.Errorf("failed to replace %s: %v", targetPath, err)
+				}
+			}
+
+			mode := header.FileInfo().Mode().Perm()
+			outFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				Error("Failed to create file %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to create file %s: %v", targetPath, err)
+			}
+
+			hash := sha256.New()
+			size, err := io.Copy(io.MultiWriter(outFile, hash), archive)
+			if err != nil {
+				outFile.Close()
+				Error("Failed to extract file %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to extract file %s: %v", targetPath, err)
+			}
+			outFile.Close()
+			// The umask applies when creating the file, not when changing its mode
+			if err := os.Chmod(targetPath, mode); err != nil {
+				Error("Failed to set mode of %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to set mode of %s: %v", targetPath, err)
+			}
+			if err := os.Chtimes(targetPath, header.ModTime, header.ModTime); err != nil {
+				Error("Failed to set mtime of %s: %v", targetPath, err)
+				return nil, fmt.Errorf("failed to set mtime of %s: %v", targetPath, err)
+			}
+			entries[header.Name] = ManifestFile{Path: header.Name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+			fileCount++
+		}
+	}
+
+	// Deepest directories first, setting the mtime of a directory doesn't
+	// change its parent's. Directories stay writable for their owner, so the
+	// extracted tree can be cleaned up.
+	for i := len(directories) - 1; i >= 0; i-- {
+		header := directories[i]
+		targetPath := filepath.Join(destinationFolder, filepath.FromSlash(header.Name))
+		if err := os.Chmod(targetPath, header.FileInfo().Mode().Perm()|0700); err != nil {
+			Error("Failed to set mode of %s: %v", targetPath, err)
+			return nil, fmt.Errorf("failed to set mode of %s: %v", targetPath, err)
+		}
+		if err := os.Chtimes(targetPath, header.ModTime, header.ModTime); err != nil {
+			Error("Failed to set mtime of %s: %v", targetPath, err)
+			return nil, fmt.Errorf("failed to set mtime of %s: %v", targetPath, err)
+		}
+	}
+
+	manifest := archive.Manifest()
+	if manifest.ChecksumsAtEnd && manifest.Files == nil {
+		Error("Archive ends before its checksums, it is truncated")
+		return nil, fmt.Errorf("archive ends before its checksums, it is truncated")
+	}
+
+	// A corrupted archive must not get as far as the database import
+	if problems := compareManifestFiles(manifest, entries); len(manifest.Files) > 0 && len(problems) > 0 {
+		Error("Archive doesn't match its manifest: %s", summarizeProblems(problems))
+		return nil, fmt.Errorf("archive doesn't match its manifest: %s", summarizeProblems(problems))
+	}
+
+	Info("Successfully extracted %d files, %d directories and %d symlinks from archive", fileCount, len(directories), linkCount)
+	return manifest, nil
+}
+
+// makeExtractDirs creates the directory dir below root along with its
+// parents. Symlinks extracted earlier are never followed, a path leading
+// through one is rejected.
+func makeExtractDirs(root string, dir string) error {
+	relPath, err := filepath.Rel(root, dir)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: %v", err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	if relPath == "." {
+		return nil
+	}
+
+	current := root
+	for _, part := range strings.Split(relPath, string(os.PathSeparator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(current, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("%s leads through the symlink %s", dir, current)
+		case !info.IsDir():
+			return fmt.Errorf("%s is not a directory", current)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntries builds an uncompressed tar stream, regular files are filled
+// with their size in x's
+func tarEntries(t testing.TB, headers ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write %s: %v", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tarWriter.Write([]byte(strings.Repeat("x", int(header.Size))))
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// checkNothingOutside fails when extracting into root/extracted wrote
+// anything else below root
+func checkNothingOutside(t testing.TB, root string) {
+	t.Helper()
+	entries, _ := os.ReadDir(root)
+	for _, entry := range entries {
+		if entry.Name() != "extracted" {
+			t.Errorf("%s written outside the destination", entry.Name())
+		}
+	}
+}
+
+func TestExtractRejectsUnsafeArchives(t *testing.T) {
+	dump := &tar.Header{Name: "db_dump.sql", Typeflag: tar.TypeReg, Size: 4}
+	for _, test := range []struct {
+		name    string
+		limits  ExtractLimits
+		entries []*tar.Header
+		err     string
+	}{
+		{"absolute path", ExtractLimits{}, []*tar.Header{
+			{Name: "/tmp/evil.php", Typeflag: tar.TypeReg, Size: 4},
+		}, "invalid file path"},
+		{"parent path", ExtractLimits{}, []*tar.Header{
+			{Name: "files/../../evil.php", Typeflag: tar.TypeReg, Size: 4},
+		}, "invalid file path"},
+		{"duplicate path", ExtractLimits{}, []*tar.Header{
+			dump, {Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 1}, {Name: "files//a.txt", Typeflag: tar.TypeReg, Size: 2},
+		}, "duplicate entry files/a.txt"},
+		{"file replacing a directory", ExtractLimits{}, []*tar.Header{
+			{Name: "files/styles/", Typeflag: tar.TypeDir}, {Name: "files/styles", Typeflag: tar.TypeReg, Size: 2},
+		}, "duplicate entry files/styles"},
+		{"absolute symlink", ExtractLimits{}, []*tar.Header{
+			{Name: "files/etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		}, "points outside the files"},
+		{"escaping symlink", ExtractLimits{}, []*tar.Header{
+			{Name: "files/inline-images/up", Typeflag: tar.TypeSymlink, Linkname: "../../db_dump.sql"},
+		}, "points outside the files"},
+		{"chained symlinks", ExtractLimits{}, []*tar.Header{
+			{Name: "files/x/y/", Typeflag: tar.TypeDir},
+			{Name: "files/x/y/b", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+			{Name: "files/a", Typeflag: tar.TypeSymlink, Linkname: "x/y/b/.."},
+		}, "points outside the files"},
+		{"symlink chained under an earlier one", ExtractLimits{}, []*tar.Header{
+			{Name: "files/a", Typeflag: tar.TypeSymlink, Linkname: "x/y/b/.."},
+			{Name: "files/x/y/", Typeflag: tar.TypeDir},
+			{Name: "files/x/y/b", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		}, "points outside the files"},
+		{"symlink loop", ExtractLimits{}, []*tar.Header{
+			{Name: "files/a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+			{Name: "files/b", Typeflag: tar.TypeSymlink, Linkname: "a/c"},
+		}, "points outside the files"},
+		{"symlink outside the files", ExtractLimits{}, []*tar.Header{
+			{Name: "db_dump.sql", Typeflag: tar.TypeSymlink, Linkname: "files/a.txt"},
+		}, "points outside the files"},
+		{"hard link outside the archive", ExtractLimits{}, []*tar.Header{
+			{Name: "files/passwd", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+		}, "hard link"},
+		{"hard link to the dump", ExtractLimits{}, []*tar.Header{
+			dump, {Name: "files/dump.sql", Typeflag: tar.TypeLink, Linkname: "db_dump.sql"},
+		}, "hard link"},
+		{"device file", ExtractLimits{}, []*tar.Header{
+			{Name: "files/sda", Typeflag: tar.TypeBlock, Devmajor: 8},
+		}, "device file"},
+		{"fifo", ExtractLimits{}, []*tar.Header{
+			{Name: "files/pipe", Typeflag: tar.TypeFifo},
+		}, "device file"},
+		{"write through a symlink", ExtractLimits{}, []*tar.Header{
+			{Name: "files/styles/", Typeflag: tar.TypeDir},
+			{Name: "files/latest", Typeflag: tar.TypeSymlink, Linkname: "styles"},
+			{Name: "files/latest/evil.php", Typeflag: tar.TypeReg, Size: 4},
+		}, "leads through the symlink"},
+		{"too many entries", ExtractLimits{MaxEntries: 2}, []*tar.Header{
+			dump, {Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 1}, {Name: "files/b.txt", Typeflag: tar.TypeReg, Size: 1},
+		}, "more than 2 entries"},
+		{"too large", ExtractLimits{MaxSize: 10}, []*tar.Header{
+			dump, {Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 7},
+		}, "more than 10 bytes"},
+	} {
+		root := t.TempDir()
+		_, err := extractBackupStream(bytes.NewReader(tarEntries(t, test.entries...)), filepath.Join(root, "extracted"), test.limits, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.name, test.err, err)
+		}
+		checkNothingOutside(t, root)
+
+		report := verifyBackupStream(bytes.NewReader(tarEntries(t, test.entries...)), test.limits)
+		checkStatuses(t, report, map[string]string{"archive stream": CheckFailed})
+	}
+}
+
+func TestExtractHardLinks(t *testing.T) {
+	extractFolder := filepath.Join(t.TempDir(), "extracted")
+	archive := tarEntries(t,
+		&tar.Header{Name: "db_dump.sql", Typeflag: tar.TypeReg, Size: 4},
+		&tar.Header{Name: "files/logo.png", Typeflag: tar.TypeReg, Size: 3},
+		&tar.Header{Name: "files/inline-images/logo.png", Typeflag: tar.TypeLink, Linkname: "files/logo.png"},
+	)
+	if _, err := extractBackupStream(bytes.NewReader(archive), extractFolder, ExtractLimits{}, nil); err != nil {
+		t.Fatalf("extractBackupStream failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(extractFolder, "files", "inline-images", "logo.png")); err != nil || string(data) != "xxx" {
+		t.Errorf("hard link not extracted: %q, %v", data, err)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{"1048576": 1 << 20, "512M": 512 << 20, "100g": 100 << 30, "2T": 2 << 40} {
+		if size, err := ParseByteSize(value); err != nil || size != expected {
+			t.Errorf("%s parsed as %d, %v, expected %d", value, size, err, expected)
+		}
+	}
+	for _, value := range []string{"", "ten", "1.5G", "4GB", "9999999999T"} {
+		if _, err := ParseByteSize(value); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+func FuzzExtractBackupStream(f *testing.F) {
+	f.Add(tarEntries(f,
+		&tar.Header{Name: "db_dump.sql", Typeflag: tar.TypeReg, Size: 4},
+		&tar.Header{Name: "files/styles/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "files/logo.png", Typeflag: tar.TypeReg, Size: 3},
+		&tar.Header{Name: "files/latest.png", Typeflag: tar.TypeSymlink, Linkname: "logo.png"},
+		&tar.Header{Name: "files/copy.png", Typeflag: tar.TypeLink, Linkname: "files/logo.png"},
+	))
+	f.Add(tarEntries(f,
+		&tar.Header{Name: "files/up", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		&tar.Header{Name: "files/up/evil.php", Typeflag: tar.TypeReg, Size: 4},
+	))
+	f.Add(tarEntries(f,
+		&tar.Header{Name: "files/x/y/b", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		&tar.Header{Name: "files/a", Typeflag: tar.TypeSymlink, Linkname: "x/y/b/.."},
+	))
+	f.Add(tarEntries(f, &tar.Header{Name: "../evil.php", Typeflag: tar.TypeReg, Size: 4}))
+	var compressed bytes.Buffer
+	writer, _ := newCompressionWriter(&compressed, CompressionZstd, 0)
+	writer.Write(tarEntries(f, &tar.Header{Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 1}))
+	writer.Close()
+	f.Add(compressed.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		root := t.TempDir()
+		extractFolder := filepath.Join(root, "extracted")
+		limits := ExtractLimits{MaxEntries: 100, MaxSize: 1 << 20}
+		extractBackupStream(bytes.NewReader(data), extractFolder, limits, nil)
+		checkNothingOutside(t, root)
+
+		// Whatever was extracted, no symlink leads out of the files
+		links := newLinkResolver(func(name string) (string, bool) {
+			link, err := os.Readlink(filepath.Join(extractFolder, "files", filepath.FromSlash(name)))
+			return link, err == nil
+		})
+		filepath.Walk(extractFolder, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				return nil
+			}
+			relPath, _ := filepath.Rel(extractFolder, path)
+			link, _ := os.Readlink(path)
+			relName, ok := strings.CutPrefix(filepath.ToSlash(relPath), "files/")
+			if !ok || links.escapes(relName, link) {
+				t.Errorf("extracted symlink %s points outside the files: %s", relPath, link)
+			}
+			return nil
+		})
+
+		verifyBackupStream(bytes.NewReader(data), limits)
+	})
+}
@@ -0,0 +1,211 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Versions of the archive format recorded in the manifest. Restores read
+// every version up to CurrentArchiveFormat and refuse newer ones.
+const (
+	// ArchiveFormatLegacy archives have no manifest. They hold db_dump.sql
+	// and files/, or the backupdb.sql of the AWS export, at their root or
+	// below a single top folder.
+	ArchiveFormatLegacy = 0
+	// ArchiveFormatManifest archives start with a manifest that doesn't
+	// record its format version
+	ArchiveFormatManifest = 1
+	// ArchiveFormatVersioned archives record their format version in the
+	// manifest, the layout is the one of ArchiveFormatManifest
+	ArchiveFormatVersioned = 2
+	// ArchiveFormatIncremental archives build on the archive of a parent run
+	// and only hold the files that changed since, they can't be restored on
+	// their own. Full backups are still written as ArchiveFormatVersioned.
+	ArchiveFormatIncremental = 3
+	// ArchiveFormatArtifacts runs are stored as separate artifacts in a
+	// folder of their own: the database dump, a files archive and a manifest
+	// listing them. The files archive has the layout of
+	// ArchiveFormatIncremental without db_dump.sql, see storedRun.
+	ArchiveFormatArtifacts = 4
+
+	// CurrentArchiveFormat is the newest version of the archives written
+	CurrentArchiveFormat = ArchiveFormatArtifacts
+)
+
+// awsExportDumpName is the name of the database dump in the AWS export
+const awsExportDumpName = "backupdb.sql"
+
+// archiveMetadataError is returned for a manifest or checksums entry that
+// can't be read. The entries that follow can still be read.
+type archiveMetadataError struct {
+	Entry string
+	Err   error
+}
+
+func (e *archiveMetadataError) Error() string {
+	return e.Err.Error()
+}
+
+// backupArchiveReader reads the entries of a backup archive of any known
+// format version. The manifest must be the first entry, the format version it
+// records tells how the names of the other entries translate to the current
+// layout. Every entry is checked with an archiveEntryChecker before it is
+// returned, the manifest and checksums entries are read and skipped.
+type backupArchiveReader struct {
+	tarReader *tar.Reader
+	checker   *archiveEntryChecker
+	started   bool
+	version   int
+
+	// manifest is nil for legacy archives, folder is the top folder their
+	// entries were found in
+	manifest     *BackupManifest
+	manifestRead bool
+	folder       string
+}
+
+func newBackupArchiveReader(r io.Reader, limits ExtractLimits) *backupArchiveReader {
+	return &backupArchiveReader{tarReader: tar.NewReader(r), checker: newArchiveEntryChecker(limits)}
+}
+
+// Next returns the header of the next entry, named as in the current layout.
+// It returns io.EOF at the end of the archive and an *archiveMetadataError
+// for a broken manifest or checksums entry, after which reading continues.
+// Any other error ends the archive.
+func (a *backupArchiveReader) Next() (*tar.Header, error) {
+	for {
+		header, err := a.tarReader.Next()
+		if err == io.EOF {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %v", err)
+		}
+		if !a.started {
+			a.started = true
+			if path.Clean(header.Name) == manifestFileName {
+				if _, err := a.checker.check(header); err != nil {
+					return nil, fmt.Errorf("refusing to extract archive: %v", err)
+				}
+				a.manifestRead = true
+				a.version = CurrentArchiveFormat
+				manifest, err := parseBackupManifest(a.tarReader)
+				if err != nil {
+					return nil, &archiveMetadataError{Entry: manifestFileName, Err: err}
+				}
+				a.manifest = manifest
+				a.version = manifest.FormatVersion
+				continue
+			}
+			a.version = ArchiveFormatLegacy
+			a.folder = legacyArchiveFolder(header.Name)
+			Info("Archive has no manifest, reading it as %s", a.describeLegacyLayout())
+		}
+
+		// Manifest archives use the current layout, the names of other
+		// versions are translated here
+		if a.version == ArchiveFormatLegacy {
+			name, err := a.legacyEntryName(header.Name)
+			if err != nil {
+				return nil, fmt.Errorf("refusing to extract archive: %v", err)
+			}
+			if name == "" {
+				continue
+			}
+			header.Name = name
+			if header.Typeflag == tar.TypeLink {
+				if header.Linkname, err = a.legacyEntryName(header.Linkname); err != nil {
+					return nil, fmt.Errorf("refusing to extract archive: %v", err)
+				}
+			}
+		}
+
+		if header.Name, err = a.checker.check(header); err != nil {
+			return nil, fmt.Errorf("refusing to extract archive: %v", err)
+		}
+		switch {
+		case header.Name == manifestFileName && a.manifestRead:
+			return nil, &archiveMetadataError{Entry: manifestFileName, Err: fmt.Errorf("archive contains more than one manifest")}
+		case header.Name == manifestFileName:
+			return nil, &archiveMetadataError{Entry: manifestFileName, Err: fmt.Errorf("manifest is not the first entry of the archive")}
+		case header.Name == checksumsFileName && a.manifest != nil:
+			if err := a.manifest.addChecksums(a.tarReader); err != nil {
+				return nil, &archiveMetadataError{Entry: checksumsFileName, Err: err}
+			}
+			continue
+		}
+		return header, nil
+	}
+}
+
+// Read reads the content of the current entry
+func (a *backupArchiveReader) Read(p []byte) (int, error) {
+	return a.tarReader.Read(p)
+}
+
+// Manifest returns the manifest of the archive, legacy archives get one
+// naming a MySQL dump
+func (a *backupArchiveReader) Manifest() *BackupManifest {
+	if a.manifest == nil {
+		return legacyBackupManifest()
+	}
+	return a.manifest
+}
+
+// legacyArchiveFolder returns the top folder the entries of a legacy archive
+// are in, told by its first entry, e.g. website-assets/ when the AWS export
+// was packed with its folder. It is empty for archives with the dump and
+// files/ at their root.
+func legacyArchiveFolder(firstEntry string) string {
+	name := path.Clean(firstEntry)
+	top, _, _ := strings.Cut(name, "/")
+	switch {
+	case path.IsAbs(name), top == ".", top == "..", top == "files", top == "db_dump.sql", top == awsExportDumpName:
+		return ""
+	}
+	return top + "/"
+}
+
+// legacyEntryName returns the name of an entry of a legacy archive in the
+// current layout, or an empty name for the top folders that aren't
+// extracted. The AWS export's backupdb.sql becomes db_dump.sql.
+func (a *backupArchiveReader) legacyEntryName(entryName string) (string, error) {
+	name := path.Clean(entryName)
+	if name == "." || name+"/" == a.folder {
+		return "", nil
+	}
+	if a.folder != "" {
+		var ok bool
+		if name, ok = strings.CutPrefix(name, a.folder); !ok {
+			return "", fmt.Errorf("%s is outside the archive's top folder %s", entryName, a.folder)
+		}
+	}
+	if name == awsExportDumpName {
+		return "db_dump.sql", nil
+	}
+	return name, nil
+}
+
+// describeLegacyLayout names the layout of a legacy archive for the logs
+func (a *backupArchiveReader) describeLegacyLayout() string {
+	if a.folder == "" {
+		return "the legacy layout"
+	}
+	return fmt.Sprintf("the legacy layout below %s", a.folder)
+}
+
+// checkFormatVersion rejects manifests of format versions this backup manager
+// doesn't know
+func checkFormatVersion(version int) error {
+	switch {
+	case version < ArchiveFormatManifest:
+		return fmt.Errorf("invalid archive format version %d", version)
+	case version > CurrentArchiveFormat:
+		return fmt.Errorf("archive format version %d is newer than this backup manager reads (up to %d), restore it with a newer backup manager",
+			version, CurrentArchiveFormat)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarWithManifest builds an uncompressed tar stream with a manifest and a
+// complete dump, followed by the given entries filled like in tarEntries
+func tarWithManifest(t *testing.T, manifestJSON string, headers ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	contents := map[string]string{manifestFileName: manifestJSON, "db_dump.sql": completeMySQLDump}
+	headers = append([]*tar.Header{
+		{Name: manifestFileName, Typeflag: tar.TypeReg, Size: int64(len(manifestJSON))},
+		{Name: "db_dump.sql", Typeflag: tar.TypeReg, Size: int64(len(completeMySQLDump))},
+	}, headers...)
+	for _, header := range headers {
+		header.Mode = 0644
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write %s: %v", header.Name, err)
+		}
+		content, ok := contents[header.Name]
+		if !ok {
+			content = strings.Repeat("x", int(header.Size))
+		}
+		tarWriter.Write([]byte(content))
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestLegacyArchiveLayouts(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		entries []*tar.Header
+	}{
+		{"root", []*tar.Header{
+			{Name: "db_dump.sql", Typeflag: tar.TypeReg, Size: 4},
+			{Name: "files/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 1},
+		}},
+		{"tar of the current folder", []*tar.Header{
+			{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "./db_dump.sql", Typeflag: tar.TypeReg, Size: 4},
+			{Name: "./files/a.txt", Typeflag: tar.TypeReg, Size: 1},
+		}},
+		{"AWS export", []*tar.Header{
+			{Name: "backupdb.sql", Typeflag: tar.TypeReg, Size: 4},
+			{Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 1},
+		}},
+		{"AWS export with its folder", []*tar.Header{
+			{Name: "website-assets/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "website-assets/backupdb.sql", Typeflag: tar.TypeReg, Size: 4},
+			{Name: "website-assets/files/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "website-assets/files/a.txt", Typeflag: tar.TypeReg, Size: 1},
+			{Name: "website-assets/files/b.txt", Typeflag: tar.TypeLink, Linkname: "website-assets/files/a.txt"},
+		}},
+	} {
+		tmpFolder := t.TempDir()
+		destination := filepath.Join(tmpFolder, "extracted")
+		manifest, err := extractBackupStream(bytes.NewReader(tarEntries(t, test.entries...)), destination, ExtractLimits{}, nil)
+		if err != nil {
+			t.Errorf("%s: extractBackupStream failed: %v", test.name, err)
+			continue
+		}
+		if manifest.FormatVersion != ArchiveFormatLegacy || manifest.DatabaseEngine != DatabaseEngineMySQL {
+			t.Errorf("%s: unexpected manifest %+v", test.name, manifest)
+		}
+		for _, name := range []string{"db_dump.sql", "files/a.txt"} {
+			if _, err := os.Stat(filepath.Join(destination, name)); err != nil {
+				t.Errorf("%s: %s not extracted: %v", test.name, name, err)
+			}
+		}
+		checkNothingOutside(t, tmpFolder)
+
+		report := verifyBackupStream(bytes.NewReader(tarEntries(t, test.entries...)), ExtractLimits{})
+		checkStatuses(t, report, map[string]string{"archive stream": CheckPassed, "manifest": CheckSkipped})
+	}
+
+	entries := tarEntries(t,
+		&tar.Header{Name: "website-assets/backupdb.sql", Typeflag: tar.TypeReg, Size: 4},
+		&tar.Header{Name: "evil.php", Typeflag: tar.TypeReg, Size: 4},
+	)
+	if _, err := extractBackupStream(bytes.NewReader(entries), filepath.Join(t.TempDir(), "extracted"), ExtractLimits{}, nil); err == nil || !strings.Contains(err.Error(), "outside the archive's top folder") {
+		t.Errorf("entries outside the top folder should be rejected, got %v", err)
+	}
+}
+
+func TestArchiveFormatVersions(t *testing.T) {
+	_, manifest := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	if manifest.FormatVersion != ArchiveFormatVersioned {
+		t.Errorf("archive written with format version %d, expected %d", manifest.FormatVersion, ArchiveFormatVersioned)
+	}
+
+	file := &tar.Header{Name: "files/a.txt", Typeflag: tar.TypeReg, Size: 1}
+	for _, test := range []struct {
+		manifest string
+		version  int
+		err      string
+	}{
+		{`{"database_engine": "mysql"}`, ArchiveFormatManifest, ""},
+		{`{"format_version": 2, "database_engine": "mysql"}`, ArchiveFormatVersioned, ""},
+		{`{"format_version": 3, "database_engine": "mysql", "parent_run_id": "run-1"}`, ArchiveFormatIncremental, ""},
+		{`{"format_version": 4, "database_engine": "mysql"}`, ArchiveFormatArtifacts, ""},
+		{`{"format_version": 5, "database_engine": "mysql"}`, 0, "archive format version 5 is newer"},
+		{`{"format_version": -1, "database_engine": "mysql"}`, 0, "invalid archive format version -1"},
+	} {
+		archive := tarWithManifest(t, test.manifest, file)
+		extracted, err := extractBackupStream(bytes.NewReader(archive), filepath.Join(t.TempDir(), "extracted"), ExtractLimits{}, nil)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.manifest, test.err, err)
+			}
+			checkStatuses(t, verifyBackupStream(bytes.NewReader(archive), ExtractLimits{}), map[string]string{"manifest": CheckFailed})
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: extractBackupStream failed: %v", test.manifest, err)
+		} else if extracted.FormatVersion != test.version {
+			t.Errorf("%s: read as format version %d, expected %d", test.manifest, extracted.FormatVersion, test.version)
+		}
+	}
+
+	// The manifest tells how to read the entries after it, it can't come later
+	archive := tarEntries(t, &tar.Header{Name: "db_dump.sql", Typeflag: tar.TypeReg, Size: 4}, &tar.Header{Name: manifestFileName, Typeflag: tar.TypeReg, Size: 4})
+	if _, err := extractBackupStream(bytes.NewReader(archive), filepath.Join(t.TempDir(), "extracted"), ExtractLimits{}, nil); err == nil || !strings.Contains(err.Error(), "not the first entry") {
+		t.Errorf("a manifest after other entries should be rejected, got %v", err)
+	}
+}
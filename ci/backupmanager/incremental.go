@@ -0,0 +1,472 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexExtension is appended to the name of a run's archive, without its
+// extension, to store the file index of the run next to it
+const indexExtension = ".index.json"
+
+// latestRunFileName is the name of the object recording the last completed
+// run of an environment, which the next incremental backup builds on
+const latestRunFileName = "latest.json"
+
+// DefaultFullBackupInterval is the number of runs after which a full backup is
+// forced when no interval is configured. Every backup is a full backup then:
+// restoring an incremental run needs every archive of its chain, which
+// retention rules deleting archives by age can break, so incremental backups
+// are only taken once BACKUP_FULL_EVERY opts into them.
+const DefaultFullBackupInterval = 1
+
+// FileIndex lists every file, directory and symlink of the files of a backup
+// run. Incremental runs name the run they build on, their parent, and only
+// archive the files that are new or changed since it. The index is stored
+// unencrypted next to the archive, so the next backup can read it without
+// the keys to decrypt archives. It holds names, sizes and checksums, never
+// the content of the files.
+type FileIndex struct {
+	Environment string `json:"environment"`
+	RunID       string `json:"run_id"`
+
+	// ParentRunID is the run an incremental run builds on, empty for full
+	// backups. Depth counts the incremental runs since the full backup.
+	ParentRunID string `json:"parent_run_id,omitempty"`
+	Depth       int    `json:"depth"`
+
+	// Files lists the complete files of the run, including those stored in
+	// the archives of earlier runs. Deleted lists the entries of the parent
+	// run that are gone.
+	Files   []IndexedFile `json:"files"`
+	Deleted []string      `json:"deleted,omitempty"`
+}
+
+// IndexedFile is an entry of a file index. Paths are relative to the files
+// folder, directory paths end with a slash. Only regular files have a size
+// and checksum, symlinks have a link target.
+type IndexedFile struct {
+	Path    string    `json:"path"`
+	Mode    int64     `json:"mode"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// isRegular reports whether the entry is a regular file
+func (f IndexedFile) isRegular() bool {
+	return !strings.HasSuffix(f.Path, "/") && f.Link == ""
+}
+
+// latestRun is stored as latestRunFileName once a backup completed
+type latestRun struct {
+	RunID string `json:"run_id"`
+}
+
+// fileIndexURL returns the storage location of the file index of a run stored
+// as a single archive, e.g. gs://bucket/backups/staging/backup_<runId>.index.json.
+// Runs stored as separate artifacts keep it in their folder, see storedRun.
+func fileIndexURL(envConfig *EnvironmentConfig, environment string, runId string) string {
+	return archivePrefix(envConfig, environment, runId) + indexExtension
+}
+
+// latestRunURL returns the storage location of the record of the last run
+// of an environment
+func latestRunURL(envConfig *EnvironmentConfig, environment string) string {
+	return fmt.Sprintf("%s/backups/%s/%s", envConfig.ArchiveBaseURL(), environment, latestRunFileName)
+}
+
+// fileIndexBuilder records the file index of a run while its files stream
+// into the archive and tells the files that are unchanged since the parent
+// run apart
+type fileIndexBuilder struct {
+	index  *FileIndex
+	parent map[string]IndexedFile
+
+	// unchanged counts the files left out of the archive
+	unchanged     int
+	unchangedSize int64
+}
+
+// newFileIndexBuilder starts the index of a run building on parent, or of a
+// full backup when parent is nil
+func newFileIndexBuilder(environment string, runId string, parent *FileIndex) *fileIndexBuilder {
+	builder := &fileIndexBuilder{index: &FileIndex{Environment: environment, RunID: runId, Files: []IndexedFile{}}}
+	if parent != nil {
+		builder.index.ParentRunID = parent.RunID
+		builder.index.Depth = parent.Depth + 1
+		builder.parent = make(map[string]IndexedFile, len(parent.Files))
+		for _, file := range parent.Files {
+			builder.parent[file.Path] = file
+		}
+	}
+	return builder
+}
+
+// unchangedFile returns the parent's entry of a regular file whose size, mode
+// and mtime are the same as in the parent run. Its content is in the
+// archives of earlier runs.
+func (b *fileIndexBuilder) unchangedFile(header *tar.Header) (IndexedFile, bool) {
+	if header.Typeflag != tar.TypeReg {
+		return IndexedFile{}, false
+	}
+	previous, ok := b.parent[header.Name]
+	if !ok || !previous.isRegular() || previous.Size != header.Size || previous.Mode != header.Mode || !previous.ModTime.Equal(header.ModTime) {
+		return IndexedFile{}, false
+	}
+	return previous, true
+}
+
+// add records an entry of the files, named relative to the files folder,
+// with the checksum of regular files
+func (b *fileIndexBuilder) add(header *tar.Header, checksum string) {
+	entry := IndexedFile{Path: header.Name, Mode: header.Mode, ModTime: header.ModTime.UTC(), Link: header.Linkname}
+	if header.Typeflag == tar.TypeReg {
+		entry.Size = header.Size
+		entry.SHA256 = checksum
+	}
+	b.index.Files = append(b.index.Files, entry)
+}
+
+// addUnchanged records a file left out of the archive as it didn't change
+func (b *fileIndexBuilder) addUnchanged(previous IndexedFile) {
+	b.index.Files = append(b.index.Files, previous)
+	b.unchanged++
+	b.unchangedSize += previous.Size
+}
+
+// finish lists the entries of the parent run that weren't seen once all
+// files were added
+func (b *fileIndexBuilder) finish() {
+	seen := make(map[string]bool, len(b.index.Files))
+	for _, file := range b.index.Files {
+		seen[file.Path] = true
+	}
+	for name := range b.parent {
+		if !seen[name] {
+			b.index.Deleted = append(b.index.Deleted, name)
+		}
+	}
+	sort.Strings(b.index.Deleted)
+}
+
+// storedObjectExists reports whether an object is stored at url
+func storedObjectExists(store ArchiveStore, url string) (bool, error) {
+	stored, err := store.ListArchives(url)
+	if err != nil {
+		return false, err
+	}
+	for _, storedURL := range stored {
+		if storedURL == url {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readStoredObject reads a small object like a file index or signature from
+// the archive store
+func readStoredObject(ctx context.Context, store ArchiveStore, url string) ([]byte, error) {
+	reader, err := store.NewArchiveReader(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", url, err)
+	}
+	return data, nil
+}
+
+// writeStoredObject stores a small object like a file index or signature
+func writeStoredObject(ctx context.Context, store ArchiveStore, url string, data []byte) error {
+	upload, err := store.NewArchiveWriter(ctx, url)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Write(data); err != nil {
+		upload.Abort(err)
+		return fmt.Errorf("failed to write %s: %v", url, err)
+	}
+	return upload.Close()
+}
+
+// readFileIndex reads the file index of a run along with the size and
+// checksum of the stored index. It returns a nil index for runs stored
+// without one, e.g. before incremental backups were added.
+func readFileIndex(ctx context.Context, store ArchiveStore, url string) (*FileIndex, *archiveDigest, error) {
+	found, err := storedObjectExists(store, url)
+	if err != nil || !found {
+		return nil, nil, err
+	}
+	data, err := readStoredObject(ctx, store, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := newArchiveDigest()
+	digest.Write(data)
+	var index FileIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse file index %s: %v", url, err)
+	}
+	return &index, digest, nil
+}
+
+// writeFileIndex stores the file index of a run and returns the size and
+// checksum of the stored index
+func writeFileIndex(ctx context.Context, store ArchiveStore, url string, index *FileIndex) (*archiveDigest, error) {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file index: %v", err)
+	}
+	if err := writeStoredObject(ctx, store, url, data); err != nil {
+		return nil, err
+	}
+	digest := newArchiveDigest()
+	digest.Write(data)
+	return digest, nil
+}
+
+// readLatestRun returns the last completed run of an environment, or an
+// empty run ID when none is recorded
+func readLatestRun(ctx context.Context, store ArchiveStore, envConfig *EnvironmentConfig, environment string) (string, error) {
+	url := latestRunURL(envConfig, environment)
+	found, err := storedObjectExists(store, url)
+	if err != nil || !found {
+		return "", err
+	}
+	data, err := readStoredObject(ctx, store, url)
+	if err != nil {
+		return "", err
+	}
+	var latest latestRun
+	if err := json.Unmarshal(data, &latest); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", url, err)
+	}
+	return latest.RunID, nil
+}
+
+// writeLatestRun records the run the next incremental backup builds on
+func writeLatestRun(ctx context.Context, store ArchiveStore, envConfig *EnvironmentConfig, environment string, runId string) error {
+	data, err := json.MarshalIndent(latestRun{RunID: runId}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode last run: %v", err)
+	}
+	return writeStoredObject(ctx, store, latestRunURL(envConfig, environment), data)
+}
+
+// findParentRun returns the file index of the run an incremental backup of
+// environment builds on, or nil when a full backup is due: no run is
+// recorded yet, the last run can't be read or the configured number of runs
+// since the last full backup is reached. Problems reading the last run never
+// fail the backup, they result in a full backup.
+func findParentRun(ctx context.Context, store ArchiveStore, envConfig *EnvironmentConfig, environment string, runId string) *FileIndex {
+	latest, err := readLatestRun(ctx, store, envConfig, environment)
+	switch {
+	case err != nil:
+		Warn("Failed to read the last run of %s, taking a full backup: %v", environment, err)
+		return nil
+	case latest == "":
+		Info("No previous run of %s is recorded, taking a full backup", environment)
+		return nil
+	case latest == runId:
+		// The archive the next run would build on is about to be replaced
+		Warn("Run '%s' is backed up again, taking a full backup", runId)
+		return nil
+	}
+
+	stored, err := findStoredRun(store, envConfig, environment, latest)
+	switch {
+	case err != nil:
+		Warn("Backup of run '%s' is missing, taking a full backup: %v", latest, err)
+		return nil
+	case stored.Folder != "" && stored.Files == "":
+		Warn("Files archive of run '%s' is missing, taking a full backup", latest)
+		return nil
+	}
+
+	parent, _, err := readFileIndex(ctx, store, stored.Index)
+	switch {
+	case err != nil:
+		Warn("Failed to read the file index of run '%s', taking a full backup: %v", latest, err)
+		return nil
+	case parent == nil:
+		Warn("Run '%s' has no file index, taking a full backup", latest)
+		return nil
+	case parent.Depth+1 >= envConfig.FullBackupInterval():
+		Info("%d runs since the last full backup of %s, taking a full backup", parent.Depth+1, environment)
+		return nil
+	}
+	Info("Taking an incremental backup on top of run '%s'", latest)
+	return parent
+}
+
+// readRestoreChain reads the file index of a run and of the runs it builds
+// on. The indexes are returned from the full backup to the run and must be
+// signed by a key the destination environment trusts, like the archives.
+// Runs stored without an index are returned as a single nil index.
+func readRestoreChain(ctx context.Context, store ArchiveStore, signing *ArchiveSigning, envConfig *EnvironmentConfig, environment string, runId string, destinationEnvironment string, options RestoreOptions) ([]*FileIndex, error) {
+	var chain []*FileIndex
+	seen := make(map[string]bool)
+	for current := runId; ; {
+		if seen[current] {
+			Error("Run '%s' builds on itself", current)
+			return nil, fmt.Errorf("run '%s' builds on itself", current)
+		}
+		seen[current] = true
+
+		stored, err := findStoredRun(store, envConfig, environment, current)
+		if err != nil && current != runId {
+			Error("Run '%s' builds on run '%s', which is missing: %v", chain[0].RunID, current, err)
+			return nil, fmt.Errorf("run '%s' builds on run '%s', which is missing: %v", chain[0].RunID, current, err)
+		}
+		if err != nil {
+			Error("Failed to find backup: %v", err)
+			return nil, fmt.Errorf("failed to find backup: %v", err)
+		}
+		url := stored.Index
+		index, digest, err := readFileIndex(ctx, store, url)
+		if err != nil {
+			Error("Failed to read file index: %v", err)
+			return nil, fmt.Errorf("failed to read file index: %v", err)
+		}
+		if index == nil {
+			if current != runId {
+				Error("Run '%s' builds on run '%s', whose file index is missing", chain[0].RunID, current)
+				return nil, fmt.Errorf("run '%s' builds on run '%s', whose file index is missing", chain[0].RunID, current)
+			}
+			return []*FileIndex{nil}, nil
+		}
+		if index.Environment != environment || index.RunID != current {
+			Error("File index of %s run '%s' belongs to %s run '%s'", environment, current, index.Environment, index.RunID)
+			return nil, fmt.Errorf("file index of %s run '%s' belongs to %s run '%s'", environment, current, index.Environment, index.RunID)
+		}
+		signature, err := checkStoredSignature(ctx, store, signing, environment, current, url)
+		if err := checkRestoreSignature(err, destinationEnvironment, options); err != nil {
+			return nil, err
+		}
+		if signature != nil {
+			if err := checkRestoreSignature(signature.checkDigest(url, digest), destinationEnvironment, options); err != nil {
+				return nil, err
+			}
+		}
+
+		chain = append([]*FileIndex{index}, chain...)
+		if index.ParentRunID == "" {
+			return chain, nil
+		}
+		current = index.ParentRunID
+	}
+}
+
+// removeDeletedFiles removes the entries an incremental run lists as deleted
+// from the files restored from the runs before it. Deleted entries below a
+// symlink or a file aren't there to remove, nothing is ever removed through
+// a symlink.
+func removeDeletedFiles(filesFolder string, deleted []string) error {
+	for _, name := range deleted {
+		cleaned := path.Clean(name)
+		if name == "" || path.IsAbs(name) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return fmt.Errorf("invalid deleted path in file index: %s", name)
+		}
+
+		target := filesFolder
+		parts := strings.Split(cleaned, "/")
+		reachable := true
+		for _, part := range parts[:len(parts)-1] {
+			target = filepath.Join(target, part)
+			info, err := os.Lstat(target)
+			if err != nil || !info.IsDir() {
+				reachable = false
+				break
+			}
+		}
+		if !reachable {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(filesFolder, filepath.FromSlash(cleaned))); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkRestoredFiles compares the files restored from a chain of runs with
+// the file index of the last run and describes every difference. Only the
+// entries filter selects are compared, the directories holding them may be
+// restored without being selected.
+func checkRestoredFiles(filesFolder string, index *FileIndex, filter *PathFilter) ([]string, error) {
+	restored := make(map[string]os.FileInfo)
+	err := filepath.Walk(filesFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(filesFolder, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %v", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+		name := filepath.ToSlash(relPath)
+		if info.IsDir() {
+			name += "/"
+		}
+		if !info.IsDir() || filter.Match(name) {
+			restored[name] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, expected := range index.Files {
+		if !filter.Match(expected.Path) {
+			continue
+		}
+		info, ok := restored[expected.Path]
+		delete(restored, expected.Path)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s is missing", expected.Path))
+		case expected.Link != "" && info.Mode()&os.ModeSymlink == 0:
+			problems = append(problems, fmt.Sprintf("%s is not a symlink", expected.Path))
+		case expected.isRegular() && !info.Mode().IsRegular():
+			problems = append(problems, fmt.Sprintf("%s is not a regular file", expected.Path))
+		case expected.isRegular() && info.Size() != expected.Size:
+			problems = append(problems, fmt.Sprintf("%s has %d bytes, expected %d", expected.Path, info.Size(), expected.Size))
+		}
+	}
+	var unexpected []string
+	for name := range restored {
+		unexpected = append(unexpected, name)
+	}
+	sort.Strings(unexpected)
+	for _, name := range unexpected {
+		problems = append(problems, fmt.Sprintf("%s is not in the file index", name))
+	}
+	return problems, nil
+}
+
+// describeIncremental summarizes what the archive of a run contains
+func describeIncremental(builder *fileIndexBuilder) string {
+	if builder.index.ParentRunID == "" {
+		return fmt.Sprintf("full backup of %d entries", len(builder.index.Files))
+	}
+	return fmt.Sprintf("incremental backup on top of run '%s': %d of %d entries archived, %d unchanged files (%d bytes) left out, %d entries deleted",
+		builder.index.ParentRunID, len(builder.index.Files)-builder.unchanged, len(builder.index.Files),
+		builder.unchanged, builder.unchangedSize, len(builder.index.Deleted))
+}
@@ -0,0 +1,232 @@
+package backupmanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newLocalFilesEngine returns a mock engine whose files and archives are
+// stored in local folders below root, see localConfigs
+func newLocalFilesEngine(t *testing.T, root string) (*BackupEngineCloud, EnvironmentConfigs) {
+	t.Helper()
+	configs := localConfigs(root)
+	engine := newMockEngine(NewMockBackend(), configs)
+	for _, backends := range engine.backends {
+		backends.Files = NewBackendLocal()
+		backends.Archives = NewBackendLocal()
+	}
+	return engine, configs
+}
+
+// readStoredIndex reads the file index of a staging run
+func readStoredIndex(t *testing.T, configs EnvironmentConfigs, runId string) *FileIndex {
+	t.Helper()
+	stored, err := findStoredRun(NewBackendLocal(), configs["staging"], "staging", runId)
+	if err != nil {
+		t.Fatalf("failed to find run '%s': %v", runId, err)
+	}
+	index, _, err := readFileIndex(context.Background(), NewBackendLocal(), stored.Index)
+	if err != nil || index == nil {
+		t.Fatalf("failed to read file index of run '%s': %v", runId, err)
+	}
+	return index
+}
+
+// checkFileContents checks the content of the files below root, an empty
+// content for a path that must not exist
+func checkFileContents(t *testing.T, root string, contents map[string]string) {
+	t.Helper()
+	for name, expected := range contents {
+		data, err := os.ReadFile(filepath.Join(root, name))
+		switch {
+		case expected == "" && !os.IsNotExist(err):
+			t.Errorf("%s should not exist, got %q, %v", name, data, err)
+		case expected != "" && (err != nil || string(data) != expected):
+			t.Errorf("%s has %q, %v, expected %q", name, data, err, expected)
+		}
+	}
+}
+
+func TestIncrementalBackupAndRestore(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].FullBackups = 7
+	staging := configs["staging"].TargetPath
+	production := configs["production"].TargetPath
+	unsigned := RestoreOptions{AllowUnsigned: true}
+
+	mustWriteFile(t, filepath.Join(staging, "a.txt"), "a")
+	mustWriteFile(t, filepath.Join(staging, "dir/b.txt"), "b")
+	mustWriteFile(t, filepath.Join(staging, "keep.txt"), "keep")
+	mustWriteFile(t, filepath.Join(staging, "x"), "x")
+	if err := os.Symlink("keep.txt", filepath.Join(staging, "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-incr-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	full := readStoredIndex(t, configs, "test-run-incr-1")
+	if full.ParentRunID != "" || full.Depth != 0 || len(full.Files) != 6 {
+		t.Errorf("first run should be a full backup of 6 entries, got %+v", full)
+	}
+
+	// Change, add and delete files, x turns from a file into a folder
+	mustWriteFile(t, filepath.Join(staging, "dir/b.txt"), "bb")
+	mustWriteFile(t, filepath.Join(staging, "c.txt"), "c")
+	if err := os.Remove(filepath.Join(staging, "a.txt")); err != nil {
+		t.Fatalf("Failed to remove a.txt: %v", err)
+	}
+	if err := os.Remove(filepath.Join(staging, "x")); err != nil {
+		t.Fatalf("Failed to remove x: %v", err)
+	}
+	mustWriteFile(t, filepath.Join(staging, "x/y.txt"), "y")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-incr-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	incremental := readStoredIndex(t, configs, "test-run-incr-2")
+	if incremental.ParentRunID != "test-run-incr-1" || incremental.Depth != 1 {
+		t.Errorf("second run should build on the first, got parent '%s' at depth %d", incremental.ParentRunID, incremental.Depth)
+	}
+	if !reflect.DeepEqual(incremental.Deleted, []string{"a.txt", "x"}) {
+		t.Errorf("unexpected deleted entries %v", incremental.Deleted)
+	}
+
+	// Only the changed files are in the archive, the index lists them all
+	archivePath := filepath.Join(root, "backups/backups/staging/test-run-incr-2/files.tar.gz")
+	extracted := filepath.Join(t.TempDir(), "extracted")
+	manifest, err := extractTestArchive(t, archivePath, extracted)
+	if err != nil {
+		t.Fatalf("extracting archive failed: %v", err)
+	}
+	if manifest.ParentRunID != "test-run-incr-1" || manifest.FormatVersion != ArchiveFormatArtifacts {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	checkFileContents(t, filepath.Join(extracted, "files"), map[string]string{
+		"dir/b.txt": "bb", "c.txt": "c", "x/y.txt": "y", "keep.txt": "", "a.txt": "",
+	})
+	if len(incremental.Files) != 7 {
+		t.Errorf("index should list 7 entries, got %d", len(incremental.Files))
+	}
+
+	// Restores rebuild the files of a run from the chain
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-incr-2", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{
+		"dir/b.txt": "bb", "c.txt": "c", "x/y.txt": "y", "keep.txt": "keep", "a.txt": "",
+	})
+	if link, err := os.Readlink(filepath.Join(production, "link.txt")); err != nil || link != "keep.txt" {
+		t.Errorf("link.txt not restored: %q, %v", link, err)
+	}
+
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-incr-1", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{
+		"dir/b.txt": "b", "c.txt": "", "x": "x", "keep.txt": "keep", "a.txt": "a",
+	})
+
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-incr-2")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"checksums": CheckPassed, "parent": CheckPassed})
+
+	// Without the files archive it builds on, the run can't be restored
+	if err := os.Remove(filepath.Join(root, "backups/backups/staging/test-run-incr-1/files.tar.gz")); err != nil {
+		t.Fatalf("Failed to remove archive: %v", err)
+	}
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-incr-2", "production", unsigned)
+	if err == nil || !strings.Contains(err.Error(), "test-run-incr-1") {
+		t.Errorf("restore without the parent archive should fail, got %v", err)
+	}
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-incr-2")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"parent": CheckFailed})
+
+	// The next backup can't build on a chain with a missing archive either
+	if err := os.Remove(filepath.Join(root, "backups/backups/staging/test-run-incr-2/files.tar.gz")); err != nil {
+		t.Fatalf("Failed to remove archive: %v", err)
+	}
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-incr-3"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	if index := readStoredIndex(t, configs, "test-run-incr-3"); index.ParentRunID != "" {
+		t.Errorf("backup after a missing archive should be full, got parent '%s'", index.ParentRunID)
+	}
+}
+
+func TestFullBackupInterval(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].FullBackups = 2
+	mustWriteFile(t, filepath.Join(configs["staging"].TargetPath, "a.txt"), "a")
+
+	for _, run := range []struct {
+		runId  string
+		parent string
+	}{
+		{"test-run-interval-1", ""},
+		{"test-run-interval-2", "test-run-interval-1"},
+		{"test-run-interval-3", ""},
+		{"test-run-interval-4", "test-run-interval-3"},
+		// Backing up a run again replaces the archive the next run builds on
+		{"test-run-interval-4", ""},
+	} {
+		if err := engine.PerformBackup(context.Background(), "staging", run.runId); err != nil {
+			t.Fatalf("PerformBackup failed: %v", err)
+		}
+		if index := readStoredIndex(t, configs, run.runId); index.ParentRunID != run.parent {
+			t.Errorf("run '%s' builds on '%s', expected '%s'", run.runId, index.ParentRunID, run.parent)
+		}
+	}
+
+	if (&EnvironmentConfig{}).FullBackupInterval() != DefaultFullBackupInterval {
+		t.Errorf("unset interval should use the default")
+	}
+
+	// Without an interval every backup is a full backup
+	configs["staging"].FullBackups = 0
+	for _, runId := range []string{"test-run-interval-5", "test-run-interval-6"} {
+		if err := engine.PerformBackup(context.Background(), "staging", runId); err != nil {
+			t.Fatalf("PerformBackup failed: %v", err)
+		}
+		if index := readStoredIndex(t, configs, runId); index.ParentRunID != "" {
+			t.Errorf("run '%s' builds on '%s' without an interval configured", runId, index.ParentRunID)
+		}
+	}
+	config := mockConfigs()["staging"]
+	config.FullBackups = -1
+	if err := config.Validate("staging"); err == nil {
+		t.Errorf("negative full backup interval should be rejected")
+	}
+}
+
+func TestRemoveDeletedFiles(t *testing.T) {
+	root := t.TempDir()
+	files := filepath.Join(root, "files")
+	outside := filepath.Join(root, "outside")
+	mustWriteFile(t, filepath.Join(files, "dir/a.txt"), "a")
+	mustWriteFile(t, filepath.Join(files, "b.txt"), "b")
+	mustWriteFile(t, filepath.Join(outside, "c.txt"), "c")
+	if err := os.Symlink("../outside", filepath.Join(files, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if err := removeDeletedFiles(files, []string{"dir/", "link/c.txt", "missing/d.txt"}); err != nil {
+		t.Fatalf("removeDeletedFiles failed: %v", err)
+	}
+	checkFileContents(t, root, map[string]string{"files/dir/a.txt": "", "files/b.txt": "b", "outside/c.txt": "c"})
+
+	for _, invalid := range []string{"../outside/c.txt", "/etc/passwd", "."} {
+		if err := removeDeletedFiles(files, []string{invalid}); err == nil {
+			t.Errorf("deleted path %s should be rejected", invalid)
+		}
+	}
+}
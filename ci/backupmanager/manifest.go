@@ -0,0 +1,211 @@
+package backupmanager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is the backup manager version recorded in the manifests. Release
+// builds set it with -ldflags "-X github.com/interledger/interledger.org-v4/ci/backup-manager.Version=<version>".
+var Version = "dev"
+
+// Database engines that produce the dumps in backup archives
+const (
+	DatabaseEngineMySQL    = "mysql"
+	DatabaseEnginePostgres = "postgresql"
+)
+
+// Formats of the database dump in a backup archive
+const (
+	DumpFormatSQL            = "sql"
+	DumpFormatSQLGzip        = "sql.gz"
+	DumpFormatPostgresCustom = "pgdump"
+)
+
+// manifestFileName is the name of the manifest inside a backup archive,
+// checksumsFileName the name of the checksums that end streamed archives
+const (
+	manifestFileName  = "manifest.json"
+	checksumsFileName = "checksums.json"
+)
+
+// BackupManifest describes where a backup archive comes from and what it
+// contains. It is stored as the first entry of the archive.
+type BackupManifest struct {
+	// FormatVersion is the version of the archive layout, manifests written
+	// before it was recorded are ArchiveFormatManifest
+	FormatVersion int `json:"format_version,omitempty"`
+
+	Environment      string `json:"environment,omitempty"`
+	RunID            string `json:"run_id,omitempty"`
+	DatabaseName     string `json:"database_name,omitempty"`
+	CloudSQLInstance string `json:"cloudsql_instance,omitempty"`
+	ToolVersion      string `json:"tool_version,omitempty"`
+
+	// ParentRunID is the run an incremental backup builds on, its archive
+	// only holds the files that changed since. Empty for full backups.
+	ParentRunID string `json:"parent_run_id,omitempty"`
+
+	// StartedAt is when the backup started, FinishedAt when the database
+	// dump and the files were complete
+	StartedAt  time.Time `json:"started_at,omitzero"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+
+	// DatabaseEngine is the engine that produced db_dump.sql, DumpFormat
+	// tells how the dump is encoded, e.g. DumpFormatSQLGzip
+	DatabaseEngine string `json:"database_engine"`
+	DumpFormat     string `json:"dump_format,omitempty"`
+
+	// Compression is the compression of the archive, e.g. CompressionZstd,
+	// and CompressionLevel its level, 0 for the default level
+	Compression      string `json:"compression,omitempty"`
+	CompressionLevel int    `json:"compression_level,omitempty"`
+
+	// FilesInclude and FilesExclude are the patterns that selected the files
+	// backed up, see EnvironmentConfig.FilesFilter. Empty when every file was
+	// backed up.
+	FilesInclude []string `json:"files_include,omitempty"`
+	FilesExclude []string `json:"files_exclude,omitempty"`
+
+	// Files lists every other entry of the archive, the dump included.
+	// Streamed archives set ChecksumsAtEnd instead, their files are only
+	// known once they're written and are listed in the checksums entry at the
+	// end of the archive.
+	Files          []ManifestFile `json:"files,omitempty"`
+	ChecksumsAtEnd bool           `json:"checksums_at_end,omitempty"`
+
+	// Artifacts lists the artifacts of a run stored as separate artifacts,
+	// e.g. db.sql.gz, with their size and checksum as stored
+	Artifacts []ManifestFile `json:"artifacts,omitempty"`
+}
+
+// FilesFilter returns the filter that selected the files backed up, nil when
+// every file was backed up
+func (m *BackupManifest) FilesFilter() (*PathFilter, error) {
+	filter, err := NewPathFilter(m.FilesInclude, m.FilesExclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file patterns in manifest: %v", err)
+	}
+	return filter, nil
+}
+
+// archiveChecksums is the last entry of streamed archives. It completes the
+// manifest with the time the backup finished and the files it contains.
+type archiveChecksums struct {
+	FinishedAt time.Time      `json:"finished_at,omitzero"`
+	Files      []ManifestFile `json:"files"`
+}
+
+// ManifestFile records the size and SHA-256 checksum of an archive entry
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// legacyBackupManifest describes archives written before manifests were
+// added, which only contain MySQL dumps
+func legacyBackupManifest() *BackupManifest {
+	return &BackupManifest{FormatVersion: ArchiveFormatLegacy, DatabaseEngine: DatabaseEngineMySQL}
+}
+
+// parseBackupManifest decodes the manifest entry of an archive
+func parseBackupManifest(r io.Reader) (*BackupManifest, error) {
+	var manifest BackupManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if manifest.FormatVersion == 0 {
+		manifest.FormatVersion = ArchiveFormatManifest
+	}
+	if err := checkFormatVersion(manifest.FormatVersion); err != nil {
+		return nil, err
+	}
+	if manifest.DatabaseEngine == "" {
+		return nil, fmt.Errorf("manifest does not name the database engine")
+	}
+	return &manifest, nil
+}
+
+// addChecksums completes the manifest of a streamed archive with the
+// checksums entry read at its end
+func (m *BackupManifest) addChecksums(r io.Reader) error {
+	if !m.ChecksumsAtEnd || m.Files != nil {
+		return fmt.Errorf("archive contains checksums its manifest doesn't announce")
+	}
+	var checksums archiveChecksums
+	if err := json.NewDecoder(r).Decode(&checksums); err != nil {
+		return fmt.Errorf("failed to parse checksums: %v", err)
+	}
+	m.FinishedAt = checksums.FinishedAt
+	m.Files = checksums.Files
+	if m.Files == nil {
+		m.Files = []ManifestFile{}
+	}
+	return nil
+}
+
+// detectDumpFormat tells gzipped SQL dumps (e.g. Cloud SQL exports), plain
+// SQL dumps and pg_dump custom format dumps apart by their first bytes. The
+// returned reader reads the whole dump, including the bytes looked at.
+func detectDumpFormat(dump io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReader(dump)
+	magic, err := buffered.Peek(5)
+	if err != nil && err != io.EOF {
+		return "", nil, fmt.Errorf("failed to read dump: %v", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return DumpFormatSQLGzip, buffered, nil
+	case bytes.Equal(magic, []byte("PGDMP")):
+		return DumpFormatPostgresCustom, buffered, nil
+	default:
+		return DumpFormatSQL, buffered, nil
+	}
+}
+
+// compareManifestFiles compares the entries read from an archive with the
+// files listed in its manifest and describes every difference
+func compareManifestFiles(manifest *BackupManifest, entries map[string]ManifestFile) []string {
+	var problems []string
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, expected := range manifest.Files {
+		listed[expected.Path] = true
+		entry, ok := entries[expected.Path]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s is missing", expected.Path))
+		case entry.Size != expected.Size:
+			problems = append(problems, fmt.Sprintf("%s has %d bytes, expected %d", expected.Path, entry.Size, expected.Size))
+		case entry.SHA256 != expected.SHA256:
+			problems = append(problems, fmt.Sprintf("%s has SHA-256 %s, expected %s", expected.Path, entry.SHA256, expected.SHA256))
+		}
+	}
+
+	var unexpected []string
+	for path := range entries {
+		if !listed[path] {
+			unexpected = append(unexpected, path)
+		}
+	}
+	sort.Strings(unexpected)
+	for _, path := range unexpected {
+		problems = append(problems, fmt.Sprintf("%s is not listed in the manifest", path))
+	}
+	return problems
+}
+
+// summarizeProblems joins the first few problems into one line
+func summarizeProblems(problems []string) string {
+	const shown = 5
+	if len(problems) <= shown {
+		return strings.Join(problems, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more", strings.Join(problems[:shown], "; "), len(problems)-shown)
+}
@@ -0,0 +1,500 @@
+package backupmanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxInsertSize is the size after which an extended INSERT statement is
+// closed and a new one started, well below the default max_allowed_packet
+const maxInsertSize = 1 << 20
+
+// definerClause matches the DEFINER of a view, which the importing user
+// usually isn't allowed to set
+var definerClause = regexp.MustCompile("DEFINER=`[^`]*`@`[^`]*` ")
+
+// mysqlDumpStats summarises a dump written by dumpMySQLDatabase
+type mysqlDumpStats struct {
+	Tables   int
+	Views    int
+	Rows     int64
+	Triggers int
+	Routines int
+	Events   int
+}
+
+// dumpWriter writes a dump and keeps the first write error, so a dump that
+// couldn't be written completely is never reported as complete
+type dumpWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dumpWriter) printf(format string, args ...any) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+func (d *dumpWriter) writeString(s string) {
+	if d.err == nil {
+		_, d.err = io.WriteString(d.w, s)
+	}
+}
+
+// dumpMySQLDatabase writes a logical dump of the database to w. All tables are
+// read inside a single consistent-snapshot transaction, so InnoDB tables are
+// dumped as of one point in time without locking them. Like a Cloud SQL
+// export the dump creates and selects the database itself, and it includes
+// the triggers, stored routines and events of the database.
+func dumpMySQLDatabase(ctx context.Context, db *sql.DB, databaseName string, out io.Writer) (mysqlDumpStats, error) {
+	var stats mysqlDumpStats
+	w := &dumpWriter{w: out}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("failed to get database connection: %v", err)
+	}
+	defer conn.Close()
+
+	for _, statement := range []string{
+		"SET NAMES utf8mb4",
+		"SET SESSION time_zone = '+00:00'",
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+	} {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return stats, fmt.Errorf("failed to start dump transaction (%s): %v", statement, err)
+		}
+	}
+	// The transaction is read only, ending it just releases the snapshot
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	var serverVersion string
+	if err := conn.QueryRowContext(ctx, "SELECT VERSION()").Scan(&serverVersion); err != nil {
+		return stats, fmt.Errorf("failed to get server version: %v", err)
+	}
+	var createDatabase string
+	if err := conn.QueryRowContext(ctx, "SHOW CREATE DATABASE "+quoteIdentifier(databaseName)).Scan(new(string), &createDatabase); err != nil {
+		return stats, fmt.Errorf("failed to read database %s: %v", databaseName, err)
+	}
+	createDatabase = strings.Replace(createDatabase, "CREATE DATABASE ", "CREATE DATABASE /*!32312 IF NOT EXISTS*/ ", 1)
+
+	tables, views, err := listTables(ctx, conn, databaseName)
+	if err != nil {
+		return stats, err
+	}
+
+	w.printf("-- MySQL dump of database %s\n", quoteIdentifier(databaseName))
+	w.printf("-- Server version: %s\n\n", serverVersion)
+	w.writeString("/*!40101 SET NAMES utf8mb4 */;\n")
+	w.writeString("/*!40103 SET @OLD_TIME_ZONE=@@TIME_ZONE, TIME_ZONE='+00:00' */;\n")
+	w.writeString("/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;\n")
+	w.writeString("/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;\n")
+	w.writeString("/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;\n\n")
+	w.printf("%s;\n\nUSE %s;\n", createDatabase, quoteIdentifier(databaseName))
+
+	for _, table := range tables {
+		rows, err := dumpTable(ctx, conn, databaseName, table, w)
+		if err != nil {
+			return stats, err
+		}
+		if w.err != nil {
+			return stats, fmt.Errorf("failed to write dump: %v", w.err)
+		}
+		stats.Tables++
+		stats.Rows += rows
+	}
+
+	definitions := make(map[string]string)
+	for _, view := range views {
+		if definitions[view], err = showCreateView(ctx, conn, databaseName, view); err != nil {
+			return stats, err
+		}
+	}
+	for _, view := range orderViews(views, definitions) {
+		w.printf("\n--\n-- View structure for view %s\n--\n\n", quoteIdentifier(view))
+		w.printf("DROP VIEW IF EXISTS %s;\n%s;\n", quoteIdentifier(view), definitions[view])
+		stats.Views++
+	}
+
+	// Triggers come after the data, so the rows inserted above don't fire them
+	for _, object := range storedObjectKinds {
+		count, err := dumpStoredObjects(ctx, conn, databaseName, object, w)
+		if err != nil {
+			return stats, err
+		}
+		switch object.kind {
+		case "TRIGGER":
+			stats.Triggers += count
+		case "EVENT":
+			stats.Events += count
+		default:
+			stats.Routines += count
+		}
+	}
+
+	w.writeString("\n/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;\n")
+	w.writeString("/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;\n")
+	w.writeString("/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;\n")
+	w.writeString("/*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;\n\n")
+	w.printf("-- Dump completed on %s\n", time.Now().UTC().Format("2006-01-02 15:04:05"))
+	if w.err != nil {
+		return stats, fmt.Errorf("failed to write dump: %v", w.err)
+	}
+	return stats, nil
+}
+
+// listTables returns the base tables and the views of the database
+func listTables(ctx context.Context, conn *sql.Conn, databaseName string) ([]string, []string, error) {
+	rows, err := conn.QueryContext(ctx,
+		"SELECT TABLE_NAME, TABLE_TYPE FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME", databaseName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables, views []string
+	for rows.Next() {
+		var name, tableType string
+		if err := rows.Scan(&name, &tableType); err != nil {
+			return nil, nil, fmt.Errorf("failed to list tables: %v", err)
+		}
+		if tableType == "VIEW" {
+			views = append(views, name)
+		} else {
+			tables = append(tables, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list tables: %v", err)
+	}
+	return tables, views, nil
+}
+
+// storedObjectKind describes a kind of object stored in the database besides
+// tables and views: how to list its objects and read their definition
+type storedObjectKind struct {
+	kind string
+	// list selects the names of the objects of a database, in the order
+	// they are created
+	list string
+	// column is the column of SHOW CREATE holding the definition
+	column string
+}
+
+var storedObjectKinds = []storedObjectKind{
+	{"TRIGGER", "SELECT TRIGGER_NAME FROM information_schema.TRIGGERS WHERE TRIGGER_SCHEMA = ? ORDER BY EVENT_OBJECT_TABLE, ACTION_ORDER", "SQL Original Statement"},
+	{"FUNCTION", "SELECT ROUTINE_NAME FROM information_schema.ROUTINES WHERE ROUTINE_SCHEMA = ? AND ROUTINE_TYPE = 'FUNCTION' ORDER BY ROUTINE_NAME", "Create Function"},
+	{"PROCEDURE", "SELECT ROUTINE_NAME FROM information_schema.ROUTINES WHERE ROUTINE_SCHEMA = ? AND ROUTINE_TYPE = 'PROCEDURE' ORDER BY ROUTINE_NAME", "Create Procedure"},
+	{"EVENT", "SELECT EVENT_NAME FROM information_schema.EVENTS WHERE EVENT_SCHEMA = ? ORDER BY EVENT_NAME", "Create Event"},
+}
+
+// dumpStoredObjects writes the definitions of the triggers, functions,
+// procedures or events of the database, without their DEFINER like views.
+// Their bodies contain semicolons, so they are written between DELIMITER
+// commands as mysqldump does, with the sql_mode they were created with.
+func dumpStoredObjects(ctx context.Context, conn *sql.Conn, databaseName string, object storedObjectKind, w *dumpWriter) (int, error) {
+	kind := strings.ToLower(object.kind)
+	rows, err := conn.QueryContext(ctx, object.list, databaseName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %ss: %v", kind, err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to list %ss: %v", kind, err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list %ss: %v", kind, err)
+	}
+
+	for _, name := range names {
+		definition, sqlMode, err := showCreateObject(ctx, conn, databaseName, object, name)
+		if err != nil {
+			return 0, err
+		}
+		var mode strings.Builder
+		writeSQLString(&mode, []byte(sqlMode))
+		w.printf("\n--\n-- Definition of %s %s\n--\n\n", kind, quoteIdentifier(name))
+		w.printf("DROP %s IF EXISTS %s;\n", object.kind, quoteIdentifier(name))
+		w.writeString("/*!50003 SET @saved_sql_mode = @@sql_mode */;\n")
+		w.printf("/*!50003 SET sql_mode = %s */;\n", mode.String())
+		w.printf("DELIMITER ;;\n%s;;\nDELIMITER ;\n", definerClause.ReplaceAllString(definition, ""))
+		w.writeString("/*!50003 SET sql_mode = @saved_sql_mode */;\n")
+	}
+	if w.err != nil {
+		return 0, fmt.Errorf("failed to write dump: %v", w.err)
+	}
+	return len(names), nil
+}
+
+// showCreateObject returns the definition of a trigger, routine or event and
+// the sql_mode it was created with. The columns of SHOW CREATE differ between
+// kinds and server versions, so they are looked up by name.
+func showCreateObject(ctx context.Context, conn *sql.Conn, databaseName string, object storedObjectKind, name string) (string, string, error) {
+	kind := strings.ToLower(object.kind)
+	rows, err := conn.QueryContext(ctx, "SHOW CREATE "+object.kind+" "+quoteIdentifier(databaseName)+"."+quoteIdentifier(name))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %s %s: %v", kind, name, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %s %s: %v", kind, name, err)
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", "", fmt.Errorf("failed to read %s %s: %v", kind, name, err)
+		}
+		return "", "", fmt.Errorf("failed to read %s %s: not found", kind, name)
+	}
+	values := make([]sql.NullString, len(columns))
+	scanArgs := make([]any, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return "", "", fmt.Errorf("failed to read %s %s: %v", kind, name, err)
+	}
+	var definition, sqlMode sql.NullString
+	for i, column := range columns {
+		switch column {
+		case object.column:
+			definition = values[i]
+		case "sql_mode":
+			sqlMode = values[i]
+		}
+	}
+	// The definition is NULL for users without the privileges to read it
+	if !definition.Valid || definition.String == "" {
+		return "", "", fmt.Errorf("no definition of %s %s, the export user may lack the privileges to read it", kind, name)
+	}
+	return definition.String, sqlMode.String, nil
+}
+
+// dumpColumn describes a column as needed to dump its values
+type dumpColumn struct {
+	Name     string
+	DataType string
+}
+
+func dumpTable(ctx context.Context, conn *sql.Conn, databaseName string, table string, w *dumpWriter) (int64, error) {
+	var createTable string
+	if err := conn.QueryRowContext(ctx, "SHOW CREATE TABLE "+quoteIdentifier(databaseName)+"."+quoteIdentifier(table)).Scan(new(string), &createTable); err != nil {
+		return 0, fmt.Errorf("failed to read table %s: %v", table, err)
+	}
+
+	w.printf("\n--\n-- Table structure for table %s\n--\n\n", quoteIdentifier(table))
+	w.printf("DROP TABLE IF EXISTS %s;\n%s;\n", quoteIdentifier(table), createTable)
+
+	columns, err := dumpColumns(ctx, conn, databaseName, table)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = quoteIdentifier(column.Name)
+	}
+	columnList := strings.Join(names, ",")
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s.%s", columnList, quoteIdentifier(databaseName), quoteIdentifier(table)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rows of table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	w.printf("\n--\n-- Dumping data for table %s\n--\n\n", quoteIdentifier(table))
+	w.printf("/*!40000 ALTER TABLE %s DISABLE KEYS */;\n", quoteIdentifier(table))
+
+	values := make([]sql.RawBytes, len(columns))
+	scanArgs := make([]any, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	var count int64
+	var statement strings.Builder
+	insertPrefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoteIdentifier(table), columnList)
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return count, fmt.Errorf("failed to read row of table %s: %v", table, err)
+		}
+		if statement.Len() == 0 {
+			statement.WriteString(insertPrefix)
+		} else {
+			statement.WriteByte(',')
+		}
+		statement.WriteByte('(')
+		for i, value := range values {
+			if i > 0 {
+				statement.WriteByte(',')
+			}
+			writeSQLValue(&statement, value, columns[i].DataType)
+		}
+		statement.WriteByte(')')
+		count++
+
+		if statement.Len() >= maxInsertSize {
+			statement.WriteString(";\n")
+			w.writeString(statement.String())
+			if w.err != nil {
+				return count, fmt.Errorf("failed to write dump: %v", w.err)
+			}
+			statement.Reset()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("failed to read rows of table %s: %v", table, err)
+	}
+	if statement.Len() > 0 {
+		statement.WriteString(";\n")
+		w.writeString(statement.String())
+	}
+	w.printf("/*!40000 ALTER TABLE %s ENABLE KEYS */;\n", quoteIdentifier(table))
+	return count, nil
+}
+
+// dumpColumns returns the columns of a table whose values are dumped.
+// Generated columns are computed again on import and can't be inserted.
+func dumpColumns(ctx context.Context, conn *sql.Conn, databaseName string, table string) ([]dumpColumn, error) {
+	rows, err := conn.QueryContext(ctx,
+		"SELECT COLUMN_NAME, DATA_TYPE, EXTRA FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION",
+		databaseName, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var columns []dumpColumn
+	for rows.Next() {
+		var column dumpColumn
+		var extra string
+		if err := rows.Scan(&column.Name, &column.DataType, &extra); err != nil {
+			return nil, fmt.Errorf("failed to read columns of table %s: %v", table, err)
+		}
+		if strings.Contains(strings.ToUpper(extra), "GENERATED") {
+			continue
+		}
+		column.DataType = strings.ToLower(column.DataType)
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// showCreateView returns the CREATE VIEW statement of a view without its DEFINER
+func showCreateView(ctx context.Context, conn *sql.Conn, databaseName string, view string) (string, error) {
+	var createView string
+	if err := conn.QueryRowContext(ctx, "SHOW CREATE VIEW "+quoteIdentifier(databaseName)+"."+quoteIdentifier(view)).Scan(new(string), &createView, new(string), new(string)); err != nil {
+		return "", fmt.Errorf("failed to read view %s: %v", view, err)
+	}
+	return definerClause.ReplaceAllString(createView, ""), nil
+}
+
+// orderViews sorts views so that every view comes after the views its
+// definition refers to
+func orderViews(views []string, definitions map[string]string) []string {
+	sort.Strings(views)
+	var ordered []string
+	done := make(map[string]bool)
+	var visit func(view string, path map[string]bool)
+	visit = func(view string, path map[string]bool) {
+		if done[view] || path[view] {
+			return
+		}
+		path[view] = true
+		for _, other := range views {
+			if other != view && strings.Contains(definitions[view], quoteIdentifier(other)) {
+				visit(other, path)
+			}
+		}
+		done[view] = true
+		ordered = append(ordered, view)
+	}
+	for _, view := range views {
+		visit(view, make(map[string]bool))
+	}
+	return ordered
+}
+
+// writeSQLValue writes a column value as a SQL literal
+func writeSQLValue(b *strings.Builder, value sql.RawBytes, dataType string) {
+	switch {
+	case value == nil:
+		b.WriteString("NULL")
+	case isNumericType(dataType):
+		b.Write(value)
+	case isBinaryType(dataType):
+		if len(value) == 0 {
+			b.WriteString("''")
+			return
+		}
+		b.WriteString("0x")
+		const hexDigits = "0123456789ABCDEF"
+		for _, c := range value {
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		}
+	default:
+		writeSQLString(b, value)
+	}
+}
+
+// writeSQLString writes a quoted string literal, escaped like mysqldump does
+func writeSQLString(b *strings.Builder, value []byte) {
+	b.WriteByte('\'')
+	for _, c := range value {
+		switch c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0x1a:
+			b.WriteString(`\Z`)
+		case '\'':
+			b.WriteString(`\'`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+}
+
+func isNumericType(dataType string) bool {
+	switch dataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "decimal", "numeric", "float", "double", "real", "year":
+		return true
+	}
+	return false
+}
+
+func isBinaryType(dataType string) bool {
+	switch dataType {
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "bit",
+		"geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection", "geomcollection":
+		return true
+	}
+	return false
+}
+
+// quoteIdentifier quotes a MySQL identifier with backticks
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
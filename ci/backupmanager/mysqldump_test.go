@@ -0,0 +1,149 @@
+package backupmanager
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteSQLValue(t *testing.T) {
+	tests := []struct {
+		value    sql.RawBytes
+		dataType string
+		want     string
+	}{
+		{nil, "varchar", "NULL"},
+		{sql.RawBytes("42"), "int", "42"},
+		{sql.RawBytes("-1.50"), "decimal", "-1.50"},
+		{sql.RawBytes("it's a \"test\"\\"), "text", `'it\'s a \"test\"\\'`},
+		{sql.RawBytes("line\nbreak\r\x00\x1a"), "longtext", `'line\nbreak\r\0\Z'`},
+		{sql.RawBytes("2024-01-15 10:00:00"), "datetime", "'2024-01-15 10:00:00'"},
+		{sql.RawBytes{0x00, 0xff, 0x1a}, "blob", "0x00FF1A"},
+		{sql.RawBytes{}, "varbinary", "''"},
+		{sql.RawBytes{}, "varchar", "''"},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		writeSQLValue(&b, test.value, test.dataType)
+		if got := b.String(); got != test.want {
+			t.Errorf("writeSQLValue(%q, %s) = %s, want %s", test.value, test.dataType, got, test.want)
+		}
+	}
+}
+
+func TestOrderViews(t *testing.T) {
+	definitions := map[string]string{
+		"a_summary": "CREATE VIEW `a_summary` AS select * from `db`.`b_base`",
+		"b_base":    "CREATE VIEW `b_base` AS select * from `db`.`node`",
+		"c_other":   "CREATE VIEW `c_other` AS select * from `db`.`node`",
+	}
+	got := orderViews([]string{"a_summary", "b_base", "c_other"}, definitions)
+	want := []string{"b_base", "a_summary", "c_other"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("orderViews = %v, want %v", got, want)
+	}
+}
+
+// TestDirectExport dumps a database from a local MySQL server over a direct
+// connection and loads the dump into another database with the mysql client:
+//
+//	LOCAL_DB_TEST=1 LOCAL_DB_PASSWORD=rootpass123 go test -run DirectExport ./...
+func TestDirectExport(t *testing.T) {
+	if os.Getenv("LOCAL_DB_TEST") == "" {
+		t.Skip("LOCAL_DB_TEST not set, skipping local MySQL integration test")
+	}
+	if _, err := exec.LookPath("mysql"); err != nil {
+		t.Skip("mysql not installed")
+	}
+
+	configs := localConfigs(t.TempDir())
+	local := NewBackendLocal()
+	for _, config := range configs {
+		config.DBExportMode = DBExportModeDirect
+		config.DBHost = local.DB.Host
+		config.DBPort = local.DB.Port
+		config.DBUser = local.DB.User
+		config.DBPassword = local.DB.Password
+	}
+
+	runSQL(t, local, "DROP DATABASE IF EXISTS staging_db; DROP DATABASE IF EXISTS production_db; CREATE DATABASE staging_db; "+
+		"CREATE TABLE staging_db.node (id INT PRIMARY KEY, title TEXT, body LONGBLOB, price DECIMAL(10,2), created DATETIME, "+
+		"title_length INT AS (CHAR_LENGTH(title)) VIRTUAL); "+
+		"INSERT INTO staging_db.node (id, title, body, price, created) VALUES "+
+		"(1, 'It''s \"quoted\" \\\\ and\\nmultiline', 0x00FF1A, 9.99, '2024-01-15 10:00:00'), (2, NULL, NULL, NULL, NULL), (3, '', '', 0, NULL); "+
+		"CREATE VIEW staging_db.node_titles AS SELECT id, title FROM staging_db.node; "+
+		"CREATE TABLE staging_db.node_log (id INT); "+
+		"CREATE TRIGGER staging_db.node_insert AFTER INSERT ON staging_db.node FOR EACH ROW INSERT INTO node_log VALUES (NEW.id); "+
+		"CREATE FUNCTION staging_db.double_it (x INT) RETURNS INT DETERMINISTIC RETURN x * 2;")
+
+	var exported bytes.Buffer
+	if err := NewBackendCloudSQL().ExportDatabase(context.Background(), configs["staging"], &exported); err != nil {
+		t.Fatalf("ExportDatabase failed: %v", err)
+	}
+	dump, err := openSQLDump(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	content, err := io.ReadAll(dump)
+	dump.Close()
+	if err != nil {
+		t.Fatalf("Failed to read dump: %v", err)
+	}
+	if !strings.Contains(string(content), "-- Dump completed on") {
+		t.Errorf("dump is not complete")
+	}
+
+	if err := local.ImportDatabase(context.Background(), &exported, configs["production"], configs["staging"]); err != nil {
+		t.Fatalf("ImportDatabase failed: %v", err)
+	}
+	query := "SELECT CONCAT_WS('|', id, IFNULL(title, 'NULL'), IFNULL(HEX(body), 'NULL'), IFNULL(price, 'NULL'), IFNULL(created, 'NULL'), IFNULL(title_length, 'NULL')) FROM %s.node ORDER BY id"
+	want := runSQL(t, local, strings.ReplaceAll(query, "%s", "staging_db"))
+	if got := runSQL(t, local, strings.ReplaceAll(query, "%s", "production_db")); got != want {
+		t.Errorf("restored rows differ:\n got: %s\nwant: %s", got, want)
+	}
+	if got := runSQL(t, local, "SELECT COUNT(*) FROM production_db.node_titles"); got != "3" {
+		t.Errorf("view not restored: %s", got)
+	}
+	if got := runSQL(t, local, "SELECT production_db.double_it(21)"); got != "42" {
+		t.Errorf("function not restored: %s", got)
+	}
+	runSQL(t, local, "INSERT INTO production_db.node (id) VALUES (4)")
+	if got := runSQL(t, local, "SELECT COUNT(*) FROM production_db.node_log"); got != "1" {
+		t.Errorf("trigger not restored or fired on import: %s rows logged", got)
+	}
+}
+
+// failingWriter fails every write after the first n bytes
+type failingWriter struct {
+	n int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		written := f.n
+		f.n = 0
+		return written, errors.New("no space left on device")
+	}
+	f.n -= len(p)
+	return len(p), nil
+}
+
+func TestDumpWriterKeepsFirstError(t *testing.T) {
+	var buf strings.Builder
+	w := &dumpWriter{w: io.MultiWriter(&failingWriter{n: 10}, &buf)}
+	w.writeString("-- MySQL dump\n")
+	w.printf("-- Dump completed on %s\n", "2024-01-15")
+	if w.err == nil || !strings.Contains(w.err.Error(), "no space left") {
+		t.Errorf("expected the write error, got %v", w.err)
+	}
+	if strings.Contains(buf.String(), "Dump completed") {
+		t.Errorf("nothing should be written after a failed write, got %q", buf.String())
+	}
+}
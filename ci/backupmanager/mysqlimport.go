@@ -0,0 +1,131 @@
+package backupmanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// importProgressInterval is how often importMySQLDump reports its progress
+const importProgressInterval = 10 * time.Second
+
+// statementTable matches the table a dump statement works on
+var statementTable = regexp.MustCompile("(?i)^(?:INSERT\\s+(?:IGNORE\\s+)?INTO|REPLACE\\s+INTO|CREATE\\s+TABLE(?:\\s+IF\\s+NOT\\s+EXISTS)?|DROP\\s+TABLE(?:\\s+IF\\s+EXISTS)?|LOCK\\s+TABLES|ALTER\\s+TABLE)\\s+(`(?:[^`]|``)+`|\\w+)")
+
+// privilegedStatement matches statements of mysqldump output that need
+// administrative privileges and don't matter for a restore
+var privilegedStatement = regexp.MustCompile(`(?i)^(?:/\*!\d+\s+)?SET\s+@@(?:GLOBAL\.GTID_PURGED|SESSION\.SQL_LOG_BIN)\b`)
+
+// importProgress describes how far an import has got
+type importProgress struct {
+	Statements int64
+	Bytes      int64
+	TotalBytes int64
+	Table      string
+}
+
+// SQLStatementError reports a dump statement the server rejected
+type SQLStatementError struct {
+	Line      int
+	Statement string
+	Err       error
+}
+
+func (e *SQLStatementError) Error() string {
+	return fmt.Sprintf("statement at line %d failed: %v\nStatement: %s", e.Line, e.Err, e.Statement)
+}
+
+func (e *SQLStatementError) Unwrap() error {
+	return e.Err
+}
+
+// importMySQLDump executes the statements of a SQL dump one by one on a single
+// connection, in databaseName unless the dump selects another database.
+// progress, when set, is called every importProgressInterval and once at the
+// end. totalBytes is the size of the dump if known, or 0.
+func importMySQLDump(ctx context.Context, db *sql.DB, databaseName string, r io.Reader, totalBytes int64, progress func(importProgress)) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %v", err)
+	}
+	defer conn.Close()
+
+	// Dumps without a CREATE DATABASE statement expect the database to exist
+	if _, err := conn.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS "+quoteIdentifier(databaseName)); err != nil {
+		return fmt.Errorf("failed to create database %s: %v", databaseName, err)
+	}
+	if _, err := conn.ExecContext(ctx, "USE "+quoteIdentifier(databaseName)); err != nil {
+		return fmt.Errorf("failed to select database %s: %v", databaseName, err)
+	}
+
+	scanner := newSQLStatementScanner(r)
+	state := importProgress{TotalBytes: totalBytes}
+	lastReport := time.Now()
+	for {
+		statement, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse SQL dump: %v", err)
+		}
+
+		if privilegedStatement.MatchString(statement.Text) {
+			Warn("Skipping statement at line %d, it needs administrative privileges: %s", statement.Line, truncateStatement(statement.Text, 100))
+			continue
+		}
+		if table := statementTableName(statement.Text); table != "" {
+			state.Table = table
+		}
+		if _, err := conn.ExecContext(ctx, statement.Text); err != nil {
+			return &SQLStatementError{
+				Line:      statement.Line,
+				Statement: truncateStatement(statement.Text, 300),
+				Err:       err,
+			}
+		}
+		state.Statements++
+		state.Bytes = scanner.BytesRead()
+
+		if progress != nil && time.Since(lastReport) >= importProgressInterval {
+			progress(state)
+			lastReport = time.Now()
+		}
+	}
+
+	state.Bytes = scanner.BytesRead()
+	if progress != nil {
+		progress(state)
+	}
+	return nil
+}
+
+// logImportProgress reports import progress in the log
+func logImportProgress(p importProgress) {
+	if p.TotalBytes > 0 {
+		Info("Import progress: %d statements, %d of %d bytes (%.1f%%), table %s",
+			p.Statements, p.Bytes, p.TotalBytes, float64(p.Bytes)*100/float64(p.TotalBytes), p.Table)
+		return
+	}
+	Info("Import progress: %d statements, %d bytes, table %s", p.Statements, p.Bytes, p.Table)
+}
+
+// statementTableName returns the table a statement works on, if any
+func statementTableName(statement string) string {
+	match := statementTable.FindStringSubmatch(statement)
+	if match == nil {
+		return ""
+	}
+	return unquoteIdentifier(match[1])
+}
+
+// truncateStatement shortens long statements (e.g. extended INSERTs) for error messages
+func truncateStatement(statement string, maxLength int) string {
+	if len(statement) <= maxLength {
+		return statement
+	}
+	return statement[:maxLength] + fmt.Sprintf("... (%d bytes)", len(statement))
+}
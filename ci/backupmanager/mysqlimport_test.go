@@ -0,0 +1,85 @@
+package backupmanager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestStatementTableName(t *testing.T) {
+	tests := map[string]string{
+		"INSERT INTO `node` VALUES (1)":                "node",
+		"insert ignore into users values (1)":          "users",
+		"DROP TABLE IF EXISTS `cache``data`":           "cache`data",
+		"CREATE TABLE IF NOT EXISTS `watchdog` (\n id": "watchdog",
+		"LOCK TABLES `node` WRITE":                     "node",
+		"/*!40101 SET NAMES utf8mb4 */":                "",
+		"SET FOREIGN_KEY_CHECKS=0":                     "",
+	}
+	for statement, want := range tests {
+		if got := statementTableName(statement); got != want {
+			t.Errorf("statementTableName(%q) = %q, want %q", statement, got, want)
+		}
+	}
+}
+
+// TestDirectImport imports dumps into a local MySQL server over a direct
+// connection:
+//
+//	LOCAL_DB_TEST=1 LOCAL_DB_PASSWORD=rootpass123 go test -run DirectImport ./...
+func TestDirectImport(t *testing.T) {
+	if os.Getenv("LOCAL_DB_TEST") == "" {
+		t.Skip("LOCAL_DB_TEST not set, skipping local MySQL integration test")
+	}
+	if _, err := exec.LookPath("mysql"); err != nil {
+		t.Skip("mysql not installed")
+	}
+
+	configs := localConfigs(t.TempDir())
+	local := NewBackendLocal()
+	config := configs["production"]
+	config.DBImportMode = DBImportModeDirect
+	config.DBHost = local.DB.Host
+	config.DBPort = local.DB.Port
+	config.DBUser = local.DB.User
+	config.DBPassword = local.DB.Password
+
+	db, closeDB, err := openDirectConnection(context.Background(), config)
+	if err != nil {
+		t.Fatalf("openDirectConnection failed: %v", err)
+	}
+	defer closeDB()
+	runSQL(t, local, "DROP DATABASE IF EXISTS production_db")
+
+	dump := "CREATE TABLE `node` (`id` int PRIMARY KEY, `title` text);\n" +
+		"INSERT INTO `node` VALUES (1,'a;b'),(2,'it''s');\n" +
+		"SET @@GLOBAL.GTID_PURGED='';\n"
+	var reports []importProgress
+	err = importMySQLDump(context.Background(), db, "production_db", strings.NewReader(dump), int64(len(dump)), func(p importProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatalf("importMySQLDump failed: %v", err)
+	}
+	if len(reports) == 0 || reports[len(reports)-1].Statements != 2 || reports[len(reports)-1].Table != "node" {
+		t.Errorf("unexpected progress reports: %+v", reports)
+	}
+	if got := runSQL(t, local, "SELECT GROUP_CONCAT(title ORDER BY id SEPARATOR '|') FROM production_db.node"); got != "a;b|it's" {
+		t.Errorf("unexpected rows: %q", got)
+	}
+
+	// A failing statement is reported with its line number
+	dump = "INSERT INTO `node` VALUES (3,'ok');\n\n" +
+		"INSERT INTO `missing_table` VALUES (1);\n"
+	err = importMySQLDump(context.Background(), db, "production_db", strings.NewReader(dump), 0, nil)
+	var statementErr *SQLStatementError
+	if !errors.As(err, &statementErr) {
+		t.Fatalf("expected a SQLStatementError, got %v", err)
+	}
+	if statementErr.Line != 3 || !strings.Contains(statementErr.Statement, "missing_table") {
+		t.Errorf("unexpected failing statement: line %d: %s", statementErr.Line, statementErr.Statement)
+	}
+}
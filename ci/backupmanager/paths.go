@@ -0,0 +1,191 @@
+package backupmanager
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathFilter selects files of the files directory by their path relative to
+// it, with glob patterns such as inline-images/** or **/*.pdf. A pattern
+// matches the whole path: * and ? match within a path segment as in
+// path.Match, ** matches any number of segments. A path is selected when an
+// include pattern matches it or one of the directories it is in, or when
+// there are no include patterns, unless an exclude pattern matches it or one
+// of the directories it is in. A nil filter selects every path.
+type PathFilter struct {
+	Include []string
+	Exclude []string
+
+	// within limits the filter to the paths another filter selects, see
+	// restrict
+	within *PathFilter
+}
+
+// NewPathFilter returns a filter selecting the paths one of the include
+// patterns matches and none of the exclude patterns, nil when there are no
+// patterns
+func NewPathFilter(include []string, exclude []string) (*PathFilter, error) {
+	includes, err := cleanGlobs(include)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := cleanGlobs(exclude)
+	if err != nil {
+		return nil, err
+	}
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil, nil
+	}
+	return &PathFilter{Include: includes, Exclude: excludes}, nil
+}
+
+// splitPatterns splits a comma or newline separated list of glob patterns,
+// skipping empty lines and lines starting with #, which are comments. A
+// pattern of a name starting with # is written with a character class, e.g.
+// [#]drafts/**.
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.Split(line, ",")...)
+	}
+	return patterns
+}
+
+// cleanGlobs validates and cleans a list of patterns, dropping empty ones
+func cleanGlobs(list []string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range list {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if err := validateGlob(pattern); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, path.Clean(pattern))
+	}
+	return patterns, nil
+}
+
+// validateGlob rejects patterns that are malformed or reach outside the
+// files directory
+func validateGlob(pattern string) error {
+	cleaned := path.Clean(pattern)
+	if path.IsAbs(pattern) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("invalid path pattern %q: patterns are relative to the files directory", pattern)
+	}
+	for _, segment := range strings.Split(cleaned, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the filter selects a path relative to the files
+// directory. Directory paths may end with a slash, as in file indexes. The
+// files directory itself is always selected.
+func (f *PathFilter) Match(name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	if f == nil || name == "" || name == "." {
+		return true
+	}
+	segments := strings.Split(path.Clean(name), "/")
+	if matchAny(f.Exclude, segments) {
+		return false
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include, segments) {
+		return false
+	}
+	return f.within.Match(name)
+}
+
+// keeps reports whether a backup taken with the filter keeps an entry.
+// Directories are kept unless they are excluded, so the files selected
+// inside them keep their parents.
+func (f *PathFilter) keeps(name string, dir bool) bool {
+	if !dir {
+		return f.Match(name)
+	}
+	return !f.excludes(name)
+}
+
+// excludes reports whether an exclude pattern matches a path or one of the
+// directories it is in, everything below an excluded directory is excluded
+func (f *PathFilter) excludes(name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	if f == nil || name == "" || name == "." {
+		return false
+	}
+	return matchAny(f.Exclude, strings.Split(path.Clean(name), "/")) || f.within.excludes(name)
+}
+
+// restrict returns a filter selecting the paths both f and outer select
+func (f *PathFilter) restrict(outer *PathFilter) *PathFilter {
+	switch {
+	case f == nil:
+		return outer
+	case outer == nil:
+		return f
+	}
+	restricted := *f
+	restricted.within = outer.restrict(f.within)
+	return &restricted
+}
+
+// String lists the patterns of the filter, for logging
+func (f *PathFilter) String() string {
+	if f == nil {
+		return "all files"
+	}
+	description := "all files"
+	if len(f.Include) > 0 {
+		description = strings.Join(f.Include, ", ")
+	}
+	if len(f.Exclude) > 0 {
+		description += " except " + strings.Join(f.Exclude, ", ")
+	}
+	if f.within != nil {
+		description += " within " + f.within.String()
+	}
+	return description
+}
+
+// matchAny reports whether one of the patterns matches a path or one of the
+// directories it is in
+func matchAny(patterns []string, segments []string) bool {
+	for _, pattern := range patterns {
+		// Everything below a matched directory is matched as well
+		if matchGlob(append(strings.Split(pattern, "/"), "**"), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches the segments of a path against those of a pattern
+func matchGlob(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,289 @@
+package backupmanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPathFilter(t *testing.T) {
+	filter, err := NewPathFilter([]string{"inline-images/**", " **/*.pdf", "styles/thumbnail", ""}, nil)
+	if err != nil {
+		t.Fatalf("NewPathFilter failed: %v", err)
+	}
+	for name, expected := range map[string]bool{
+		"":                             true,
+		"inline-images":                true,
+		"inline-images/":               true,
+		"inline-images/a/b.png":        true,
+		"inline-images-old/a.png":      false,
+		"report.pdf":                   true,
+		"documents/2024/report.pdf":    true,
+		"documents/2024/report.pdf.gz": false,
+		"styles":                       false,
+		"styles/thumbnail/a.png":       true,
+		"styles/medium/a.png":          false,
+	} {
+		if filter.Match(name) != expected {
+			t.Errorf("Match(%q) = %v, expected %v", name, !expected, expected)
+		}
+	}
+	if !(*PathFilter)(nil).Match("anything") {
+		t.Errorf("nil filter should select every path")
+	}
+
+	excluding, err := NewPathFilter(nil, []string{"styles", "css/", "**/*.tmp"})
+	if err != nil {
+		t.Fatalf("NewPathFilter failed: %v", err)
+	}
+	for name, expected := range map[string]bool{
+		"inline-images/a.png":  true,
+		"styles":               false,
+		"styles/thumbnail/a":   false,
+		"css":                  false,
+		"css/site.css":         false,
+		"js/site.js":           true,
+		"uploads/partial.tmp":  false,
+		"uploads/partial.tmpx": true,
+	} {
+		if excluding.Match(name) != expected {
+			t.Errorf("Match(%q) = %v, expected %v", name, !expected, expected)
+		}
+	}
+
+	// Restricted filters select what both filters select
+	restricted := filter.restrict(excluding)
+	for name, expected := range map[string]bool{
+		"inline-images/a.png":        true,
+		"inline-images/a.tmp":        false,
+		"styles/thumbnail/a.png":     false,
+		"documents/report.pdf":       true,
+		"documents/report.docx":      false,
+		"inline-images/styles/a.png": true,
+	} {
+		if restricted.Match(name) != expected {
+			t.Errorf("restricted Match(%q) = %v, expected %v", name, !expected, expected)
+		}
+	}
+	if filter.restrict(nil) != filter || (*PathFilter)(nil).restrict(excluding) != excluding {
+		t.Errorf("restricting to or from no filter should give the other filter")
+	}
+
+	// Backups keep the directories that aren't excluded
+	for _, test := range []struct {
+		name     string
+		dir      bool
+		expected bool
+	}{
+		{"documents", true, true},
+		{"documents/a.docx", false, false},
+		{"styles", true, false},
+		{"styles/thumbnail", true, false},
+		{"inline-images/a.tmp", false, false},
+	} {
+		if restricted.keeps(test.name, test.dir) != test.expected {
+			t.Errorf("keeps(%q, %v) = %v, expected %v", test.name, test.dir, !test.expected, test.expected)
+		}
+	}
+
+	if filter, err := NewPathFilter([]string{"", " "}, nil); filter != nil || err != nil {
+		t.Errorf("no patterns should give no filter, got %v, %v", filter, err)
+	}
+	for _, pattern := range []string{"/etc/**", "../other", "a/../../b", ".", "[a-"} {
+		if _, err := NewPathFilter([]string{pattern}, nil); err == nil {
+			t.Errorf("pattern %q should be rejected", pattern)
+		}
+		if _, err := NewPathFilter(nil, []string{pattern}); err == nil {
+			t.Errorf("exclude pattern %q should be rejected", pattern)
+		}
+	}
+
+	// Configured lists skip comment lines, a character class matches names
+	// starting with #
+	configured, err := (&EnvironmentConfig{FilesExclude: "# regenerated on demand\nstyles, css\n[#]drafts"}).FilesFilter()
+	if err != nil {
+		t.Fatalf("FilesFilter failed: %v", err)
+	}
+	if expected := []string{"styles", "css", "[#]drafts"}; !reflect.DeepEqual(configured.Exclude, expected) {
+		t.Errorf("configured patterns %v, expected %v", configured.Exclude, expected)
+	}
+	if configured.Match("#drafts/a.txt") || !configured.Match("drafts/a.txt") {
+		t.Errorf("[#]drafts should only exclude #drafts")
+	}
+}
+
+func TestSelectiveRestore(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	staging := configs["staging"].TargetPath
+	production := configs["production"].TargetPath
+	database := engine.backends["production"].Database.(*MockBackend)
+
+	mustWriteFile(t, filepath.Join(staging, "inline-images/a.png"), "a")
+	mustWriteFile(t, filepath.Join(staging, "css/site.css"), "css")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-select-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	mustWriteFile(t, filepath.Join(staging, "inline-images/sub/b.png"), "b")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-select-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// Only the selected files are replaced or deleted
+	mustWriteFile(t, filepath.Join(production, "inline-images/a.png"), "changed")
+	mustWriteFile(t, filepath.Join(production, "inline-images/extra.png"), "extra")
+	mustWriteFile(t, filepath.Join(production, "css/site.css"), "production css")
+	mustWriteFile(t, filepath.Join(production, "other.txt"), "other")
+	paths, _ := NewPathFilter([]string{"inline-images/**"}, nil)
+	options := RestoreOptions{AllowUnsigned: true, Only: RestoreFiles, Paths: paths}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-select-2", "production", options); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{
+		"inline-images/a.png": "a", "inline-images/sub/b.png": "b", "inline-images/extra.png": "",
+		"css/site.css": "production css", "other.txt": "other",
+	})
+	if database.importedConfig != nil {
+		t.Errorf("files restore should not import the database")
+	}
+
+	// The database alone needs neither the files nor the runs before
+	for _, run := range []string{"test-run-select-1", "test-run-select-2"} {
+		if err := os.Remove(filepath.Join(root, "backups/backups/staging", run, "files.tar.gz")); err != nil {
+			t.Fatalf("Failed to remove files archive: %v", err)
+		}
+	}
+	options = RestoreOptions{AllowUnsigned: true, Only: RestoreDatabase}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-select-2", "production", options); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	if database.importedConfig == nil {
+		t.Errorf("database restore should import the database")
+	}
+	checkFileContents(t, production, map[string]string{"css/site.css": "production css", "other.txt": "other"})
+	err := engine.PerformRestore(context.Background(), "staging", "test-run-select-2", "production", RestoreOptions{AllowUnsigned: true})
+	if err == nil || !strings.Contains(err.Error(), "no files archive is stored") {
+		t.Errorf("full restore without the files archive should fail, got %v", err)
+	}
+
+	for _, invalid := range []RestoreOptions{
+		{Only: "logs"},
+		{Only: RestoreDatabase, Paths: paths},
+	} {
+		err := engine.PerformRestore(context.Background(), "staging", "test-run-select-2", "production", invalid)
+		if err == nil || !strings.Contains(err.Error(), "invalid restore options") {
+			t.Errorf("restore with %+v should be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestSelectiveRestoreOfArchive(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	production := configs["production"].TargetPath
+	archive, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	runs := filepath.Join(root, "backups/backups/staging")
+	if err := os.MkdirAll(runs, 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if err := copyFile(archive, filepath.Join(runs, "backup_test-run-legacy.tar.gz"), 0644); err != nil {
+		t.Fatalf("Failed to store archive: %v", err)
+	}
+
+	// Runs stored as a single archive only have the selected files extracted
+	mustWriteFile(t, filepath.Join(production, "other.txt"), "other")
+	paths, _ := NewPathFilter([]string{"inline-images/logo.png"}, nil)
+	options := RestoreOptions{AllowUnsigned: true, Paths: paths}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-legacy", "production", options); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{"inline-images/logo.png": "not really a png", "other.txt": "other"})
+	if engine.backends["production"].Database.(*MockBackend).importedConfig == nil {
+		t.Errorf("restore should import the database")
+	}
+}
+
+func TestFilesPatterns(t *testing.T) {
+	root := t.TempDir()
+	engine, configs := newLocalFilesEngine(t, root)
+	configs["staging"].FullBackups = 7
+	staging := configs["staging"].TargetPath
+	production := configs["production"].TargetPath
+	unsigned := RestoreOptions{AllowUnsigned: true}
+
+	mustWriteFile(t, filepath.Join(staging, "inline-images/a.png"), "a")
+	mustWriteFile(t, filepath.Join(staging, "styles/thumbnail/a.png"), "thumbnail")
+	mustWriteFile(t, filepath.Join(staging, "css/site.css"), "css")
+	mustWriteFile(t, filepath.Join(staging, "php/twig/cache.php"), "twig")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-patterns-1"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// Excluded files are left out of the incremental run built on a full one
+	configs["staging"].FilesExclude = "styles, css\nphp/**"
+	mustWriteFile(t, filepath.Join(staging, "inline-images/b.png"), "b")
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-patterns-2"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	index := readStoredIndex(t, configs, "test-run-patterns-2")
+	if index.ParentRunID != "test-run-patterns-1" {
+		t.Errorf("second run should build on the first, got parent '%s'", index.ParentRunID)
+	}
+	for _, file := range index.Files {
+		if strings.HasPrefix(file.Path, "styles") || strings.HasPrefix(file.Path, "css") || strings.HasPrefix(file.Path, "php") {
+			t.Errorf("excluded %s is in the file index", file.Path)
+		}
+	}
+	stored, err := findStoredRun(NewBackendLocal(), configs["staging"], "staging", "test-run-patterns-2")
+	if err != nil {
+		t.Fatalf("Failed to find run: %v", err)
+	}
+	manifest, _, err := readRunManifest(context.Background(), NewBackendLocal(), stored.Manifest)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if !reflect.DeepEqual(manifest.FilesExclude, []string{"styles", "css", "php/**"}) || manifest.FilesInclude != nil {
+		t.Errorf("manifest records patterns %v and %v", manifest.FilesInclude, manifest.FilesExclude)
+	}
+
+	// Excluded paths on the destination are neither replaced nor deleted
+	mustWriteFile(t, filepath.Join(production, "styles/medium/old.png"), "medium")
+	mustWriteFile(t, filepath.Join(production, "css/site.css"), "production css")
+	mustWriteFile(t, filepath.Join(production, "stale.txt"), "stale")
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-patterns-2", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{
+		"inline-images/a.png": "a", "inline-images/b.png": "b", "stale.txt": "",
+		"styles/medium/old.png": "medium", "styles/thumbnail/a.png": "", "css/site.css": "production css",
+		"php/twig/cache.php": "",
+	})
+
+	// Include patterns limit the backup to the selected files
+	configs["staging"].FilesInclude = "**/*.png"
+	configs["staging"].FullBackups = 1
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-patterns-3"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	var paths []string
+	for _, file := range readStoredIndex(t, configs, "test-run-patterns-3").Files {
+		paths = append(paths, file.Path)
+	}
+	expected := []string{"inline-images/", "inline-images/a.png", "inline-images/b.png"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("backup with include patterns has %v, expected %v", paths, expected)
+	}
+	mustWriteFile(t, filepath.Join(production, "notes.txt"), "notes")
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-patterns-3", "production", unsigned); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	checkFileContents(t, production, map[string]string{"inline-images/b.png": "b", "notes.txt": "notes", "styles/medium/old.png": "medium"})
+
+	configs["staging"].FilesExclude = "../outside"
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-patterns-4"); err == nil || !strings.Contains(err.Error(), "invalid file patterns") {
+		t.Errorf("backup with an invalid pattern should fail, got %v", err)
+	}
+}
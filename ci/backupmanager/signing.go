@@ -0,0 +1,402 @@
+package backupmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// signatureExtension is appended to the URL of an archive to store its
+// signature next to it
+const signatureExtension = ".sig"
+
+// maxSignatureSize limits the size of the signature files read on restore
+const maxSignatureSize = 64 << 10
+
+// ArchiveSigning holds the ed25519 key backup archives are signed with and
+// the public keys whose signatures restores trust. Keys are in the OpenSSH
+// format, e.g. written by ssh-keygen -t ed25519.
+type ArchiveSigning struct {
+	Key         ed25519.PrivateKey
+	TrustedKeys []ssh.PublicKey
+}
+
+// SignatureError reports an archive that is unsigned, signed by a key that
+// isn't trusted or doesn't match its signature. Restores only continue past
+// it when unsigned archives are explicitly allowed.
+type SignatureError struct {
+	Archive string
+	Reason  string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("archive %s %s", e.Archive, e.Reason)
+}
+
+// archiveSignature is stored next to an archive. The signature covers the
+// environment and run the archive was written for, its name, size and
+// SHA-256 checksum as stored, after compression and encryption.
+type archiveSignature struct {
+	Environment string `json:"environment"`
+	RunID       string `json:"run_id"`
+	Archive     string `json:"archive"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	PublicKey   string `json:"public_key"`
+	Signature   string `json:"signature"`
+}
+
+// message returns the signed statement
+func (s *archiveSignature) message() []byte {
+	return []byte(fmt.Sprintf("backup-manager archive signature v1\nenvironment: %s\nrun id: %s\narchive: %s\nsize: %d\nsha256: %s\n",
+		s.Environment, s.RunID, s.Archive, s.Size, s.SHA256))
+}
+
+// newArchiveSigning parses the signing key and the trusted keys configured
+// for an environment. It returns nil when neither are configured.
+func newArchiveSigning(envConfig *EnvironmentConfig) (*ArchiveSigning, error) {
+	signing := &ArchiveSigning{}
+
+	keyData := []byte(envConfig.SigningKey)
+	if envConfig.SigningKeyFile != "" {
+		data, err := os.ReadFile(expandHome(envConfig.SigningKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key file: %v", err)
+		}
+		keyData = data
+	}
+	if len(bytes.TrimSpace(keyData)) > 0 {
+		key, err := parseSigningKey(keyData)
+		if err != nil {
+			return nil, err
+		}
+		signing.Key = key
+	}
+
+	trustedKeys := splitRecipients(envConfig.TrustedKeys)
+	if envConfig.TrustedKeysFile != "" {
+		data, err := os.ReadFile(expandHome(envConfig.TrustedKeysFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted keys file: %v", err)
+		}
+		trustedKeys = append(trustedKeys, splitRecipients(string(data))...)
+	}
+	for _, trustedKey := range trustedKeys {
+		parsed, err := parseTrustedKey(trustedKey)
+		if err != nil {
+			return nil, err
+		}
+		signing.TrustedKeys = append(signing.TrustedKeys, parsed)
+	}
+
+	if signing.Key == nil && len(signing.TrustedKeys) == 0 {
+		return nil, nil
+	}
+	return signing, nil
+}
+
+// parseSigningKey parses an unencrypted OpenSSH ed25519 private key
+func parseSigningKey(data []byte) (ed25519.PrivateKey, error) {
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missingPassphrase *ssh.PassphraseMissingError
+	if errors.As(err, &missingPassphrase) {
+		return nil, fmt.Errorf("signing key is protected by a passphrase, which isn't supported")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	switch key := key.(type) {
+	case *ed25519.PrivateKey:
+		return *key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("signing key is a %T, only ed25519 keys are supported", key)
+	}
+}
+
+// parseTrustedKey parses an ssh-ed25519 public key in the authorized_keys
+// format
+func parseTrustedKey(trustedKey string) (ssh.PublicKey, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(trustedKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted key '%s': %v", trustedKey, err)
+	}
+	if parsed.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("trusted key %s is a %s key, only ed25519 keys are supported", ssh.FingerprintSHA256(parsed), parsed.Type())
+	}
+	return parsed, nil
+}
+
+// CanSign reports whether archives are signed after upload
+func (s *ArchiveSigning) CanSign() bool {
+	return s != nil && s.Key != nil
+}
+
+// trusts reports whether restores accept signatures of the key
+func (s *ArchiveSigning) trusts(key ssh.PublicKey) bool {
+	if s == nil {
+		return false
+	}
+	for _, trusted := range s.TrustedKeys {
+		if bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign signs an archive of environment and runId stored at archiveURL with
+// the checksum in digest
+func (s *ArchiveSigning) sign(environment string, runId string, archiveURL string, digest *archiveDigest) ([]byte, error) {
+	publicKey, err := ssh.NewPublicKey(s.Key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %v", err)
+	}
+	signature := &archiveSignature{
+		Environment: environment,
+		RunID:       runId,
+		Archive:     path.Base(archiveURL),
+		Size:        digest.size,
+		SHA256:      digest.sum(),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+	}
+	signature.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.Key, signature.message()))
+	data, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signature: %v", err)
+	}
+	return data, nil
+}
+
+// checkSignature checks that the signature of an archive was made by a
+// trusted key for the environment and run it is stored under. The archive
+// itself is checked against it with checkDigest once it has been read.
+func (s *ArchiveSigning) checkSignature(data []byte, environment string, runId string, archiveURL string) (*archiveSignature, error) {
+	var signature archiveSignature
+	if err := json.Unmarshal(data, &signature); err != nil {
+		return nil, &SignatureError{Archive: archiveURL, Reason: fmt.Sprintf("has an unreadable signature: %v", err)}
+	}
+	if signature.Environment != environment || signature.RunID != runId || signature.Archive != path.Base(archiveURL) {
+		return nil, &SignatureError{Archive: archiveURL, Reason: fmt.Sprintf("has the signature of %s in %s run '%s'",
+			signature.Archive, signature.Environment, signature.RunID)}
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature.PublicKey))
+	if err != nil {
+		return nil, &SignatureError{Archive: archiveURL, Reason: fmt.Sprintf("has a signature with an invalid public key: %v", err)}
+	}
+	if !s.trusts(publicKey) {
+		return nil, &SignatureError{Archive: archiveURL, Reason: fmt.Sprintf("is signed by %s, which is not a trusted key", ssh.FingerprintSHA256(publicKey))}
+	}
+	cryptoKey, ok := publicKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, &SignatureError{Archive: archiveURL, Reason: "has a signature with an unsupported public key"}
+	}
+	ed25519Key, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if !ok || err != nil || !ed25519.Verify(ed25519Key, signature.message(), signatureBytes) {
+		return nil, &SignatureError{Archive: archiveURL, Reason: "has a signature that doesn't verify"}
+	}
+	return &signature, nil
+}
+
+// fingerprint returns the SHA-256 fingerprint of the signing key
+func (s *archiveSignature) fingerprint() string {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.PublicKey))
+	if err != nil {
+		return "an invalid key"
+	}
+	return ssh.FingerprintSHA256(publicKey)
+}
+
+// checkDigest checks that the archive read is the one that was signed
+func (s *archiveSignature) checkDigest(archiveURL string, digest *archiveDigest) error {
+	if digest.size != s.Size || digest.sum() != s.SHA256 {
+		return &SignatureError{Archive: archiveURL, Reason: fmt.Sprintf("has %d bytes with SHA-256 %s, but %d bytes with SHA-256 %s were signed",
+			digest.size, digest.sum(), s.Size, s.SHA256)}
+	}
+	return nil
+}
+
+// readArchiveSignature reads the signature stored next to an archive. A
+// missing signature results in a SignatureError.
+func readArchiveSignature(ctx context.Context, store ArchiveStore, archiveURL string) ([]byte, error) {
+	signatureURL := archiveURL + signatureExtension
+	found, err := storedObjectExists(store, signatureURL)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &SignatureError{Archive: archiveURL, Reason: "is not signed"}
+	}
+
+	reader, err := store.NewArchiveReader(ctx, signatureURL)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxSignatureSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %v", err)
+	}
+	if len(data) > maxSignatureSize {
+		return nil, &SignatureError{Archive: archiveURL, Reason: "has a signature of more than 64 KiB"}
+	}
+	return data, nil
+}
+
+// checkStoredSignature reads the signature of a stored archive and checks it
+// with the keys signing trusts. The archive itself is checked against the
+// returned signature once it has been read.
+func checkStoredSignature(ctx context.Context, store ArchiveStore, signing *ArchiveSigning, environment string, runId string, archiveURL string) (*archiveSignature, error) {
+	data, err := readArchiveSignature(ctx, store, archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	if signing == nil || len(signing.TrustedKeys) == 0 {
+		return nil, &SignatureError{Archive: archiveURL, Reason: "is signed, but no trusted keys are configured to check its signature"}
+	}
+	signature, err := signing.checkSignature(data, environment, runId, archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	Info("Archive is signed by the trusted key %s", signature.fingerprint())
+	return signature, nil
+}
+
+// writeArchiveSignature stores the signature of an archive next to it
+func writeArchiveSignature(ctx context.Context, store ArchiveStore, archiveURL string, signature []byte) error {
+	return writeStoredObject(ctx, store, archiveURL+signatureExtension, signature)
+}
+
+// checkedBlockSize is the size of the blocks an object checked with
+// newBlockDigest is read again in, see checkedReader
+const checkedBlockSize = 1 << 20
+
+// archiveDigest counts and hashes the bytes of an archive as they are
+// written to or read from the archive store. Digests of newBlockDigest also
+// hash every block of checkedBlockSize bytes on its own.
+type archiveDigest struct {
+	hash   hash.Hash
+	size   int64
+	block  hash.Hash
+	blocks [][]byte
+}
+
+func newArchiveDigest() *archiveDigest {
+	return &archiveDigest{hash: sha256.New()}
+}
+
+func newBlockDigest() *archiveDigest {
+	return &archiveDigest{hash: sha256.New(), block: sha256.New()}
+}
+
+func (d *archiveDigest) Write(p []byte) (int, error) {
+	for rest := p; d.block != nil && len(rest) > 0; {
+		n := min(len(rest), checkedBlockSize-int(d.size%checkedBlockSize))
+		d.block.Write(rest[:n])
+		d.size += int64(n)
+		rest = rest[n:]
+		if d.size%checkedBlockSize == 0 {
+			d.blocks = append(d.blocks, d.block.Sum(nil))
+			d.block.Reset()
+		}
+	}
+	if d.block == nil {
+		d.size += int64(len(p))
+	}
+	return d.hash.Write(p)
+}
+
+func (d *archiveDigest) sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// blockSums returns the checksums of the blocks hashed so far, the last one
+// may be shorter than checkedBlockSize
+func (d *archiveDigest) blockSums() [][]byte {
+	if d.size%checkedBlockSize == 0 {
+		return d.blocks
+	}
+	return append(d.blocks[:len(d.blocks):len(d.blocks)], d.block.Sum(nil))
+}
+
+// digestArchiveWriter hashes an archive on its way into the archive store
+type digestArchiveWriter struct {
+	ArchiveWriter
+	digest *archiveDigest
+}
+
+func (w *digestArchiveWriter) Write(p []byte) (int, error) {
+	n, err := w.ArchiveWriter.Write(p)
+	w.digest.Write(p[:n])
+	return n, err
+}
+
+// checkedReader reads an object again after it was checked, e.g. a dump that
+// was checked against its manifest before it is imported. The object is read
+// a block at a time and every block is compared to the one that was checked
+// before any of its bytes are returned, so nothing of an object replaced in
+// between is passed on: reads fail instead.
+type checkedReader struct {
+	r       io.Reader
+	name    string
+	size    int64
+	sums    [][]byte
+	buf     []byte
+	pending []byte
+	next    int
+	err     error
+}
+
+// newCheckedReader reads r, which must still have the blocks checked, a
+// digest of newBlockDigest, hashed
+func newCheckedReader(r io.Reader, name string, checked *archiveDigest) *checkedReader {
+	return &checkedReader{r: r, name: name, size: checked.size, sums: checked.blockSums(), buf: make([]byte, checkedBlockSize)}
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.err == nil {
+		c.pending, c.err = c.readBlock()
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return 0, c.err
+}
+
+// readBlock reads and compares the next block of the object
+func (c *checkedReader) readBlock() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	switch {
+	case err == io.EOF && c.next == len(c.sums):
+		return nil, io.EOF
+	case err == io.EOF:
+		return nil, fmt.Errorf("%s changed since it was checked, it ends after %d bytes", c.name, int64(c.next)*checkedBlockSize)
+	case err != nil && err != io.ErrUnexpectedEOF:
+		return nil, err
+	case c.next == len(c.sums):
+		return nil, fmt.Errorf("%s changed since it was checked, it has more than %d bytes", c.name, c.size)
+	}
+	sum := sha256.Sum256(c.buf[:n])
+	if !bytes.Equal(sum[:], c.sums[c.next]) {
+		return nil, fmt.Errorf("%s changed since it was checked, its bytes from %d on differ", c.name, int64(c.next)*checkedBlockSize)
+	}
+	c.next++
+	return c.buf[:n], nil
+}
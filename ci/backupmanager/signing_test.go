@@ -0,0 +1,247 @@
+package backupmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// generateSigningKey returns a new OpenSSH ed25519 private key and its
+// public key in the authorized_keys format
+func generateSigningKey(t *testing.T) (string, string) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, "backup signing")
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(block)), string(ssh.MarshalAuthorizedKey(sshKey))
+}
+
+// newSigningEngine returns a mock engine whose staging backups are signed
+// with a new key that both environments trust
+func newSigningEngine(t *testing.T, backend *MockBackend) (*BackupEngineCloud, string) {
+	t.Helper()
+	signingKey, trustedKey := generateSigningKey(t)
+	configs := mockConfigs()
+	configs["staging"].SigningKey = signingKey
+	configs["staging"].TrustedKeys = trustedKey
+	configs["production"].TrustedKeys = trustedKey
+	engine := newMockEngine(backend, configs)
+	for environment, backends := range engine.backends {
+		signing, err := newArchiveSigning(configs[environment])
+		if err != nil {
+			t.Fatalf("newArchiveSigning failed: %v", err)
+		}
+		backends.Signing = signing
+	}
+	return engine, trustedKey
+}
+
+func TestSignedBackupAndRestore(t *testing.T) {
+	backend := NewMockBackend()
+	engine, _ := newSigningEngine(t, backend)
+
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-signed"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+	folder := "gs://test-backup-bucket/backups/staging/test-run-signed/"
+	for _, name := range []string{"manifest.json", "index.json"} {
+		if _, ok := backend.metadata[folder+name+signatureExtension]; !ok {
+			t.Fatalf("no signature stored next to %s", folder+name)
+		}
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-signed", "production", RestoreOptions{}); err != nil {
+		t.Fatalf("PerformRestore failed: %v", err)
+	}
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-signed")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"signature": CheckPassed, "artifacts": CheckPassed})
+
+	// Another files archive put in place of the signed one doesn't match
+	// the signed manifest and is refused before the database is touched
+	backend.importedConfig = nil
+	files := backend.metadata[folder+"files.tar.gz"]
+	other, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	if backend.metadata[folder+"files.tar.gz"], err = os.ReadFile(other); err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-signed", "production", RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "doesn't match the manifest") {
+		t.Errorf("restore of a replaced files archive should fail, got %v", err)
+	}
+	if backend.importedConfig != nil {
+		t.Errorf("database should not be imported when the files archive doesn't match the manifest")
+	}
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-signed")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"artifacts": CheckFailed, "signature": CheckPassed})
+	backend.metadata[folder+"files.tar.gz"] = files
+
+	// A changed manifest no longer matches its signature
+	manifest := backend.metadata[folder+"manifest.json"]
+	backend.metadata[folder+"manifest.json"] = append(append([]byte{}, manifest...), '\n')
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-signed", "production", RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "were signed") {
+		t.Errorf("restore of a changed manifest should fail, got %v", err)
+	}
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-signed")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"signature": CheckFailed})
+
+	// The override restores it anyway
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-signed", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Errorf("restore with unsigned archives allowed failed: %v", err)
+	}
+}
+
+func TestUnsignedArchivesAreRefused(t *testing.T) {
+	backend := NewMockBackend()
+	backend.archiveToServe, _ = createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	engine, _ := newSigningEngine(t, backend)
+
+	err := engine.PerformRestore(context.Background(), "staging", "test-run-unsigned", "production", RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "is not signed") {
+		t.Errorf("restore of an unsigned archive should fail, got %v", err)
+	}
+	if backend.importedConfig != nil || backend.downloadedAs != "" {
+		t.Errorf("unsigned archive should be refused before it is downloaded")
+	}
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-unsigned")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"signature": CheckFailed})
+
+	// Without trusted keys there is nothing a signature could be checked with
+	engine.backends["production"].Signing = nil
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-unsigned", "production", RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "refusing to restore into production") {
+		t.Errorf("restore without trusted keys should fail, got %v", err)
+	}
+	if err := engine.PerformRestore(context.Background(), "staging", "test-run-unsigned", "production", RestoreOptions{AllowUnsigned: true}); err != nil {
+		t.Errorf("restore with unsigned archives allowed failed: %v", err)
+	}
+}
+
+func TestUntrustedSignatures(t *testing.T) {
+	backend := NewMockBackend()
+	engine, _ := newSigningEngine(t, backend)
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-signed"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	// Production only trusts another key
+	_, otherKey := generateSigningKey(t)
+	configs := mockConfigs()
+	configs["production"].TrustedKeys = otherKey
+	signing, err := newArchiveSigning(configs["production"])
+	if err != nil {
+		t.Fatalf("newArchiveSigning failed: %v", err)
+	}
+	engine.backends["production"].Signing = signing
+	err = engine.PerformRestore(context.Background(), "staging", "test-run-signed", "production", RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "which is not a trusted key") {
+		t.Errorf("restore of an archive signed by an untrusted key should fail, got %v", err)
+	}
+
+	// A valid signature doesn't vouch for another run or environment
+	url := "gs://test-backup-bucket/backups/staging/test-run-signed/manifest.json"
+	data := backend.metadata[url+signatureExtension]
+	trusting := engine.backends["staging"].Signing
+	if _, err := trusting.checkSignature(data, "staging", "test-run-signed", url); err != nil {
+		t.Errorf("checkSignature failed: %v", err)
+	}
+	for _, other := range []struct{ environment, runId, url string }{
+		{"production", "test-run-signed", url},
+		{"staging", "test-run-other", url},
+		{"staging", "test-run-signed", strings.Replace(url, runManifestName, runIndexName, 1)},
+	} {
+		if _, err := trusting.checkSignature(data, other.environment, other.runId, other.url); err == nil || !strings.Contains(err.Error(), "has the signature of") {
+			t.Errorf("signature accepted for %s run '%s' at %s: %v", other.environment, other.runId, other.url, err)
+		}
+	}
+	tampered := strings.Replace(string(data), `"size": `, `"size": 1`, 1)
+	if _, err := trusting.checkSignature([]byte(tampered), "staging", "test-run-signed", url); err == nil || !strings.Contains(err.Error(), "doesn't verify") {
+		t.Errorf("tampered signature should not verify, got %v", err)
+	}
+}
+
+func TestSigningKeyConfiguration(t *testing.T) {
+	signingKey, trustedKey := generateSigningKey(t)
+	config := mockConfigs()["staging"]
+	config.SigningKey = signingKey
+	config.TrustedKeys = "# backup signing\n" + trustedKey + "," + trustedKey
+	signing, err := newArchiveSigning(config)
+	if err != nil {
+		t.Fatalf("newArchiveSigning failed: %v", err)
+	}
+	if !signing.CanSign() || len(signing.TrustedKeys) != 2 {
+		t.Errorf("expected a signing key and 2 trusted keys, got %+v", signing)
+	}
+
+	if signing, err := newArchiveSigning(mockConfigs()["staging"]); signing != nil || err != nil {
+		t.Errorf("without keys archives are neither signed nor checked, got %+v, %v", signing, err)
+	}
+	for _, invalid := range []*EnvironmentConfig{
+		{SigningKey: "not a key"},
+		{TrustedKeys: "ssh-ed25519 not-base64"},
+		{TrustedKeys: "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg="},
+	} {
+		if _, err := newArchiveSigning(invalid); err == nil {
+			t.Errorf("invalid key configuration %+v should be rejected", invalid)
+		}
+	}
+}
+
+func TestCheckedReaderPassesOnlyCheckedBlocks(t *testing.T) {
+	object := randomContent(1, 3*checkedBlockSize+100)
+	checked := newBlockDigest()
+	checked.Write(object[:10])
+	checked.Write(object[10:])
+
+	read, err := io.ReadAll(newCheckedReader(bytes.NewReader(object), "object", checked))
+	if err != nil || !bytes.Equal(read, object) {
+		t.Fatalf("unchanged object read as %d bytes, %v", len(read), err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		object  []byte
+		checked int
+	}{
+		{"second block changed", append(append(append([]byte{}, object[:checkedBlockSize+5]...), 'x'), object[checkedBlockSize+6:]...), checkedBlockSize},
+		{"truncated", object[:2*checkedBlockSize], 2 * checkedBlockSize},
+		{"shortened last block", object[:len(object)-1], 3 * checkedBlockSize},
+		{"extended", append(append([]byte{}, object...), 'x'), 3 * checkedBlockSize},
+	} {
+		read, err := io.ReadAll(newCheckedReader(bytes.NewReader(test.object), "object", checked))
+		if err == nil || !strings.Contains(err.Error(), "changed since it was checked") {
+			t.Errorf("%s: expected a changed object error, got %v", test.name, err)
+		}
+		if len(read) != test.checked || !bytes.Equal(read, object[:len(read)]) {
+			t.Errorf("%s: %d bytes passed on, expected the %d checked ones", test.name, len(read), test.checked)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package backupmanager
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// sqlDumpChunkSize is how much of a SQL dump is processed at once. Reading,
+// rewriting and uploading a dump never holds more than a few chunks in memory.
+const sqlDumpChunkSize = 1 << 20
+
+// sqlDump reads a SQL dump, decompressing it on the fly when it is gzipped
+// (as produced by Cloud SQL exports)
+type sqlDump struct {
+	io.Reader
+	gzip *gzip.Reader
+}
+
+func openSQLDump(r io.Reader) (*sqlDump, error) {
+	dump := &sqlDump{}
+
+	// Check if the dump is gzipped by peeking at the magic bytes
+	buffered := bufio.NewReaderSize(r, sqlDumpChunkSize)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress SQL dump: %v", err)
+		}
+		dump.gzip = gzipReader
+		dump.Reader = gzipReader
+	} else {
+		dump.Reader = buffered
+	}
+	return dump, nil
+}
+
+// Close releases the decompressor, the reader the dump is read from is left
+// open
+func (d *sqlDump) Close() error {
+	if d.gzip != nil {
+		return d.gzip.Close()
+	}
+	return nil
+}
+
+// openSQLDumpForImport opens a dump of sourceDBName for an import into
+// targetDBName. When the dump creates or selects another database than the
+// target, that database is renamed on the fly.
+func openSQLDumpForImport(r io.Reader, targetDBName string, sourceDBName string) (*sqlDump, error) {
+	dump, err := openSQLDump(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The preamble read to find the database is imported as well
+	var preamble bytes.Buffer
+	dumpDBName, err := dumpDatabaseName(io.TeeReader(dump.Reader, &preamble))
+	if err != nil {
+		dump.Close()
+		return nil, err
+	}
+	dump.Reader = io.MultiReader(&preamble, dump.Reader)
+	if dumpDBName != "" && dumpDBName != sourceDBName {
+		Warn("SQL dump is of database '%s', expected '%s' of the source environment", dumpDBName, sourceDBName)
+	}
+	sourceDBName = dumpDBName
+
+	if sourceDBName != "" && sourceDBName != targetDBName {
+		Info("Renaming database '%s' to '%s' in SQL dump", sourceDBName, targetDBName)
+		dump.Reader = newDatabaseRenamer(dump.Reader, sourceDBName, targetDBName)
+	}
+	return dump, nil
+}
+
+// writeCompressedSQLDump gzips a dump into w, e.g. an upload to a bucket.
+// Speed matters more than size for these short-lived copies.
+func writeCompressedSQLDump(w io.Writer, dump io.Reader) (int64, error) {
+	gzipWriter, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(gzipWriter, dump)
+	if err != nil {
+		return written, err
+	}
+	return written, gzipWriter.Close()
+}
@@ -0,0 +1,161 @@
+package backupmanager
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSQLDumpStreamingMemory decompresses, renames and recompresses a large
+// synthetic dump the way a Cloud SQL import uploads it, and checks that the
+// heap stays bounded regardless of the dump size. SQL_DUMP_TEST_SIZE sets the
+// uncompressed dump size, e.g. 4G, see ParseByteSize; the default keeps the
+// test fast.
+func TestSQLDumpStreamingMemory(t *testing.T) {
+	size := int64(256 << 20)
+	if value := os.Getenv("SQL_DUMP_TEST_SIZE"); value != "" {
+		parsed, err := ParseByteSize(value)
+		if err != nil {
+			t.Fatalf("invalid SQL_DUMP_TEST_SIZE: %v", err)
+		}
+		size = parsed
+	}
+	if testing.Short() {
+		size = 16 << 20
+	}
+
+	dumpPath := filepath.Join(t.TempDir(), "db_dump.sql")
+	occurrences := writeSyntheticDump(t, dumpPath, size)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	peak := sampleHeapPeak()
+
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		t.Fatalf("failed to open dump: %v", err)
+	}
+	defer file.Close()
+	dump, err := openSQLDumpForImport(file, "production_db", "staging_db")
+	if err != nil {
+		t.Fatalf("openSQLDumpForImport failed: %v", err)
+	}
+	defer dump.Close()
+	written, err := writeCompressedSQLDump(io.Discard, dump)
+	if err != nil {
+		t.Fatalf("writeCompressedSQLDump failed: %v", err)
+	}
+
+	peakHeap := peak()
+	if expected := size + occurrences*int64(len("production_db")-len("staging_db")); written != expected {
+		t.Errorf("expected %d bytes after renaming, got %d", expected, written)
+	}
+	growth := int64(peakHeap) - int64(before.HeapAlloc)
+	t.Logf("streamed %d MB with a peak heap growth of %.1f MB", size>>20, float64(growth)/(1<<20))
+	if growth > 64<<20 {
+		t.Errorf("heap grew by %d MB while streaming a %d MB dump", growth>>20, size>>20)
+	}
+}
+
+func BenchmarkSQLDumpRewrite(b *testing.B) {
+	input := bytes.Repeat([]byte("INSERT INTO `staging_db`.`node` VALUES (1,'Lorem ipsum dolor sit amet');\n"), sqlDumpChunkSize/64)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := newDatabaseRenamer(bytes.NewReader(input), "staging_db", "production_db")
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// writeSyntheticDump writes a gzipped dump of the staging database with size
+// uncompressed bytes and returns how often the database name occurs in it
+func writeSyntheticDump(t *testing.T, path string, size int64) int64 {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create dump: %v", err)
+	}
+	defer file.Close()
+	gzipWriter, _ := gzip.NewWriterLevel(file, gzip.BestSpeed)
+	w := bufio.NewWriterSize(gzipWriter, sqlDumpChunkSize)
+
+	header := "CREATE DATABASE IF NOT EXISTS `staging_db`;\nUSE `staging_db`;\n"
+	row := "INSERT INTO `node` VALUES (1,'Lorem ipsum dolor sit amet, consectetur adipiscing elit');\n"
+	rename := "ALTER TABLE `staging_db`.`node` ENGINE=InnoDB;\n"
+	var written, occurrences int64 = 0, 2
+	w.WriteString(header)
+	written += int64(len(header))
+	for i := 0; written < size; i++ {
+		line := row
+		if i%1000 == 0 {
+			line = rename
+		}
+		// Pad the end to the exact size
+		if remaining := size - written; int64(len(line)) > remaining {
+			line = strings.Repeat("\n", int(remaining))
+		}
+		if line == rename {
+			occurrences++
+		}
+		w.WriteString(line)
+		written += int64(len(line))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to write dump: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("failed to write dump: %v", err)
+	}
+	return occurrences
+}
+
+// sampleHeapPeak samples the heap in the background until the returned
+// function is called, which returns the largest heap seen
+func sampleHeapPeak() func() uint64 {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	var peak uint64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapAlloc)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		wg.Wait()
+		return peak
+	}
+}
+
+func writeGzipFile(t *testing.T, path string, content string) {
+	t.Helper()
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	gzipWriter.Write([]byte(content))
+	gzipWriter.Close()
+	if err := os.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,453 @@
+package backupmanager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// databaseStatement matches the CREATE DATABASE and USE statements of a dump
+// and captures the database name
+var databaseStatement = regexp.MustCompile("(?is)^(?:USE|CREATE\\s+(?:DATABASE|SCHEMA)(?:\\s+/\\*!\\d*\\s*IF\\s+NOT\\s+EXISTS\\s*\\*/|\\s+IF\\s+NOT\\s+EXISTS)?)\\s+(`(?:[^`]|``)+`|[\\w$]+)")
+
+// preambleStatement matches the session settings and database drops dumps
+// start with, before the CREATE DATABASE and USE statements
+var preambleStatement = regexp.MustCompile(`(?is)^(?:/\*!|SET\b|DROP\s+(?:DATABASE|SCHEMA)\b)`)
+
+// dumpDatabaseName returns the database a dump creates or selects in its
+// CREATE DATABASE or USE statement, or an empty string if it has none. Only
+// the preamble of the decompressed dump is read, up to the first other
+// statement.
+func dumpDatabaseName(dump io.Reader) (string, error) {
+	scanner := newSQLStatementScanner(dump)
+	for {
+		statement, err := scanner.Next()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse SQL dump: %v", err)
+		}
+		if match := databaseStatement.FindStringSubmatch(statement.Text); match != nil {
+			return unquoteIdentifier(match[1]), nil
+		}
+		if !preambleStatement.MatchString(statement.Text) {
+			return "", nil
+		}
+	}
+}
+
+// Lexical states of databaseRenamer
+const (
+	renameCode             = iota
+	renameWord             // unquoted word
+	renameIdentifier       // inside `...`
+	renameIdentifierQuote  // after a backtick in an identifier, doubled backticks continue it
+	renameString           // inside '...' or "..."
+	renameStringEscape     // after a backslash in a string
+	renameStringQuote      // after a quote in a string, doubled quotes continue it
+	renameDash             // after '-' in code
+	renameDashDash         // after "--" in code, a space starts a comment
+	renameSlash            // after '/' in code
+	renameSlashStar        // after "/*", '!' starts an executable comment
+	renameVersion          // version number of an executable comment
+	renameExecutableStar   // after '*' in an executable comment
+	renameLineComment      // -- or # comment
+	renameBlockComment     // /* ... */ comment
+	renameBlockCommentStar // after '*' in a block comment
+)
+
+// maxStatementWords is how many leading words of a statement are kept to
+// recognise CREATE DATABASE IF NOT EXISTS and USE
+const maxStatementWords = 6
+
+// Words that make up the database statements, other words are statementWordOther
+const (
+	statementWordOther = iota
+	statementWordUse
+	statementWordCreate
+	statementWordDatabase
+	statementWordIf
+	statementWordNot
+	statementWordExists
+)
+
+var statementWords = []struct {
+	word []byte
+	kind int
+}{
+	{[]byte("use"), statementWordUse},
+	{[]byte("create"), statementWordCreate},
+	{[]byte("database"), statementWordDatabase},
+	{[]byte("schema"), statementWordDatabase},
+	{[]byte("if"), statementWordIf},
+	{[]byte("not"), statementWordNot},
+	{[]byte("exists"), statementWordExists},
+}
+
+// databaseRenamer renames a database in a SQL dump stream. It follows the
+// MySQL lexer closely enough to only rename backtick quoted identifiers equal
+// to the old name, e.g. `staging_db`.`node`, and unquoted names in CREATE
+// DATABASE and USE statements. String literals and comments are copied
+// unchanged, so data mentioning the database name isn't touched. The body of
+// executable /*! ... */ comments is SQL and renamed like other statements.
+type databaseRenamer struct {
+	source       io.Reader
+	from, to     []byte
+	fromQuoted   []byte
+	toQuoted     []byte
+	chunk        []byte
+	buffer       []byte
+	output       []byte
+	err          error
+	state        int
+	quote        byte
+	inExecutable bool
+	token        []byte
+	spilled      bool
+	words        [maxStatementWords]int
+	wordCount    int
+}
+
+func newDatabaseRenamer(source io.Reader, from string, to string) *databaseRenamer {
+	return &databaseRenamer{
+		source:     source,
+		from:       []byte(from),
+		to:         []byte(to),
+		fromQuoted: []byte(strings.ReplaceAll(from, "`", "``")),
+		toQuoted:   []byte(strings.ReplaceAll(to, "`", "``")),
+		chunk:      make([]byte, sqlDumpChunkSize),
+	}
+}
+
+func (r *databaseRenamer) Read(p []byte) (int, error) {
+	for len(r.output) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.output)
+	r.output = r.output[n:]
+	return n, nil
+}
+
+// fill renames the next chunk of the source. Only a word or identifier that
+// may be split across chunks is held back.
+func (r *databaseRenamer) fill() {
+	n, err := r.source.Read(r.chunk)
+	r.err = err
+	r.buffer = r.buffer[:0]
+	r.process(r.chunk[:n])
+	if err != nil {
+		r.flush()
+	}
+	r.output = r.buffer
+}
+
+func (r *databaseRenamer) process(data []byte) {
+	for i := 0; i < len(data); {
+		// Fast paths through string literals, words and identifiers, which
+		// hold most of a dump, up to the byte that ends them
+		switch r.state {
+		case renameString:
+			j := indexStringEnd(data[i:], r.quote)
+			if j < 0 {
+				r.buffer = append(r.buffer, data[i:]...)
+				return
+			}
+			r.buffer = append(r.buffer, data[i:i+j]...)
+			i += j
+		case renameWord:
+			j := i
+			for j < len(data) && isWordByte(data[j]) {
+				j++
+			}
+			r.addToToken(data[i:j], len(r.from))
+			if i = j; i == len(data) {
+				return
+			}
+		case renameIdentifier:
+			j := bytes.IndexByte(data[i:], '`')
+			if j < 0 {
+				r.addToToken(data[i:], len(r.fromQuoted))
+				return
+			}
+			r.addToToken(data[i:i+j], len(r.fromQuoted))
+			i += j
+		}
+		if r.step(data[i]) {
+			i++
+		}
+	}
+}
+
+// step processes a single byte. It returns false when the byte ended a token
+// and has to be processed again in the new state.
+func (r *databaseRenamer) step(c byte) bool {
+	switch r.state {
+	case renameCode:
+		switch {
+		case c == '\'' || c == '"':
+			r.quote = c
+			r.state = renameString
+		case c == '`':
+			r.startToken()
+			r.state = renameIdentifier
+		case c == '-':
+			r.state = renameDash
+		case c == '/':
+			r.state = renameSlash
+		case c == '#':
+			r.state = renameLineComment
+		case c == '*' && r.inExecutable:
+			r.state = renameExecutableStar
+		case c == ';':
+			r.wordCount = 0
+		case isWordByte(c):
+			r.startToken()
+			r.addToToken([]byte{c}, len(r.from))
+			r.state = renameWord
+			return true
+		}
+		r.buffer = append(r.buffer, c)
+
+	case renameWord:
+		if isWordByte(c) {
+			r.addToToken([]byte{c}, len(r.from))
+			return true
+		}
+		r.finishWord()
+		r.state = renameCode
+		return false
+
+	case renameIdentifier:
+		if c == '`' {
+			r.state = renameIdentifierQuote
+			return true
+		}
+		r.addToToken([]byte{c}, len(r.fromQuoted))
+
+	case renameIdentifierQuote:
+		if c == '`' {
+			r.addToToken([]byte("``"), len(r.fromQuoted))
+			r.state = renameIdentifier
+			return true
+		}
+		r.finishIdentifier()
+		r.state = renameCode
+		return false
+
+	case renameString:
+		switch c {
+		case '\\':
+			r.state = renameStringEscape
+		case r.quote:
+			r.state = renameStringQuote
+		}
+		r.buffer = append(r.buffer, c)
+
+	case renameStringEscape:
+		r.state = renameString
+		r.buffer = append(r.buffer, c)
+
+	case renameStringQuote:
+		if c != r.quote {
+			r.state = renameCode
+			return false
+		}
+		r.state = renameString
+		r.buffer = append(r.buffer, c)
+
+	case renameDash:
+		if c != '-' {
+			r.state = renameCode
+			return false
+		}
+		r.state = renameDashDash
+		r.buffer = append(r.buffer, c)
+
+	case renameDashDash:
+		if !isSQLSpace(c) {
+			r.state = renameCode
+			return false
+		}
+		r.state = renameLineComment
+		if c == '\n' {
+			r.state = renameCode
+		}
+		r.buffer = append(r.buffer, c)
+
+	case renameSlash:
+		if c != '*' {
+			r.state = renameCode
+			return false
+		}
+		r.state = renameSlashStar
+		r.buffer = append(r.buffer, c)
+
+	case renameSlashStar:
+		if c != '!' {
+			r.state = renameBlockComment
+			return false
+		}
+		r.inExecutable = true
+		r.state = renameVersion
+		r.buffer = append(r.buffer, c)
+
+	case renameVersion:
+		if c < '0' || c > '9' {
+			r.state = renameCode
+			return false
+		}
+		r.buffer = append(r.buffer, c)
+
+	case renameExecutableStar:
+		if c != '/' {
+			r.state = renameCode
+			return false
+		}
+		r.inExecutable = false
+		r.state = renameCode
+		r.buffer = append(r.buffer, c)
+
+	case renameLineComment:
+		if c == '\n' {
+			r.state = renameCode
+		}
+		r.buffer = append(r.buffer, c)
+
+	case renameBlockComment:
+		if c == '*' {
+			r.state = renameBlockCommentStar
+		}
+		r.buffer = append(r.buffer, c)
+
+	case renameBlockCommentStar:
+		switch c {
+		case '/':
+			r.state = renameCode
+		case '*':
+		default:
+			r.state = renameBlockComment
+		}
+		r.buffer = append(r.buffer, c)
+	}
+	return true
+}
+
+// flush writes out a token held back at the end of the stream
+func (r *databaseRenamer) flush() {
+	switch r.state {
+	case renameWord:
+		r.finishWord()
+	case renameIdentifierQuote:
+		r.finishIdentifier()
+	case renameIdentifier:
+		// Unterminated identifier, copy it as it is
+		r.buffer = append(r.buffer, r.token...)
+	}
+	r.state = renameCode
+}
+
+func (r *databaseRenamer) startToken() {
+	r.token = r.token[:0]
+	r.spilled = false
+}
+
+// addToToken collects bytes of the current word or identifier. Tokens longer
+// than limit can't be the database name or a keyword and are copied straight
+// to the output.
+func (r *databaseRenamer) addToToken(data []byte, limit int) {
+	if r.spilled {
+		r.buffer = append(r.buffer, data...)
+		return
+	}
+	r.token = append(r.token, data...)
+	if len(r.token) > max(limit, len("database")) {
+		r.buffer = append(r.buffer, r.token...)
+		r.token = r.token[:0]
+		r.spilled = true
+	}
+}
+
+func (r *databaseRenamer) finishWord() {
+	switch {
+	case r.spilled:
+		r.addStatementWord(statementWordOther)
+	case bytes.Equal(r.token, r.from) && r.namesDatabase():
+		r.buffer = append(r.buffer, r.to...)
+		r.addStatementWord(statementWordOther)
+	default:
+		r.buffer = append(r.buffer, r.token...)
+		// Only the words before the database name need to be classified
+		kind := statementWordOther
+		if r.wordCount < maxStatementWords-1 {
+			for _, keyword := range statementWords {
+				if bytes.EqualFold(r.token, keyword.word) {
+					kind = keyword.kind
+					break
+				}
+			}
+		}
+		r.addStatementWord(kind)
+	}
+}
+
+func (r *databaseRenamer) finishIdentifier() {
+	if !r.spilled && bytes.Equal(r.token, r.fromQuoted) {
+		r.buffer = append(r.buffer, r.toQuoted...)
+	} else if !r.spilled {
+		r.buffer = append(r.buffer, r.token...)
+	}
+	r.buffer = append(r.buffer, '`')
+	r.addStatementWord(statementWordOther)
+}
+
+func (r *databaseRenamer) addStatementWord(kind int) {
+	if r.wordCount < maxStatementWords {
+		r.words[r.wordCount] = kind
+	}
+	r.wordCount++
+}
+
+// namesDatabase reports whether the next word of the statement is the name
+// of the database in a USE or CREATE DATABASE statement
+func (r *databaseRenamer) namesDatabase() bool {
+	words := r.words[:min(r.wordCount, maxStatementWords)]
+	switch {
+	case r.wordCount == 1:
+		return words[0] == statementWordUse
+	case r.wordCount == 2:
+		return words[0] == statementWordCreate && words[1] == statementWordDatabase
+	case r.wordCount == 5:
+		return words[0] == statementWordCreate && words[1] == statementWordDatabase &&
+			words[2] == statementWordIf && words[3] == statementWordNot && words[4] == statementWordExists
+	}
+	return false
+}
+
+// indexStringEnd returns the index of the next quote or backslash, or -1
+func indexStringEnd(data []byte, quote byte) int {
+	for i, c := range data {
+		if c == quote || c == '\\' {
+			return i
+		}
+	}
+	return -1
+}
+
+// isWordByte reports whether c can be part of an unquoted identifier or keyword
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+// unquoteIdentifier removes the backticks around an identifier
+func unquoteIdentifier(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") {
+		return strings.ReplaceAll(name[1:len(name)-1], "``", "`")
+	}
+	return name
+}
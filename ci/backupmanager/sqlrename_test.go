@@ -0,0 +1,160 @@
+package backupmanager
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDatabaseRenamer(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name: "Cloud SQL export preamble",
+			input: "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `staging_db` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;\n" +
+				"USE `staging_db`;\n",
+			expected: "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `production_db` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;\n" +
+				"USE `production_db`;\n",
+		},
+		{
+			name:     "unquoted database statements",
+			input:    "CREATE DATABASE IF NOT EXISTS staging_db;\nuse staging_db;\ncreate schema staging_db",
+			expected: "CREATE DATABASE IF NOT EXISTS production_db;\nuse production_db;\ncreate schema production_db",
+		},
+		{
+			name:     "qualified identifiers",
+			input:    "CREATE VIEW `staging_db`.`v` AS SELECT `n`.`id` FROM `staging_db`.`node` `n`;",
+			expected: "CREATE VIEW `production_db`.`v` AS SELECT `n`.`id` FROM `production_db`.`node` `n`;",
+		},
+		{
+			name:     "executable comments",
+			input:    "/*!50001 CREATE ALGORITHM=UNDEFINED */\n/*!50001 VIEW `staging_db`.`v` AS select 1 AS `id` */;",
+			expected: "/*!50001 CREATE ALGORITHM=UNDEFINED */\n/*!50001 VIEW `production_db`.`v` AS select 1 AS `id` */;",
+		},
+		{
+			name: "data literals",
+			input: "INSERT INTO `node` VALUES (1,'Moved from staging_db to `staging_db`','https://example.com/staging_db'," +
+				"'a:1:{s:2:\\\"db\\\";s:10:\\\"staging_db\\\";}',\"`staging_db`\");",
+			expected: "INSERT INTO `node` VALUES (1,'Moved from staging_db to `staging_db`','https://example.com/staging_db'," +
+				"'a:1:{s:2:\\\"db\\\";s:10:\\\"staging_db\\\";}',\"`staging_db`\");",
+		},
+		{
+			name:     "escaped and doubled quotes",
+			input:    "INSERT INTO `t` VALUES ('It\\'s `staging_db`','It''s `staging_db`','\\\\'),(`staging_db`);",
+			expected: "INSERT INTO `t` VALUES ('It\\'s `staging_db`','It''s `staging_db`','\\\\'),(`production_db`);",
+		},
+		{
+			name:     "other identifiers",
+			input:    "SELECT `staging_db_old`.`a`, `xstaging_db`.`b`, `staging``db`.`c`, `staging_db```.`d` FROM t;",
+			expected: "SELECT `staging_db_old`.`a`, `xstaging_db`.`b`, `staging``db`.`c`, `staging_db```.`d` FROM t;",
+		},
+		{
+			name:     "unquoted names outside database statements",
+			input:    "INSERT INTO staging_db.node VALUES (staging_db);\nSELECT staging_db FROM t;\nUSE other; SELECT staging_db;",
+			expected: "INSERT INTO staging_db.node VALUES (staging_db);\nSELECT staging_db FROM t;\nUSE other; SELECT staging_db;",
+		},
+		{
+			name:     "comments",
+			input:    "-- Database: staging_db\n# `staging_db`\n/* `staging_db` */ /*/ `staging_db` */ USE `staging_db`;",
+			expected: "-- Database: staging_db\n# `staging_db`\n/* `staging_db` */ /*/ `staging_db` */ USE `production_db`;",
+		},
+		{
+			name:     "minus is not a comment without a space",
+			input:    "SELECT 1--1, `staging_db`.`x`;",
+			expected: "SELECT 1--1, `production_db`.`x`;",
+		},
+		{
+			name:     "unterminated identifier",
+			input:    "SELECT `staging_db",
+			expected: "SELECT `staging_db",
+		},
+		{
+			name:     "identifier at the end",
+			input:    "USE `staging_db`",
+			expected: "USE `production_db`",
+		},
+	}
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	}
+	for _, test := range tests {
+		for readerName, wrap := range readers {
+			r := newDatabaseRenamer(wrap(strings.NewReader(test.input)), "staging_db", "production_db")
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s (%s read) failed: %v", test.name, readerName, err)
+			}
+			if string(got) != test.expected {
+				t.Errorf("%s (%s read):\n got: %s\nwant: %s", test.name, readerName, got, test.expected)
+			}
+		}
+	}
+}
+
+func TestDatabaseRenamerAcrossChunks(t *testing.T) {
+	// Place identifiers and a string right across the first chunk boundary
+	padding := strings.Repeat(" ", sqlDumpChunkSize-5)
+	input := "USE `staging_db`;" + padding + "SELECT `staging_db`.`a`, 'staging_db', `staging_db`.`b`;"
+	expected := "USE `production_db`;" + padding + "SELECT `production_db`.`a`, 'staging_db', `production_db`.`b`;"
+
+	got, err := io.ReadAll(newDatabaseRenamer(strings.NewReader(input), "staging_db", "production_db"))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(got) != expected {
+		t.Errorf("identifiers across chunks not renamed correctly")
+	}
+}
+
+func TestDumpDatabaseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		dump     string
+		expected string
+	}{
+		{
+			name: "mysqldump",
+			dump: "-- MySQL dump 10.13\n/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+				"SET @@SESSION.SQL_LOG_BIN= 0;\n/*!40000 DROP DATABASE IF EXISTS `staging_db`*/;\n" +
+				"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `staging_db` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;\nUSE `staging_db`;\n",
+			expected: "staging_db",
+		},
+		{
+			name:     "unquoted",
+			dump:     "USE staging_db;\nCREATE TABLE node (id INT);\n",
+			expected: "staging_db",
+		},
+		{
+			name:     "quoted backtick",
+			dump:     "CREATE DATABASE IF NOT EXISTS `odd``name`;\n",
+			expected: "odd`name",
+		},
+		{
+			name:     "single database dump",
+			dump:     "SET NAMES utf8mb4;\nCREATE TABLE `node` (id INT);\nUSE `staging_db`;\n",
+			expected: "",
+		},
+		{
+			name:     "data mentioning a database",
+			dump:     "INSERT INTO `node` VALUES ('USE `staging_db`;');\n",
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		name, err := dumpDatabaseName(strings.NewReader(test.dump))
+		if err != nil {
+			t.Fatalf("%s: dumpDatabaseName failed: %v", test.name, err)
+		}
+		if name != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, name)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package backupmanager
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sqlStatement is a single statement read from a SQL dump
+type sqlStatement struct {
+	Text string
+	Line int
+}
+
+// sqlStatementScanner splits a SQL dump into statements as the mysql client
+// does: delimiters inside quotes, backticks and comments are ignored, comments
+// between statements are skipped and DELIMITER commands are honoured.
+// MySQL-specific /*! ... */ comments are statements of their own.
+type sqlStatementScanner struct {
+	reader    *bufio.Reader
+	delimiter string
+	line      int
+	bytesRead int64
+}
+
+func newSQLStatementScanner(r io.Reader) *sqlStatementScanner {
+	return &sqlStatementScanner{
+		reader:    bufio.NewReaderSize(r, 1<<20),
+		delimiter: ";",
+		line:      1,
+	}
+}
+
+// BytesRead returns the number of bytes of the dump consumed so far
+func (s *sqlStatementScanner) BytesRead() int64 {
+	return s.bytesRead
+}
+
+// Next returns the next statement, or io.EOF after the last one
+func (s *sqlStatementScanner) Next() (sqlStatement, error) {
+	for {
+		if err := s.skipSpaceAndComments(); err != nil {
+			return sqlStatement{}, err
+		}
+
+		startLine := s.line
+		text, err := s.readStatement()
+		if err != nil && err != io.EOF {
+			return sqlStatement{}, err
+		}
+		text = strings.TrimSpace(text)
+
+		// DELIMITER is a client command and ends at the end of the line
+		if fields := strings.Fields(text); len(fields) > 0 && strings.EqualFold(fields[0], "DELIMITER") {
+			if len(fields) != 2 {
+				return sqlStatement{}, fmt.Errorf("invalid DELIMITER command at line %d", startLine)
+			}
+			s.delimiter = fields[1]
+			continue
+		}
+		if text == "" {
+			if err == io.EOF {
+				return sqlStatement{}, io.EOF
+			}
+			continue
+		}
+		return sqlStatement{Text: text, Line: startLine}, nil
+	}
+}
+
+// readStatement reads up to and including the next delimiter outside of
+// quotes and comments, and returns the text before it
+func (s *sqlStatementScanner) readStatement() (string, error) {
+	var statement bytes.Buffer
+	startLine := s.line
+	atStart := true
+
+	for {
+		c, err := s.readByte()
+		if err == io.EOF {
+			return statement.String(), io.EOF
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// A DELIMITER command ends at the end of its line
+		if atStart && (c == 'd' || c == 'D') {
+			if rest, _ := s.reader.Peek(8); strings.EqualFold(string(rest), "ELIMITER") {
+				statement.WriteByte(c)
+				for {
+					c, err := s.readByte()
+					if err != nil || c == '\n' {
+						return statement.String(), err
+					}
+					statement.WriteByte(c)
+				}
+			}
+		}
+		atStart = false
+
+		switch c {
+		case '\'', '"', '`':
+			statement.WriteByte(c)
+			if err := s.readQuoted(c, &statement); err != nil {
+				return "", err
+			}
+			continue
+		case '-':
+			if next, _ := s.reader.Peek(2); len(next) == 2 && next[0] == '-' && isSQLSpace(next[1]) {
+				if err := s.skipLine(); err != nil && err != io.EOF {
+					return "", err
+				}
+				statement.WriteByte('\n')
+				continue
+			}
+		case '#':
+			if err := s.skipLine(); err != nil && err != io.EOF {
+				return "", err
+			}
+			statement.WriteByte('\n')
+			continue
+		case '/':
+			if next, _ := s.reader.Peek(1); len(next) == 1 && next[0] == '*' {
+				statement.WriteByte(c)
+				if err := s.readBlockComment(&statement); err != nil {
+					return "", fmt.Errorf("unterminated comment in statement starting at line %d", startLine)
+				}
+				continue
+			}
+		}
+
+		if c == s.delimiter[0] {
+			rest, _ := s.reader.Peek(len(s.delimiter) - 1)
+			if string(rest) == s.delimiter[1:] {
+				s.reader.Discard(len(rest))
+				s.bytesRead += int64(len(rest))
+				return statement.String(), nil
+			}
+		}
+		statement.WriteByte(c)
+	}
+}
+
+// readQuoted copies a quoted string or identifier up to its closing quote
+func (s *sqlStatementScanner) readQuoted(quote byte, statement *bytes.Buffer) error {
+	startLine := s.line
+	for {
+		c, err := s.readByte()
+		if err == io.EOF {
+			return fmt.Errorf("unterminated %c quote starting at line %d", quote, startLine)
+		}
+		if err != nil {
+			return err
+		}
+		statement.WriteByte(c)
+
+		switch {
+		case c == '\\' && quote != '`':
+			// Copy the escaped character
+			next, err := s.readByte()
+			if err != nil {
+				return fmt.Errorf("unterminated %c quote starting at line %d", quote, startLine)
+			}
+			statement.WriteByte(next)
+		case c == quote:
+			// A doubled quote is an escaped quote
+			if next, _ := s.reader.Peek(1); len(next) == 1 && next[0] == quote {
+				s.readByte()
+				statement.WriteByte(quote)
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+// readBlockComment copies a /* ... */ comment, the opening slash already read
+func (s *sqlStatementScanner) readBlockComment(statement *bytes.Buffer) error {
+	var previous byte
+	for n := 1; ; n++ {
+		c, err := s.readByte()
+		if err != nil {
+			return err
+		}
+		statement.WriteByte(c)
+		// The first character is the opening star, so /*/ doesn't close
+		if n > 2 && previous == '*' && c == '/' {
+			return nil
+		}
+		previous = c
+	}
+}
+
+// skipSpaceAndComments skips whitespace and comments before a statement.
+// MySQL-specific /*! ... */ comments are kept, the server executes them.
+func (s *sqlStatementScanner) skipSpaceAndComments() error {
+	for {
+		next, err := s.reader.Peek(3)
+		if len(next) == 0 {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case isSQLSpace(next[0]):
+			s.readByte()
+		case next[0] == '#':
+			if err := s.skipLine(); err != nil && err != io.EOF {
+				return err
+			}
+		case len(next) >= 2 && next[0] == '-' && next[1] == '-' && (len(next) == 2 || isSQLSpace(next[2])):
+			if err := s.skipLine(); err != nil && err != io.EOF {
+				return err
+			}
+		case len(next) >= 2 && next[0] == '/' && next[1] == '*' && (len(next) == 2 || next[2] != '!'):
+			startLine := s.line
+			s.readByte()
+			var comment bytes.Buffer
+			comment.WriteByte('/')
+			if err := s.readBlockComment(&comment); err != nil {
+				return fmt.Errorf("unterminated comment starting at line %d", startLine)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *sqlStatementScanner) skipLine() error {
+	for {
+		c, err := s.readByte()
+		if err != nil || c == '\n' {
+			return err
+		}
+	}
+}
+
+func (s *sqlStatementScanner) readByte() (byte, error) {
+	c, err := s.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.bytesRead++
+	if c == '\n' {
+		s.line++
+	}
+	return c, nil
+}
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
@@ -0,0 +1,73 @@
+package backupmanager
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func scanAll(t *testing.T, dump string) []sqlStatement {
+	t.Helper()
+	scanner := newSQLStatementScanner(strings.NewReader(dump))
+	var statements []sqlStatement
+	for {
+		statement, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		statements = append(statements, statement)
+	}
+	if scanner.BytesRead() != int64(len(dump)) {
+		t.Errorf("BytesRead = %d, want %d", scanner.BytesRead(), len(dump))
+	}
+	return statements
+}
+
+func TestSQLStatementScanner(t *testing.T) {
+	dump := "-- MySQL dump 10.13\n" +
+		"/*!40101 SET NAMES utf8mb4 */;\n" +
+		"/* plain comment; with a semicolon */\n" +
+		"# hash comment;\n" +
+		"\n" +
+		"CREATE TABLE `semi;colon` (\n" +
+		"  `id` int -- trailing comment; ignored\n" +
+		");\n" +
+		"INSERT INTO `semi;colon` VALUES (1,'a;b'),(2,'it\\'s'),(3,'double '' quote'),(4,\"dq;\"),(5,'back\\\\');\n" +
+		"DELIMITER ;;\n" +
+		"CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW BEGIN SET NEW.a = 1; SET NEW.b = 2; END ;;\n" +
+		"DELIMITER ;\n" +
+		"SELECT 1-1;SELECT 2\n"
+
+	want := []sqlStatement{
+		{Text: "/*!40101 SET NAMES utf8mb4 */", Line: 2},
+		{Text: "CREATE TABLE `semi;colon` (\n  `id` int \n)", Line: 6},
+		{Text: "INSERT INTO `semi;colon` VALUES (1,'a;b'),(2,'it\\'s'),(3,'double '' quote'),(4,\"dq;\"),(5,'back\\\\')", Line: 9},
+		{Text: "CREATE TRIGGER t BEFORE INSERT ON x FOR EACH ROW BEGIN SET NEW.a = 1; SET NEW.b = 2; END", Line: 11},
+		{Text: "SELECT 1-1", Line: 13},
+		{Text: "SELECT 2", Line: 13},
+	}
+	if got := scanAll(t, dump); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected statements:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestSQLStatementScannerErrors(t *testing.T) {
+	for _, dump := range []string{
+		"INSERT INTO t VALUES ('unterminated);\n",
+		"SELECT 1 /* unterminated comment;\n",
+		"DELIMITER\n",
+	} {
+		scanner := newSQLStatementScanner(strings.NewReader(dump))
+		var err error
+		for err == nil {
+			_, err = scanner.Next()
+		}
+		if err == io.EOF {
+			t.Errorf("expected a parse error for %q", dump)
+		}
+	}
+}
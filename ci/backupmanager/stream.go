@@ -0,0 +1,334 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileStreamer is implemented by file backends that can stream the files of
+// an environment without storing them locally first. StreamFolder calls
+// addFile for every file, directory and symlink below TargetPath with its
+// header, named relative to TargetPath, and the content of regular files.
+// Directory names end with a slash.
+type FileStreamer interface {
+	StreamFolder(envConfig *EnvironmentConfig, addFile func(header *tar.Header, content io.Reader) error) error
+}
+
+// backupStream writes a backup archive as a stream: the tar entries go
+// through the compression and, when configured, the encryption straight into
+// an archive store. The manifest is written first, the checksums of the
+// entries follow at the end.
+type backupStream struct {
+	upload     ArchiveWriter
+	encryption io.WriteCloser
+	compressor io.WriteCloser
+	tarWriter  *tar.Writer
+	files      []ManifestFile
+	size       int64
+}
+
+// newBackupStream starts an archive in upload and writes the manifest
+func newBackupStream(upload ArchiveWriter, manifest *BackupManifest, encryption *ArchiveEncryption) (*backupStream, error) {
+	if manifest.Compression == "" {
+		manifest.Compression = CompressionGzip
+	}
+	// The files archives of runs stored as separate artifacts keep their version
+	if manifest.FormatVersion != ArchiveFormatArtifacts {
+		manifest.FormatVersion = ArchiveFormatVersioned
+		if manifest.ParentRunID != "" {
+			manifest.FormatVersion = ArchiveFormatIncremental
+		}
+	}
+	manifest.ChecksumsAtEnd = true
+	manifest.Files = nil
+
+	stream := &backupStream{upload: upload}
+	var w io.Writer = upload
+	if encryption.CanEncrypt() {
+		encrypter, err := encryption.NewEncryptingWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		stream.encryption = encrypter
+		w = encrypter
+	}
+	compressor, err := newCompressionWriter(w, manifest.Compression, manifest.CompressionLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s writer: %v", manifest.Compression, err)
+	}
+	stream.compressor = compressor
+	stream.tarWriter = tar.NewWriter(compressor)
+
+	if err := addManifestToTar(stream.tarWriter, manifest); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// addFile writes an entry to the archive and records the size and checksum
+// of regular files. Their content must have the size given in the header,
+// directories and symlinks have none.
+func (s *backupStream) addFile(header *tar.Header, content io.Reader) error {
+	if err := s.tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header for %s: %v", header.Name, err)
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(s.tarWriter, hash), content)
+	if err != nil {
+		return fmt.Errorf("failed to write %s to archive: %v", header.Name, err)
+	}
+	if written != header.Size {
+		return fmt.Errorf("%s has %d bytes, expected %d", header.Name, written, header.Size)
+	}
+	s.files = append(s.files, ManifestFile{Path: header.Name, Size: written, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	s.size += written
+	return nil
+}
+
+// finish writes the checksums, ends the tar, compressed and encrypted streams
+// and stores the archive. The archive isn't stored when any of them fail.
+func (s *backupStream) finish(finishedAt time.Time) error {
+	data, err := json.MarshalIndent(archiveChecksums{FinishedAt: finishedAt, Files: s.files}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checksums: %v", err)
+	}
+	header := &tar.Header{Name: checksumsFileName, Mode: 0644, Size: int64(len(data)), ModTime: finishedAt}
+	if err := s.tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write header for %s: %v", checksumsFileName, err)
+	}
+	if _, err := s.tarWriter.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s to tar: %v", checksumsFileName, err)
+	}
+
+	if err := s.tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish tar stream: %v", err)
+	}
+	if err := s.compressor.Close(); err != nil {
+		return fmt.Errorf("failed to finish compressed stream: %v", err)
+	}
+	if s.encryption != nil {
+		if err := s.encryption.Close(); err != nil {
+			return fmt.Errorf("failed to finish encrypted stream: %v", err)
+		}
+	}
+	return s.upload.Close()
+}
+
+// streamLocalFolder calls addFile for every file, directory and symlink
+// below root, in lexical order, with its path relative to root. Symlinks are
+// added as links and never followed, links pointing outside root, also
+// through other links, are skipped as restores reject them. Entries filter doesn't keep are skipped, excluded
+// directories aren't walked.
+func streamLocalFolder(root string, filter *PathFilter, addFile func(header *tar.Header, content io.Reader) error) error {
+	links := newLinkResolver(nil)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %v", err)
+		}
+		if relPath == "." {
+			return nil
+		}
+		if !filter.keeps(filepath.ToSlash(relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			Warn("Skipping special file %s", path)
+			return nil
+		}
+
+		header, err := localTarHeader(path, info, filepath.ToSlash(relPath))
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeSymlink && !links.add(header.Name, header.Linkname) {
+			Warn("Skipping symlink %s pointing outside the files: %s", path, header.Linkname)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return addFile(header, nil)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open file %s: %v", path, err)
+		}
+		defer file.Close()
+		return addFile(header, file)
+	})
+}
+
+// localTarHeader returns the archive header of a local file, directory or
+// symlink with its permission bits and mtime. Directory names get a trailing
+// slash, owners are left out as they differ between hosts.
+func localTarHeader(path string, info os.FileInfo, name string) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %v", path, err)
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tar header for %s: %v", path, err)
+	}
+	header.Name = name
+	if info.IsDir() && !strings.HasSuffix(name, "/") {
+		header.Name += "/"
+	}
+	header.Uname, header.Gname = "", ""
+	return header, nil
+}
+
+// StreamFolder streams the files below the local TargetPath
+func (b *BackendLocal) StreamFolder(envConfig *EnvironmentConfig, addFile func(header *tar.Header, content io.Reader) error) error {
+	Info("Streaming files from %s", envConfig.TargetPath)
+	filter, err := envConfig.FilesFilter()
+	if err != nil {
+		return err
+	}
+	if err := streamLocalFolder(envConfig.TargetPath, filter, addFile); err != nil {
+		Error("Failed to stream files: %v", err)
+		return err
+	}
+	return nil
+}
+
+// StreamFolder streams the files below the remote TargetPath as the remote
+// tar writes them, nothing is stored locally. With a files filter the remote
+// files are listed first and tar only reads those the filter keeps.
+func (b *BackendSSH) StreamFolder(envConfig *EnvironmentConfig, addFile func(header *tar.Header, content io.Reader) error) error {
+	Info("Streaming files from %s@%s:%s via SSH", envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+
+	filter, err := envConfig.FilesFilter()
+	if err != nil {
+		return err
+	}
+	client, err := dialSSH(envConfig)
+	if err != nil {
+		Error("SSH connection failed: %v", err)
+		return err
+	}
+	defer client.Close()
+
+	cmd := remoteTarCommand(envConfig, false)
+	var list []byte
+	if filter != nil {
+		remote, err := listRemoteTree(client, envConfig)
+		if err != nil {
+			Error("Failed to list remote files: %v", err)
+			return err
+		}
+		filterTree(remote, filter)
+		paths := make([]string, 0, len(remote))
+		for path := range remote {
+			paths = append(paths, path)
+		}
+		// Sorting puts directories before their content
+		sort.Strings(paths)
+		list = nulList(paths)
+		cmd = remoteTarCommand(envConfig, true)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "session", Err: err}
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	if filter != nil {
+		session.Stdin = bytes.NewReader(list)
+	}
+	session.Stderr = &stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "session", Err: err}
+	}
+	if err := session.Start(cmd); err != nil {
+		return &SSHError{Host: envConfig.TargetHost, Op: "tar", Err: err}
+	}
+
+	count, streamErr := streamTarFiles(stdout, addFile)
+	if streamErr != nil {
+		// Drain the stream so the remote tar can exit
+		io.Copy(io.Discard, stdout)
+	}
+	if err := waitRemoteTar(session, envConfig, &stderr); err != nil {
+		return err
+	}
+	if streamErr != nil {
+		Error("Failed to stream files: %v", streamErr)
+		return fmt.Errorf("failed to stream files: %v", streamErr)
+	}
+
+	Info("Successfully streamed %d entries via SSH from %s@%s:%s", count, envConfig.TargetUser, envConfig.TargetHost, envConfig.TargetPath)
+	return nil
+}
+
+// streamTarFiles calls addFile for every file, directory and symlink of a
+// tar stream, with the name cleaned of ./ prefixes. Special files and
+// symlinks pointing outside the stream's root are skipped. Hard links are
+// refused: remoteTarCommand writes hard linked files in full, and a link left
+// out would silently lose its file.
+func streamTarFiles(r io.Reader, addFile func(header *tar.Header, content io.Reader) error) (int, error) {
+	tarReader := tar.NewReader(r)
+	links := newLinkResolver(nil)
+	count := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to read tar header: %v", err)
+		}
+		if header.Typeflag == tar.TypeLink {
+			return count, fmt.Errorf("hard link %s to %s in transfer, the remote tar must write hard linked files in full", header.Name, header.Linkname)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeSymlink {
+			Warn("Skipping special file %s", header.Name)
+			continue
+		}
+
+		name := filepath.ToSlash(filepath.Clean(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return count, fmt.Errorf("invalid file path in transfer: %s", header.Name)
+		}
+		if name == "." {
+			continue
+		}
+		if header.Typeflag == tar.TypeSymlink && !links.add(name, header.Linkname) {
+			Warn("Skipping symlink %s pointing outside the files: %s", name, header.Linkname)
+			continue
+		}
+		if header.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		header.Name = name
+		header.Uname, header.Gname = "", ""
+		if err := addFile(header, tarReader); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
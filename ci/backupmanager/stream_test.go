@@ -0,0 +1,266 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLocalStoreEngine creates a mock engine whose staging archives are stored
+// in a local folder
+func newLocalStoreEngine(t *testing.T, backend *MockBackend) (*BackupEngineCloud, string) {
+	t.Helper()
+	backupFolder := t.TempDir()
+	configs := mockConfigs()
+	configs["staging"].BackupURL = "file://" + backupFolder
+	engine := newMockEngine(backend, configs)
+	engine.backends["staging"].Archives = NewBackendLocal()
+	return engine, filepath.Join(backupFolder, "backups", "staging")
+}
+
+// extractTestArchive extracts an archive file with extractBackupStream, as
+// restores extract the archives they stream out of the archive store
+func extractTestArchive(t *testing.T, archivePath string, destinationFolder string) (*BackupManifest, error) {
+	t.Helper()
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+	return extractBackupStream(file, destinationFolder, ExtractLimits{}, nil)
+}
+
+// writeTestArchive writes a single archive with the manifest, the dump as
+// db_dump.sql and the files below filesFolder, the way runs were stored
+// before they were split into separate artifacts. The checksums of the
+// entries are added to the manifest.
+func writeTestArchive(t *testing.T, archivePath string, manifest *BackupManifest, dumpPath string, filesFolder string) {
+	t.Helper()
+	upload, err := NewBackendLocal().NewArchiveWriter(context.Background(), "file://"+archivePath)
+	if err != nil {
+		t.Fatalf("NewArchiveWriter failed: %v", err)
+	}
+	stream, err := newBackupStream(upload, manifest, nil)
+	if err != nil {
+		t.Fatalf("newBackupStream failed: %v", err)
+	}
+	if err := stream.addLocalFile(dumpPath, "db_dump.sql"); err != nil {
+		t.Fatalf("addLocalFile failed: %v", err)
+	}
+	err = streamLocalFolder(filesFolder, nil, func(header *tar.Header, content io.Reader) error {
+		header.Name = "files/" + header.Name
+		return stream.addFile(header, content)
+	})
+	if err != nil {
+		t.Fatalf("Failed to add files: %v", err)
+	}
+	if err := stream.finish(time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("finish failed: %v", err)
+	}
+	manifest.Files = stream.files
+}
+
+// addLocalFile writes a local file to the archive under archiveName
+func (s *backupStream) addLocalFile(filePath string, archiveName string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := localTarHeader(filePath, info, archiveName)
+	if err != nil {
+		return err
+	}
+	return s.addFile(header, file)
+}
+
+func TestStreamedBackupArchive(t *testing.T) {
+	engine, runFolder := newLocalStoreEngine(t, NewMockBackend())
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-stream"); err != nil {
+		t.Fatalf("PerformBackup failed: %v", err)
+	}
+
+	archivePath := filepath.Join(runFolder, "test-run-stream", "files.tar.gz")
+	manifest, err := extractTestArchive(t, archivePath, filepath.Join(t.TempDir(), "extracted"))
+	if err != nil {
+		t.Fatalf("extracting archive failed: %v", err)
+	}
+	if !manifest.ChecksumsAtEnd || manifest.FinishedAt.IsZero() {
+		t.Errorf("streamed manifest should take its checksums and finish time from the end of the archive")
+	}
+	var paths []string
+	for _, file := range manifest.Files {
+		paths = append(paths, file.Path)
+	}
+	if strings.Join(paths, ",") != "files/dummy.txt" {
+		t.Errorf("unexpected checksums for %v", paths)
+	}
+
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-stream")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"archive stream": CheckPassed, "manifest": CheckPassed, "checksums": CheckPassed, "artifacts": CheckPassed})
+}
+
+func TestTruncatedStreamedArchive(t *testing.T) {
+	tmpFolder := t.TempDir()
+	archivePath := filepath.Join(tmpFolder, "backup_archive.tar")
+	upload, err := NewBackendLocal().NewArchiveWriter(context.Background(), "file://"+archivePath)
+	if err != nil {
+		t.Fatalf("NewArchiveWriter failed: %v", err)
+	}
+	stream, err := newBackupStream(upload, &BackupManifest{DatabaseEngine: DatabaseEngineMySQL, Compression: CompressionNone}, nil)
+	if err != nil {
+		t.Fatalf("newBackupStream failed: %v", err)
+	}
+	dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+	mustWriteFile(t, dumpPath, completeMySQLDump)
+	if err := stream.addLocalFile(dumpPath, "db_dump.sql"); err != nil {
+		t.Fatalf("addLocalFile failed: %v", err)
+	}
+	if err := stream.finish(time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("finish failed: %v", err)
+	}
+	if report := VerifyBackupArchive(archivePath); !report.Passed() {
+		t.Fatalf("complete archive fails verification: %+v", report.Checks)
+	}
+
+	// Cut the archive where the checksums start, the tar stream itself
+	// still ends cleanly
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+	cut := bytes.Index(data, []byte(checksumsFileName))
+	truncatedPath := filepath.Join(tmpFolder, "truncated.tar")
+	if err := os.WriteFile(truncatedPath, data[:cut-cut%512], 0644); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+
+	if _, err := extractTestArchive(t, truncatedPath, filepath.Join(tmpFolder, "extracted")); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("truncated archive should not extract, got %v", err)
+	}
+	checkStatuses(t, VerifyBackupArchive(truncatedPath), map[string]string{"archive stream": CheckPassed, "checksums": CheckFailed})
+}
+
+func TestFailedFileStreamAbortsUpload(t *testing.T) {
+	backend := NewMockBackend()
+	backend.failDownload = true
+	engine, runFolder := newLocalStoreEngine(t, backend)
+
+	if err := engine.PerformBackup(context.Background(), "staging", "test-run-abort"); err == nil {
+		t.Fatalf("PerformBackup should fail when the files can't be read")
+	}
+	// Neither the archive nor its partial upload is left behind
+	if entries, _ := os.ReadDir(runFolder); len(entries) != 0 {
+		t.Errorf("failed backup left %d files in the archive store", len(entries))
+	}
+}
+
+func TestStreamTarFiles(t *testing.T) {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./logo.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Uname: "www-data"},
+		{Name: "./inline-images/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./inline-images/link.png", Typeflag: tar.TypeSymlink, Linkname: "../logo.png"},
+		{Name: "./inline-images//photo.jpg", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "./inline-images/top", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "./escape", Typeflag: tar.TypeSymlink, Linkname: "inline-images/top/.."},
+	} {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("failed to write header: %v", err)
+		}
+		if header.Size > 0 {
+			tarWriter.Write([]byte("data"))
+		}
+	}
+	tarWriter.Close()
+
+	var names []string
+	count, err := streamTarFiles(&buf, func(header *tar.Header, content io.Reader) error {
+		if header.Uname != "" {
+			t.Errorf("%s keeps the remote owner %s", header.Name, header.Uname)
+		}
+		names = append(names, header.Name)
+		return nil
+	})
+	if err != nil || count != 5 {
+		t.Fatalf("expected 5 entries, got %d, %v", count, err)
+	}
+	if strings.Join(names, ",") != "logo.png,inline-images/,inline-images/link.png,inline-images/photo.jpg,inline-images/top" {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	buf.Reset()
+	tarWriter = tar.NewWriter(&buf)
+	tarWriter.WriteHeader(&tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644})
+	tarWriter.Close()
+	if _, err := streamTarFiles(&buf, func(*tar.Header, io.Reader) error { return nil }); err == nil {
+		t.Errorf("paths outside the files folder should be rejected")
+	}
+
+	// A hard link would lose its file, it fails the stream
+	buf.Reset()
+	tarWriter = tar.NewWriter(&buf)
+	tarWriter.WriteHeader(&tar.Header{Name: "./photo.jpg", Typeflag: tar.TypeReg, Mode: 0644})
+	tarWriter.WriteHeader(&tar.Header{Name: "./copy.jpg", Typeflag: tar.TypeLink, Linkname: "./photo.jpg"})
+	tarWriter.Close()
+	if _, err := streamTarFiles(&buf, func(*tar.Header, io.Reader) error { return nil }); err == nil || !strings.Contains(err.Error(), "hard link") {
+		t.Errorf("hard links should be rejected, got %v", err)
+	}
+}
+
+func TestSSHStreamFolderTarStatus(t *testing.T) {
+	for _, test := range []struct {
+		status uint32
+		fails  bool
+	}{
+		{0, false},
+		// GNU tar's status for files that changed while it read them
+		{1, false},
+		{2, true},
+	} {
+		envConfig := newTestSSHServerRunning(t, func(command string, _ io.Reader, stdout io.Writer, stderr io.Writer) uint32 {
+			if !strings.HasPrefix(command, "tar ") {
+				fmt.Fprintf(stderr, "unexpected remote command: %s\n", command)
+				return 2
+			}
+			tarWriter := tar.NewWriter(stdout)
+			tarWriter.WriteHeader(&tar.Header{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+			tarWriter.Write([]byte("data"))
+			tarWriter.Close()
+			if test.status != 0 {
+				fmt.Fprintln(stderr, "tar: ./a.txt: file changed as we read it")
+			}
+			return test.status
+		})
+		var names []string
+		err := NewBackendSSH().StreamFolder(envConfig, func(header *tar.Header, content io.Reader) error {
+			names = append(names, header.Name)
+			return nil
+		})
+		if test.fails {
+			if err == nil {
+				t.Errorf("tar exiting with status %d should fail the stream", test.status)
+			}
+			continue
+		}
+		if err != nil || strings.Join(names, ",") != "a.txt" {
+			t.Errorf("tar exiting with status %d streamed %v, %v", test.status, names, err)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package backupmanager
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Results of the checks in a verification report
+const (
+	CheckPassed  = "PASS"
+	CheckFailed  = "FAIL"
+	CheckSkipped = "SKIP"
+)
+
+// mysqlDumpCompletedMarker ends complete mysqldump and direct export dumps
+const mysqlDumpCompletedMarker = "-- Dump completed"
+
+// VerificationCheck is the result of one check of a backup archive
+type VerificationCheck struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// VerificationReport lists the checks run against a backup archive
+type VerificationReport struct {
+	Manifest *BackupManifest
+	Checks   []VerificationCheck
+}
+
+// Passed reports whether no check failed
+func (r *VerificationReport) Passed() bool {
+	for _, check := range r.Checks {
+		if check.Status == CheckFailed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *VerificationReport) add(name string, status string, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, VerificationCheck{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// replace replaces the check of the same name, or adds it
+func (r *VerificationReport) replace(check VerificationCheck) {
+	for i := range r.Checks {
+		if r.Checks[i].Name == check.Name {
+			r.Checks[i] = check
+			return
+		}
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Will verify the backup archive of the given environment and runId without
+// restoring it. The archive is streamed from the archive store and read end to
+// end, its entries are checked against the manifest and the database dump must
+// be complete. When the environment trusts signing keys, the archive must
+// match a signature by one of them. Incremental archives only hold the files
+// that changed since the run they build on, whose archive must be stored.
+// The database dump and files archive of runs stored as separate artifacts
+// are read the same way and must match their manifest, which is what is
+// signed. Runs stored in the chunk store are verified by reading every chunk of their
+// snapshot. Nothing is stored locally.
+// An error is only returned when the archive can't be downloaded, a broken
+// archive results in a report with failed checks. Cancelling the context,
+// e.g. when the CLI is interrupted, stops the download and returns an error.
+func (e *BackupEngineCloud) VerifyBackup(ctx context.Context, environment string, runId string) (*VerificationReport, error) {
+	report, err := e.verifyBackup(ctx, environment, runId)
+	if err == nil && ctx.Err() != nil {
+		// The checks that failed on the way only say that reading stopped
+		Error("Verification interrupted: %v", ctx.Err())
+		return nil, fmt.Errorf("verification interrupted: %v", ctx.Err())
+	}
+	return report, err
+}
+
+func (e *BackupEngineCloud) verifyBackup(ctx context.Context, environment string, runId string) (*VerificationReport, error) {
+	Info("Verifying backup of environment '%s' with run ID '%s'", environment, runId)
+	envConfig, ok := e.configs[environment]
+	if !ok {
+		Error("Unknown environment: %s", environment)
+		return nil, fmt.Errorf("unknown environment: %s", environment)
+	}
+	backends := e.backends[environment]
+
+	snapshot, snapshotDigest, err := readChunkSnapshot(ctx, backends.Archives, envConfig, environment, runId)
+	if err != nil {
+		Error("Failed to read snapshot: %v", err)
+		return nil, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	if snapshot != nil {
+		return e.verifySnapshot(ctx, envConfig, backends, environment, runId, snapshot, snapshotDigest)
+	}
+
+	stored, err := findStoredRun(backends.Archives, envConfig, environment, runId)
+	if err != nil {
+		Error("Failed to find backup: %v", err)
+		return nil, fmt.Errorf("failed to find backup: %v", err)
+	}
+	if stored.Folder != "" {
+		return e.verifyRunArtifacts(ctx, envConfig, backends, environment, runId, stored)
+	}
+	sourceArchivePath := stored.Archive
+
+	// The signature is checked with the keys the environment trusts
+	signature, signatureErr := checkStoredSignature(ctx, backends.Archives, backends.Signing, environment, runId, sourceArchivePath)
+	var unsigned *SignatureError
+	if signatureErr != nil && !errors.As(signatureErr, &unsigned) {
+		Error("Failed to check archive signature: %v", signatureErr)
+		return nil, fmt.Errorf("failed to check archive signature: %v", signatureErr)
+	}
+
+	Info("Streaming backup archive from %s", sourceArchivePath)
+	report, digest, err := verifyStoredArchive(ctx, envConfig, backends, sourceArchivePath)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case backends.Signing == nil || len(backends.Signing.TrustedKeys) == 0:
+		report.add("signature", CheckSkipped, "no trusted keys are configured for %s", environment)
+	case signatureErr != nil:
+		report.add("signature", CheckFailed, "%v", signatureErr)
+	case digest == nil:
+		report.add("signature", CheckFailed, "archive could not be read to the end")
+	default:
+		if err := signature.checkDigest(sourceArchivePath, digest); err != nil {
+			report.add("signature", CheckFailed, "%v", err)
+		} else {
+			report.add("signature", CheckPassed, "archive matches its signature by the trusted key %s", signature.fingerprint())
+		}
+	}
+	addRunChecks(report, backends.Archives, envConfig, environment, runId)
+	return report, nil
+}
+
+// verifyStoredArchive streams an archive out of the archive store into
+// verifyBackupStream. It returns the report along with the size and checksum
+// of the archive as stored, nil when it couldn't be read to the end. A
+// missing or wrong key is returned as an error.
+func verifyStoredArchive(ctx context.Context, envConfig *EnvironmentConfig, backends *EnvironmentBackends, url string) (*VerificationReport, *archiveDigest, error) {
+	reader, err := backends.Archives.NewArchiveReader(ctx, url)
+	if err != nil {
+		Error("NewArchiveReader failed: %v", err)
+		return nil, nil, fmt.Errorf("NewArchiveReader failed: %v", err)
+	}
+	defer reader.Close()
+	digest := newArchiveDigest()
+	stored := io.TeeReader(&contextReader{ctx: ctx, Reader: reader}, digest)
+
+	// A wrong or missing key says nothing about the archive, a failed
+	// decryption means it was corrupted or tampered with
+	stream, encrypted, err := backends.Encryption.NewDecryptingReader(stored, url)
+	var keyErr *DecryptionKeyError
+	if errors.As(err, &keyErr) {
+		Error("Decryption failed: %v", err)
+		return nil, nil, err
+	}
+	if err != nil {
+		report := &VerificationReport{}
+		report.add("encryption", CheckFailed, "%v", err)
+		Error("Check 'encryption' failed: %v", err)
+		return report, nil, nil
+	}
+
+	decrypted := &readErrorRecorder{Reader: stream}
+	report := verifyBackupStream(decrypted, envConfig.ExtractLimits())
+	if encrypted {
+		check := VerificationCheck{Name: "encryption", Status: CheckPassed, Detail: "archive decrypted and authenticated"}
+		if decrypted.err != nil {
+			check.Status = CheckFailed
+			check.Detail = decrypted.err.Error()
+			Error("Check 'encryption' failed: %s", check.Detail)
+		}
+		report.Checks = append([]VerificationCheck{check}, report.Checks...)
+	}
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return report, nil, nil
+	}
+	return report, digest, nil
+}
+
+// contextReader stops reading once the context is cancelled, for stores
+// whose readers don't watch the context themselves
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// addRunChecks adds the checks of the run a verified backup was stored as:
+// the manifest must name it, and the run an incremental backup builds on must
+// be stored
+func addRunChecks(report *VerificationReport, store ArchiveStore, envConfig *EnvironmentConfig, environment string, runId string) {
+	if report.Manifest != nil && report.Manifest.RunID != "" &&
+		(report.Manifest.Environment != environment || report.Manifest.RunID != runId) {
+		report.add("origin", CheckFailed, "archive stored as %s run '%s' was taken from %s run '%s'",
+			environment, runId, report.Manifest.Environment, report.Manifest.RunID)
+	}
+
+	// Incremental backups can only be restored along with the run they build on
+	if report.Manifest != nil && report.Manifest.ParentRunID != "" {
+		parent := report.Manifest.ParentRunID
+		stored, err := findStoredRun(store, envConfig, environment, parent)
+		if err == nil && stored.Folder != "" && stored.Files == "" {
+			err = fmt.Errorf("no files archive is stored in %s", stored.Folder)
+		}
+		if err != nil {
+			report.add("parent", CheckFailed, "incremental backup on top of run '%s', whose archive is missing: %v", parent, err)
+		} else {
+			report.add("parent", CheckPassed, "incremental backup on top of run '%s', whose archive is stored", parent)
+		}
+	}
+}
+
+// VerifyBackupArchive reads a backup archive end to end and reports whether
+// the compressed and tar streams are intact, every entry is safe to extract,
+// the entries match the sizes and checksums in the manifest and the database
+// dump is complete
+func VerifyBackupArchive(archivePath string) *VerificationReport {
+	Info("Verifying archive %s", archivePath)
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		report := &VerificationReport{}
+		report.add("archive stream", CheckFailed, "failed to open archive: %v", err)
+		return report
+	}
+	defer file.Close()
+	return verifyBackupStream(file, ExtractLimits{})
+}
+
+// verifyBackupStream runs the checks of VerifyBackupArchive on an archive
+// read from r. Entries that restores would refuse to extract within limits
+// fail the archive stream check.
+func verifyBackupStream(r io.Reader, limits ExtractLimits) *VerificationReport {
+	report := &VerificationReport{}
+	archive := &readErrorRecorder{Reader: r}
+
+	var manifestErr, checksumsErr error
+	var dumpCheck *VerificationCheck
+	var compression, format string
+	entries := make(map[string]ManifestFile)
+	streamErr := func() error {
+		decompressionReader, detected, err := newDecompressionReader(archive)
+		if err != nil {
+			return err
+		}
+		defer decompressionReader.Close()
+		compression = detected
+		reader := newBackupArchiveReader(decompressionReader, limits)
+		defer func() { report.Manifest, format = reader.manifest, reader.describeLegacyLayout() }()
+
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			var metadataErr *archiveMetadataError
+			if errors.As(err, &metadataErr) {
+				if metadataErr.Entry == manifestFileName && manifestErr == nil {
+					manifestErr = err
+				}
+				if metadataErr.Entry == checksumsFileName {
+					checksumsErr = err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeLink {
+				linked := entries[path.Clean(header.Linkname)]
+				entries[header.Name] = ManifestFile{Path: header.Name, Size: linked.Size, SHA256: linked.SHA256}
+				continue
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+
+			// Entries are hashed as they stream by, the dump is parsed on the way
+			hash := sha256.New()
+			entry := &readErrorRecorder{Reader: io.TeeReader(reader, hash)}
+			if header.Name == "db_dump.sql" {
+				check := verifySQLDump(entry, reader.manifest)
+				dumpCheck = &check
+			}
+			io.Copy(io.Discard, entry)
+			if entry.err != nil {
+				if header.Name == "db_dump.sql" {
+					dumpCheck = nil
+				}
+				return fmt.Errorf("failed to read %s: %v", header.Name, entry.err)
+			}
+			entries[header.Name] = ManifestFile{Path: header.Name, Size: entry.n, SHA256: hex.EncodeToString(hash.Sum(nil))}
+		}
+
+		// The tar stream ends before the gzip trailer or the last zstd
+		// frame, whose checksums are only verified when reading to the end
+		if _, err := io.Copy(io.Discard, decompressionReader); err != nil {
+			return fmt.Errorf("failed to read the end of the %s stream: %v", compression, err)
+		}
+		return nil
+	}()
+
+	if streamErr != nil {
+		report.add("archive stream", CheckFailed, "%v", streamErr)
+	} else {
+		report.add("archive stream", CheckPassed, "%d entries in %d bytes, %s compressed", len(entries), archive.n, compression)
+	}
+
+	switch {
+	case manifestErr != nil:
+		report.add("manifest", CheckFailed, "%v", manifestErr)
+	case report.Manifest == nil:
+		report.add("manifest", CheckSkipped, "archive has no manifest, it was read as %s", format)
+	case report.Manifest.Compression != "" && compression != "" && report.Manifest.Compression != compression:
+		report.add("manifest", CheckFailed, "manifest records %s compression, but the archive is %s compressed", report.Manifest.Compression, compression)
+	default:
+		report.add("manifest", CheckPassed, "%s", describeManifest(report.Manifest))
+	}
+
+	switch {
+	case report.Manifest == nil || (!report.Manifest.ChecksumsAtEnd && len(report.Manifest.Files) == 0):
+		report.add("checksums", CheckSkipped, "no checksums in the manifest")
+	case streamErr != nil:
+		report.add("checksums", CheckFailed, "archive could not be read to the end")
+	case checksumsErr != nil:
+		report.add("checksums", CheckFailed, "%v", checksumsErr)
+	case report.Manifest.Files == nil:
+		report.add("checksums", CheckFailed, "archive ends before its checksums, it is truncated")
+	default:
+		if problems := compareManifestFiles(report.Manifest, entries); len(problems) > 0 {
+			report.add("checksums", CheckFailed, "%s", summarizeProblems(problems))
+		} else {
+			report.add("checksums", CheckPassed, "%d entries match the manifest", len(entries))
+		}
+	}
+
+	switch {
+	case dumpCheck != nil:
+		report.Checks = append(report.Checks, *dumpCheck)
+	case report.Manifest != nil && report.Manifest.FormatVersion >= ArchiveFormatArtifacts:
+		report.add("database dump", CheckSkipped, "the dump of runs stored as separate artifacts is stored next to the files archive")
+	case streamErr == nil:
+		report.add("database dump", CheckFailed, "archive contains no db_dump.sql")
+	default:
+		report.add("database dump", CheckFailed, "the dump could not be read from the archive")
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == CheckFailed {
+			Error("Check '%s' failed: %s", check.Name, check.Detail)
+		}
+	}
+	return report
+}
+
+// verifySQLDump checks that a MySQL dump parses as SQL statements and ends
+// with the marker mysqldump and direct exports write after the last table.
+// Dumps of other engines are only recognized.
+func verifySQLDump(dump io.Reader, manifest *BackupManifest) VerificationCheck {
+	check := VerificationCheck{Name: "database dump"}
+	buffered := bufio.NewReaderSize(dump, sqlDumpChunkSize)
+	magic, _ := buffered.Peek(5)
+
+	if manifest != nil && manifest.DatabaseEngine != DatabaseEngineMySQL {
+		if bytes.Equal(magic, []byte("PGDMP")) {
+			check.Status = CheckSkipped
+			check.Detail = "pg_dump custom format dump, only MySQL dumps are parsed"
+		} else {
+			check.Status = CheckFailed
+			check.Detail = fmt.Sprintf("%s dump is not in the pg_dump custom format", manifest.DatabaseEngine)
+		}
+		return check
+	}
+
+	var reader io.Reader = buffered
+	if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			check.Status = CheckFailed
+			check.Detail = fmt.Sprintf("failed to decompress dump: %v", err)
+			return check
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	tail := &tailWriter{size: 4096}
+	scanner := newSQLStatementScanner(io.TeeReader(reader, tail))
+	statements := 0
+	for {
+		_, err := scanner.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			check.Status = CheckFailed
+			check.Detail = fmt.Sprintf("dump doesn't parse after %d statements: %v", statements, err)
+			return check
+		}
+		statements++
+	}
+
+	lines := strings.Split(strings.TrimRight(string(tail.Bytes()), "\n"), "\n")
+	if lastLine := lines[len(lines)-1]; !strings.HasPrefix(lastLine, mysqlDumpCompletedMarker) {
+		check.Status = CheckFailed
+		check.Detail = fmt.Sprintf("dump of %d statements is incomplete, it doesn't end with '%s'", statements, mysqlDumpCompletedMarker)
+		return check
+	}
+	check.Status = CheckPassed
+	check.Detail = fmt.Sprintf("%d statements in %d bytes of SQL, %s", statements, scanner.BytesRead(), strings.TrimPrefix(lines[len(lines)-1], "-- "))
+	return check
+}
+
+// describeManifest summarizes the origin of a backup
+func describeManifest(manifest *BackupManifest) string {
+	if manifest.RunID == "" {
+		return fmt.Sprintf("%s dump", manifest.DatabaseEngine)
+	}
+	description := fmt.Sprintf("%s dump of %s in %s (run ID '%s') taken %s by backup manager %s",
+		manifest.DatabaseEngine, manifest.DatabaseName, manifest.Environment, manifest.RunID,
+		manifest.FinishedAt.Format(time.RFC3339), manifest.ToolVersion)
+	if manifest.ParentRunID != "" {
+		description += fmt.Sprintf(", with the files changed since run '%s'", manifest.ParentRunID)
+	}
+	return description
+}
+
+// readErrorRecorder counts the bytes read and remembers the first error of
+// the underlying reader, so a broken archive can be told apart from a broken
+// dump inside it
+type readErrorRecorder struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// tailWriter keeps the last size bytes written to it
+type tailWriter struct {
+	size int
+	buf  []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	if len(p) >= w.size {
+		w.buf = append(w.buf[:0], p[len(p)-w.size:]...)
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	if excess := len(w.buf) - w.size; excess > 0 {
+		w.buf = append(w.buf[:0], w.buf[excess:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) Bytes() []byte {
+	return w.buf
+}
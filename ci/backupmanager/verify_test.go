@@ -0,0 +1,207 @@
+package backupmanager
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const completeMySQLDump = "-- MySQL dump 10.13\n" +
+	"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `staging_db`;\nUSE `staging_db`;\n" +
+	"CREATE TABLE `node` (`id` int, `title` text);\n" +
+	"INSERT INTO `node` VALUES (1,'It''s done; really');\n" +
+	"-- Dump completed on 2024-01-15 02:06:41\n"
+
+// createTestArchive writes an archive with the given dump and a single file
+// and returns its path and manifest
+func createTestArchive(t *testing.T, dump string, engine string) (string, *BackupManifest) {
+	t.Helper()
+	tmpFolder := t.TempDir()
+	filesFolder := filepath.Join(tmpFolder, "files")
+	mustWriteFile(t, filepath.Join(filesFolder, "inline-images", "logo.png"), "not really a png")
+	dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+	writeGzipFile(t, dumpPath, dump)
+
+	archivePath := filepath.Join(tmpFolder, "backup_archive.tar.gz")
+	manifest := &BackupManifest{Environment: "staging", RunID: "test-run-verify", DatabaseEngine: engine}
+	writeTestArchive(t, archivePath, manifest, dumpPath, filesFolder)
+	return archivePath, manifest
+}
+
+func checkStatuses(t *testing.T, report *VerificationReport, expected map[string]string) {
+	t.Helper()
+	for _, check := range report.Checks {
+		if status, ok := expected[check.Name]; ok && status != check.Status {
+			t.Errorf("check '%s' is %s (%s), expected %s", check.Name, check.Status, check.Detail, status)
+		}
+		delete(expected, check.Name)
+	}
+	for name := range expected {
+		t.Errorf("check '%s' missing from report", name)
+	}
+}
+
+func TestVerifyBackupArchive(t *testing.T) {
+	archivePath, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+
+	report := VerifyBackupArchive(archivePath)
+	checkStatuses(t, report, map[string]string{
+		"archive stream": CheckPassed,
+		"manifest":       CheckPassed,
+		"checksums":      CheckPassed,
+		"database dump":  CheckPassed,
+	})
+	if !report.Passed() {
+		t.Errorf("complete archive should pass")
+	}
+	if report.Manifest == nil || report.Manifest.RunID != "test-run-verify" {
+		t.Errorf("report should contain the manifest, got %+v", report.Manifest)
+	}
+}
+
+func TestVerifyIncompleteDump(t *testing.T) {
+	for name, dump := range map[string]string{
+		"truncated":             strings.TrimSuffix(completeMySQLDump, "-- Dump completed on 2024-01-15 02:06:41\n"),
+		"unterminated string":   "INSERT INTO `node` VALUES (1,'cut off here",
+		"marker not at the end": completeMySQLDump + "INSERT INTO `node` VALUES (2,'after');\n",
+	} {
+		archivePath, _ := createTestArchive(t, dump, DatabaseEngineMySQL)
+		report := VerifyBackupArchive(archivePath)
+		checkStatuses(t, report, map[string]string{
+			"archive stream": CheckPassed,
+			"checksums":      CheckPassed,
+			"database dump":  CheckFailed,
+		})
+		if report.Passed() {
+			t.Errorf("%s: archive with an incomplete dump should fail", name)
+		}
+	}
+}
+
+func TestVerifyPostgresDump(t *testing.T) {
+	archivePath, _ := createTestArchive(t, completeMySQLDump, DatabaseEnginePostgres)
+	report := VerifyBackupArchive(archivePath)
+	checkStatuses(t, report, map[string]string{"database dump": CheckFailed})
+
+	tmpFolder := t.TempDir()
+	dumpPath := filepath.Join(tmpFolder, "db_dump.sql")
+	mustWriteFile(t, dumpPath, "PGDMP\x01\x0e\x00")
+	archivePath = filepath.Join(tmpFolder, "backup_archive.tar.gz")
+	writeTestArchive(t, archivePath, &BackupManifest{DatabaseEngine: DatabaseEnginePostgres}, dumpPath, t.TempDir())
+	report = VerifyBackupArchive(archivePath)
+	checkStatuses(t, report, map[string]string{"database dump": CheckSkipped, "checksums": CheckPassed})
+	if !report.Passed() {
+		t.Errorf("pg_dump archive should pass")
+	}
+}
+
+func TestVerifyTamperedArchive(t *testing.T) {
+	_, manifest := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	manifestJSON, _ := json.Marshal(manifest)
+
+	// Same manifest, but a file was replaced and another one added
+	tmpFolder := t.TempDir()
+	archivePath := filepath.Join(tmpFolder, "tampered.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{
+		"manifest.json":                string(manifestJSON),
+		"db_dump.sql":                  completeMySQLDump,
+		"files/inline-images/logo.png": "something else",
+		"files/extra.php":              "<?php",
+	})
+
+	report := VerifyBackupArchive(archivePath)
+	checkStatuses(t, report, map[string]string{
+		"archive stream": CheckPassed,
+		"manifest":       CheckPassed,
+		"checksums":      CheckFailed,
+	})
+	for _, check := range report.Checks {
+		if check.Name == "checksums" {
+			for _, problem := range []string{"db_dump.sql has", "logo.png has", "files/extra.php is not listed"} {
+				if !strings.Contains(check.Detail, problem) {
+					t.Errorf("checksum report should mention %q: %s", problem, check.Detail)
+				}
+			}
+		}
+	}
+
+	// Restores refuse the archive before the database is touched
+	if _, err := extractTestArchive(t, archivePath, filepath.Join(tmpFolder, "extracted")); err == nil {
+		t.Errorf("extracting an archive that doesn't match its manifest should fail")
+	}
+}
+
+func TestVerifyCorruptedArchive(t *testing.T) {
+	archivePath, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("failed to read archive: %v", err)
+	}
+
+	// A truncated upload and a flipped byte in the middle of the stream
+	truncated := data[:len(data)-20]
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+	for name, content := range map[string][]byte{"truncated": truncated, "flipped": flipped} {
+		corruptedPath := filepath.Join(t.TempDir(), name+".tar.gz")
+		if err := os.WriteFile(corruptedPath, content, 0644); err != nil {
+			t.Fatalf("failed to write archive: %v", err)
+		}
+		report := VerifyBackupArchive(corruptedPath)
+		checkStatuses(t, report, map[string]string{"archive stream": CheckFailed})
+		if report.Passed() {
+			t.Errorf("%s archive should fail verification", name)
+		}
+	}
+}
+
+func TestVerifyLegacyArchive(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "backup_archive.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{
+		"db_dump.sql":      completeMySQLDump,
+		"files/images.txt": "test content",
+	})
+
+	report := VerifyBackupArchive(archivePath)
+	checkStatuses(t, report, map[string]string{
+		"archive stream": CheckPassed,
+		"manifest":       CheckSkipped,
+		"checksums":      CheckSkipped,
+		"database dump":  CheckPassed,
+	})
+	if !report.Passed() {
+		t.Errorf("legacy archive should pass")
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	archivePath, _ := createTestArchive(t, completeMySQLDump, DatabaseEngineMySQL)
+	backend := NewMockBackend()
+	backend.archiveToServe = archivePath
+	engine := newMockEngine(backend, mockConfigs())
+
+	report, err := engine.VerifyBackup(context.Background(), "staging", "test-run-verify")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if !report.Passed() {
+		t.Errorf("backup should pass verification: %+v", report.Checks)
+	}
+
+	// The archive stored under another run comes from test-run-verify
+	report, err = engine.VerifyBackup(context.Background(), "staging", "test-run-other")
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	checkStatuses(t, report, map[string]string{"origin": CheckFailed})
+
+	// An interrupted verification stops instead of reading on
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := engine.VerifyBackup(ctx, "staging", "test-run-verify"); err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("cancelled verification should fail as interrupted, got %v", err)
+	}
+}
@@ -27,8 +27,9 @@
 echo "  ✓ Files copied (js and css excluded)"
 
 echo "Step 3: Creating tar.gz archive..."
-# Create archive specifying files explicitly to avoid directory entries
-# The backup manager expects: db_dump.sql (root) and files/* (all files recursively)
+# The archive has no manifest, the backup manager reads it as format version 0:
+# db_dump.sql and files/ at the root (see "Archive Format Versions" in
+# backupmanager/README.md)
 cd "$WORK_DIR"
 tar -czf "../$ARCHIVE_NAME" db_dump.sql files
 cd ..